@@ -0,0 +1,192 @@
+package address
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string {
+		"instances.json": `{ "instances": { "i-1": { "public": ["203.0.113.1", "2001:db8::1"], "private": ["10.0.0.1"] } } }`,
+		"instances.yaml": "instances:\n  i-1:\n    public: [203.0.113.1, \"2001:db8::1\"]\n    private: [10.0.0.1]\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resolver, err := LoadFile(path)
+		if err != nil {
+			t.Fatalf("LoadFile of %v should have succeeded ---> %v", name, err)
+		}
+
+		addresses, err := resolver.Resolve(context.TODO(), "i-1")
+		if err != nil || addresses.PublicIp() != "203.0.113.1" || addresses.PrivateIp() != "10.0.0.1" || len(addresses.Public) != 2 {
+			t.Fatalf("%v resolved i-1 to %v ---> %v", name, addresses, err)
+		}
+
+		addresses, err = resolver.Resolve(context.TODO(), "i-2")
+		if err != nil || addresses != nil {
+			t.Fatalf("%v should not know i-2, resolved to %v ---> %v", name, addresses, err)
+		}
+	}
+
+	fmt.Println("SUCCESS: TestLoadFile")
+}
+
+func TestStaticResolverRejectsBadAddress(t *testing.T) {
+	_, err := NewStaticResolver(map[string]Addresses { "i-1": Addresses { Public: []string { "not-an-ip" } } })
+	if err == nil {
+		t.Fatal("An address that is not an IP should have been rejected")
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestStaticResolverRejectsBadAddress Expected error received --> %v", err))
+}
+
+const describeInstancesXml = `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <reservationSet><item><instancesSet><item>
+    <instanceId>i-0abc</instanceId>
+    <privateIpAddress>10.0.0.5</privateIpAddress>
+    <ipAddress>203.0.113.5</ipAddress>
+    <networkInterfaceSet><item>
+      <privateIpAddressesSet>
+        <item><privateIpAddress>10.0.0.5</privateIpAddress><association><publicIp>203.0.113.5</publicIp></association></item>
+        <item><privateIpAddress>10.0.0.6</privateIpAddress><association><publicIp>203.0.113.6</publicIp></association></item>
+      </privateIpAddressesSet>
+      <ipv6AddressesSet><item><ipv6Address>2001:db8::5</ipv6Address></item></ipv6AddressesSet>
+    </item></networkInterfaceSet>
+  </item></instancesSet></item></reservationSet>
+</DescribeInstancesResponse>`
+
+// A local stand-in for the EC2 Query API that knows one instance
+func ec2Stub(requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		form, err := url.ParseQuery(string(body))
+		if err != nil || form.Get("Action") != "DescribeInstances" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch form.Get("InstanceId.1") {
+		case "i-0abc":
+		case "i-0bad":
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `<Response><Errors><Error><Code>InternalError</Code><Message>An internal error has occurred</Message></Error></Errors></Response>`)
+			return
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `<Response><Errors><Error><Code>InvalidInstanceID.NotFound</Code><Message>The instance ID does not exist</Message></Error></Errors></Response>`)
+			return
+		}
+
+		io.WriteString(w, describeInstancesXml)
+	}))
+}
+
+func ec2Client(server *httptest.Server) *ec2.Client {
+	return ec2.New(ec2.Options {
+		Region: "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		EndpointResolver: ec2.EndpointResolverFromURL(server.URL),
+		Retryer: aws.NopRetryer {},
+	})
+}
+
+func TestEc2Resolver(t *testing.T) {
+	requests := 0
+	server := ec2Stub(&requests)
+	defer server.Close()
+
+	client := ec2Client(server)
+
+	resolver := NewEc2Resolver(client)
+	addresses, err := resolver.Resolve(context.TODO(), "i-0abc")
+	if err != nil {
+		t.Fatalf("Resolve of i-0abc should have succeeded ---> %v", err)
+	}
+
+	expected := Addresses {
+		Public: []string { "203.0.113.5", "203.0.113.6", "2001:db8::5" },
+		Private: []string { "10.0.0.5", "10.0.0.6" },
+	}
+
+	if !reflect.DeepEqual(*addresses, expected) {
+		t.Fatalf("i-0abc resolved to %v rather than %v", *addresses, expected)
+	}
+
+	addresses, err = resolver.Resolve(context.TODO(), "i-0def")
+	if err != nil || addresses != nil {
+		t.Fatalf("i-0def should be unknown, resolved to %v ---> %v", addresses, err)
+	}
+
+	_, err = resolver.Resolve(context.TODO(), "i-0bad")
+	if err == nil {
+		t.Fatal("Resolve should have failed when DescribeInstances did")
+	}
+
+	fmt.Println("SUCCESS: TestEc2Resolver")
+}
+
+func TestCachingResolver(t *testing.T) {
+	requests := 0
+	server := ec2Stub(&requests)
+	defer server.Close()
+
+	client := ec2Client(server)
+
+	now := time.Now()
+	cache := NewCachingResolver(NewEc2Resolver(client), time.Minute)
+	cache.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		_, err := cache.Resolve(context.TODO(), "i-0abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if requests != 1 {
+		t.Fatalf("%d requests were made for 3 resolutions within the ttl", requests)
+	}
+
+	now = now.Add(2 * time.Minute)
+	_, err := cache.Resolve(context.TODO(), "i-0abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Invalidate("i-0abc")
+	_, err = cache.Resolve(context.TODO(), "i-0abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 3 {
+		t.Fatalf("%d requests were made, expiry and invalidation should have made it 3", requests)
+	}
+
+	fmt.Println("SUCCESS: TestCachingResolver")
+}
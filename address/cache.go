@@ -0,0 +1,57 @@
+package address
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Keeps what another resolver returns for ttl, including that it knows
+// nothing about an instance. Errors are not kept.
+type CachingResolver struct {
+	resolver AddressResolver
+	ttl time.Duration
+	now func() time.Time
+	mu sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	addresses *Addresses
+	expires time.Time
+}
+
+func NewCachingResolver(resolver AddressResolver, ttl time.Duration) *CachingResolver {
+	return &CachingResolver {
+		resolver: resolver,
+		ttl: ttl,
+		now: time.Now,
+		entries: map[string]cacheEntry {},
+	}
+}
+
+func (c *CachingResolver) Resolve(ctx context.Context, instance string) (*Addresses, error) {
+	c.mu.Lock()
+	entry, present := c.entries[instance]
+	c.mu.Unlock()
+	if present && c.now().Before(entry.expires) {
+		return entry.addresses, nil
+	}
+
+	addresses, err := c.resolver.Resolve(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[instance] = cacheEntry { addresses: addresses, expires: c.now().Add(c.ttl) }
+	c.mu.Unlock()
+	return addresses, nil
+}
+
+// Drops what is kept for instance, e.g. after it has been replaced
+func (c *CachingResolver) Invalidate(instance string) {
+	c.mu.Lock()
+	delete(c.entries, instance)
+	c.mu.Unlock()
+}
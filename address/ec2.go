@@ -0,0 +1,92 @@
+package address
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+// Resolves instances named by their EC2 instance ids, through DescribeInstances
+// of an ec2.Client. IPv6 addresses, which are globally routable in EC2, are
+// public addresses after the IPv4 ones. The primary address of each kind
+// comes first.
+type Ec2Resolver struct {
+	api ec2.DescribeInstancesAPIClient
+}
+
+func NewEc2Resolver(api ec2.DescribeInstancesAPIClient) *Ec2Resolver {
+	return &Ec2Resolver { api: api }
+}
+
+func (r *Ec2Resolver) Resolve(ctx context.Context, instance string) (*Addresses, error) {
+	paginator := ec2.NewDescribeInstancesPaginator(r.api, &ec2.DescribeInstancesInput { InstanceIds: []string { instance } })
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if isUnknownInstance(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, reservation := range output.Reservations {
+			for _, i := range reservation.Instances {
+				if aws.ToString(i.InstanceId) == instance {
+					return ec2Addresses(&i), nil
+				}
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// EC2 fails DescribeInstances of an id it does not know, or of a name that is
+// not an instance id at all, rather than returning no instances
+func isUnknownInstance(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	code := apiErr.ErrorCode()
+	return code == "InvalidInstanceID.NotFound" || code == "InvalidInstanceID.Malformed"
+}
+
+func ec2Addresses(instance *types.Instance) *Addresses {
+	addresses := &Addresses {}
+	addresses.Public = appendNew(addresses.Public, aws.ToString(instance.PublicIpAddress))
+	addresses.Private = appendNew(addresses.Private, aws.ToString(instance.PrivateIpAddress))
+	ipv6 := []string {}
+	for _, networkInterface := range instance.NetworkInterfaces {
+		for _, ip := range networkInterface.PrivateIpAddresses {
+			addresses.Private = appendNew(addresses.Private, aws.ToString(ip.PrivateIpAddress))
+			if ip.Association != nil {
+				addresses.Public = appendNew(addresses.Public, aws.ToString(ip.Association.PublicIp))
+			}
+		}
+
+		for _, ip := range networkInterface.Ipv6Addresses {
+			ipv6 = appendNew(ipv6, aws.ToString(ip.Ipv6Address))
+		}
+	}
+
+	addresses.Public = append(addresses.Public, ipv6...)
+	return addresses
+}
+
+func appendNew(ips []string, ip string) []string {
+	if ip == "" {
+		return ips
+	}
+
+	for _, existing := range ips {
+		if existing == ip {
+			return ips
+		}
+	}
+
+	return append(ips, ip)
+}
@@ -0,0 +1,79 @@
+// Package address finds the IP addresses to hand out for an instance.
+// Register and the read APIs go through an AddressResolver, which by default
+// reads the instanceIp table.
+package address
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"loadbalancer/go/tables"
+)
+
+// The addresses of an instance. Either list may mix IPv4 and IPv6 addresses,
+// and has the primary address, the one Register returns, first.
+type Addresses struct {
+	Public []string `json:"public" yaml:"public"`
+	Private []string `json:"private" yaml:"private"`
+}
+
+func (a *Addresses) PublicIp() string {
+	return first(a.Public)
+}
+
+func (a *Addresses) PrivateIp() string {
+	return first(a.Private)
+}
+
+// Errors on any address that does not parse as IPv4 or IPv6
+func (a *Addresses) Validate() error {
+	for _, ip := range append(append([]string {}, a.Public...), a.Private...) {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("Address %q is not an IP address", ip)
+		}
+	}
+
+	return nil
+}
+
+func first(ips []string) string {
+	if len(ips) == 0 {
+		return ""
+	}
+
+	return ips[0]
+}
+
+type AddressResolver interface {
+	// nil, with no error, for an instance the resolver knows nothing about
+	Resolve(ctx context.Context, instance string) (*Addresses, error)
+}
+
+// Reads the instanceIp table, which holds a primary public and private
+// address per instance, and optionally all of them.
+type TableResolver struct {
+	ddb tables.DynamoDBAPI
+}
+
+func NewTableResolver(ddb tables.DynamoDBAPI) *TableResolver {
+	return &TableResolver { ddb: ddb }
+}
+
+func (r *TableResolver) Resolve(ctx context.Context, instance string) (*Addresses, error) {
+	instanceIp, err := tables.GetInstanceIp(ctx, r.ddb, instance)
+	if err != nil || instanceIp == nil {
+		return nil, err
+	}
+
+	addresses := Addresses { Public: instanceIp.PublicIps, Private: instanceIp.PrivateIps }
+	if len(addresses.Public) == 0 && instanceIp.PublicIp != "" {
+		addresses.Public = []string { instanceIp.PublicIp }
+	}
+
+	if len(addresses.Private) == 0 && instanceIp.PrivateIp != "" {
+		addresses.Private = []string { instanceIp.PrivateIp }
+	}
+
+	return &addresses, nil
+}
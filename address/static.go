@@ -0,0 +1,69 @@
+package address
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"gopkg.in/yaml.v3"
+)
+
+// Addresses from a fixed map of instance to addresses, e.g. loaded from a
+// file with LoadFile.
+type StaticResolver struct {
+	instances map[string]Addresses
+}
+
+// The layout of the files LoadFile reads, in JSON
+//
+//	{ "instances": { "i-1": { "public": ["203.0.113.1", "2001:db8::1"], "private": ["10.0.0.1"] } } }
+//
+// or the same in YAML.
+type StaticFile struct {
+	Instances map[string]Addresses `json:"instances" yaml:"instances"`
+}
+
+// Errors on any address that does not parse as IPv4 or IPv6
+func NewStaticResolver(instances map[string]Addresses) (*StaticResolver, error) {
+	for instance, addresses := range instances {
+		err := addresses.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("Instance %v: %v", instance, err)
+		}
+	}
+
+	return &StaticResolver { instances: instances }, nil
+}
+
+// Reads YAML from .yaml and .yml files, and JSON from anything else
+func LoadFile(path string) (*StaticResolver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file StaticFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	default:
+		err = json.Unmarshal(data, &file)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %v [%v]", path, err)
+	}
+
+	return NewStaticResolver(file.Instances)
+}
+
+func (r *StaticResolver) Resolve(ctx context.Context, instance string) (*Addresses, error) {
+	addresses, present := r.instances[instance]
+	if !present {
+		return nil, nil
+	}
+
+	return &addresses, nil
+}
@@ -0,0 +1,157 @@
+// Package agent runs on an instance and keeps its record current: it
+// registers the instance with its addresses, capacity and labels on start,
+// heartbeats with the streams it is actually serving while it runs, and
+// deregisters it on shutdown.
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	lb "loadbalancer/go"
+)
+
+const DEFAULT_HEARTBEAT_INTERVAL = 15 * time.Second
+const DEFAULT_RETRY_DELAY = 5 * time.Second
+const DEFAULT_SHUTDOWN_TIMEOUT = time.Minute
+
+type Agent struct {
+	HeartbeatInterval time.Duration
+
+	// Between attempts to register
+	RetryDelay time.Duration
+
+	// How long deregistering may take once Run's context is done
+	ShutdownTimeout time.Duration
+
+	// Without Drain, an instance that still has streams on shutdown is left
+	// cordoned rather than deregistered. With it, the streams are moved to
+	// other instances first.
+	Drain bool
+
+	// When set, the agent reports the ports of the streams it serves rather
+	// than only counting them, and the counter is not used.
+	Ports PortLister
+
+	spec lb.InstanceSpec
+	backend Backend
+	counter Counter
+}
+
+// counter can be nil, for plain heartbeats without load reports
+func New(backend Backend, spec lb.InstanceSpec, counter Counter) *Agent {
+	return &Agent {
+		HeartbeatInterval: DEFAULT_HEARTBEAT_INTERVAL,
+		RetryDelay: DEFAULT_RETRY_DELAY,
+		ShutdownTimeout: DEFAULT_SHUTDOWN_TIMEOUT,
+		spec: spec,
+		backend: backend,
+		counter: counter,
+	}
+}
+
+// Registers, retrying until it succeeds, heartbeats until ctx is done, and
+// then deregisters. Returns the error deregistering, if any, or ctx's error
+// if it is done before the instance is registered. Registering uncordons the
+// instance, which a shutdown that left streams on it left cordoned, so that
+// a restarted agent's instance takes streams again.
+func (a *Agent) Run(ctx context.Context) error {
+	for {
+		err := a.backend.RegisterInstance(ctx, a.spec)
+		if err == nil {
+			err = a.backend.Uncordon(ctx, a.spec.Instance)
+		}
+
+		if err == nil {
+			break
+		}
+
+		log.Printf("INFO: Unable to register %v --> %v", a.spec.Instance, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(a.RetryDelay):
+		}
+	}
+
+	log.Printf("INFO: Registered %v", a.spec.Instance)
+	ticker := time.NewTicker(a.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		err := a.Beat(ctx)
+		if err != nil {
+			log.Printf("INFO: Heartbeat of %v failed --> %v", a.spec.Instance, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), a.ShutdownTimeout)
+			defer cancel()
+			return a.Deregister(shutdownCtx)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sends one heartbeat, with the active streams when there is a counter or
+// port lister. A failed count still sends a plain heartbeat, since the
+// instance is alive.
+func (a *Agent) Beat(ctx context.Context) error {
+	if a.Ports != nil {
+		ports, err := a.Ports.Ports(ctx)
+		if err == nil {
+			return a.backend.ReportLoad(ctx, a.spec.Instance, lb.Load { Ports: ports })
+		}
+
+		log.Printf("INFO: Unable to list the ports of %v --> %v", a.spec.Instance, err)
+	} else if a.counter != nil {
+		count, err := a.counter.Count(ctx)
+		if err == nil {
+			return a.backend.ReportLoad(ctx, a.spec.Instance, lb.Load { ActiveStreams: count })
+		}
+
+		log.Printf("INFO: Unable to count the streams of %v --> %v", a.spec.Instance, err)
+	}
+
+	return a.backend.Heartbeat(ctx, a.spec.Instance)
+}
+
+// Cordons the instance so it gets no new streams, moves its streams away
+// with Drain, and removes it if none are left.
+func (a *Agent) Deregister(ctx context.Context) error {
+	err := a.backend.Cordon(ctx, a.spec.Instance)
+	if err != nil {
+		return err
+	}
+
+	shops, err := a.backend.Streams(ctx, a.spec.Instance)
+	if err != nil {
+		return err
+	}
+
+	remaining := len(shops)
+	if a.Drain {
+		for _, shop := range shops {
+			err = a.backend.Move(ctx, shop.ShopId, shop.Stream)
+			if err != nil {
+				log.Printf("INFO: Unable to move %v of %v off %v --> %v", shop.Stream, shop.ShopId, a.spec.Instance, err)
+			} else {
+				remaining--
+			}
+		}
+	}
+
+	if remaining > 0 {
+		return fmt.Errorf("%v left cordoned with %d streams", a.spec.Instance, remaining)
+	}
+
+	err = a.backend.DeregisterInstance(ctx, a.spec.Instance)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("INFO: Deregistered %v", a.spec.Instance)
+	return nil
+}
@@ -0,0 +1,287 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	lb "loadbalancer/go"
+)
+
+type fakeBackend struct {
+	mutex sync.Mutex
+	registerFailures int
+	registered *lb.InstanceSpec
+	loads []lb.Load
+	heartbeats int
+	cordoned bool
+	streams []lb.Shop
+	unmovable map[string]bool
+	deregistered bool
+}
+
+func (b *fakeBackend) RegisterInstance(ctx context.Context, spec lb.InstanceSpec) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.registerFailures > 0 {
+		b.registerFailures--
+		return fmt.Errorf("conflict")
+	}
+
+	b.registered = &spec
+	return nil
+}
+
+func (b *fakeBackend) ReportLoad(ctx context.Context, instance string, load lb.Load) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.loads = append(b.loads, load)
+	return nil
+}
+
+func (b *fakeBackend) Heartbeat(ctx context.Context, instance string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.heartbeats++
+	return nil
+}
+
+func (b *fakeBackend) Cordon(ctx context.Context, instance string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.cordoned = true
+	return nil
+}
+
+func (b *fakeBackend) Uncordon(ctx context.Context, instance string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.cordoned = false
+	return nil
+}
+
+// What lb.Register would do with the instance as the only candidate
+func (b *fakeBackend) register(shop lb.Shop) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.registered == nil || b.deregistered || b.cordoned {
+		return fmt.Errorf("No instance can take %v", shop.Stream)
+	}
+
+	b.streams = append(b.streams, shop)
+	return nil
+}
+
+func (b *fakeBackend) Streams(ctx context.Context, instance string) ([]lb.Shop, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]lb.Shop {}, b.streams...), nil
+}
+
+func (b *fakeBackend) Move(ctx context.Context, shopId string, stream string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.unmovable[stream] {
+		return fmt.Errorf("no room")
+	}
+
+	for i, shop := range b.streams {
+		if shop.Stream == stream {
+			b.streams = append(b.streams[:i], b.streams[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (b *fakeBackend) DeregisterInstance(ctx context.Context, instance string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.streams) > 0 {
+		return fmt.Errorf("still has streams")
+	}
+
+	b.deregistered = true
+	return nil
+}
+
+type fixedCounter uint8
+
+func (c fixedCounter) Count(ctx context.Context) (uint8, error) {
+	return uint8(c), nil
+}
+
+func TestRun(t *testing.T) {
+	backend := &fakeBackend { registerFailures: 2 }
+	spec := lb.InstanceSpec { Instance: "i-1", Capacity: 2, Labels: map[string]string { "zone": "a" } }
+	a := New(backend, spec, fixedCounter(1))
+	a.HeartbeatInterval = 10 * time.Millisecond
+	a.RetryDelay = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx) }()
+	for {
+		backend.mutex.Lock()
+		beats := len(backend.loads)
+		backend.mutex.Unlock()
+		if beats >= 2 {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	err := <-done
+	if err != nil {
+		t.Fatalf("Run should have deregistered cleanly ---> %v", err)
+	}
+
+	if backend.registered == nil || backend.registered.Labels["zone"] != "a" || backend.loads[0].ActiveStreams != 1 || !backend.cordoned || !backend.deregistered {
+		t.Fatalf("Unexpected backend state %+v", backend)
+	}
+
+	fmt.Println("SUCCESS: TestRun")
+}
+
+// An agent restarted without Drain left its instance cordoned with its
+// streams, which must not keep it out of placement
+func TestRestart(t *testing.T) {
+	backend := &fakeBackend { streams: []lb.Shop { lb.Shop { ShopId: "shop0", Stream: "stream0" } } }
+	a := New(backend, lb.InstanceSpec { Instance: "i-1" }, nil)
+	a.HeartbeatInterval = time.Millisecond
+	for run := 0; run < 2; run++ {
+		backend.mutex.Lock()
+		before := backend.heartbeats
+		backend.mutex.Unlock()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- a.Run(ctx) }()
+		for {
+			backend.mutex.Lock()
+			beats := backend.heartbeats
+			backend.mutex.Unlock()
+			if beats > before {
+				break
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+
+		err := backend.register(lb.Shop { ShopId: "shop1", Stream: fmt.Sprintf("stream%d", run + 1) })
+		if err != nil {
+			t.Fatalf("The instance should have taken a stream in run %d ---> %v", run, err)
+		}
+
+		cancel()
+		err = <-done
+		if err == nil || !backend.cordoned || backend.deregistered {
+			t.Fatalf("Run %d should have left the instance cordoned with its streams ---> %v", run, err)
+		}
+	}
+
+	fmt.Println("SUCCESS: TestRestart")
+}
+
+func TestDeregister(t *testing.T) {
+	ctx := context.Background()
+	streams := []lb.Shop {
+		lb.Shop { ShopId: "shop0", Stream: "stream0" },
+		lb.Shop { ShopId: "shop1", Stream: "stream1" },
+	}
+
+	backend := &fakeBackend { streams: append([]lb.Shop {}, streams...) }
+	a := New(backend, lb.InstanceSpec { Instance: "i-1" }, nil)
+	err := a.Deregister(ctx)
+	if err == nil || !backend.cordoned || backend.deregistered {
+		t.Fatal("Without Drain the instance should have been left cordoned")
+	}
+
+	backend = &fakeBackend { streams: append([]lb.Shop {}, streams...), unmovable: map[string]bool { "stream1": true } }
+	a = New(backend, lb.InstanceSpec { Instance: "i-1" }, nil)
+	a.Drain = true
+	err = a.Deregister(ctx)
+	if err == nil || backend.deregistered || len(backend.streams) != 1 {
+		t.Fatalf("stream1 should have stayed and kept the instance registered: %v", backend.streams)
+	}
+
+	backend.unmovable = nil
+	err = a.Deregister(ctx)
+	if err != nil || !backend.deregistered {
+		t.Fatalf("The drained instance should have been deregistered ---> %v", err)
+	}
+
+	fmt.Println("SUCCESS: TestDeregister")
+}
+
+func TestCounters(t *testing.T) {
+	ctx := context.Background()
+	count, err := CommandCounter { Command: "echo 2" }.Count(ctx)
+	if err != nil || count != 2 {
+		t.Fatalf("echo 2 should count 2, not %d ---> %v", count, err)
+	}
+
+	_, err = CommandCounter { Command: "echo many" }.Count(ctx)
+	if err == nil {
+		t.Fatal("A count should be a number")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, 3)
+	}))
+	defer server.Close()
+
+	count, err = HTTPCounter { URL: server.URL }.Count(ctx)
+	if err != nil || count != 3 {
+		t.Fatalf("The HTTP counter should count 3, not %d ---> %v", count, err)
+	}
+
+	fmt.Println("SUCCESS: TestCounters")
+}
+
+func TestPortListers(t *testing.T) {
+	ctx := context.Background()
+	ports, err := CommandPortLister { Command: "echo 11001, 11000 11001" }.Ports(ctx)
+	if err != nil || fmt.Sprint(ports) != "[11000 11001]" {
+		t.Fatalf("Unexpected ports %v ---> %v", ports, err)
+	}
+
+	proc := "  sl  local_address rem_address   st tx_queue rx_queue\n" +
+		"   0: 00000000:2AF8 00000000:0000 0A 00000000:00000000\n" +
+		"   1: 0100007F:2AF9 0100007F:D431 01 00000000:00000000\n" +
+		"   2: 00000000:0016 00000000:0000 0A 00000000:00000000\n"
+	listening, err := listeningPorts(strings.NewReader(proc))
+	if err != nil || fmt.Sprint(listening) != "[11000 22]" {
+		t.Fatalf("Only 11000 and 22 are listening: %v ---> %v", listening, err)
+	}
+
+	lister := NewListeningPortLister(10000, 20000)
+	path := t.TempDir() + "/tcp"
+	err = os.WriteFile(path, []byte(proc), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lister.procFiles = []string { path, t.TempDir() + "/absent" }
+	ports, err = lister.Ports(ctx)
+	if err != nil || fmt.Sprint(ports) != "[11000]" {
+		t.Fatalf("Only 11000 is listening in range: %v ---> %v", ports, err)
+	}
+
+	backend := &fakeBackend {}
+	a := New(backend, lb.InstanceSpec { Instance: "i-1" }, fixedCounter(5))
+	a.Ports = lister
+	err = a.Beat(ctx)
+	if err != nil || len(backend.loads) != 1 || fmt.Sprint(backend.loads[0].Ports) != "[11000]" {
+		t.Fatalf("The beat should have reported port 11000: %v ---> %v", backend.loads, err)
+	}
+
+	fmt.Println("SUCCESS: TestPortListers")
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"context"
+
+	lb "loadbalancer/go"
+)
+
+// What the agent writes its instance through
+type Backend interface {
+	RegisterInstance(ctx context.Context, spec lb.InstanceSpec) error
+	ReportLoad(ctx context.Context, instance string, load lb.Load) error
+	Heartbeat(ctx context.Context, instance string) error
+	Cordon(ctx context.Context, instance string) error
+	Uncordon(ctx context.Context, instance string) error
+	Streams(ctx context.Context, instance string) ([]lb.Shop, error)
+	Move(ctx context.Context, shopId string, stream string) error
+	DeregisterInstance(ctx context.Context, instance string) error
+}
+
+// Goes through the lb APIs
+type LbBackend struct {}
+
+func (LbBackend) RegisterInstance(ctx context.Context, spec lb.InstanceSpec) error {
+	_, err := lb.RegisterInstance(spec)
+	return err
+}
+
+func (LbBackend) ReportLoad(ctx context.Context, instance string, load lb.Load) error {
+	_, err := lb.ReportLoad(instance, load)
+	return err
+}
+
+func (LbBackend) Heartbeat(ctx context.Context, instance string) error {
+	_, err := lb.Heartbeat(instance)
+	return err
+}
+
+func (LbBackend) Cordon(ctx context.Context, instance string) error {
+	_, err := lb.Cordon(instance)
+	return err
+}
+
+func (LbBackend) Uncordon(ctx context.Context, instance string) error {
+	_, err := lb.Uncordon(instance)
+	return err
+}
+
+func (LbBackend) Streams(ctx context.Context, instance string) ([]lb.Shop, error) {
+	shops, _, err := lb.ListShopsOnInstance(instance)
+	return shops, err
+}
+
+func (LbBackend) Move(ctx context.Context, shopId string, stream string) error {
+	_, _, _, err := lb.Move(shopId, stream)
+	return err
+}
+
+func (LbBackend) DeregisterInstance(ctx context.Context, instance string) error {
+	_, err := lb.DeregisterInstance(instance)
+	return err
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Counts the streams the instance is actually serving
+type Counter interface {
+	Count(ctx context.Context) (uint8, error)
+}
+
+// Runs a shell command that prints the count
+type CommandCounter struct {
+	Command string
+}
+
+func (c CommandCounter) Count(ctx context.Context) (uint8, error) {
+	output, err := exec.CommandContext(ctx, "sh", "-c", c.Command).Output()
+	if err != nil {
+		return 0, fmt.Errorf("%v failed [%v]", c.Command, err)
+	}
+
+	return parseCount(string(output))
+}
+
+// Gets a URL whose body is the count
+type HTTPCounter struct {
+	URL string
+
+	// http.DefaultClient when nil
+	Client *http.Client
+}
+
+func (c HTTPCounter) Count(ctx context.Context) (uint8, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return 0, fmt.Errorf("%v returned %d", c.URL, response.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 64))
+	if err != nil {
+		return 0, err
+	}
+
+	return parseCount(string(body))
+}
+
+func parseCount(s string) (uint8, error) {
+	count, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a stream count", strings.TrimSpace(s))
+	}
+
+	return uint8(count), nil
+}
@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Lists the ports of the streams the instance is actually serving
+type PortLister interface {
+	Ports(ctx context.Context) ([]uint16, error)
+}
+
+// Runs a shell command that prints the ports, separated by spaces, commas or
+// newlines
+type CommandPortLister struct {
+	Command string
+}
+
+func (l CommandPortLister) Ports(ctx context.Context) ([]uint16, error) {
+	output, err := exec.CommandContext(ctx, "sh", "-c", l.Command).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v failed [%v]", l.Command, err)
+	}
+
+	ports := []uint16 {}
+	fields := strings.FieldsFunc(string(output), func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\t' })
+	for _, field := range fields {
+		port, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a port", field)
+		}
+
+		ports = append(ports, uint16(port))
+	}
+
+	return dedupePorts(ports), nil
+}
+
+// Finds the TCP ports listened on between MinPort and MaxPort in
+// /proc/net/tcp and /proc/net/tcp6, so on Linux only
+type ListeningPortLister struct {
+	MinPort uint16
+	MaxPort uint16
+	procFiles []string
+}
+
+func NewListeningPortLister(minPort uint16, maxPort uint16) *ListeningPortLister {
+	return &ListeningPortLister {
+		MinPort: minPort,
+		MaxPort: maxPort,
+		procFiles: []string { "/proc/net/tcp", "/proc/net/tcp6" },
+	}
+}
+
+// The state of a listening socket in /proc/net/tcp
+const tcpListen = "0A"
+
+func (l *ListeningPortLister) Ports(ctx context.Context) ([]uint16, error) {
+	ports := []uint16 {}
+	for _, path := range l.procFiles {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		listening, err := listeningPorts(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read %v [%v]", path, err)
+		}
+
+		for _, port := range listening {
+			if port >= l.MinPort && port <= l.MaxPort {
+				ports = append(ports, port)
+			}
+		}
+	}
+
+	return dedupePorts(ports), nil
+}
+
+// Lines look like
+//   sl  local_address rem_address   st ...
+//   0: 00000000:2AF8 00000000:0000 0A ...
+func listeningPorts(r io.Reader) ([]uint16, error) {
+	ports := []uint16 {}
+	scanner := bufio.NewScanner(r)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpListen {
+			continue
+		}
+
+		colon := strings.LastIndex(fields[1], ":")
+		port, err := strconv.ParseUint(fields[1][colon+1:], 16, 16)
+		if err != nil {
+			return nil, err
+		}
+
+		ports = append(ports, uint16(port))
+	}
+
+	return ports, scanner.Err()
+}
+
+func dedupePorts(ports []uint16) []uint16 {
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	deduped := []uint16 {}
+	for i, port := range ports {
+		if i == 0 || port != ports[i-1] {
+			deduped = append(deduped, port)
+		}
+	}
+
+	return deduped
+}
@@ -0,0 +1,56 @@
+package lb
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"loadbalancer/go/address"
+	"loadbalancer/go/tables"
+)
+
+// Allocates streams in one set of lb tables. The package functions, like
+// Register, go through Default.
+type Allocator struct {
+	// nil for a client made from tables.Context on every call
+	ddb tables.DynamoDBAPI
+	resolver address.AddressResolver
+	stale staleCounters
+	// where instances with room are found, tables.LoadIndexStreams when empty
+	loadIndex tables.LoadIndex
+	// nil when not cached, see EnableCache
+	addresses *address.CachingResolver
+	candidates *candidateSnapshot
+}
+
+// Uses the AWS configuration from the environment, or
+// tables.TestMockAwsCfg
+var Default = &Allocator {}
+
+// An allocator over the tables ddb reaches, e.g. through tables.Namespace
+func NewAllocator(ddb tables.DynamoDBAPI) *Allocator {
+	return &Allocator { ddb: ddb }
+}
+
+func (a *Allocator) client() (context.Context, tables.DynamoDBAPI, error) {
+	if a.ddb != nil {
+		return context.TODO(), a.ddb, nil
+	}
+
+	context, err := tables.Context()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return context.Ctx(), dynamodb.NewFromConfig(*context.Cfg()), nil
+}
+
+// Switches the candidate search to index. tables.LoadIndexSharded is only
+// for tables that have InstancesGsiLoad, backfilled, see
+// tables.LoadIndexReady.
+func SetLoadIndex(index tables.LoadIndex) {
+	Default.SetLoadIndex(index)
+}
+
+func (a *Allocator) SetLoadIndex(index tables.LoadIndex) {
+	a.loadIndex = index
+}
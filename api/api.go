@@ -0,0 +1,300 @@
+// Package api serves Register, Unregister and the admin operations of lb
+// over HTTP, to callers identified by an auth.Authenticator and allowed by
+// an auth.Policy.
+//
+//	POST /v1/register    { "shopId", "stream", "port" }  register on shopId
+//	POST /v1/unregister  { "stream" }                    unregister on the stream's shop
+//	GET  /v1/streams/<stream>                            read on the stream's shop
+//	POST /v1/move        { "shopId", "stream" }          move
+//	POST /v1/drain       { "instance" }                  drain
+//
+// Errors are { "error": ... }, with 401 for callers that could not be
+// authenticated and 403 for those not allowed. Streams that do not exist are
+// 403 too, unless the caller is an admin, so that they cannot be probed for.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	lb "loadbalancer/go"
+	"loadbalancer/go/auth"
+)
+
+type Server struct {
+	backend Backend
+	authenticator auth.Authenticator
+	policy *auth.Policy
+	mux *http.ServeMux
+}
+
+func New(backend Backend, authenticator auth.Authenticator, policy *auth.Policy) *Server {
+	s := &Server { backend: backend, authenticator: authenticator, policy: policy, mux: http.NewServeMux() }
+	s.mux.HandleFunc("/v1/register", s.post(s.register))
+	s.mux.HandleFunc("/v1/unregister", s.post(s.unregister))
+	s.mux.HandleFunc("/v1/streams/", s.get(s.stream))
+	s.mux.HandleFunc("/v1/move", s.post(s.move))
+	s.mux.HandleFunc("/v1/drain", s.post(s.drain))
+	return s
+}
+
+type RegisterRequest struct {
+	ShopId string `json:"shopId"`
+	Stream string `json:"stream"`
+	Port uint16 `json:"port"`
+}
+
+type RegisterResponse struct {
+	PublicIp string `json:"publicIp"`
+	PrivateIp string `json:"privateIp"`
+}
+
+type UnregisterRequest struct {
+	Stream string `json:"stream"`
+}
+
+type MoveRequest struct {
+	ShopId string `json:"shopId"`
+	Stream string `json:"stream"`
+}
+
+type DrainRequest struct {
+	Instance string `json:"instance"`
+}
+
+// Remaining are the streams that could not be moved, the instance is left
+// cordoned either way.
+type DrainResponse struct {
+	Moved int `json:"moved"`
+	Remaining []string `json:"remaining"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type handler func(w http.ResponseWriter, r *http.Request, principal *auth.Principal)
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) post(h handler) http.HandlerFunc {
+	return s.handle(http.MethodPost, h)
+}
+
+func (s *Server) get(h handler) http.HandlerFunc {
+	return s.handle(http.MethodGet, h)
+}
+
+func (s *Server) handle(method string, h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, 405, fmt.Errorf("%v only", method))
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, auth.MAX_BODY)
+		principal, err := s.authenticator.Authenticate(r)
+		if err != nil {
+			log.Printf("INFO: Unauthenticated %v %v from %v --> %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			writeError(w, 401, fmt.Errorf("Unauthenticated"))
+			return
+		}
+
+		h(w, r, principal)
+	}
+}
+
+// Writes 403 and returns false unless principal may take action on shopId
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, principal *auth.Principal, action auth.Action, shopId string) bool {
+	err := s.policy.Authorize(principal, action, shopId)
+	if err == nil {
+		return true
+	}
+
+	log.Printf("INFO: Denied %v %v to %v (%v) --> %v", r.Method, r.URL.Path, principal.Subject, principal.Method, err)
+	writeError(w, 403, err)
+	return false
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request, principal *auth.Principal) {
+	var request RegisterRequest
+	if !readRequest(w, r, &request) {
+		return
+	}
+
+	if request.ShopId == "" || request.Stream == "" || request.Port == 0 {
+		writeError(w, 400, fmt.Errorf("shopId, stream and port are required"))
+		return
+	}
+
+	if !s.authorize(w, r, principal, auth.ActionRegister, request.ShopId) {
+		return
+	}
+
+	publicIp, privateIp, status, err := s.backend.Register(request.ShopId, request.Stream, request.Port)
+	if status != 200 {
+		writeError(w, status, err)
+		return
+	}
+
+	writeJson(w, 200, RegisterResponse { PublicIp: publicIp, PrivateIp: privateIp })
+}
+
+func (s *Server) unregister(w http.ResponseWriter, r *http.Request, principal *auth.Principal) {
+	var request UnregisterRequest
+	if !readRequest(w, r, &request) {
+		return
+	}
+
+	shop, ok := s.streamShop(w, r, principal, auth.ActionUnregister, request.Stream)
+	if !ok {
+		return
+	}
+
+	// By shop, so a stream given up and registered by another shop since
+	// the lookup is left alone
+	status, err := s.backend.UnregisterShopStream(shop.ShopId, shop.Stream)
+	if status != 200 {
+		writeError(w, status, err)
+		return
+	}
+
+	writeJson(w, 200, shop)
+}
+
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, principal *auth.Principal) {
+	shop, ok := s.streamShop(w, r, principal, auth.ActionRead, strings.TrimPrefix(r.URL.Path, "/v1/streams/"))
+	if !ok {
+		return
+	}
+
+	writeJson(w, 200, shop)
+}
+
+// The shop of stream, once principal is allowed action on it
+func (s *Server) streamShop(w http.ResponseWriter, r *http.Request, principal *auth.Principal, action auth.Action, stream string) (*lb.Shop, bool) {
+	if stream == "" || strings.Contains(stream, "/") {
+		writeError(w, 400, fmt.Errorf("A stream is required"))
+		return nil, false
+	}
+
+	// The same answer whether the stream is missing or of another shop,
+	// which is not named
+	shop, status, err := s.backend.GetShopByStream(stream)
+	denied := status == 400 && !s.policy.Admin(principal)
+	if status == 200 {
+		err = s.policy.Authorize(principal, action, shop.ShopId)
+		if err != nil {
+			log.Printf("INFO: Denied %v %v to %v (%v) --> %v", r.Method, r.URL.Path, principal.Subject, principal.Method, err)
+			denied = true
+		}
+	}
+
+	if denied {
+		writeError(w, 403, fmt.Errorf("%w: %v may not %v stream %v", auth.ErrForbidden, principal.Subject, action, stream))
+		return nil, false
+	}
+
+	if status != 200 {
+		writeError(w, status, err)
+		return nil, false
+	}
+
+	return shop, true
+}
+
+func (s *Server) move(w http.ResponseWriter, r *http.Request, principal *auth.Principal) {
+	var request MoveRequest
+	if !readRequest(w, r, &request) {
+		return
+	}
+
+	if !s.authorize(w, r, principal, auth.ActionMove, request.ShopId) {
+		return
+	}
+
+	publicIp, privateIp, status, err := s.backend.Move(request.ShopId, request.Stream)
+	if status != 200 {
+		writeError(w, status, err)
+		return
+	}
+
+	log.Printf("INFO: %v moved %v of %v", principal.Subject, request.Stream, request.ShopId)
+	writeJson(w, 200, RegisterResponse { PublicIp: publicIp, PrivateIp: privateIp })
+}
+
+// Cordons the instance and moves its streams away, like the agent does with
+// Drain, without removing the instance.
+func (s *Server) drain(w http.ResponseWriter, r *http.Request, principal *auth.Principal) {
+	var request DrainRequest
+	if !readRequest(w, r, &request) {
+		return
+	}
+
+	if !s.authorize(w, r, principal, auth.ActionDrain, "") {
+		return
+	}
+
+	status, err := s.backend.Cordon(request.Instance)
+	if status != 200 {
+		writeError(w, status, err)
+		return
+	}
+
+	shops, status, err := s.backend.ListShopsOnInstance(request.Instance)
+	if status != 200 {
+		writeError(w, status, err)
+		return
+	}
+
+	response := DrainResponse { Remaining: []string {} }
+	for _, shop := range shops {
+		_, _, status, err := s.backend.Move(shop.ShopId, shop.Stream)
+		if status != 200 {
+			log.Printf("INFO: Unable to move %v of %v off %v --> %v", shop.Stream, shop.ShopId, request.Instance, err)
+			response.Remaining = append(response.Remaining, shop.Stream)
+		} else {
+			response.Moved++
+		}
+	}
+
+	log.Printf("INFO: %v drained %v, %d moved and %d remaining", principal.Subject, request.Instance, response.Moved, len(response.Remaining))
+	writeJson(w, 200, response)
+}
+
+func readRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err != nil {
+		writeError(w, 400, fmt.Errorf("Invalid request body [%v]", err))
+		return false
+	}
+
+	return true
+}
+
+// The details of 500s are logged, not sent
+func writeError(w http.ResponseWriter, status int, err error) {
+	if err == nil {
+		err = fmt.Errorf("Status %d", status)
+	}
+
+	message := err.Error()
+	if status >= 500 {
+		log.Printf("INFO: Status %d --> %v", status, err)
+		message = http.StatusText(status)
+	}
+
+	writeJson(w, status, ErrorResponse { Error: message })
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
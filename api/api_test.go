@@ -0,0 +1,247 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	lb "loadbalancer/go"
+	"loadbalancer/go/auth"
+)
+
+type fakeBackend struct {
+	mutex sync.Mutex
+	shops map[string]lb.Shop
+	unmovable map[string]bool
+	cordoned map[string]bool
+}
+
+func newFakeBackend(shops ...lb.Shop) *fakeBackend {
+	b := &fakeBackend { shops: map[string]lb.Shop {}, unmovable: map[string]bool {}, cordoned: map[string]bool {} }
+	for _, shop := range shops {
+		b.shops[shop.Stream] = shop
+	}
+
+	return b
+}
+
+func (b *fakeBackend) Register(shopId string, stream string, port uint16) (string, string, int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, present := b.shops[stream]; present {
+		return "", "", 400, fmt.Errorf("Stream %v is taken", stream)
+	}
+
+	b.shops[stream] = lb.Shop { ShopId: shopId, Stream: stream, Port: port, Instance: "i-1", PublicIp: "1.1.1.1", PrivateIp: "10.0.0.1" }
+	return "1.1.1.1", "10.0.0.1", 200, nil
+}
+
+func (b *fakeBackend) GetShopByStream(stream string) (*lb.Shop, int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	shop, present := b.shops[stream]
+	if !present {
+		return nil, 400, fmt.Errorf("Stream %v does not exist", stream)
+	}
+
+	return &shop, 200, nil
+}
+
+func (b *fakeBackend) UnregisterShopStream(shopId string, stream string) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	shop, present := b.shops[stream]
+	if !present || shop.ShopId != shopId {
+		return 400, fmt.Errorf("Stream %v of shop %v does not exist", stream, shopId)
+	}
+
+	delete(b.shops, stream)
+	return 200, nil
+}
+
+func (b *fakeBackend) Move(shopId string, stream string) (string, string, int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	shop, present := b.shops[stream]
+	if !present || shop.ShopId != shopId {
+		return "", "", 400, fmt.Errorf("Stream %v of shop %v does not exist", stream, shopId)
+	}
+
+	if b.unmovable[stream] {
+		return "", "", 503, fmt.Errorf("No room for %v", stream)
+	}
+
+	shop.Instance = "i-2"
+	b.shops[stream] = shop
+	return "2.2.2.2", "10.0.0.2", 200, nil
+}
+
+func (b *fakeBackend) Cordon(instance string) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.cordoned[instance] = true
+	return 200, nil
+}
+
+func (b *fakeBackend) ListShopsOnInstance(instance string) ([]lb.Shop, int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	shops := []lb.Shop {}
+	for _, shop := range b.shops {
+		if shop.Instance == instance {
+			shops = append(shops, shop)
+		}
+	}
+
+	return shops, 200, nil
+}
+
+func newTestServer(t *testing.T, backend Backend) *Server {
+	keys, err := auth.NewAPIKeys([]auth.APIKey {
+		auth.APIKey { Subject: "shop-a", SHA256: auth.HashAPIKey("key-a") },
+		auth.APIKey { Subject: "shop-b", SHA256: auth.HashAPIKey("key-b") },
+		auth.APIKey { Subject: "ops", SHA256: auth.HashAPIKey("key-ops") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := auth.NewPolicy([]auth.Rule {
+		auth.Rule { Subject: "shop-a", ShopPrefixes: []string { "a-" } },
+		auth.Rule { Subject: "shop-b", ShopPrefixes: []string { "b-" } },
+		auth.Rule { Subject: "ops", Admin: true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(backend, auth.Chain { keys }, policy)
+}
+
+func call(server *Server, method string, path string, key string, body string) (int, map[string]interface{}) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(auth.API_KEY_HEADER, key)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	response := map[string]interface{} {}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestRegisterAndUnregister(t *testing.T) {
+	backend := newFakeBackend(lb.Shop { ShopId: "b-1", Stream: "b-stream", Port: 2000, Instance: "i-1" })
+	server := newTestServer(t, backend)
+	status, _ := call(server, "POST", "/v1/register", "", `{"shopId": "a-1", "stream": "a-stream", "port": 1000}`)
+	if status != 401 {
+		t.Fatalf("Expected 401 without credentials, not %d", status)
+	}
+
+	status, _ = call(server, "POST", "/v1/register", "key-x", `{"shopId": "a-1", "stream": "a-stream", "port": 1000}`)
+	if status != 401 {
+		t.Fatalf("Expected 401 with an unknown key, not %d", status)
+	}
+
+	status, _ = call(server, "POST", "/v1/register", "key-a", `{"shopId": "b-1", "stream": "a-stream", "port": 1000}`)
+	if status != 403 {
+		t.Fatalf("Expected 403 registering for another shop, not %d", status)
+	}
+
+	status, response := call(server, "POST", "/v1/register", "key-a", `{"shopId": "a-1", "stream": "a-stream", "port": 1000}`)
+	if status != 200 || response["publicIp"] != "1.1.1.1" {
+		t.Fatalf("Unexpected register response %d %v", status, response)
+	}
+
+	status, _ = call(server, "GET", "/v1/register", "key-a", "")
+	if status != 405 {
+		t.Fatalf("Expected 405 for a GET, not %d", status)
+	}
+
+	// Another shop's stream and a missing one look the same
+	status, taken := call(server, "POST", "/v1/unregister", "key-a", `{"stream": "b-stream"}`)
+	statusMissing, missing := call(server, "POST", "/v1/unregister", "key-a", `{"stream": "c-stream"}`)
+	if status != 403 || statusMissing != 403 || strings.Contains(fmt.Sprint(taken["error"]), "b-1") {
+		t.Fatalf("Expected 403s without the shop, not %d %v and %d %v", status, taken, statusMissing, missing)
+	}
+
+	if _, present := backend.shops["b-stream"]; !present {
+		t.Fatal("b-stream should not have been unregistered by shop-a")
+	}
+
+	status, _ = call(server, "POST", "/v1/unregister", "key-ops", `{"stream": "c-stream"}`)
+	if status != 400 {
+		t.Fatalf("Expected 400 for an admin unregistering a missing stream, not %d", status)
+	}
+
+	status, response = call(server, "GET", "/v1/streams/a-stream", "key-a", "")
+	if status != 200 || response["ShopId"] != "a-1" {
+		t.Fatalf("Unexpected stream %d %v", status, response)
+	}
+
+	status, _ = call(server, "GET", "/v1/streams/a-stream", "key-b", "")
+	if status != 403 {
+		t.Fatalf("Expected 403 reading another shop's stream, not %d", status)
+	}
+
+	status, _ = call(server, "POST", "/v1/unregister", "key-a", `{"stream": "a-stream"}`)
+	if status != 200 || len(backend.shops) != 1 {
+		t.Fatalf("Expected a-stream unregistered, not %d %v", status, backend.shops)
+	}
+
+	status, _ = call(server, "POST", "/v1/unregister", "key-b", `{"stream": "b-stream"}`)
+	if status != 200 || len(backend.shops) != 0 {
+		t.Fatalf("Expected b-stream unregistered, not %d %v", status, backend.shops)
+	}
+
+	fmt.Println("SUCCESS: TestRegisterAndUnregister")
+}
+
+func TestAdminOperations(t *testing.T) {
+	backend := newFakeBackend(
+		lb.Shop { ShopId: "a-1", Stream: "stream0", Instance: "i-1" },
+		lb.Shop { ShopId: "b-1", Stream: "stream1", Instance: "i-1" },
+		lb.Shop { ShopId: "b-1", Stream: "stream2", Instance: "i-3" },
+	)
+	backend.unmovable["stream1"] = true
+	server := newTestServer(t, backend)
+	status, _ := call(server, "POST", "/v1/move", "key-a", `{"shopId": "a-1", "stream": "stream0"}`)
+	if status != 403 {
+		t.Fatalf("Expected 403 for a shop moving its own stream, not %d", status)
+	}
+
+	status, _ = call(server, "POST", "/v1/drain", "key-b", `{"instance": "i-1"}`)
+	if status != 403 || backend.cordoned["i-1"] {
+		t.Fatalf("Expected 403 for a shop draining, not %d", status)
+	}
+
+	status, response := call(server, "POST", "/v1/move", "key-ops", `{"shopId": "b-1", "stream": "stream2"}`)
+	if status != 200 || response["publicIp"] != "2.2.2.2" {
+		t.Fatalf("Unexpected move response %d %v", status, response)
+	}
+
+	status, response = call(server, "POST", "/v1/drain", "key-ops", `{"instance": "i-1"}`)
+	if status != 200 || !backend.cordoned["i-1"] || response["moved"] != 1.0 || fmt.Sprint(response["remaining"]) != "[stream1]" {
+		t.Fatalf("Unexpected drain response %d %v", status, response)
+	}
+
+	fmt.Println("SUCCESS: TestAdminOperations")
+}
+
+func TestInternalErrorsAreNotSent(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, 500, fmt.Errorf("table lb_shops at arn:aws:dynamodb:..."))
+	if w.Code != 500 || strings.Contains(w.Body.String(), "arn") || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected error response %d %v", w.Code, w.Body.String())
+	}
+
+	fmt.Println("SUCCESS: TestInternalErrorsAreNotSent")
+}
+
+var _ http.Handler = &Server {}
+var _ Backend = lb.Default
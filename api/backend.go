@@ -0,0 +1,16 @@
+package api
+
+import (
+	lb "loadbalancer/go"
+)
+
+// What the API serves, with the status codes of lb. *lb.Allocator is one,
+// e.g. lb.Default.
+type Backend interface {
+	Register(shopId string, stream string, port uint16) (string, string, int, error)
+	GetShopByStream(stream string) (*lb.Shop, int, error)
+	UnregisterShopStream(shopId string, stream string) (int, error)
+	Move(shopId string, stream string) (string, string, int, error)
+	Cordon(instance string) (int, error)
+	ListShopsOnInstance(instance string) ([]lb.Shop, int, error)
+}
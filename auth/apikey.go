@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const API_KEY_HEADER = "X-Api-Key"
+
+// Only the SHA-256 of a key is kept, in hex, see HashAPIKey
+type APIKey struct {
+	Subject string `json:"subject" yaml:"subject"`
+	SHA256 string `json:"sha256" yaml:"sha256"`
+}
+
+// Static keys sent in the X-Api-Key header
+type APIKeys struct {
+	subjects map[string]string
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewAPIKeys(keys []APIKey) (*APIKeys, error) {
+	subjects := map[string]string {}
+	for _, key := range keys {
+		hash := strings.ToLower(key.SHA256)
+		if key.Subject == "" || len(hash) != 2 * sha256.Size {
+			return nil, fmt.Errorf("API key of %q needs a subject and the SHA-256 of the key in hex", key.Subject)
+		}
+
+		if _, present := subjects[hash]; present {
+			return nil, fmt.Errorf("API key of %v is repeated", key.Subject)
+		}
+
+		subjects[hash] = key.Subject
+	}
+
+	return &APIKeys { subjects: subjects }, nil
+}
+
+func (k *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(API_KEY_HEADER)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	subject, present := k.subjects[HashAPIKey(key)]
+	if !present {
+		return nil, fmt.Errorf("Unknown API key")
+	}
+
+	return &Principal { Subject: subject, Method: "api-key" }, nil
+}
@@ -0,0 +1,72 @@
+// Package auth identifies the callers of the lb HTTP API, with static API
+// keys, HMAC signed requests, TLS client certificates or JWTs checked
+// against a local JWKS file, and decides with a Policy what they may do:
+// register and unregister the streams of shops under the prefixes granted to
+// them, or the admin operations, like moving streams and draining instances.
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Requests bodies are read whole to be signed and checked, up to this size
+const MAX_BODY = 1 << 20
+
+// Who made a request, and how that was found out. ShopPrefixes and Admin are
+// what the credentials themselves grant, e.g. the claims of a JWT, on top of
+// what the Policy grants the Subject.
+type Principal struct {
+	Subject string
+	Method string
+	ShopPrefixes []string
+	Admin bool
+}
+
+// Returned by an Authenticator for a request without the kind of
+// credentials it checks, so that the next one can look. Any other error is
+// for credentials that are there but wrong.
+var ErrNoCredentials = errors.New("No credentials")
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Tries each Authenticator in turn. The first to find credentials decides.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, authenticator := range c {
+		principal, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+
+		return principal, err
+	}
+
+	return nil, ErrNoCredentials
+}
+
+// Reads the body of r, and puts it back for the handler
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return []byte {}, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, MAX_BODY + 1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > MAX_BODY {
+		return nil, fmt.Errorf("Request body over %d bytes", MAX_BODY)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
@@ -0,0 +1,396 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	keys, err := NewAPIKeys([]APIKey { APIKey { Subject: "shop-a", SHA256: HashAPIKey("secret-a") } })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/v1/register", nil)
+	_, err = keys.Authenticate(r)
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("A request without a key should have no credentials ---> %v", err)
+	}
+
+	r.Header.Set(API_KEY_HEADER, "secret-b")
+	_, err = keys.Authenticate(r)
+	if err == nil || errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("An unknown key should be refused ---> %v", err)
+	}
+
+	r.Header.Set(API_KEY_HEADER, "secret-a")
+	principal, err := keys.Authenticate(r)
+	if err != nil || principal.Subject != "shop-a" || principal.Method != "api-key" {
+		t.Fatalf("Unexpected principal %+v ---> %v", principal, err)
+	}
+
+	_, err = NewAPIKeys([]APIKey { APIKey { Subject: "shop-a", SHA256: "secret-a" } })
+	if err == nil {
+		t.Fatal("A key should be given by its SHA-256")
+	}
+
+	fmt.Println("SUCCESS: TestAPIKeys")
+}
+
+func TestHMACKeys(t *testing.T) {
+	keys, err := NewHMACKeys([]HMACKey { HMACKey { Id: "k1", Subject: "shop-b", Secret: "s3cret" } })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	keys.now = func() time.Time { return now }
+	r := httptest.NewRequest("POST", "/v1/register?x=1", strings.NewReader(`{"shopId":"b-1"}`))
+	err = SignRequest(r, "k1", "s3cret", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	principal, err := keys.Authenticate(r)
+	if err != nil || principal.Subject != "shop-b" || principal.Method != "hmac" {
+		t.Fatalf("Unexpected principal %+v ---> %v", principal, err)
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	if string(body) != `{"shopId":"b-1"}` {
+		t.Fatalf("The body should have been put back, not %q", body)
+	}
+
+	r = httptest.NewRequest("POST", "/v1/register?x=1", strings.NewReader(`{"shopId":"b-1"}`))
+	SignRequest(r, "k1", "s3cret", now)
+	_, err = keys.Authenticate(r)
+	if err == nil {
+		t.Fatal("A replayed request should be refused")
+	}
+
+	r = httptest.NewRequest("POST", "/v1/register", strings.NewReader(`{"shopId":"b-2"}`))
+	SignRequest(r, "k1", "s3cret", now)
+	r.Body = io.NopCloser(strings.NewReader(`{"shopId":"a-2"}`))
+	_, err = keys.Authenticate(r)
+	if err == nil {
+		t.Fatal("A request whose body changed should be refused")
+	}
+
+	r = httptest.NewRequest("POST", "/v1/register", strings.NewReader(`{"shopId":"b-3"}`))
+	SignRequest(r, "k1", "s3cret", now.Add(-DEFAULT_HMAC_TOLERANCE - time.Second))
+	_, err = keys.Authenticate(r)
+	if err == nil {
+		t.Fatal("A request signed too long ago should be refused")
+	}
+
+	r = httptest.NewRequest("POST", "/v1/register", strings.NewReader(`{"shopId":"b-4"}`))
+	SignRequest(r, "k1", "other", now)
+	_, err = keys.Authenticate(r)
+	if err == nil {
+		t.Fatal("A request signed with another secret should be refused")
+	}
+
+	fmt.Println("SUCCESS: TestHMACKeys")
+}
+
+func TestClientCerts(t *testing.T) {
+	certs := &ClientCerts {}
+	r := httptest.NewRequest("POST", "/v1/register", nil)
+	_, err := certs.Authenticate(r)
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("A request without TLS should have no credentials ---> %v", err)
+	}
+
+	cert := &x509.Certificate { Subject: pkix.Name { CommonName: "ops.example.com" } }
+	r.TLS = &tls.ConnectionState { VerifiedChains: [][]*x509.Certificate { []*x509.Certificate { cert } } }
+	principal, err := certs.Authenticate(r)
+	if err != nil || principal.Subject != "ops.example.com" || principal.Method != "mtls" {
+		t.Fatalf("Unexpected principal %+v ---> %v", principal, err)
+	}
+
+	certs.Subjects = map[string]string { "ops.example.com": "ops" }
+	principal, err = certs.Authenticate(r)
+	if err != nil || principal.Subject != "ops" {
+		t.Fatalf("The common name should have been mapped to ops, not %+v ---> %v", principal, err)
+	}
+
+	cert.Subject.CommonName = "other.example.com"
+	_, err = certs.Authenticate(r)
+	if err == nil {
+		t.Fatal("A common name that is not mapped should be refused")
+	}
+
+	fmt.Println("SUCCESS: TestClientCerts")
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signToken(t *testing.T, kid string, alg string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string { "alg": alg, "kid": kid, "typ": "JWT" })
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + b64(signature)
+}
+
+// A JWKS file with rsaKey as "r1" and ecKey as "e1"
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	set := map[string]interface{} {
+		"keys": []map[string]string {
+			map[string]string { "kty": "RSA", "kid": "r1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes()) },
+			map[string]string { "kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes()) },
+			map[string]string { "kty": "RSA", "kid": "enc", "use": "enc", "n": "", "e": "" },
+		},
+	}
+
+	data, _ := json.Marshal(set)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadJWKS(writeJWKS(t, rsaKey, ecKey))
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("Expected the two signing keys, not %v ---> %v", keys, err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	verifier := NewJWTVerifier(keys, "https://idp", "lb")
+	verifier.now = func() time.Time { return now }
+	claims := func() map[string]interface{} {
+		return map[string]interface{} {
+			"sub": "shop-c",
+			"iss": "https://idp",
+			"aud": []string { "other", "lb" },
+			"exp": now.Add(time.Hour).Unix(),
+			"shops": []string { "c-" },
+		}
+	}
+
+	authenticate := func(token string) (*Principal, error) {
+		r := httptest.NewRequest("GET", "/v1/streams/s", nil)
+		r.Header.Set("Authorization", "Bearer " + token)
+		return verifier.Authenticate(r)
+	}
+
+	for _, token := range []string { signToken(t, "r1", "RS256", rsaKey, claims()), signToken(t, "e1", "ES256", ecKey, claims()) } {
+		principal, err := authenticate(token)
+		if err != nil || principal.Subject != "shop-c" || principal.Method != "jwt" || len(principal.ShopPrefixes) != 1 || principal.ShopPrefixes[0] != "c-" || principal.Admin {
+			t.Fatalf("Unexpected principal %+v ---> %v", principal, err)
+		}
+	}
+
+	expired := claims()
+	expired["exp"] = now.Add(-DEFAULT_JWT_LEEWAY - time.Second).Unix()
+	wrongAudience := claims()
+	wrongAudience["aud"] = "other"
+	wrongIssuer := claims()
+	wrongIssuer["iss"] = "https://elsewhere"
+	noExpiry := claims()
+	delete(noExpiry, "exp")
+	notYet := claims()
+	notYet["nbf"] = now.Add(time.Hour).Unix()
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	refused := map[string]string {
+		"expired": signToken(t, "r1", "RS256", rsaKey, expired),
+		"wrong audience": signToken(t, "r1", "RS256", rsaKey, wrongAudience),
+		"wrong issuer": signToken(t, "r1", "RS256", rsaKey, wrongIssuer),
+		"without exp": signToken(t, "r1", "RS256", rsaKey, noExpiry),
+		"not valid yet": signToken(t, "r1", "RS256", rsaKey, notYet),
+		"other key": signToken(t, "e1", "ES256", otherKey, claims()),
+		"alg mismatch": signToken(t, "e1", "RS256", rsaKey, claims()),
+		"unknown kid": signToken(t, "x1", "RS256", rsaKey, claims()),
+		"malformed": "not.a.token",
+	}
+
+	for name, token := range refused {
+		_, err := authenticate(token)
+		if err == nil || errors.Is(err, ErrNoCredentials) {
+			t.Fatalf("The %v token should have been refused ---> %v", name, err)
+		}
+	}
+
+	fmt.Println("SUCCESS: TestJWT")
+}
+
+func TestWeakRSAKeys(t *testing.T) {
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strongKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := b64(strongKey.N.Bytes())
+	for name, key := range map[string]map[string]string {
+		"1024 bits": map[string]string { "kty": "RSA", "kid": "r1", "n": b64(smallKey.N.Bytes()), "e": b64(big.NewInt(int64(smallKey.E)).Bytes()) },
+		"e of 1": map[string]string { "kty": "RSA", "kid": "r1", "n": n, "e": b64(big.NewInt(1).Bytes()) },
+		"even e": map[string]string { "kty": "RSA", "kid": "r1", "n": n, "e": b64(big.NewInt(65536).Bytes()) },
+		"e over 31 bits": map[string]string { "kty": "RSA", "kid": "r1", "n": n, "e": b64(big.NewInt(1 << 40 + 1).Bytes()) },
+	} {
+		data, _ := json.Marshal(map[string]interface{} { "keys": []map[string]string { key } })
+		_, err = ParseJWKS(data)
+		if err == nil {
+			t.Fatalf("A JWKS with an RSA key with %v should have been refused", name)
+		}
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestWeakRSAKeys Expected error received --> %v", err))
+}
+
+func TestPolicy(t *testing.T) {
+	policy, err := NewPolicy([]Rule {
+		Rule { Subject: "shop-a", ShopPrefixes: []string { "a-" } },
+		Rule { Subject: "ops", Admin: true },
+		Rule { Subject: "*", ShopPrefixes: []string { "public-" } },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Principal { Subject: "shop-a" }
+	ops := &Principal { Subject: "ops" }
+	token := &Principal { Subject: "shop-c", ShopPrefixes: []string { "c-" } }
+	cases := []struct {
+		principal *Principal
+		action Action
+		shopId string
+		allowed bool
+	} {
+		{ a, ActionRegister, "a-1", true },
+		{ a, ActionUnregister, "b-1", false },
+		{ a, ActionRead, "public-1", true },
+		{ a, ActionMove, "a-1", false },
+		{ a, ActionDrain, "", false },
+		{ ops, ActionUnregister, "b-1", true },
+		{ ops, ActionDrain, "", true },
+		{ token, ActionRegister, "c-1", true },
+		{ token, ActionRegister, "a-1", false },
+		{ &Principal { Subject: "nobody" }, ActionRead, "a-1", false },
+	}
+
+	for _, c := range cases {
+		err := policy.Authorize(c.principal, c.action, c.shopId)
+		if (err == nil) != c.allowed || (err != nil && !errors.Is(err, ErrForbidden)) {
+			t.Fatalf("%v on %v by %v: expected allowed %v ---> %v", c.action, c.shopId, c.principal.Subject, c.allowed, err)
+		}
+	}
+
+	if policy.Admin(a) || !policy.Admin(ops) {
+		t.Fatal("Only ops should be an admin")
+	}
+
+	_, err = NewPolicy([]Rule { Rule { Subject: "shop-a", ShopPrefixes: []string { "" } } })
+	if err == nil {
+		t.Fatal("An empty prefix should be refused")
+	}
+
+	fmt.Println("SUCCESS: TestPolicy")
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	config := "apiKeys:\n" +
+		"  - { subject: shop-a, sha256: " + HashAPIKey("secret-a") + " }\n" +
+		"hmacKeys:\n" +
+		"  - { id: k1, subject: shop-b, secret: s3cret }\n" +
+		"rules:\n" +
+		"  - { subject: shop-a, shopPrefixes: [a-] }\n" +
+		"  - { subject: shop-b, admin: true }\n"
+	err := os.WriteFile(path, []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator, policy, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/v1/drain", strings.NewReader("{}"))
+	SignRequest(r, "k1", "s3cret", time.Now())
+	principal, err := authenticator.Authenticate(r)
+	if err != nil || principal.Subject != "shop-b" || policy.Authorize(principal, ActionDrain, "") != nil {
+		t.Fatalf("shop-b should be an admin through its HMAC key, not %+v ---> %v", principal, err)
+	}
+
+	r = httptest.NewRequest("POST", "/v1/register", nil)
+	r.Header.Set(API_KEY_HEADER, "secret-a")
+	principal, err = authenticator.Authenticate(r)
+	if err != nil || principal.Subject != "shop-a" || policy.Authorize(principal, ActionRegister, "b-1") == nil {
+		t.Fatalf("shop-a should only have a-, not %+v ---> %v", principal, err)
+	}
+
+	r = httptest.NewRequest("POST", "/v1/register", nil)
+	_, err = authenticator.Authenticate(r)
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("A request without credentials should have none ---> %v", err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "auth.json")
+	os.WriteFile(empty, []byte(`{"rules": []}`), 0600)
+	_, _, err = LoadFile(empty)
+	if err == nil {
+		t.Fatal("A file without any authentication method should be refused")
+	}
+
+	fmt.Println("SUCCESS: TestLoadFile")
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"gopkg.in/yaml.v3"
+)
+
+// The layout of the files LoadFile reads, in YAML
+//
+//	apiKeys:
+//	  - { subject: shop-a-service, sha256: 9f86d0... }
+//	hmacKeys:
+//	  - { id: k1, subject: shop-b-service, secret: ... }
+//	clientCerts:
+//	  subjects: { ops.example.com: ops }
+//	jwt: { jwks: /etc/lb/jwks.json, issuer: https://idp.example.com, audience: lb }
+//	rules:
+//	  - { subject: shop-a-service, shopPrefixes: [a-] }
+//	  - { subject: ops, admin: true }
+//
+// or the same in JSON. Only the methods given are accepted, and subjects are
+// the same whichever method a caller authenticates with.
+type File struct {
+	APIKeys []APIKey `json:"apiKeys" yaml:"apiKeys"`
+	HMACKeys []HMACKey `json:"hmacKeys" yaml:"hmacKeys"`
+	ClientCerts *ClientCerts `json:"clientCerts" yaml:"clientCerts"`
+	JWT *JWTConfig `json:"jwt" yaml:"jwt"`
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// Reads YAML from .yaml and .yml files, and JSON from anything else
+func LoadFile(path string) (Authenticator, *Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var file File
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	default:
+		err = json.Unmarshal(data, &file)
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to parse %v [%v]", path, err)
+	}
+
+	return file.Build()
+}
+
+func (f *File) Build() (Authenticator, *Policy, error) {
+	chain := Chain {}
+	if f.ClientCerts != nil {
+		chain = append(chain, f.ClientCerts)
+	}
+
+	if len(f.HMACKeys) > 0 {
+		keys, err := NewHMACKeys(f.HMACKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		chain = append(chain, keys)
+	}
+
+	if len(f.APIKeys) > 0 {
+		keys, err := NewAPIKeys(f.APIKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		chain = append(chain, keys)
+	}
+
+	if f.JWT != nil {
+		keys, err := LoadJWKS(f.JWT.JWKS)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to load the JWKS %v [%v]", f.JWT.JWKS, err)
+		}
+
+		chain = append(chain, NewJWTVerifier(keys, f.JWT.Issuer, f.JWT.Audience))
+	}
+
+	if len(chain) == 0 {
+		return nil, nil, fmt.Errorf("No authentication method is configured")
+	}
+
+	policy, err := NewPolicy(f.Rules)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return chain, policy, nil
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const HMAC_KEY_ID_HEADER = "X-Lb-Key-Id"
+const HMAC_TIMESTAMP_HEADER = "X-Lb-Timestamp"
+const HMAC_SIGNATURE_HEADER = "X-Lb-Signature"
+
+// How far the timestamp of a signed request may be from now, either way
+const DEFAULT_HMAC_TOLERANCE = 5 * time.Minute
+
+type HMACKey struct {
+	Id string `json:"id" yaml:"id"`
+	Subject string `json:"subject" yaml:"subject"`
+	Secret string `json:"secret" yaml:"secret"`
+}
+
+// Requests signed with a shared secret, see SignRequest. A signature is only
+// accepted once, so a captured request cannot be sent again while its
+// timestamp is within the tolerance.
+type HMACKeys struct {
+	Tolerance time.Duration
+	keys map[string]HMACKey
+	now func() time.Time
+	mutex sync.Mutex
+	// the signatures accepted, until they expire
+	seen map[string]time.Time
+}
+
+func NewHMACKeys(keys []HMACKey) (*HMACKeys, error) {
+	byId := map[string]HMACKey {}
+	for _, key := range keys {
+		if key.Id == "" || key.Subject == "" || key.Secret == "" {
+			return nil, fmt.Errorf("HMAC key %q needs an id, a subject and a secret", key.Id)
+		}
+
+		if _, present := byId[key.Id]; present {
+			return nil, fmt.Errorf("HMAC key %v is repeated", key.Id)
+		}
+
+		byId[key.Id] = key
+	}
+
+	return &HMACKeys { Tolerance: DEFAULT_HMAC_TOLERANCE, keys: byId, now: time.Now, seen: map[string]time.Time {} }, nil
+}
+
+// The signature covers the method, the path with the query, the timestamp
+// and the body.
+func Signature(secret string, method string, requestURI string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method))
+	mac.Write([]byte(" "))
+	mac.Write([]byte(requestURI))
+	mac.Write([]byte("."))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// For clients. Sets the headers signing r, whose body is read and put back.
+func SignRequest(r *http.Request, keyId string, secret string, now time.Time) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	r.Header.Set(HMAC_KEY_ID_HEADER, keyId)
+	r.Header.Set(HMAC_TIMESTAMP_HEADER, timestamp)
+	r.Header.Set(HMAC_SIGNATURE_HEADER, Signature(secret, r.Method, r.URL.RequestURI(), timestamp, body))
+	return nil
+}
+
+func (k *HMACKeys) Authenticate(r *http.Request) (*Principal, error) {
+	keyId := r.Header.Get(HMAC_KEY_ID_HEADER)
+	signature := r.Header.Get(HMAC_SIGNATURE_HEADER)
+	if keyId == "" && signature == "" {
+		return nil, ErrNoCredentials
+	}
+
+	key, present := k.keys[keyId]
+	if !present {
+		return nil, fmt.Errorf("Unknown HMAC key %q", keyId)
+	}
+
+	timestamp := r.Header.Get(HMAC_TIMESTAMP_HEADER)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid timestamp %q", timestamp)
+	}
+
+	now := k.now()
+	signed := time.Unix(seconds, 0)
+	if signed.Before(now.Add(-k.Tolerance)) || signed.After(now.Add(k.Tolerance)) {
+		return nil, fmt.Errorf("Timestamp %v is more than %v from now", timestamp, k.Tolerance)
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := Signature(key.Secret, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, fmt.Errorf("Signature mismatch")
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for seen, expires := range k.seen {
+		if now.After(expires) {
+			delete(k.seen, seen)
+		}
+	}
+
+	if _, replayed := k.seen[signature]; replayed {
+		return nil, fmt.Errorf("Signature already used")
+	}
+
+	k.seen[signature] = signed.Add(k.Tolerance)
+	return &Principal { Subject: key.Subject, Method: "hmac" }, nil
+}
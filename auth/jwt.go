@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// How far past exp, or before nbf, a token is still taken, for clock skew
+const DEFAULT_JWT_LEEWAY = time.Minute
+
+// RSA keys shorter than this can be factored, and are refused
+const MIN_RSA_KEY_BITS = 2048
+
+type JWTConfig struct {
+	// A JWKS file, { "keys": [ ... ] }, with RSA keys for RS256 and P-256
+	// keys for ES256
+	JWKS string `json:"jwks" yaml:"jwks"`
+	// Checked when set
+	Issuer string `json:"issuer" yaml:"issuer"`
+	Audience string `json:"audience" yaml:"audience"`
+}
+
+// Bearer tokens signed by one of the keys of a JWKS. The subject is the sub
+// claim, and the token may grant shop prefixes itself with a "shops" claim,
+// a list of them, and admin operations with an "admin" claim of true.
+type JWTVerifier struct {
+	Issuer string
+	Audience string
+	Leeway time.Duration
+	keys map[string]crypto.PublicKey
+	now func() time.Time
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N string `json:"n"`
+	E string `json:"e"`
+	Crv string `json:"crv"`
+	X string `json:"x"`
+	Y string `json:"y"`
+}
+
+func NewJWTVerifier(keys map[string]crypto.PublicKey, issuer string, audience string) *JWTVerifier {
+	return &JWTVerifier { Issuer: issuer, Audience: audience, Leeway: DEFAULT_JWT_LEEWAY, keys: keys, now: time.Now }
+}
+
+// The keys of a JWKS file by kid. Keys for other uses than signatures are
+// left out.
+func LoadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseJWKS(data)
+}
+
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the JWKS [%v]", err)
+	}
+
+	keys := map[string]crypto.PublicKey {}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Key %q: %v", k.Kid, err)
+		}
+
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &rsa.PublicKey { N: new(big.Int).SetBytes(n) }
+		if key.N.BitLen() < MIN_RSA_KEY_BITS {
+			return nil, fmt.Errorf("RSA key of %d bits, shorter than %d", key.N.BitLen(), MIN_RSA_KEY_BITS)
+		}
+
+		// what crypto/rsa accepts as an exponent
+		exponent := new(big.Int).SetBytes(e)
+		if exponent.BitLen() > 31 || exponent.Int64() < 3 || exponent.Bit(0) == 0 {
+			return nil, fmt.Errorf("Invalid RSA exponent %v", exponent)
+		}
+
+		key.E = int(exponent.Int64())
+		return key, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve %v", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &ecdsa.PublicKey { Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y) }
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("Point not on the curve")
+		}
+
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported key type %v", k.Kty)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject string `json:"sub"`
+	Issuer string `json:"iss"`
+	Audience audience `json:"aud"`
+	Expires *int64 `json:"exp"`
+	NotBefore *int64 `json:"nbf"`
+	Shops []string `json:"shops"`
+	Admin bool `json:"admin"`
+}
+
+// A single audience or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = audience { one }
+		return nil
+	}
+
+	var many []string
+	err := json.Unmarshal(data, &many)
+	*a = many
+	return err
+}
+
+func (v *JWTVerifier) Authenticate(r *http.Request) (*Principal, error) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := v.verify(strings.TrimPrefix(authorization, "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal { Subject: claims.Subject, Method: "jwt", ShopPrefixes: claims.Shops, Admin: claims.Admin }, nil
+}
+
+func (v *JWTVerifier) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed token")
+	}
+
+	var header jwtHeader
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+
+	key, present := v.keys[header.Kid]
+	if !present {
+		return nil, fmt.Errorf("Unknown key %q", header.Kid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed signature")
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("Algorithm %v does not go with key %q", header.Alg, header.Kid)
+		}
+
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, fmt.Errorf("Algorithm %v does not go with key %q", header.Alg, header.Kid)
+		}
+
+		if !ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			err = fmt.Errorf("Invalid signature")
+		}
+	default:
+		err = fmt.Errorf("Unsupported key %q", header.Kid)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid signature [%v]", err)
+	}
+
+	var claims jwtClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	now := v.now()
+	if claims.Expires == nil || now.After(time.Unix(*claims.Expires, 0).Add(v.Leeway)) {
+		return nil, fmt.Errorf("Token expired or without exp")
+	}
+
+	if claims.NotBefore != nil && now.Before(time.Unix(*claims.NotBefore, 0).Add(-v.Leeway)) {
+		return nil, fmt.Errorf("Token not valid yet")
+	}
+
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return nil, fmt.Errorf("Token issued by %q", claims.Issuer)
+	}
+
+	if v.Audience != "" && !contains(claims.Audience, v.Audience) {
+		return nil, fmt.Errorf("Token not meant for %q", v.Audience)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("Token without sub")
+	}
+
+	return &claims, nil
+}
+
+func decodeSegment(segment string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("Malformed token segment")
+	}
+
+	err = json.Unmarshal(data, out)
+	if err != nil {
+		return fmt.Errorf("Malformed token segment [%v]", err)
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
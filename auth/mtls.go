@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// TLS client certificates, verified by the server's tls.Config against its
+// ClientCAs. The subject is the certificate's common name, or what Subjects
+// maps it to. With Subjects set, other common names are refused.
+type ClientCerts struct {
+	Subjects map[string]string `json:"subjects" yaml:"subjects"`
+}
+
+func (c *ClientCerts) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	subject := commonName
+	if len(c.Subjects) > 0 {
+		mapped, present := c.Subjects[commonName]
+		if !present {
+			return nil, fmt.Errorf("Client certificate %q is not allowed", commonName)
+		}
+
+		subject = mapped
+	}
+
+	if subject == "" {
+		return nil, fmt.Errorf("Client certificate without a common name")
+	}
+
+	return &Principal { Subject: subject, Method: "mtls" }, nil
+}
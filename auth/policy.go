@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Action string
+
+const (
+	// On the streams of a shop
+	ActionRegister Action = "register"
+	ActionUnregister Action = "unregister"
+	ActionRead Action = "read"
+
+	// Admin operations, on any shop or instance
+	ActionMove Action = "move"
+	ActionDrain Action = "drain"
+)
+
+func (a Action) admin() bool {
+	return a == ActionMove || a == ActionDrain
+}
+
+// Grants Subject, or every caller with "*", the shops whose ids start with
+// one of ShopPrefixes, and with Admin every shop and the admin operations.
+type Rule struct {
+	Subject string `json:"subject" yaml:"subject"`
+	ShopPrefixes []string `json:"shopPrefixes" yaml:"shopPrefixes"`
+	Admin bool `json:"admin" yaml:"admin"`
+}
+
+// Authorize's errors wrap it
+var ErrForbidden = errors.New("Forbidden")
+
+type Policy struct {
+	rules map[string][]Rule
+}
+
+// An empty prefix would grant every shop, which is what Admin is for, so it
+// is refused.
+func NewPolicy(rules []Rule) (*Policy, error) {
+	bySubject := map[string][]Rule {}
+	for _, rule := range rules {
+		if rule.Subject == "" {
+			return nil, fmt.Errorf("A rule needs a subject, or * for every caller")
+		}
+
+		for _, prefix := range rule.ShopPrefixes {
+			if prefix == "" {
+				return nil, fmt.Errorf("Rule of %v has an empty shop prefix, use admin to grant every shop", rule.Subject)
+			}
+		}
+
+		bySubject[rule.Subject] = append(bySubject[rule.Subject], rule)
+	}
+
+	return &Policy { rules: bySubject }, nil
+}
+
+func (p *Policy) grants(principal *Principal) []Rule {
+	grants := append([]Rule { Rule { ShopPrefixes: principal.ShopPrefixes, Admin: principal.Admin } }, p.rules[principal.Subject]...)
+	return append(grants, p.rules["*"]...)
+}
+
+// Whether principal may do anything, on any shop
+func (p *Policy) Admin(principal *Principal) bool {
+	for _, grant := range p.grants(principal) {
+		if grant.Admin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nil if principal may take action on shopId, which is ignored for admin
+// actions
+func (p *Policy) Authorize(principal *Principal, action Action, shopId string) error {
+	for _, grant := range p.grants(principal) {
+		if grant.Admin {
+			return nil
+		}
+
+		if action.admin() {
+			continue
+		}
+
+		for _, prefix := range grant.ShopPrefixes {
+			if prefix != "" && strings.HasPrefix(shopId, prefix) {
+				return nil
+			}
+		}
+	}
+
+	if action.admin() {
+		return fmt.Errorf("%w: %v may not %v", ErrForbidden, principal.Subject, action)
+	}
+
+	return fmt.Errorf("%w: %v may not %v streams of shop %v", ErrForbidden, principal.Subject, action, shopId)
+}
@@ -0,0 +1,506 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+
+	"loadbalancer/go/tables"
+)
+
+type RegisterRequest struct {
+	ShopId string
+	Stream string
+	Port uint16
+}
+
+// Status and Err mean the same as the status and error returned by Register
+type RegisterResult struct {
+	RegisterRequest
+	PublicIp string
+	PrivateIp string
+	Status int
+	Err error
+}
+
+type UnregisterResult struct {
+	Stream string
+	Status int
+	Err error
+}
+
+// Registers many shops at once. Placements for the whole batch are planned
+// up front against a single read of the instance loads and port usage, and
+// then written in as few transactions as the transact item limit allows.
+// When a transaction fails, the requests in it and in every later group are
+// registered one at a time through Register so each gets its own result, as
+// are the requests of shops with a quota. Results are in the same order as
+// the requests.
+func RegisterBatch(requests []RegisterRequest) []RegisterResult {
+	return Default.RegisterBatch(requests)
+}
+
+func (a *Allocator) RegisterBatch(requests []RegisterRequest) []RegisterResult {
+	results := make([]RegisterResult, len(requests))
+	for i, request := range requests {
+		results[i].RegisterRequest = request
+	}
+
+	ctx, ddb, err := a.client()
+	if err != nil {
+		failAll(results, 500, err)
+		return results
+	}
+
+	pending, governed, guards := a.validateRegisterBatch(ctx, ddb, results)
+
+	// The quota usage of a shop is a single item, which one transaction
+	// cannot write twice, so the requests of shops with a quota are
+	// registered one at a time.
+	for _, i := range governed {
+		r := &results[i]
+		r.PublicIp, r.PrivateIp, r.Status, r.Err = a.Register(r.ShopId, r.Stream, r.Port)
+	}
+
+	if len(pending) == 0 {
+		return results
+	}
+
+	instanceRecords, err := a.loadCandidateInstances(ctx, ddb)
+	if err != nil {
+		failPending(results, pending, 500, err)
+		return results
+	}
+
+	placements := planPlacements(ctx, ddb, results, pending, instanceRecords)
+
+	// Once a transaction fails the instance records can no longer be trusted
+	// to plan with, so every later request is registered on its own.
+	oneAtATime := false
+	for _, group := range groupPlacements(placements, func(p *plannedPlacement) string { return p.Instance }, func(p *plannedPlacement) string { return p.ShopId }) {
+		var newVersion string
+		if !oneAtATime {
+			groupPlacements := make([]tables.PlacementType, len(group))
+			added := map[string]int {}
+			for i, p := range group {
+				groupPlacements[i] = p.PlacementType
+				added[p.ShopId]++
+			}
+
+			// one guard put for each shop, however many of its streams
+			// the group places
+			guardVersion := uuid.New().String()
+			guardPuts := []types.TransactWriteItem {}
+			for shopId := range added {
+				guardPuts, err = guards[shopId].put(guardPuts, guardVersion)
+				if err != nil {
+					break
+				}
+			}
+
+			if err == nil {
+				newVersion, err = tables.TransactAddStreams(ctx, ddb, groupPlacements, instanceRecords, guardPuts...)
+			}
+
+			if err != nil {
+				log.Printf("INFO: Batch transaction of %d registrations failed, registering the rest one at a time --> %v", len(group), err)
+				oneAtATime = true
+			} else {
+				for shopId, n := range added {
+					guards[shopId].committed(n, guardVersion)
+				}
+			}
+		}
+
+		if oneAtATime {
+			for _, p := range group {
+				r := &results[p.index]
+				r.PublicIp, r.PrivateIp, r.Status, r.Err = a.Register(r.ShopId, r.Stream, r.Port)
+			}
+
+			continue
+		}
+
+		for _, p := range group {
+			record := instanceRecords[p.Instance]
+			record.Streams++
+			record.Version = newVersion
+			r := &results[p.index]
+			r.PublicIp, r.PrivateIp, err = a.resolveIps(ctx, ddb, p.Instance)
+			if err != nil {
+				r.Status, r.Err = 500, err
+			} else {
+				r.Status = 200
+			}
+		}
+	}
+
+	return results
+}
+
+// Unregisters many streams at once, grouping the deletions into as few
+// transactions as the transact item limit allows. Streams that need anything
+// other than a plain deletion, streams of shops with a quota, and the streams
+// of a failed transaction, go through Unregister one at a time.
+func UnregisterBatch(streams []string) []UnregisterResult {
+	return Default.UnregisterBatch(streams)
+}
+
+func (a *Allocator) UnregisterBatch(streams []string) []UnregisterResult {
+	results := make([]UnregisterResult, len(streams))
+	for i, stream := range streams {
+		results[i].Stream = stream
+	}
+
+	ctx, ddb, err := a.client()
+	if err != nil {
+		for i := range results {
+			results[i].Status, results[i].Err = 500, err
+		}
+
+		return results
+	}
+
+	seen := map[string]interface{} {}
+	governed := map[string]bool {}
+	shops := []*plannedDeletion {}
+	instanceRecords := map[string]*tables.InstanceType {}
+	for i, stream := range streams {
+		if _, present := seen[stream]; present {
+			results[i].Status, results[i].Err = 400, fmt.Errorf("Stream %v is repeated in the batch", stream)
+			continue
+		}
+
+		seen[stream] = nil
+		shop, status, err := a.findStreamShop(ctx, ddb, stream)
+		if status != 200 {
+			results[i].Status, results[i].Err = status, err
+			continue
+		}
+
+		if _, present := governed[shop.ShopId]; !present {
+			quota, err := tables.ConsistentGetQuota(ctx, ddb, tables.ShopScope(shop.ShopId))
+			if err != nil {
+				results[i].Status, results[i].Err = 500, err
+				continue
+			}
+
+			governed[shop.ShopId] = quota != nil
+		}
+
+		if governed[shop.ShopId] {
+			results[i].Status, results[i].Err = unregister(ctx, ddb, shop, nil)
+			continue
+		}
+
+		if _, present := instanceRecords[shop.Instance]; !present {
+			instanceRecord, err := tables.ConsistentGetInstance(ctx, ddb, shop.Instance)
+			if err != nil {
+				results[i].Status, results[i].Err = 500, err
+				continue
+			}
+
+			instanceRecords[shop.Instance] = instanceRecord
+		}
+
+		shops = append(shops, &plannedDeletion { shop: shop, index: i })
+	}
+
+	oneAtATime := false
+	for _, group := range groupPlacements(shops, func(d *plannedDeletion) string { return d.shop.Instance }, nil) {
+		var newVersion string
+		if !oneAtATime {
+			groupShops := make([]*tables.ShopType, len(group))
+			for i, d := range group {
+				groupShops[i] = d.shop
+			}
+
+			newVersion, err = tables.TransactDeleteStreams(ctx, ddb, groupShops, instanceRecords)
+			if err != nil {
+				log.Printf("INFO: Batch transaction of %d unregistrations failed, unregistering the rest one at a time --> %v", len(group), err)
+				oneAtATime = true
+			}
+		}
+
+		if oneAtATime {
+			for _, d := range group {
+				results[d.index].Status, results[d.index].Err = a.Unregister(d.shop.Stream)
+			}
+
+			continue
+		}
+
+		for _, d := range group {
+			record := instanceRecords[d.shop.Instance]
+			record.Streams--
+			record.Version = newVersion
+			results[d.index].Status = 200
+		}
+	}
+
+	return results
+}
+
+type plannedPlacement struct {
+	tables.PlacementType
+	index int
+}
+
+type plannedDeletion struct {
+	shop *tables.ShopType
+	index int
+}
+
+// Settles the requests that can be answered without placing anything, the
+// same way Register would, and returns the indices of the rest to be placed
+// by the batch, those of shops with a quota, and the guards of the shops of
+// the former. It only reads.
+func (a *Allocator) validateRegisterBatch(ctx context.Context, ddb tables.DynamoDBAPI, results []RegisterResult) ([]int, []int, map[string]*streamsGuard) {
+	pending := []int {}
+	governedPending := []int {}
+	streams := map[string]interface{} {}
+
+	// streams of each shop pending in the batch, on top of what its guard
+	// counted
+	shopStreams := map[string]int {}
+	guards := map[string]*streamsGuard {}
+
+	// shops with a quota
+	governed := map[string]bool {}
+	for i := range results {
+		r := &results[i]
+		_, streamRepeated := streams[r.Stream]
+		streams[r.Stream] = nil
+		if streamRepeated {
+			r.Status, r.Err = 400, fmt.Errorf("Stream %v is repeated in the batch", r.Stream)
+			continue
+		}
+
+		shop, err := tables.ConsistentGetShop(ctx, ddb, r.ShopId, r.Stream)
+		if err != nil {
+			r.Status, r.Err = 500, err
+			continue
+		}
+
+		if shop != nil && shop.Port == r.Port {
+			r.PublicIp, r.PrivateIp, err = a.resolveIps(ctx, ddb, shop.Instance)
+			if err != nil {
+				r.Status, r.Err = 500, err
+			} else {
+				r.Status = 200
+			}
+
+			continue
+		} else if shop != nil {
+			r.Status, r.Err = 400, fmt.Errorf(fmt.Sprintf("Stream %v in use", r.Stream))
+			continue
+		}
+
+		if _, present := governed[r.ShopId]; !present {
+			quota, err := tables.ConsistentGetQuota(ctx, ddb, tables.ShopScope(r.ShopId))
+			if err != nil {
+				r.Status, r.Err = 500, err
+				continue
+			}
+
+			governed[r.ShopId] = quota != nil
+		}
+
+		// Register checks the quota and the stream itself
+		if governed[r.ShopId] {
+			governedPending = append(governedPending, i)
+			continue
+		}
+
+		if _, present := guards[r.ShopId]; !present {
+			guard, err := loadStreamsGuard(ctx, ddb, r.ShopId)
+			if err != nil {
+				r.Status, r.Err = 500, err
+				continue
+			}
+
+			guards[r.ShopId] = guard
+		}
+
+		err = guards[r.ShopId].check(shopStreams[r.ShopId] + 1)
+		if err != nil {
+			r.Status, r.Err = 400, err
+			continue
+		}
+
+		streamExists, err := tables.TestStreamPresence(ctx, ddb, r.Stream)
+		if err != nil {
+			r.Status, r.Err = 500, err
+			continue
+		}
+
+		if streamExists {
+			r.Status, r.Err = 400, fmt.Errorf(fmt.Sprintf("Stream %v in use", r.Stream))
+			continue
+		}
+
+		shopStreams[r.ShopId]++
+		pending = append(pending, i)
+	}
+
+	return pending, governedPending, guards
+}
+
+// Consistent reads of every uncordoned, healthy instance that still has room, as
+// found through the Streams GSI and the instances it missed.
+func (a *Allocator) loadCandidateInstances(ctx context.Context, ddb tables.DynamoDBAPI) (map[string]*tables.InstanceType, error) {
+	instanceRecords := map[string]*tables.InstanceType {}
+	var err error
+	_, er := a.eachCandidate(ctx, ddb, func(instance string, streams uint8) bool {
+		instanceRecord, er := tables.ConsistentGetInstance(ctx, ddb, instance)
+		if er != nil {
+			err = er
+			return true
+		}
+
+		if instanceRecord.Streams != streams {
+			a.stale.instanceCounts.Add(1)
+		}
+
+		a.observeInstance(instanceRecord, instanceRecord.Streams)
+
+		if !instanceRecord.Cordoned && !instanceRecord.Unhealthy {
+			instanceRecords[instance] = instanceRecord
+		}
+
+		return false
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if er != nil {
+		return nil, er
+	}
+
+	return instanceRecords, nil
+}
+
+// Puts every pending request on the least loaded instance that is not
+// already using its port, counting the placements planned so far. Requests
+// that cannot be placed get the status Register would have given them.
+func planPlacements(ctx context.Context, ddb tables.DynamoDBAPI, results []RegisterResult, pending []int, instanceRecords map[string]*tables.InstanceType) []*plannedPlacement {
+	planned := map[string]uint8 {}
+	portUsers := map[uint16]map[string]interface{} {}
+	placements := []*plannedPlacement {}
+	instances := make([]string, 0, len(instanceRecords))
+	for instance := range instanceRecords {
+		instances = append(instances, instance)
+	}
+
+	sort.Strings(instances)
+	for _, i := range pending {
+		r := &results[i]
+		users, present := portUsers[r.Port]
+		if !present {
+			instanceNamesUsingPort, err := tables.QueryInstancesUsingPort(ctx, ddb, r.Port)
+			if err != nil {
+				r.Status, r.Err = 500, err
+				continue
+			}
+
+			users = map[string]interface{} {}
+			for _, record := range *instanceNamesUsingPort {
+				users[record.Instance] = nil
+			}
+
+			portUsers[r.Port] = users
+		}
+
+		if len(users) >= int(MAX_INSTANCES) {
+			r.Status, r.Err = 400, fmt.Errorf(fmt.Sprintf("Port %d in use", r.Port))
+			continue
+		}
+
+		best := ""
+		for _, instance := range instances {
+			load := instanceRecords[instance].Streams + planned[instance]
+			if _, using := users[instance]; using || load >= capacityOf(instanceRecords[instance]) {
+				continue
+			}
+
+			if best == "" || load < instanceRecords[best].Streams + planned[best] {
+				best = instance
+			}
+		}
+
+		if best == "" {
+			r.Status, r.Err = 503, fmt.Errorf(fmt.Sprintf("Unable to allocate for %v, %v and %d", r.ShopId, r.Stream, r.Port))
+			continue
+		}
+
+		planned[best]++
+		users[best] = nil
+		placements = append(placements, &plannedPlacement {
+			PlacementType: tables.PlacementType { ShopId: r.ShopId, Stream: r.Stream, Port: r.Port, Instance: best },
+			index: i,
+		})
+	}
+
+	return placements
+}
+
+// Splits items into groups that fit in one transaction, at 3 transact items
+// per item plus 1 per instance touched, and 1 per shop when shopOf is given,
+// for the guards of registrations.
+func groupPlacements[T any](items []T, instanceOf func(T) string, shopOf func(T) string) [][]T {
+	groups := [][]T {}
+	group := []T {}
+	instances := map[string]interface{} {}
+	shops := map[string]interface{} {}
+	for _, item := range items {
+		instance := instanceOf(item)
+		size := 3 * (len(group) + 1) + len(instances) + len(shops)
+		if _, present := instances[instance]; !present {
+			size++
+		}
+
+		shop := ""
+		if shopOf != nil {
+			shop = shopOf(item)
+			if _, present := shops[shop]; !present {
+				size++
+			}
+		}
+
+		if size > tables.MAX_TRANSACT_ITEMS {
+			groups = append(groups, group)
+			group = []T {}
+			instances = map[string]interface{} {}
+			shops = map[string]interface{} {}
+		}
+
+		group = append(group, item)
+		instances[instance] = nil
+		if shopOf != nil {
+			shops[shop] = nil
+		}
+	}
+
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+func failAll(results []RegisterResult, status int, err error) {
+	for i := range results {
+		results[i].Status, results[i].Err = status, err
+	}
+}
+
+func failPending(results []RegisterResult, pending []int, status int, err error) {
+	for _, i := range pending {
+		results[i].Status, results[i].Err = status, err
+	}
+}
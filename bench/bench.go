@@ -0,0 +1,327 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lb "loadbalancer/go"
+)
+
+// What the load is driven against
+type Target interface {
+	Register(shopId string, stream string, port uint16) (int, error)
+	Unregister(stream string) (int, error)
+}
+
+// A Target calling the lb functions of Allocator, or of lb.Default when nil
+type LbTarget struct {
+	Allocator *lb.Allocator
+}
+
+func (t LbTarget) allocator() *lb.Allocator {
+	if t.Allocator == nil {
+		return lb.Default
+	}
+
+	return t.Allocator
+}
+
+func (t LbTarget) Register(shopId string, stream string, port uint16) (int, error) {
+	_, _, status, err := t.allocator().Register(shopId, stream, port)
+	return status, err
+}
+
+func (t LbTarget) Unregister(stream string) (int, error) {
+	return t.allocator().Unregister(stream)
+}
+
+const (
+	OpRegister = "register"
+	OpUnregister = "unregister"
+)
+
+// Relative weights of the calls. An unregister is only made by a client with
+// a stream of its own to unregister, and is a register otherwise.
+type Mix struct {
+	Register int
+	Unregister int
+}
+
+const DEFAULT_CLIENTS = 8
+const DEFAULT_DURATION = 30 * time.Second
+
+// Zero values are the defaults
+type Config struct {
+	Clients int
+	// Calls per second over all the clients, or as many as they can make
+	// when zero
+	Rate float64
+	Duration time.Duration
+	// Stops after this many calls, when not zero
+	Operations int64
+	Mix Mix
+
+	// Streams go to one of Shops shops, and one of Ports ports from
+	// FirstPort. Stream names start with Prefix, so runs can be told apart.
+	Shops int
+	Ports int
+	FirstPort uint16
+	Prefix string
+	Seed int64
+
+	// The streams still registered at the end are left, rather than
+	// unregistered
+	Keep bool
+}
+
+func (c *Config) defaults() {
+	if c.Clients == 0 {
+		c.Clients = DEFAULT_CLIENTS
+	}
+
+	if c.Duration == 0 {
+		c.Duration = DEFAULT_DURATION
+	}
+
+	if c.Mix.Register == 0 && c.Mix.Unregister == 0 {
+		c.Mix = Mix { Register: 1, Unregister: 1 }
+	}
+
+	if c.Shops == 0 {
+		c.Shops = 1000
+	}
+
+	if c.Ports == 0 {
+		c.Ports = 1000
+	}
+
+	if c.FirstPort == 0 {
+		c.FirstPort = 20000
+	}
+
+	if c.Prefix == "" {
+		c.Prefix = "bench"
+	}
+}
+
+type Latency struct {
+	Mean time.Duration
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+type OpReport struct {
+	Count int
+	Statuses map[int]int
+	Latency Latency
+	// The first error of each status, as an example
+	Errors map[int]string `json:",omitempty"`
+	latencies []time.Duration
+}
+
+type Report struct {
+	Elapsed time.Duration
+	// Calls per second made
+	Throughput float64
+	Operations map[string]*OpReport
+	// nil when the store was not counted
+	Store *StoreCounts `json:",omitempty"`
+	// Canceled transactions over all transactions
+	ConflictRate float64
+}
+
+// Drives the load until cfg.Duration is over, cfg.Operations were made or
+// ctx is done. counter, which may be nil, is the one the target's calls go
+// through, to report on the store.
+func Run(ctx context.Context, cfg Config, target Target, counter *Counter) *Report {
+	cfg.defaults()
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	var tokens <-chan time.Time
+	if cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	report := &Report { Operations: map[string]*OpReport {} }
+	for _, op := range []string { OpRegister, OpUnregister } {
+		report.Operations[op] = &OpReport { Statuses: map[int]int {}, Errors: map[int]string {} }
+	}
+
+	var mutex sync.Mutex
+	record := func(op string, status int, err error, latency time.Duration) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		r := report.Operations[op]
+		r.Count++
+		r.Statuses[status]++
+		if err != nil && r.Errors[status] == "" {
+			r.Errors[status] = err.Error()
+		}
+
+		r.latencies = append(r.latencies, latency)
+	}
+
+	var made int64
+	leftovers := make([][]string, cfg.Clients)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for client := 0; client < cfg.Clients; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(cfg.Seed + int64(client)))
+			active := []string {}
+			for n := 0; ; n++ {
+				if tokens != nil {
+					select {
+					case <-ctx.Done():
+					case <-tokens:
+					}
+				}
+
+				if ctx.Err() != nil || (cfg.Operations > 0 && atomic.AddInt64(&made, 1) > cfg.Operations) {
+					break
+				}
+
+				if len(active) == 0 || random.Intn(cfg.Mix.Register + cfg.Mix.Unregister) < cfg.Mix.Register {
+					shopId := fmt.Sprintf("%vshop%d", cfg.Prefix, random.Intn(cfg.Shops))
+					stream := fmt.Sprintf("%v-%d-%d", cfg.Prefix, client, n)
+					port := cfg.FirstPort + uint16(random.Intn(cfg.Ports))
+					began := time.Now()
+					status, err := target.Register(shopId, stream, port)
+					record(OpRegister, status, err, time.Since(began))
+					if status == 200 {
+						active = append(active, stream)
+					}
+				} else {
+					i := random.Intn(len(active))
+					began := time.Now()
+					status, err := target.Unregister(active[i])
+					record(OpUnregister, status, err, time.Since(began))
+					if status == 200 || status == 400 {
+						active = append(active[:i], active[i + 1:]...)
+					}
+				}
+			}
+
+			leftovers[client] = active
+		}(client)
+	}
+
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+	// before the cleanup, whose calls are not part of the run
+	if counter != nil {
+		counts := counter.Counts()
+		report.Store = &counts
+	}
+
+	if !cfg.Keep {
+		for _, active := range leftovers {
+			for _, stream := range active {
+				target.Unregister(stream)
+			}
+		}
+	}
+
+	calls := 0
+	for _, r := range report.Operations {
+		calls += r.Count
+		r.Latency = summarize(r.latencies)
+	}
+
+	report.Throughput = float64(calls) / report.Elapsed.Seconds()
+	if report.Store != nil {
+		canceled := 0
+		for _, n := range report.Store.Canceled {
+			canceled += n
+		}
+
+		if report.Store.Transactions > 0 {
+			report.ConflictRate = float64(canceled) / float64(report.Store.Transactions)
+		}
+	}
+
+	return report
+}
+
+func summarize(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency {}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+
+	return Latency {
+		Mean: total / time.Duration(len(latencies)),
+		P50: percentile(latencies, 0.5),
+		P90: percentile(latencies, 0.9),
+		P99: percentile(latencies, 0.99),
+		Max: latencies[len(latencies) - 1],
+	}
+}
+
+// Of sorted latencies, the smallest that p of them are not above
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	i := int(p * float64(len(latencies)) + 0.999999) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return latencies[i]
+}
+
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "%d calls in %v, %.1f/s\n", r.count(), r.Elapsed.Round(time.Millisecond), r.Throughput)
+	for _, op := range []string { OpRegister, OpUnregister } {
+		o := r.Operations[op]
+		l := o.Latency
+		fmt.Fprintf(w, "%-10v %7d  mean %v  p50 %v  p90 %v  p99 %v  max %v\n", op, o.Count, l.Mean.Round(time.Microsecond),
+			l.P50.Round(time.Microsecond), l.P90.Round(time.Microsecond), l.P99.Round(time.Microsecond), l.Max.Round(time.Microsecond))
+		for _, status := range sortedStatuses(o.Statuses) {
+			fmt.Fprintf(w, "           %d: %d %v\n", status, o.Statuses[status], o.Errors[status])
+		}
+	}
+
+	if r.Store != nil {
+		fmt.Fprintf(w, "transactions %d, canceled %v (%.1f%%), throttled %d, reads %d\n", r.Store.Transactions, r.Store.Canceled,
+			100 * r.ConflictRate, r.Store.Throttled, r.Store.Reads)
+		if partition, share := r.Store.HottestPartition(); partition != "" {
+			fmt.Fprintf(w, "index queries over %d partitions, the hottest %v with %.1f%% of its index's\n", len(r.Store.IndexPartitions), partition, 100 * share)
+		}
+	}
+}
+
+func (r *Report) count() int {
+	n := 0
+	for _, o := range r.Operations {
+		n += o.Count
+	}
+
+	return n
+}
+
+func sortedStatuses(statuses map[int]int) []int {
+	keys := []int {}
+	for k := range statuses {
+		keys = append(keys, k)
+	}
+
+	sort.Ints(keys)
+	return keys
+}
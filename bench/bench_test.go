@@ -0,0 +1,170 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"loadbalancer/go/chaos"
+)
+
+// Refuses every third registration, and remembers what is registered
+type fakeTarget struct {
+	mutex sync.Mutex
+	calls int
+	streams map[string]bool
+}
+
+func (f *fakeTarget) Register(shopId string, stream string, port uint16) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls++
+	if f.calls % 3 == 0 {
+		return 503, errors.New("no room")
+	}
+
+	f.streams[stream] = true
+	return 200, nil
+}
+
+func (f *fakeTarget) Unregister(stream string) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.streams[stream] {
+		return 400, errors.New("unknown stream")
+	}
+
+	delete(f.streams, stream)
+	return 200, nil
+}
+
+func TestOperations(t *testing.T) {
+	target := &fakeTarget { streams: map[string]bool {} }
+	report := Run(context.Background(), Config { Clients: 4, Operations: 200, Duration: time.Minute }, target, nil)
+
+	registers := report.Operations[OpRegister]
+	unregisters := report.Operations[OpUnregister]
+	if registers.Count + unregisters.Count != 200 || registers.Statuses[503] == 0 || unregisters.Statuses[400] != 0 {
+		t.Fatalf("Unexpected report %v %v", *registers, *unregisters)
+	}
+
+	if registers.Errors[503] != "no room" || registers.Latency.P50 > registers.Latency.P99 || registers.Latency.P99 > registers.Latency.Max {
+		t.Fatalf("Unexpected register details %v", *registers)
+	}
+
+	if len(target.streams) != 0 {
+		t.Fatalf("Every stream should have been unregistered at the end: %v", target.streams)
+	}
+
+	var out bytes.Buffer
+	report.Print(&out)
+	fmt.Println(fmt.Sprintf("SUCCESS: TestOperations\n%v", out.String()))
+}
+
+// A fakeTarget that makes a transaction through counter on every call
+type countingTarget struct {
+	fakeTarget
+	counter *Counter
+}
+
+func (c *countingTarget) Register(shopId string, stream string, port uint16) (int, error) {
+	c.counter.TransactWriteItems(context.Background(), &dynamodb.TransactWriteItemsInput {})
+	return c.fakeTarget.Register(shopId, stream, port)
+}
+
+func (c *countingTarget) Unregister(stream string) (int, error) {
+	c.counter.TransactWriteItems(context.Background(), &dynamodb.TransactWriteItemsInput {})
+	return c.fakeTarget.Unregister(stream)
+}
+
+// The unregistrations cleaning up after the run are not counted
+func TestCountsBeforeCleanup(t *testing.T) {
+	store := chaos.Wrap(nil)
+	store.Inject(chaos.Fault { Operation: chaos.OpTransactWriteItems, Err: chaos.ProvisionedThroughputExceeded() })
+	counter := Count(store)
+	target := &countingTarget { fakeTarget: fakeTarget { streams: map[string]bool {} }, counter: counter }
+	report := Run(context.Background(), Config { Clients: 4, Operations: 100, Duration: time.Minute }, target, counter)
+	if len(target.streams) != 0 || report.Store == nil || report.Store.Transactions != 100 {
+		t.Fatalf("Expected 100 transactions counted for 100 calls, found %v", report.Store)
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestCountsBeforeCleanup %v", *report.Store))
+}
+
+func TestRate(t *testing.T) {
+	target := &fakeTarget { streams: map[string]bool {} }
+	report := Run(context.Background(), Config { Clients: 4, Rate: 100, Duration: 300 * time.Millisecond, Keep: true }, target, nil)
+	calls := report.Operations[OpRegister].Count + report.Operations[OpUnregister].Count
+	if calls < 10 || calls > 40 {
+		t.Fatalf("About 30 calls should have been made at 100/s in 300ms, not %d", calls)
+	}
+
+	if len(target.streams) == 0 {
+		t.Fatal("Streams should have been kept")
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestRate %d calls", calls))
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := []time.Duration {}
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i) * time.Millisecond)
+	}
+
+	l := summarize(latencies)
+	if l.P50 != 50 * time.Millisecond || l.P90 != 90 * time.Millisecond || l.P99 != 99 * time.Millisecond || l.Max != 100 * time.Millisecond {
+		t.Fatalf("Unexpected percentiles %v", l)
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestPercentile %v", l))
+}
+
+func TestCounter(t *testing.T) {
+	store := chaos.Wrap(nil)
+	store.Inject(chaos.Fault { Operation: chaos.OpTransactWriteItems, Times: 1, Err: chaos.TransactionCanceled(chaos.ReasonNone, chaos.ReasonConditionalCheckFailed) })
+	store.Inject(chaos.Fault { Operation: chaos.OpTransactWriteItems, Err: chaos.ProvisionedThroughputExceeded() })
+	counter := Count(store)
+	for i := 0; i < 4; i++ {
+		counter.TransactWriteItems(context.Background(), &dynamodb.TransactWriteItemsInput {})
+	}
+
+	counts := counter.Counts()
+	if counts.Transactions != 4 || counts.Canceled[chaos.ReasonConditionalCheckFailed] != 1 || counts.Throttled != 3 {
+		t.Fatalf("Unexpected counts %v", counts)
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestCounter %v", counts))
+}
+
+func TestHottestPartition(t *testing.T) {
+	store := chaos.Wrap(nil)
+	store.Inject(chaos.Fault { Operation: chaos.OpQuery, Err: chaos.Throttling() })
+	counter := Count(store)
+	query := func(index string, value string) {
+		counter.Query(context.Background(), &dynamodb.QueryInput {
+			IndexName: &index,
+			ExpressionAttributeValues: map[string]types.AttributeValue { ":0": &types.AttributeValueMemberS { Value: value } },
+		})
+	}
+
+	for i := 0; i < 8; i++ {
+		query("InstancesGsiLoad", fmt.Sprintf("0#%d", i % 4))
+	}
+
+	query("InstancesGsiLoad", "0#1")
+	query("ShopsGsiStream", "stream0")
+	counts := counter.Counts()
+	partition, share := counts.HottestPartition()
+	if partition != "InstancesGsiLoad 0#1" || share != 3.0 / 9.0 || len(counts.IndexPartitions) != 5 {
+		t.Fatalf("Unexpected hottest partition %v with %v of %v", partition, share, counts.IndexPartitions)
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestHottestPartition %v %.2f", partition, share))
+}
@@ -0,0 +1,170 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+
+	"loadbalancer/go/tables"
+)
+
+// What DynamoDB did under the load
+type StoreCounts struct {
+	Transactions int
+	// Transactions canceled, by the first reason of an item other than None,
+	// e.g. ConditionalCheckFailed for a Version that changed, or
+	// TransactionConflict for a transaction racing another
+	Canceled map[string]int
+	// Calls refused for going over the capacity of a table, a partition or
+	// the account, once the SDK's own retries gave up
+	Throttled int
+	Reads int
+	// Queries of a GSI, by index and key, to tell how much of the load its
+	// hottest partition takes
+	IndexPartitions map[string]int
+}
+
+// Counts the transactions and reads made through it, and how they failed.
+// Calls other than TransactWriteItems, Query and GetItem go through
+// uncounted.
+type Counter struct {
+	tables.DynamoDBAPI
+	mutex sync.Mutex
+	counts StoreCounts
+}
+
+func Count(ddb tables.DynamoDBAPI) *Counter {
+	return &Counter { DynamoDBAPI: ddb, counts: StoreCounts { Canceled: map[string]int {}, IndexPartitions: map[string]int {} } }
+}
+
+func (c *Counter) Counts() StoreCounts {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	counts := c.counts
+	counts.Canceled = make(map[string]int, len(c.counts.Canceled))
+	for k, v := range c.counts.Canceled {
+		counts.Canceled[k] = v
+	}
+
+	counts.IndexPartitions = make(map[string]int, len(c.counts.IndexPartitions))
+	for k, v := range c.counts.IndexPartitions {
+		counts.IndexPartitions[k] = v
+	}
+
+	return counts
+}
+
+func (c *Counter) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	output, err := c.DynamoDBAPI.TransactWriteItems(ctx, params, optFns...)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts.Transactions++
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		c.counts.Canceled[cancellationReason(canceled)]++
+	}
+
+	c.countThrottle(err)
+	return output, err
+}
+
+func (c *Counter) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	output, err := c.DynamoDBAPI.Query(ctx, params, optFns...)
+	c.read(err)
+	if params.IndexName != nil {
+		c.mutex.Lock()
+		c.counts.IndexPartitions[partitionOf(params)]++
+		c.mutex.Unlock()
+	}
+
+	return output, err
+}
+
+// The index of a query with the values of its key condition, which for the
+// GSIs lb queries is the partition key, but for ShopsGsiInstancePort by port
+func partitionOf(params *dynamodb.QueryInput) string {
+	placeholders := []string {}
+	for placeholder := range params.ExpressionAttributeValues {
+		placeholders = append(placeholders, placeholder)
+	}
+
+	sort.Strings(placeholders)
+	partition := *params.IndexName
+	for _, placeholder := range placeholders {
+		switch v := params.ExpressionAttributeValues[placeholder].(type) {
+		case *types.AttributeValueMemberS:
+			partition += " " + v.Value
+		case *types.AttributeValueMemberN:
+			partition += " " + v.Value
+		}
+	}
+
+	return partition
+}
+
+// The key of IndexPartitions queried most, and its share of the queries of
+// its index
+func (s *StoreCounts) HottestPartition() (string, float64) {
+	hottest, most := "", 0
+	byIndex := map[string]int {}
+	for partition, n := range s.IndexPartitions {
+		byIndex[strings.SplitN(partition, " ", 2)[0]] += n
+		if n > most || (n == most && partition < hottest) {
+			hottest, most = partition, n
+		}
+	}
+
+	if most == 0 {
+		return "", 0
+	}
+
+	return hottest, float64(most) / float64(byIndex[strings.SplitN(hottest, " ", 2)[0]])
+}
+
+func (c *Counter) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	output, err := c.DynamoDBAPI.GetItem(ctx, params, optFns...)
+	c.read(err)
+	return output, err
+}
+
+func (c *Counter) read(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts.Reads++
+	c.countThrottle(err)
+}
+
+func (c *Counter) countThrottle(err error) {
+	if isThrottle(err) {
+		c.counts.Throttled++
+	}
+}
+
+func cancellationReason(canceled *types.TransactionCanceledException) string {
+	for _, reason := range canceled.CancellationReasons {
+		if reason.Code != nil && *reason.Code != "None" {
+			return *reason.Code
+		}
+	}
+
+	return "Unknown"
+}
+
+func isThrottle(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode() {
+	case "ProvisionedThroughputExceededException", "ThrottlingException", "RequestLimitExceeded":
+		return true
+	}
+
+	return false
+}
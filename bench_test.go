@@ -0,0 +1,71 @@
+package lb
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"loadbalancer/go/tables"
+	"loadbalancer/go/test_setup"
+)
+
+// Registers and unregisters a stream per iteration, on ports spread over a
+// fleet with room for every parallel client. lbbench drives mixes at a
+// target rate and reports percentiles and conflicts. Registrations that
+// lose races with each other are reported as failed/op.
+func benchmarkRegister(b *testing.B, parallel bool, index tables.LoadIndex) {
+	_, ddb := test_setup.Namespace(b, test_setup.Fleet(32))
+	a := NewAllocator(ddb)
+	a.SetLoadIndex(index)
+	var n int64
+	var failed int64
+	cycle := func() {
+		i := atomic.AddInt64(&n, 1)
+		stream := fmt.Sprintf("stream%d", i)
+		_, _, status, err := a.Register(fmt.Sprintf("shop%d", i), stream, 20000 + uint16(i % 1000))
+		if err != nil {
+			atomic.AddInt64(&failed, 1)
+			return
+		}
+
+		status, err = a.Unregister(stream)
+		if err != nil {
+			b.Errorf("(%d) Unregister of %v failed ---> %v", status, stream, err)
+		}
+	}
+
+	defer func() {
+		b.ReportMetric(float64(failed) / float64(b.N), "failed/op")
+	}()
+
+	b.ResetTimer()
+	if !parallel {
+		for i := 0; i < b.N; i++ {
+			cycle()
+		}
+
+		return
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cycle()
+		}
+	})
+}
+
+func BenchmarkRegister(b *testing.B) {
+	benchmarkRegister(b, false, tables.LoadIndexStreams)
+}
+
+func BenchmarkRegisterParallel(b *testing.B) {
+	benchmarkRegister(b, true, tables.LoadIndexStreams)
+}
+
+func BenchmarkRegisterSharded(b *testing.B) {
+	benchmarkRegister(b, false, tables.LoadIndexSharded)
+}
+
+func BenchmarkRegisterParallelSharded(b *testing.B) {
+	benchmarkRegister(b, true, tables.LoadIndexSharded)
+}
@@ -0,0 +1,213 @@
+package lb
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"loadbalancer/go/address"
+	"loadbalancer/go/changefeed"
+	"loadbalancer/go/tables"
+)
+
+const DEFAULT_ADDRESS_TTL = time.Minute
+const DEFAULT_CANDIDATE_TTL = 5 * time.Second
+
+// Keeps the addresses of instances for addressTTL, and the instances with
+// room, with their counts of streams, for candidateTTL, so that Register
+// does not read them for every call. A zero ttl leaves that part uncached.
+// The cached instances are only the order candidates are tried in: each is
+// still read consistently before its transaction, whose conditions are the
+// checks, and when none of them takes a stream the indexes are queried as
+// without the cache. CacheHandler keeps both up to date from the change
+// feed in between. Meant to be called once, before anything else in the
+// package.
+func EnableCache(addressTTL time.Duration, candidateTTL time.Duration) {
+	Default.EnableCache(addressTTL, candidateTTL)
+}
+
+func (a *Allocator) EnableCache(addressTTL time.Duration, candidateTTL time.Duration) {
+	a.addresses, a.candidates = nil, nil
+	if addressTTL > 0 {
+		a.addresses = address.NewCachingResolver(allocatorResolver { a: a }, addressTTL)
+	}
+
+	if candidateTTL > 0 {
+		a.candidates = &candidateSnapshot { ttl: candidateTTL, now: time.Now }
+	}
+}
+
+// Applies the instance events of the change feed to the cache: counts of
+// streams replace those cached, and the addresses of an instance updated or
+// removed are dropped, along with the instances with room, which are read
+// again on the next Register.
+func (a *Allocator) CacheHandler() changefeed.Handler {
+	return func(event changefeed.Event) error {
+		switch e := event.(type) {
+		case changefeed.InstanceLoadChanged:
+			a.candidates.observe(e.Instance, e.Streams, e.Streams < MAX_INSTANCES)
+		case changefeed.InstanceUpdated:
+			a.InvalidateInstance(e.Instance)
+		case changefeed.InstanceRemoved:
+			a.InvalidateInstance(e.Instance)
+		}
+
+		return nil
+	}
+}
+
+// Drops what is cached about instance, for a change made other than through
+// the allocator
+func InvalidateInstance(instance string) {
+	Default.InvalidateInstance(instance)
+}
+
+func (a *Allocator) InvalidateInstance(instance string) {
+	if a.addresses != nil {
+		a.addresses.Invalidate(instance)
+	}
+
+	a.candidates.invalidate()
+}
+
+// The resolver set with SetAddressResolver, or the instanceIp table, as the
+// source of the address cache
+type allocatorResolver struct {
+	a *Allocator
+}
+
+func (r allocatorResolver) Resolve(ctx context.Context, instance string) (*address.Addresses, error) {
+	if r.a.resolver != nil {
+		return r.a.resolver.Resolve(ctx, instance)
+	}
+
+	_, ddb, err := r.a.client()
+	if err != nil {
+		return nil, err
+	}
+
+	return address.NewTableResolver(ddb).Resolve(ctx, instance)
+}
+
+type candidate struct {
+	instance string
+	streams uint8
+}
+
+// The instances with room as last seen, in the index or by the allocator's
+// own reads and transactions. The methods do nothing on a nil snapshot.
+type candidateSnapshot struct {
+	ttl time.Duration
+	now func() time.Time
+	mutex sync.Mutex
+	streams map[string]uint8
+	// zero when the snapshot has to be read again
+	expires time.Time
+	// serializes reads of the index, so that one refresh serves all waiting
+	refreshing sync.Mutex
+}
+
+// Least loaded first, then by name, like the buckets of the index
+func (s *candidateSnapshot) list() ([]candidate, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.expires.IsZero() || !s.now().Before(s.expires) {
+		return nil, false
+	}
+
+	candidates := make([]candidate, 0, len(s.streams))
+	for instance, streams := range s.streams {
+		candidates = append(candidates, candidate { instance: instance, streams: streams })
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].streams != candidates[j].streams {
+			return candidates[i].streams < candidates[j].streams
+		}
+
+		return candidates[i].instance < candidates[j].instance
+	})
+
+	return candidates, true
+}
+
+func (s *candidateSnapshot) replace(streams map[string]uint8) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.streams = streams
+	s.expires = s.now().Add(s.ttl)
+}
+
+// Records the count of streams of an instance, and whether it has room
+func (s *candidateSnapshot) observe(instance string, streams uint8, room bool) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.streams == nil {
+		return
+	}
+
+	if room {
+		s.streams[instance] = streams
+	} else {
+		delete(s.streams, instance)
+	}
+}
+
+func (s *candidateSnapshot) invalidate() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expires = time.Time {}
+}
+
+// The cached instances with room, read from the index again once they
+// expire. nil when there is no snapshot.
+func (a *Allocator) cachedCandidates(ctx context.Context, ddb tables.DynamoDBAPI) ([]candidate, error) {
+	s := a.candidates
+	if s == nil {
+		return nil, nil
+	}
+
+	candidates, fresh := s.list()
+	if fresh {
+		return candidates, nil
+	}
+
+	s.refreshing.Lock()
+	defer s.refreshing.Unlock()
+	candidates, fresh = s.list()
+	if fresh {
+		return candidates, nil
+	}
+
+	streams := map[string]uint8 {}
+	var num uint8
+	for num = 0; num < MAX_INSTANCES; num++ {
+		instanceNameRecords, err := tables.QueryInstancesWithStreams(ctx, ddb, a.loadIndex, num)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range *instanceNameRecords {
+			streams[record.Instance] = num
+		}
+	}
+
+	s.replace(streams)
+	candidates, _ = s.list()
+	return candidates, nil
+}
+
+// Keeps the snapshot in line with what judgeInstance read
+func (a *Allocator) observeInstance(instanceRecord *tables.InstanceType, streams uint8) {
+	room := !instanceRecord.Cordoned && !instanceRecord.Unhealthy && streams < capacityOf(instanceRecord)
+	a.candidates.observe(instanceRecord.Instance, streams, room)
+}
@@ -0,0 +1,69 @@
+package lb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"loadbalancer/go/changefeed"
+	"loadbalancer/go/chaos"
+	"loadbalancer/go/tables"
+	"loadbalancer/go/test_setup"
+)
+
+// Once cached, the instances with room and their addresses are not read
+// again, while the instance records still are.
+func TestCache(t *testing.T) {
+	fleet := test_setup.Fleet(1)
+	h := newHarness(t, fleet)
+	a, c := h.chaos()
+	a.EnableCache(time.Minute, time.Minute)
+	publicIp, _, status, err := a.Register("shop0", "stream0", 18000)
+	if err != nil || publicIp != fleet[0].PublicIp {
+		t.Fatalf("(%d) Register should have succeeded ---> %v", status, err)
+	}
+
+	unavailable := func() {
+		c.Inject(chaos.Fault { Operation: chaos.OpQuery, Table: *tables.Instances.TableName, Err: chaos.Throttling() })
+		c.Inject(chaos.Fault { Operation: chaos.OpGetItem, Table: *tables.InstanceIp.TableName, Err: chaos.Throttling() })
+	}
+
+	unavailable()
+	var i uint16
+	for i = 1; i < uint16(MAX_INSTANCES); i++ {
+		publicIp, _, status, err = a.Register(fmt.Sprintf("shop%d", i), fmt.Sprintf("stream%d", i), 18000 + i)
+		if err != nil || publicIp != fleet[0].PublicIp {
+			t.Fatalf("(%d) Register should have gone through the cache ---> %v", status, err)
+		}
+	}
+
+	_, _, status, err = a.Register("shopX", "streamX", 18100)
+	if err == nil || status != 503 {
+		t.Fatalf("(%d) Register on a full fleet should have failed", status)
+	}
+
+	// the feed makes room again without the index being read
+	c.Reset()
+	status, err = a.Unregister("stream0")
+	if err != nil {
+		t.Fatalf("(%d) Unregister should have succeeded ---> %v", status, err)
+	}
+
+	unavailable()
+	a.CacheHandler()(changefeed.InstanceLoadChanged { Instance: fleet[0].Instance, Streams: MAX_INSTANCES - 1, PreviousStreams: MAX_INSTANCES })
+	_, _, status, err = a.Register("shopX", "streamX", 18100)
+	if err != nil {
+		t.Fatalf("(%d) Register should have found the room the feed reported ---> %v", status, err)
+	}
+
+	// an update drops the cache, which the faults then keep from being read
+	a.CacheHandler()(changefeed.InstanceUpdated { Instance: fleet[0].Instance })
+	_, status, err = a.GetShopByStream("streamX")
+	if err == nil || status != 500 {
+		t.Fatalf("(%d) The addresses should have been read again", status)
+	}
+
+	c.Reset()
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestCache (%d) --> %v", status, err))
+}
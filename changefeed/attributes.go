@@ -0,0 +1,54 @@
+package changefeed
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+)
+
+// The streams API has its own copy of the AttributeValue union. Converting to
+// the dynamodb one lets us reuse attributevalue and the tables record types
+// instead of maintaining a second set of unmarshalers.
+func toDynamodbAttributes(image map[string]streamtypes.AttributeValue) map[string]types.AttributeValue {
+	converted := make(map[string]types.AttributeValue, len(image))
+	for name, value := range image {
+		if v := toDynamodbAttribute(value); v != nil {
+			converted[name] = v
+		}
+	}
+
+	return converted
+}
+
+func toDynamodbAttribute(value streamtypes.AttributeValue) types.AttributeValue {
+	switch v := value.(type) {
+	case *streamtypes.AttributeValueMemberS:
+		return &types.AttributeValueMemberS { Value: v.Value }
+	case *streamtypes.AttributeValueMemberN:
+		return &types.AttributeValueMemberN { Value: v.Value }
+	case *streamtypes.AttributeValueMemberB:
+		return &types.AttributeValueMemberB { Value: v.Value }
+	case *streamtypes.AttributeValueMemberBOOL:
+		return &types.AttributeValueMemberBOOL { Value: v.Value }
+	case *streamtypes.AttributeValueMemberNULL:
+		return &types.AttributeValueMemberNULL { Value: v.Value }
+	case *streamtypes.AttributeValueMemberSS:
+		return &types.AttributeValueMemberSS { Value: v.Value }
+	case *streamtypes.AttributeValueMemberNS:
+		return &types.AttributeValueMemberNS { Value: v.Value }
+	case *streamtypes.AttributeValueMemberBS:
+		return &types.AttributeValueMemberBS { Value: v.Value }
+	case *streamtypes.AttributeValueMemberL:
+		list := make([]types.AttributeValue, 0, len(v.Value))
+		for _, item := range v.Value {
+			if converted := toDynamodbAttribute(item); converted != nil {
+				list = append(list, converted)
+			}
+		}
+
+		return &types.AttributeValueMemberL { Value: list }
+	case *streamtypes.AttributeValueMemberM:
+		return &types.AttributeValueMemberM { Value: toDynamodbAttributes(v.Value) }
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package changefeed
+
+import (
+	"context"
+	"sync"
+
+	"loadbalancer/go/tables"
+)
+
+// A Checkpointer remembers the last sequence number that was handed to every
+// handler, per shard. An empty sequence number means the shard has not been
+// read yet.
+type Checkpointer interface {
+	Load(ctx context.Context, streamArn string, shardId string) (string, error)
+	Save(ctx context.Context, streamArn string, shardId string, sequenceNumber string) error
+}
+
+// Checkpoints kept in the feedCheckpoints table, so that a restarted consumer
+// picks up where the previous one stopped.
+type tableCheckpointer struct {
+	ddb tables.DynamoDBAPI
+}
+
+func TableCheckpointer(ddb tables.DynamoDBAPI) Checkpointer {
+	return tableCheckpointer { ddb: ddb }
+}
+
+func (c tableCheckpointer) Load(ctx context.Context, streamArn string, shardId string) (string, error) {
+	return tables.GetFeedCheckpoint(ctx, c.ddb, streamArn, shardId)
+}
+
+func (c tableCheckpointer) Save(ctx context.Context, streamArn string, shardId string, sequenceNumber string) error {
+	return tables.PutFeedCheckpoint(ctx, c.ddb, streamArn, shardId, sequenceNumber)
+}
+
+// Checkpoints that only live as long as the process. Useful for consumers
+// that rebuild their state from scratch on start, and for tests.
+type MemoryCheckpointer struct {
+	mutex sync.Mutex
+	sequenceNumbers map[string]string
+}
+
+func NewMemoryCheckpointer() *MemoryCheckpointer {
+	return &MemoryCheckpointer { sequenceNumbers: map[string]string {} }
+}
+
+func (c *MemoryCheckpointer) Load(ctx context.Context, streamArn string, shardId string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.sequenceNumbers[streamArn + "/" + shardId], nil
+}
+
+func (c *MemoryCheckpointer) Save(ctx context.Context, streamArn string, shardId string, sequenceNumber string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sequenceNumbers[streamArn + "/" + shardId] = sequenceNumber
+	return nil
+}
@@ -0,0 +1,239 @@
+package changefeed
+
+import (
+	"time"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+
+	"loadbalancer/go/tables"
+)
+
+// Every event carries where in the stream it came from. The sequence number
+// is only ordered within a shard.
+type Meta struct {
+	SequenceNumber string
+	Time time.Time
+}
+
+type Event interface {
+	EventMeta() Meta
+}
+
+type StreamRegistered struct {
+	Meta
+	ShopId string
+	Stream string
+	Port uint16
+	Instance string
+}
+
+type StreamUnregistered struct {
+	Meta
+	ShopId string
+	Stream string
+	Port uint16
+	Instance string
+}
+
+// The shop kept its stream and port but is now served by another instance
+type StreamMoved struct {
+	Meta
+	ShopId string
+	Stream string
+	Port uint16
+	Instance string
+	PreviousInstance string
+}
+
+type InstanceLoadChanged struct {
+	Meta
+	Instance string
+	Streams uint8
+	PreviousStreams uint8
+}
+
+// The instance was changed other than in its count of streams, e.g.
+// replaced with other addresses, cordoned or found unhealthy. Heartbeats and
+// agent reports are not changes.
+type InstanceUpdated struct {
+	Meta
+	Instance string
+}
+
+type InstanceRemoved struct {
+	Meta
+	Instance string
+}
+
+func (m Meta) EventMeta() Meta {
+	return m
+}
+
+// Handlers are called in stream order for each shard. Returning an error
+// stops the feed before the record is checkpointed, so the record will be
+// delivered again when the feed is restarted.
+type Handler func(Event) error
+
+func recordMeta(record *streamtypes.StreamRecord) Meta {
+	meta := Meta {}
+	if record.SequenceNumber != nil {
+		meta.SequenceNumber = *record.SequenceNumber
+	}
+
+	if record.ApproximateCreationDateTime != nil {
+		meta.Time = *record.ApproximateCreationDateTime
+	}
+
+	return meta
+}
+
+func shopEvents(record streamtypes.Record) ([]Event, error) {
+	if record.Dynamodb == nil {
+		return nil, nil
+	}
+
+	meta := recordMeta(record.Dynamodb)
+	var oldShop, newShop *tables.ShopType
+	var err error
+	if len(record.Dynamodb.OldImage) > 0 {
+		oldShop = &tables.ShopType {}
+		err = unmarshalImage(record.Dynamodb.OldImage, oldShop)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(record.Dynamodb.NewImage) > 0 {
+		newShop = &tables.ShopType {}
+		err = unmarshalImage(record.Dynamodb.NewImage, newShop)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	events := []Event {}
+	switch record.EventName {
+	case streamtypes.OperationTypeInsert:
+		if newShop != nil {
+			events = append(events, registered(meta, newShop))
+		}
+	case streamtypes.OperationTypeRemove:
+		if oldShop != nil {
+			events = append(events, unregistered(meta, oldShop))
+		}
+	case streamtypes.OperationTypeModify:
+		// A rewrite of the shop record that only bumps the Version is not
+		// interesting to anyone downstream.
+		if oldShop == nil || newShop == nil || samePlacement(oldShop, newShop) {
+			break
+		}
+
+		if sameStream(oldShop, newShop) {
+			events = append(events, moved(meta, oldShop, newShop))
+		} else {
+			events = append(events, unregistered(meta, oldShop), registered(meta, newShop))
+		}
+	}
+
+	return events, nil
+}
+
+func instanceEvents(record streamtypes.Record) ([]Event, error) {
+	if record.Dynamodb == nil {
+		return nil, nil
+	}
+
+	var oldInstance *tables.InstanceType
+	if len(record.Dynamodb.OldImage) > 0 {
+		oldInstance = &tables.InstanceType {}
+		err := unmarshalImage(record.Dynamodb.OldImage, oldInstance)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(record.Dynamodb.NewImage) == 0 {
+		if record.EventName == streamtypes.OperationTypeRemove && oldInstance != nil {
+			return []Event { InstanceRemoved { Meta: recordMeta(record.Dynamodb), Instance: oldInstance.Instance } }, nil
+		}
+
+		return nil, nil
+	}
+
+	var newInstance tables.InstanceType
+	err := unmarshalImage(record.Dynamodb.NewImage, &newInstance)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous uint8 = 0
+	if oldInstance != nil {
+		previous = oldInstance.Streams
+	}
+
+	if record.EventName == streamtypes.OperationTypeModify && previous == newInstance.Streams {
+		if oldInstance != nil && sameSpec(oldInstance, &newInstance) {
+			return nil, nil
+		}
+
+		return []Event { InstanceUpdated { Meta: recordMeta(record.Dynamodb), Instance: newInstance.Instance } }, nil
+	}
+
+	event := InstanceLoadChanged {
+		Meta: recordMeta(record.Dynamodb),
+		Instance: newInstance.Instance,
+		Streams: newInstance.Streams,
+		PreviousStreams: previous,
+	}
+
+	return []Event { event }, nil
+}
+
+func registered(meta Meta, shop *tables.ShopType) StreamRegistered {
+	return StreamRegistered {
+		Meta: meta,
+		ShopId: shop.ShopId,
+		Stream: shop.Stream,
+		Port: shop.Port,
+		Instance: shop.Instance,
+	}
+}
+
+func unregistered(meta Meta, shop *tables.ShopType) StreamUnregistered {
+	return StreamUnregistered {
+		Meta: meta,
+		ShopId: shop.ShopId,
+		Stream: shop.Stream,
+		Port: shop.Port,
+		Instance: shop.Instance,
+	}
+}
+
+func moved(meta Meta, oldShop *tables.ShopType, newShop *tables.ShopType) StreamMoved {
+	return StreamMoved {
+		Meta: meta,
+		ShopId: newShop.ShopId,
+		Stream: newShop.Stream,
+		Port: newShop.Port,
+		Instance: newShop.Instance,
+		PreviousInstance: oldShop.Instance,
+	}
+}
+
+// Whether what the allocator decides on, other than the streams, is the
+// same. The Version changes with the addresses, in TransactPutInstance.
+func sameSpec(a *tables.InstanceType, b *tables.InstanceType) bool {
+	return a.Version == b.Version && a.Cordoned == b.Cordoned && a.Unhealthy == b.Unhealthy && a.Capacity == b.Capacity
+}
+
+func sameStream(a *tables.ShopType, b *tables.ShopType) bool {
+	return a.ShopId == b.ShopId && a.Stream == b.Stream && a.Port == b.Port
+}
+
+func samePlacement(a *tables.ShopType, b *tables.ShopType) bool {
+	return sameStream(a, b) && a.Instance == b.Instance
+}
+
+func unmarshalImage(image map[string]streamtypes.AttributeValue, out interface{}) error {
+	return attributevalue.UnmarshalMap(toDynamodbAttributes(image), out)
+}
@@ -0,0 +1,175 @@
+package changefeed
+
+import (
+	"fmt"
+	"testing"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+)
+
+func shopImage(shopId string, stream string, port string, instance string, version string) map[string]streamtypes.AttributeValue {
+	return map[string]streamtypes.AttributeValue {
+		"ShopId": &streamtypes.AttributeValueMemberS { Value: shopId },
+		"Stream": &streamtypes.AttributeValueMemberS { Value: stream },
+		"Port": &streamtypes.AttributeValueMemberN { Value: port },
+		"Instance": &streamtypes.AttributeValueMemberS { Value: instance },
+		"Version": &streamtypes.AttributeValueMemberS { Value: version },
+	}
+}
+
+func instanceImage(instance string, streams string) map[string]streamtypes.AttributeValue {
+	return map[string]streamtypes.AttributeValue {
+		"Instance": &streamtypes.AttributeValueMemberS { Value: instance },
+		"Streams": &streamtypes.AttributeValueMemberN { Value: streams },
+		"Version": &streamtypes.AttributeValueMemberS { Value: "v" },
+	}
+}
+
+func TestShopInsertIsStreamRegistered(t *testing.T) {
+	sequenceNumber := "100"
+	record := streamtypes.Record {
+		EventName: streamtypes.OperationTypeInsert,
+		Dynamodb: &streamtypes.StreamRecord {
+			SequenceNumber: &sequenceNumber,
+			NewImage: shopImage("shop0", "stream0", "11000", "instance0", "v0"),
+		},
+	}
+
+	events, err := shopEvents(record)
+	if err != nil {
+		t.Fatalf("Decoding error: [%v]", err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, received %d", len(events))
+	}
+
+	registered, ok := events[0].(StreamRegistered)
+	if !ok || registered.ShopId != "shop0" || registered.Stream != "stream0" || registered.Port != 11000 || registered.Instance != "instance0" {
+		t.Fatalf("Unexpected event %#v", events[0])
+	}
+
+	if registered.EventMeta().SequenceNumber != sequenceNumber {
+		t.Fatalf("Unexpected sequence number %v", registered.EventMeta().SequenceNumber)
+	}
+
+	fmt.Println("SUCCESS: TestShopInsertIsStreamRegistered")
+}
+
+func TestShopVersionOnlyModifyIsIgnored(t *testing.T) {
+	record := streamtypes.Record {
+		EventName: streamtypes.OperationTypeModify,
+		Dynamodb: &streamtypes.StreamRecord {
+			OldImage: shopImage("shop0", "stream0", "11000", "instance0", "v0"),
+			NewImage: shopImage("shop0", "stream0", "11000", "instance0", "v1"),
+		},
+	}
+
+	events, err := shopEvents(record)
+	if err != nil {
+		t.Fatalf("Decoding error: [%v]", err)
+	}
+
+	if len(events) != 0 {
+		t.Fatalf("Expected no events, received %v", events)
+	}
+
+	fmt.Println("SUCCESS: TestShopVersionOnlyModifyIsIgnored")
+}
+
+func TestShopInstanceModifyIsStreamMoved(t *testing.T) {
+	record := streamtypes.Record {
+		EventName: streamtypes.OperationTypeModify,
+		Dynamodb: &streamtypes.StreamRecord {
+			OldImage: shopImage("shop0", "stream0", "11000", "instance0", "v0"),
+			NewImage: shopImage("shop0", "stream0", "11000", "instance2", "v1"),
+		},
+	}
+
+	events, err := shopEvents(record)
+	if err != nil {
+		t.Fatalf("Decoding error: [%v]", err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, received %d", len(events))
+	}
+
+	moved, ok := events[0].(StreamMoved)
+	if !ok || moved.Instance != "instance2" || moved.PreviousInstance != "instance0" {
+		t.Fatalf("Unexpected event %#v", events[0])
+	}
+
+	fmt.Println("SUCCESS: TestShopInstanceModifyIsStreamMoved")
+}
+
+func TestInstanceModifyIsInstanceLoadChanged(t *testing.T) {
+	record := streamtypes.Record {
+		EventName: streamtypes.OperationTypeModify,
+		Dynamodb: &streamtypes.StreamRecord {
+			OldImage: instanceImage("instance1", "1"),
+			NewImage: instanceImage("instance1", "2"),
+		},
+	}
+
+	events, err := instanceEvents(record)
+	if err != nil {
+		t.Fatalf("Decoding error: [%v]", err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, received %d", len(events))
+	}
+
+	changed, ok := events[0].(InstanceLoadChanged)
+	if !ok || changed.Instance != "instance1" || changed.Streams != 2 || changed.PreviousStreams != 1 {
+		t.Fatalf("Unexpected event %#v", events[0])
+	}
+
+	fmt.Println("SUCCESS: TestInstanceModifyIsInstanceLoadChanged")
+}
+
+func TestInstanceCordonIsInstanceUpdated(t *testing.T) {
+	cordoned := instanceImage("instance1", "1")
+	cordoned["Cordoned"] = &streamtypes.AttributeValueMemberBOOL { Value: true }
+	heartbeat := instanceImage("instance1", "1")
+	heartbeat["Heartbeat"] = &streamtypes.AttributeValueMemberN { Value: "1700000000" }
+	events, err := instanceEvents(streamtypes.Record {
+		EventName: streamtypes.OperationTypeModify,
+		Dynamodb: &streamtypes.StreamRecord { OldImage: instanceImage("instance1", "1"), NewImage: heartbeat },
+	})
+	if err != nil || len(events) != 0 {
+		t.Fatalf("A heartbeat should not have been an event: %v [%v]", events, err)
+	}
+
+	events, err = instanceEvents(streamtypes.Record {
+		EventName: streamtypes.OperationTypeModify,
+		Dynamodb: &streamtypes.StreamRecord { OldImage: instanceImage("instance1", "1"), NewImage: cordoned },
+	})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("Expected 1 event, received %v [%v]", events, err)
+	}
+
+	updated, ok := events[0].(InstanceUpdated)
+	if !ok || updated.Instance != "instance1" {
+		t.Fatalf("Unexpected event %#v", events[0])
+	}
+
+	fmt.Println("SUCCESS: TestInstanceCordonIsInstanceUpdated")
+}
+
+func TestInstanceRemoveIsInstanceRemoved(t *testing.T) {
+	events, err := instanceEvents(streamtypes.Record {
+		EventName: streamtypes.OperationTypeRemove,
+		Dynamodb: &streamtypes.StreamRecord { OldImage: instanceImage("instance1", "0") },
+	})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("Expected 1 event, received %v [%v]", events, err)
+	}
+
+	removed, ok := events[0].(InstanceRemoved)
+	if !ok || removed.Instance != "instance1" {
+		t.Fatalf("Unexpected event %#v", events[0])
+	}
+
+	fmt.Println("SUCCESS: TestInstanceRemoveIsInstanceRemoved")
+}
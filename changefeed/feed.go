@@ -0,0 +1,305 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+
+	"loadbalancer/go/tables"
+)
+
+const DEFAULT_POLL_INTERVAL = time.Second
+
+// Tails the streams of the shops and instances tables and hands typed events
+// to the subscribed handlers. Records are checkpointed only after every
+// handler has accepted them, so delivery is at least once.
+type Feed struct {
+	// How long to wait before polling again when no shard had new records
+	PollInterval time.Duration
+
+	// Shards without a checkpoint are read from the oldest record still in
+	// the stream unless this is set, in which case the shards that are open
+	// when the feed starts are read from their newest record.
+	StartAtLatest bool
+
+	ddb *dynamodb.Client
+	streams *dynamodbstreams.Client
+	checkpointer Checkpointer
+	handlers []Handler
+}
+
+type decoder func(streamtypes.Record) ([]Event, error)
+
+type shardState struct {
+	shard streamtypes.Shard
+	iterator *string
+	done bool
+}
+
+func New(context tables.Ctxt, checkpointer Checkpointer) *Feed {
+	cfg := context.Cfg()
+	return &Feed {
+		PollInterval: DEFAULT_POLL_INTERVAL,
+		ddb: dynamodb.NewFromConfig(*cfg),
+		streams: dynamodbstreams.NewFromConfig(*cfg),
+		checkpointer: checkpointer,
+	}
+}
+
+// Not safe to call once Run has started
+func (f *Feed) Subscribe(handler Handler) {
+	f.handlers = append(f.handlers, handler)
+}
+
+// Blocks until ctx is done or a table cannot be tailed any more. A handler
+// error is returned as is.
+func (f *Feed) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Handlers are not required to be safe for concurrent use, even though
+	// each table is tailed on its own goroutine.
+	var handlerMutex sync.Mutex
+	errs := make(chan error, 2)
+	tail := func(table *string, decode decoder) {
+		err := f.tail(ctx, table, decode, &handlerMutex)
+		if err != nil {
+			cancel()
+		}
+
+		errs <- err
+	}
+
+	go tail(tables.Shops.TableName, shopEvents)
+	go tail(tables.Instances.TableName, instanceEvents)
+
+	// The table that failed first cancels the other, so its error is the
+	// one worth returning rather than the cancellation it caused.
+	var err error
+	for i := 0; i < 2; i++ {
+		if e := <-errs; e != nil && !errors.Is(e, context.Canceled) && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Runs the feed until ctx is done, restarting it after delay each time it
+// stops with an error, which is logged. For long running consumers whose
+// handlers never need the feed to stop.
+func (f *Feed) RunRestarting(ctx context.Context, delay time.Duration) {
+	for ctx.Err() == nil {
+		err := f.Run(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("INFO: Change feed stopped, restarting in %v --> %v", delay, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+func (f *Feed) tail(ctx context.Context, table *string, decode decoder, handlerMutex *sync.Mutex) error {
+	streamArn, err := tables.LatestStreamArn(ctx, f.ddb, table)
+	if err != nil {
+		return err
+	}
+
+	shards := map[string]*shardState {}
+	order := []string {}
+	first := true
+	for {
+		shardList, err := f.describeShards(ctx, streamArn)
+		if err != nil {
+			return err
+		}
+
+		for _, shard := range shardList {
+			if _, present := shards[*shard.ShardId]; !present {
+				state := &shardState { shard: shard }
+				err = f.startShard(ctx, streamArn, state, first)
+				if err != nil {
+					return err
+				}
+
+				shards[*shard.ShardId] = state
+				order = append(order, *shard.ShardId)
+			}
+		}
+
+		first = false
+		received := false
+		for _, shardId := range order {
+			state := shards[shardId]
+			if state.done || !parentDone(state, shards) {
+				continue
+			}
+
+			n, err := f.readShard(ctx, streamArn, state, decode, handlerMutex)
+			if err != nil {
+				return err
+			}
+
+			received = received || n > 0
+		}
+
+		if !received {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(f.PollInterval):
+			}
+		}
+	}
+}
+
+// Records in a child shard must not be handled before the ones in its
+// parent. A parent that has aged out of the stream no longer holds anyone up.
+func parentDone(state *shardState, shards map[string]*shardState) bool {
+	if state.shard.ParentShardId == nil {
+		return true
+	}
+
+	parent, present := shards[*state.shard.ParentShardId]
+	return !present || parent.done
+}
+
+func (f *Feed) describeShards(ctx context.Context, streamArn string) ([]streamtypes.Shard, error) {
+	shards := []streamtypes.Shard {}
+	var exclusiveStartShardId *string
+	for {
+		input := dynamodbstreams.DescribeStreamInput {
+			StreamArn: &streamArn,
+			ExclusiveStartShardId: exclusiveStartShardId,
+		}
+
+		output, err := f.streams.DescribeStream(ctx, &input)
+		if err != nil {
+			return nil, fmt.Errorf("Could not describe stream %v [%v]", streamArn, err)
+		}
+
+		if output.StreamDescription == nil {
+			return shards, nil
+		}
+
+		shards = append(shards, output.StreamDescription.Shards...)
+		exclusiveStartShardId = output.StreamDescription.LastEvaluatedShardId
+		if exclusiveStartShardId == nil {
+			return shards, nil
+		}
+	}
+}
+
+func (f *Feed) startShard(ctx context.Context, streamArn string, state *shardState, first bool) error {
+	sequenceNumber, err := f.checkpointer.Load(ctx, streamArn, *state.shard.ShardId)
+	if err != nil {
+		return err
+	}
+
+	input := dynamodbstreams.GetShardIteratorInput {
+		StreamArn: &streamArn,
+		ShardId: state.shard.ShardId,
+		ShardIteratorType: streamtypes.ShardIteratorTypeTrimHorizon,
+	}
+
+	open := state.shard.SequenceNumberRange == nil || state.shard.SequenceNumberRange.EndingSequenceNumber == nil
+	if sequenceNumber != "" {
+		input.ShardIteratorType = streamtypes.ShardIteratorTypeAfterSequenceNumber
+		input.SequenceNumber = &sequenceNumber
+	} else if f.StartAtLatest && first && open {
+		input.ShardIteratorType = streamtypes.ShardIteratorTypeLatest
+	} else if f.StartAtLatest && first {
+		// closed before we started, so there is nothing new in it
+		state.done = true
+		return nil
+	}
+
+	output, err := f.streams.GetShardIterator(ctx, &input)
+	if err != nil {
+		var trimmed *streamtypes.TrimmedDataAccessException
+		if errors.As(err, &trimmed) && sequenceNumber != "" {
+			log.Println(fmt.Sprintf("WARN: Checkpoint %v of shard %v was trimmed, reading from the oldest record", sequenceNumber, *state.shard.ShardId))
+			err = f.checkpointer.Save(ctx, streamArn, *state.shard.ShardId, "")
+			if err != nil {
+				return err
+			}
+
+			return f.startShard(ctx, streamArn, state, false)
+		}
+
+		var notFound *streamtypes.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			state.done = true
+			return nil
+		}
+
+		return fmt.Errorf("Could not get an iterator for shard %v [%v]", *state.shard.ShardId, err)
+	}
+
+	state.iterator = output.ShardIterator
+	state.done = state.iterator == nil
+	return nil
+}
+
+func (f *Feed) readShard(ctx context.Context, streamArn string, state *shardState, decode decoder, handlerMutex *sync.Mutex) (int, error) {
+	input := dynamodbstreams.GetRecordsInput {
+		ShardIterator: state.iterator,
+	}
+
+	output, err := f.streams.GetRecords(ctx, &input)
+	if err != nil {
+		var expired *streamtypes.ExpiredIteratorException
+		if errors.As(err, &expired) {
+			return 0, f.startShard(ctx, streamArn, state, false)
+		}
+
+		return 0, fmt.Errorf("Could not get records for shard %v [%v]", *state.shard.ShardId, err)
+	}
+
+	for _, record := range output.Records {
+		events, err := decode(record)
+		if err != nil {
+			return 0, fmt.Errorf("Could not decode record %v [%v]", aws.ToString(record.EventID), err)
+		}
+
+		handlerMutex.Lock()
+		err = f.dispatch(events)
+		handlerMutex.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		if record.Dynamodb != nil && record.Dynamodb.SequenceNumber != nil {
+			err = f.checkpointer.Save(ctx, streamArn, *state.shard.ShardId, *record.Dynamodb.SequenceNumber)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	state.iterator = output.NextShardIterator
+	state.done = state.iterator == nil
+	return len(output.Records), nil
+}
+
+func (f *Feed) dispatch(events []Event) error {
+	for _, event := range events {
+		for _, handler := range f.handlers {
+			err := handler(event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,363 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"loadbalancer/go/tables"
+)
+
+type Operation string
+
+const (
+	OpGetItem Operation = "GetItem"
+	OpPutItem Operation = "PutItem"
+	OpUpdateItem Operation = "UpdateItem"
+	OpDeleteItem Operation = "DeleteItem"
+	OpQuery Operation = "Query"
+	OpScan Operation = "Scan"
+	OpTransactWriteItems Operation = "TransactWriteItems"
+	OpCreateTable Operation = "CreateTable"
+	OpDescribeTable Operation = "DescribeTable"
+	OpUpdateTable Operation = "UpdateTable"
+)
+
+// A fault injected into the calls it matches
+type Fault struct {
+	// An empty Operation matches every operation, and an empty Table every
+	// table. Table is the name as the Client is given it, so under a
+	// tables.Namespace it is without the prefix. A transaction matches if
+	// any of its items is on Table.
+	Operation Operation
+	Table string
+
+	// The first Skip matching calls go through untouched, then Times of them
+	// get the fault, or every one after when Times is zero
+	Skip int
+	Times int
+
+	// Waited before the call is made, or fails
+	Latency time.Duration
+
+	// Returned instead of making the call. With Committed the call is made
+	// first, and Err returned only if it succeeded, the way a write that
+	// timed out after going through looks to the caller.
+	Err error
+	Committed bool
+
+	seen int
+}
+
+func (f *Fault) matches(op Operation, tableNames []*string) bool {
+	if f.Operation != "" && f.Operation != op {
+		return false
+	}
+
+	if f.Table == "" {
+		return true
+	}
+
+	for _, table := range tableNames {
+		if table != nil && *table == f.Table {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Takes the call if the fault applies to it
+func (f *Fault) take() bool {
+	f.seen++
+	if f.seen <= f.Skip {
+		return false
+	}
+
+	return f.Times == 0 || f.seen <= f.Skip + f.Times
+}
+
+// Wraps a DynamoDB client for tests, to inject faults into the calls made
+// through it and to make index queries stale. Without faults or lag it only
+// counts the calls.
+type Client struct {
+	ddb tables.DynamoDBAPI
+	mutex sync.Mutex
+	faults []*Fault
+	calls map[Operation]int
+	lagging map[string]bool
+	// the last output of each index query, by query
+	indexed map[string]*dynamodb.QueryOutput
+}
+
+func Wrap(ddb tables.DynamoDBAPI) *Client {
+	return &Client {
+		ddb: ddb,
+		calls: map[Operation]int {},
+		lagging: map[string]bool {},
+		indexed: map[string]*dynamodb.QueryOutput {},
+	}
+}
+
+// Adds a fault. When a call matches several, the first added that still
+// applies is injected.
+func (c *Client) Inject(fault Fault) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.faults = append(c.faults, &fault)
+}
+
+// Removes every fault and ends every lag
+func (c *Client) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.faults = nil
+	c.lagging = map[string]bool {}
+}
+
+// The calls of op made so far, faulted or not
+func (c *Client) Calls(op Operation) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.calls[op]
+}
+
+// From now on queries of index on table are answered with what they last
+// returned, as if the index had stopped being updated, until CatchUp. A query
+// not made before is made once, and answered the same from then on. This is
+// the eventual consistency of global secondary indexes, which cannot be read
+// consistently.
+func (c *Client) Lag(table string, index string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lagging[indexKey(table, index)] = true
+}
+
+func (c *Client) CatchUp(table string, index string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.lagging, indexKey(table, index))
+}
+
+func indexKey(table string, index string) string {
+	return table + "/" + index
+}
+
+// Counts the call and finds the fault for it. The error is the one to
+// return without making the call.
+func (c *Client) enter(ctx context.Context, op Operation, tableNames ...*string) (*Fault, error) {
+	c.mutex.Lock()
+	c.calls[op]++
+	var fault *Fault
+	for _, f := range c.faults {
+		if f.matches(op, tableNames) && f.take() {
+			fault = f
+			break
+		}
+	}
+	c.mutex.Unlock()
+
+	if fault == nil {
+		return nil, nil
+	}
+
+	if fault.Latency > 0 {
+		timer := time.NewTimer(fault.Latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if fault.Err != nil && !fault.Committed {
+		return nil, fault.Err
+	}
+
+	return fault, nil
+}
+
+func exit[T any](fault *Fault, output *T, err error) (*T, error) {
+	if err == nil && fault != nil && fault.Committed && fault.Err != nil {
+		return nil, fault.Err
+	}
+
+	return output, err
+}
+
+func (c *Client) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	fault, err := c.enter(ctx, OpGetItem, params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.ddb.GetItem(ctx, params, optFns...)
+	return exit(fault, output, err)
+}
+
+func (c *Client) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	fault, err := c.enter(ctx, OpPutItem, params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.ddb.PutItem(ctx, params, optFns...)
+	return exit(fault, output, err)
+}
+
+func (c *Client) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	fault, err := c.enter(ctx, OpUpdateItem, params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.ddb.UpdateItem(ctx, params, optFns...)
+	return exit(fault, output, err)
+}
+
+func (c *Client) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	fault, err := c.enter(ctx, OpDeleteItem, params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.ddb.DeleteItem(ctx, params, optFns...)
+	return exit(fault, output, err)
+}
+
+func (c *Client) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	fault, err := c.enter(ctx, OpQuery, params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.IndexName == nil || params.TableName == nil {
+		output, err := c.ddb.Query(ctx, params, optFns...)
+		return exit(fault, output, err)
+	}
+
+	key, err := queryKey(params)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	stale, found := c.indexed[key]
+	lagging := c.lagging[indexKey(*params.TableName, *params.IndexName)]
+	c.mutex.Unlock()
+	if lagging && found {
+		return exit(fault, stale, nil)
+	}
+
+	output, err := c.ddb.Query(ctx, params, optFns...)
+	if err == nil {
+		c.mutex.Lock()
+		// a lagging index keeps the first answer, whichever call got it
+		if _, found := c.indexed[key]; !lagging || !found {
+			c.indexed[key] = output
+		}
+		c.mutex.Unlock()
+	}
+
+	return exit(fault, output, err)
+}
+
+// What identifies a query, for answering it again
+func queryKey(params *dynamodb.QueryInput) (string, error) {
+	var values map[string]interface{}
+	err := attributevalue.UnmarshalMap(params.ExpressionAttributeValues, &values)
+	if err != nil {
+		return "", err
+	}
+
+	var start map[string]interface{}
+	err = attributevalue.UnmarshalMap(params.ExclusiveStartKey, &start)
+	if err != nil {
+		return "", err
+	}
+
+	// fmt prints maps sorted by key
+	return fmt.Sprint(*params.TableName, *params.IndexName, deref(params.KeyConditionExpression), deref(params.FilterExpression),
+		params.ExpressionAttributeNames, values, start, deref(params.Limit), deref(params.ScanIndexForward)), nil
+}
+
+func deref[T any](p *T) interface{} {
+	if p == nil {
+		return nil
+	}
+
+	return *p
+}
+
+func (c *Client) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	fault, err := c.enter(ctx, OpScan, params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.ddb.Scan(ctx, params, optFns...)
+	return exit(fault, output, err)
+}
+
+func (c *Client) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	fault, err := c.enter(ctx, OpTransactWriteItems, transactTables(params.TransactItems)...)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.ddb.TransactWriteItems(ctx, params, optFns...)
+	return exit(fault, output, err)
+}
+
+func transactTables(items []types.TransactWriteItem) []*string {
+	tableNames := []*string {}
+	for _, item := range items {
+		switch {
+		case item.Put != nil:
+			tableNames = append(tableNames, item.Put.TableName)
+		case item.Update != nil:
+			tableNames = append(tableNames, item.Update.TableName)
+		case item.Delete != nil:
+			tableNames = append(tableNames, item.Delete.TableName)
+		case item.ConditionCheck != nil:
+			tableNames = append(tableNames, item.ConditionCheck.TableName)
+		}
+	}
+
+	return tableNames
+}
+
+func (c *Client) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	fault, err := c.enter(ctx, OpCreateTable, params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.ddb.CreateTable(ctx, params, optFns...)
+	return exit(fault, output, err)
+}
+
+func (c *Client) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	fault, err := c.enter(ctx, OpDescribeTable, params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.ddb.DescribeTable(ctx, params, optFns...)
+	return exit(fault, output, err)
+}
+
+func (c *Client) UpdateTable(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+	fault, err := c.enter(ctx, OpUpdateTable, params.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.ddb.UpdateTable(ctx, params, optFns...)
+	return exit(fault, output, err)
+}
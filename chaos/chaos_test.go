@@ -0,0 +1,161 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+
+	"loadbalancer/go/tables"
+)
+
+// Counts writes, and answers queries with the number of them
+type fakeDynamoDB struct {
+	tables.DynamoDBAPI
+	writes int
+}
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.writes++
+	return &dynamodb.PutItemOutput {}, nil
+}
+
+func (f *fakeDynamoDB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	f.writes++
+	return &dynamodb.TransactWriteItemsOutput {}, nil
+}
+
+func (f *fakeDynamoDB) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput { Count: int32(f.writes) }, nil
+}
+
+func put(c *Client, table string) error {
+	_, err := c.PutItem(context.Background(), &dynamodb.PutItemInput { TableName: aws.String(table) })
+	return err
+}
+
+func TestSkipAndTimes(t *testing.T) {
+	c := Wrap(&fakeDynamoDB {})
+	c.Inject(Fault { Operation: OpPutItem, Table: "shops", Skip: 1, Times: 1, Err: Throttling() })
+
+	var apiErr smithy.APIError
+	if put(c, "shops") != nil {
+		t.Fatal("The first put should have been skipped")
+	}
+
+	err := put(c, "shops")
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "ThrottlingException" {
+		t.Fatalf("The second put should have been throttled: %v", err)
+	}
+
+	if put(c, "shops") != nil || put(c, "instances") != nil {
+		t.Fatal("Only one put on shops should have been throttled")
+	}
+
+	if c.Calls(OpPutItem) != 4 {
+		t.Fatalf("Expected 4 puts, counted %d", c.Calls(OpPutItem))
+	}
+
+	fmt.Println("SUCCESS: TestSkipAndTimes")
+}
+
+func TestCommitted(t *testing.T) {
+	fake := &fakeDynamoDB {}
+	c := Wrap(fake)
+	c.Inject(Fault { Operation: OpTransactWriteItems, Table: "instances", Times: 1, Err: Timeout(), Committed: true })
+	input := dynamodb.TransactWriteItemsInput {
+		TransactItems: []types.TransactWriteItem {
+			types.TransactWriteItem { Put: &types.Put { TableName: aws.String("shops") } },
+			types.TransactWriteItem { Update: &types.Update { TableName: aws.String("instances") } },
+		},
+	}
+
+	_, err := c.TransactWriteItems(context.Background(), &input)
+	if !errors.Is(err, context.DeadlineExceeded) || fake.writes != 1 {
+		t.Fatalf("The transaction should have gone through and timed out: %d writes ---> %v", fake.writes, err)
+	}
+
+	_, err = c.TransactWriteItems(context.Background(), &input)
+	if err != nil || fake.writes != 2 {
+		t.Fatalf("The second transaction should have gone through: %d writes ---> %v", fake.writes, err)
+	}
+
+	fmt.Println("SUCCESS: TestCommitted")
+}
+
+func TestTransactionCanceled(t *testing.T) {
+	fake := &fakeDynamoDB {}
+	c := Wrap(fake)
+	c.Inject(Fault { Operation: OpTransactWriteItems, Err: TransactionCanceled(ReasonNone, ReasonConditionalCheckFailed) })
+	_, err := c.TransactWriteItems(context.Background(), &dynamodb.TransactWriteItemsInput {})
+
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) || len(canceled.CancellationReasons) != 2 || *canceled.CancellationReasons[1].Code != ReasonConditionalCheckFailed {
+		t.Fatalf("Expected a cancellation for a failed condition: %v", err)
+	}
+
+	if fake.writes != 0 {
+		t.Fatal("A canceled transaction should not have been made")
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestTransactionCanceled %v", err))
+}
+
+func TestLatency(t *testing.T) {
+	c := Wrap(&fakeDynamoDB {})
+	c.Inject(Fault { Latency: time.Hour })
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+
+	_, err := c.PutItem(ctx, &dynamodb.PutItemInput { TableName: aws.String("shops") })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("The put should have waited until the deadline: %v", err)
+	}
+
+	c.Reset()
+	if put(c, "shops") != nil {
+		t.Fatal("Reset should have removed the latency")
+	}
+
+	fmt.Println("SUCCESS: TestLatency")
+}
+
+func TestLag(t *testing.T) {
+	c := Wrap(&fakeDynamoDB {})
+	query := func(index string) int32 {
+		input := dynamodb.QueryInput { TableName: aws.String("instances"), KeyConditionExpression: aws.String("#0 = :0") }
+		if index != "" {
+			input.IndexName = aws.String(index)
+		}
+
+		output, err := c.Query(context.Background(), &input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return output.Count
+	}
+
+	put(c, "instances")
+	if query("gsi") != 1 {
+		t.Fatal("The index should be up to date before it lags")
+	}
+
+	c.Lag("instances", "gsi")
+	put(c, "instances")
+	if query("gsi") != 1 || query("") != 2 {
+		t.Fatal("Only the lagging index should have missed the second put")
+	}
+
+	c.CatchUp("instances", "gsi")
+	if count := query("gsi"); count != 2 {
+		t.Fatalf("The index should have caught up, counted %d", count)
+	}
+
+	fmt.Println("SUCCESS: TestLag")
+}
@@ -0,0 +1,68 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// The reasons a transaction item can be canceled for, as DynamoDB names them
+const (
+	ReasonNone = "None"
+	ReasonConditionalCheckFailed = "ConditionalCheckFailed"
+	ReasonTransactionConflict = "TransactionConflict"
+	ReasonThrottling = "ThrottlingError"
+	ReasonValidation = "ValidationError"
+)
+
+// What DynamoDB returns when requests come faster than the account allows
+func Throttling() error {
+	return &smithy.GenericAPIError {
+		Code: "ThrottlingException",
+		Message: "Rate of requests exceeds the allowed throughput.",
+		Fault: smithy.FaultServer,
+	}
+}
+
+// What DynamoDB returns when a table or index is out of capacity
+func ProvisionedThroughputExceeded() error {
+	message := "The level of configured provisioned throughput for the table was exceeded."
+	return &types.ProvisionedThroughputExceededException { Message: &message }
+}
+
+// A canceled transaction, with one reason per item in the order of the
+// items, e.g. ReasonNone, ReasonConditionalCheckFailed
+func TransactionCanceled(reasons ...string) error {
+	cancellationReasons := make([]types.CancellationReason, len(reasons))
+	for i := range reasons {
+		cancellationReasons[i] = types.CancellationReason { Code: &reasons[i] }
+	}
+
+	message := fmt.Sprintf("Transaction cancelled, please refer cancellation reasons for specific reasons [%v]", strings.Join(reasons, ", "))
+	return &types.TransactionCanceledException {
+		Message: &message,
+		CancellationReasons: cancellationReasons,
+	}
+}
+
+// A request that got no answer in time. With Fault.Committed it is what the
+// caller sees when the write went through anyway.
+func Timeout() error {
+	return timeoutError {}
+}
+
+type timeoutError struct {}
+
+func (e timeoutError) Error() string {
+	return "request timed out"
+}
+
+func (e timeoutError) Timeout() bool {
+	return true
+}
+
+func (e timeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
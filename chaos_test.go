@@ -0,0 +1,130 @@
+package lb
+
+import (
+	"fmt"
+	"testing"
+
+	"loadbalancer/go/chaos"
+	"loadbalancer/go/tables"
+	"loadbalancer/go/test_setup"
+)
+
+// An allocator over the harness's tables, through a chaos client
+func (h *harness) chaos() (*Allocator, *chaos.Client) {
+	c := chaos.Wrap(h.ddb)
+	return NewAllocator(c), c
+}
+
+func TestRegisterCommittedTimeout(t *testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	a, c := h.chaos()
+	c.Inject(chaos.Fault { Operation: chaos.OpTransactWriteItems, Times: 1, Err: chaos.Timeout(), Committed: true })
+
+	_, _, status, err := a.Register("shopC", "streamC", 11000)
+	if err == nil || status != 500 {
+		t.Fatalf("(%d) Register should have failed with the timeout", status)
+	}
+
+	publicIp, _, status, err := a.Register("shopC", "streamC", 11000)
+	if err != nil || status != 200 || publicIp == "" {
+		t.Fatalf("(%d) A retry of Register should have found the stream it placed ---> %v", status, err)
+	}
+
+	// the outcome was written with the stream, so the timeout is seen through
+	c.Inject(chaos.Fault { Operation: chaos.OpTransactWriteItems, Times: 1, Err: chaos.Timeout(), Committed: true })
+	_, _, status, err = a.RegisterWithKey("keyC", "shopC", "streamC1", 11001)
+	if err != nil || status != 200 {
+		t.Fatalf("(%d) RegisterWithKey should have found its own outcome ---> %v", status, err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterCommittedTimeout (%d)", status))
+}
+
+func TestRegisterCanceledAndThrottled(t *testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	a, c := h.chaos()
+	c.Inject(chaos.Fault { Operation: chaos.OpTransactWriteItems, Times: 1, Err: chaos.TransactionCanceled(chaos.ReasonConditionalCheckFailed) })
+
+	_, _, status, err := a.Register("shopC", "streamC", 11000)
+	if err != nil {
+		t.Fatalf("(%d) Register should have gone on to another instance ---> %v", status, err)
+	}
+
+	c.Inject(chaos.Fault { Operation: chaos.OpQuery, Times: 1, Err: chaos.ProvisionedThroughputExceeded() })
+	_, _, status, err = a.Register("shopC", "streamC1", 11001)
+	if err == nil || status != 500 {
+		t.Fatalf("(%d) Register should have failed on the throttled query", status)
+	}
+
+	_, _, status, err = a.Register("shopC", "streamC1", 11001)
+	if err != nil {
+		t.Fatalf("(%d) Register should have succeeded once the throttling stopped ---> %v", status, err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterCanceledAndThrottled (%d)", status))
+}
+
+// Instances are chosen from the Streams GSI, but checked against a
+// consistent read, so a stale index cannot take them over capacity.
+func TestRegisterStaleIndex(t *testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	a, c := h.chaos()
+	c.Lag(*tables.Instances.TableName, tables.InstancesGsiStreamsInstance)
+
+	var i uint16
+	for i = 0; i < 3 * uint16(MAX_INSTANCES); i++ {
+		shopId := fmt.Sprintf("shop%d", i)
+		_, _, status, err := a.Register(shopId, fmt.Sprintf("stream%d", i), 12000 + i)
+		if err != nil {
+			t.Fatalf("(%d) Register of %v should have succeeded with the index lagging ---> %v", status, shopId, err)
+		}
+	}
+
+	_, _, status, err := a.Register("shopX", "streamX", 13000)
+	if err == nil || status != 503 {
+		t.Fatalf("(%d) Register on a full fleet should have failed", status)
+	}
+
+	h.check()
+	c.CatchUp(*tables.Instances.TableName, tables.InstancesGsiStreamsInstance)
+	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterStaleIndex Expected error received (%d) --> %v", status, err))
+}
+
+// Requests of shops with a quota are left to RegisterBatch, so validating a
+// batch writes nothing
+func TestValidateRegisterBatchOnlyReads(t *testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	status, err := h.a.SetShopQuota("shopV0", Quota { MaxStreams: 2 }, "")
+	if err != nil {
+		t.Fatalf("(%d) SetShopQuota of shopV0 should have succeeded ---> %v", status, err)
+	}
+
+	a, c := h.chaos()
+	results := []RegisterResult {
+		RegisterResult { RegisterRequest: RegisterRequest { ShopId: "shopV0", Stream: "streamV0", Port: 16000 } },
+		RegisterResult { RegisterRequest: RegisterRequest { ShopId: "shopV1", Stream: "streamV1", Port: 16001 } },
+	}
+
+	pending, governed, _ := a.validateRegisterBatch(h.ctx, c, results)
+	if len(pending) != 1 || pending[0] != 1 || len(governed) != 1 || governed[0] != 0 || results[0].Status != 0 {
+		t.Fatalf("Expected streamV1 to be pending and streamV0 governed, found %v %v %v", pending, governed, results)
+	}
+
+	for _, op := range []chaos.Operation { chaos.OpPutItem, chaos.OpUpdateItem, chaos.OpDeleteItem, chaos.OpTransactWriteItems } {
+		if c.Calls(op) != 0 {
+			t.Fatalf("Validation made %d %v calls", c.Calls(op), op)
+		}
+	}
+
+	results = a.RegisterBatch([]RegisterRequest { results[0].RegisterRequest, results[1].RegisterRequest })
+	for i, r := range results {
+		if r.Err != nil || r.Status != 200 {
+			t.Fatalf("(%d) Batch registration %d should have succeeded ---> %v", r.Status, i, r.Err)
+		}
+	}
+
+	h.check()
+	fmt.Println("SUCCESS: TestValidateRegisterBatchOnlyReads")
+}
@@ -0,0 +1,139 @@
+// Runs on an instance, registering it with its addresses, capacity and
+// labels, heartbeating with the streams it serves, and deregistering it on
+// SIGINT or SIGTERM. AWS configuration comes from the environment, like for
+// the rest of lb.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	lb "loadbalancer/go"
+	"loadbalancer/go/address"
+	"loadbalancer/go/agent"
+)
+
+// A flag that can be repeated, and takes comma separated values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, strings.Split(value, ",")...)
+	return nil
+}
+
+func main() {
+	hostname, _ := os.Hostname()
+	instance := flag.String("instance", hostname, "name of the instance")
+	var publicIps, privateIps, labels listFlag
+	flag.Var(&publicIps, "public-ip", "public addresses, the primary one first")
+	flag.Var(&privateIps, "private-ip", "private addresses, the primary one first, detected when absent")
+	flag.Var(&labels, "label", "key=value labels")
+	capacity := flag.Uint("capacity", uint(lb.MAX_INSTANCES), "streams the instance can serve")
+	heartbeat := flag.Duration("heartbeat", agent.DEFAULT_HEARTBEAT_INTERVAL, "interval between heartbeats")
+	countCommand := flag.String("count-command", "", "shell command printing the active streams")
+	countUrl := flag.String("count-url", "", "URL returning the active streams")
+	portCommand := flag.String("port-command", "", "shell command printing the ports of the active streams")
+	listenRange := flag.String("listen-range", "", "min-max, to report the ports listened on in that range as the active streams")
+	drain := flag.Bool("drain", false, "move the streams to other instances on shutdown")
+	flag.Parse()
+
+	if *capacity > uint(lb.MAX_INSTANCES) {
+		log.Fatalf("-capacity can be at most %d", lb.MAX_INSTANCES)
+	}
+
+	if len(privateIps) == 0 {
+		privateIps = detectPrivateIps()
+	}
+
+	spec := lb.InstanceSpec {
+		Instance: *instance,
+		Addresses: address.Addresses { Public: publicIps, Private: privateIps },
+		Capacity: uint8(*capacity),
+		Labels: map[string]string {},
+	}
+
+	for _, label := range labels {
+		key, value, found := strings.Cut(label, "=")
+		if !found {
+			log.Fatalf("Label %q is not key=value", label)
+		}
+
+		spec.Labels[key] = value
+	}
+
+	var counter agent.Counter
+	if *countCommand != "" {
+		counter = agent.CommandCounter { Command: *countCommand }
+	} else if *countUrl != "" {
+		counter = agent.HTTPCounter { URL: *countUrl }
+	}
+
+	var ports agent.PortLister
+	if *portCommand != "" {
+		ports = agent.CommandPortLister { Command: *portCommand }
+	} else if *listenRange != "" {
+		minPort, maxPort, err := parseRange(*listenRange)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ports = agent.NewListeningPortLister(minPort, maxPort)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	a := agent.New(agent.LbBackend {}, spec, counter)
+	a.HeartbeatInterval = *heartbeat
+	a.Drain = *drain
+	a.Ports = ports
+	err := a.Run(ctx)
+	if err != nil {
+		log.Fatalf("Agent stopped --> %v", err)
+	}
+}
+
+func parseRange(s string) (uint16, uint16, error) {
+	minStr, maxStr, _ := strings.Cut(s, "-")
+	minPort, err := strconv.ParseUint(minStr, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q is not a port range", s)
+	}
+
+	maxPort, err := strconv.ParseUint(maxStr, 10, 16)
+	if err != nil || maxPort < minPort {
+		return 0, 0, fmt.Errorf("%q is not a port range", s)
+	}
+
+	return uint16(minPort), uint16(maxPort), nil
+}
+
+// The private addresses of this host's interfaces
+func detectPrivateIps() []string {
+	ips := []string {}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("INFO: Unable to list interface addresses --> %v", err)
+		return ips
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.IsPrivate() {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+
+	return ips
+}
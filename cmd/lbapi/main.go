@@ -0,0 +1,107 @@
+// Serves Register, Unregister and the admin operations of lb over HTTP, to
+// the callers and with the rules of an -auth file, see auth.File. With
+// -client-ca, TLS client certificates signed by it are asked for, for the
+// clientCerts of the file. API keys, signatures and tokens would go over the
+// network in the clear without TLS, so serving plain HTTP takes -insecure,
+// e.g. behind a proxy that terminates TLS. AWS configuration comes from the
+// environment, like for the rest of lb.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	lb "loadbalancer/go"
+	"loadbalancer/go/api"
+	"loadbalancer/go/auth"
+	"loadbalancer/go/tables"
+)
+
+func main() {
+	listen := flag.String("listen", ":8443", "address to serve on")
+	authFile := flag.String("auth", "", "YAML or JSON file of the callers and their rules")
+	tlsCert := flag.String("tls-cert", "", "certificate to serve HTTPS with")
+	tlsKey := flag.String("tls-key", "", "key of -tls-cert")
+	clientCA := flag.String("client-ca", "", "CA bundle client certificates are verified against, with -tls-cert")
+	insecure := flag.Bool("insecure", false, "serve plain HTTP without -tls-cert")
+	cache := flag.Bool("cache", false, "cache instance addresses and the instances with room")
+	loadIndex := flag.String("load-index", string(tables.LoadIndexStreams), "index instances with room are found through: streams or sharded")
+	flag.Parse()
+	if *authFile == "" {
+		log.Fatal("-auth is required")
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") || (*clientCA != "" && *tlsCert == "") {
+		log.Fatal("-tls-cert and -tls-key go together, and -client-ca needs them")
+	}
+
+	if *tlsCert == "" && !*insecure {
+		log.Fatal("-tls-cert and -tls-key are required, or -insecure to serve plain HTTP")
+	}
+
+	index := tables.LoadIndex(*loadIndex)
+	if index != tables.LoadIndexStreams && index != tables.LoadIndexSharded {
+		log.Fatalf("Unknown -load-index %v", *loadIndex)
+	}
+
+	authenticator, policy, err := auth.LoadFile(*authFile)
+	if err != nil {
+		log.Fatalf("Unable to load %v --> %v", *authFile, err)
+	}
+
+	lb.SetLoadIndex(index)
+	if *cache {
+		lb.EnableCache(lb.DEFAULT_ADDRESS_TTL, lb.DEFAULT_CANDIDATE_TTL)
+	}
+
+	server := &http.Server {
+		Addr: *listen,
+		Handler: api.New(lb.Default, authenticator, policy),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if *clientCA != "" {
+		pem, err := os.ReadFile(*clientCA)
+		if err != nil {
+			log.Fatalf("Unable to read %v --> %v", *clientCA, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates in %v", *clientCA)
+		}
+
+		// Callers may use the other methods, so a certificate is not
+		// required
+		server.TLSConfig = &tls.Config { ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven, MinVersion: tls.VersionTLS12 }
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	log.Printf("INFO: Serving on %v", *listen)
+	if *tlsCert != "" {
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Server stopped --> %v", err)
+	}
+}
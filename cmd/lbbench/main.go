@@ -0,0 +1,107 @@
+// Drives Register and Unregister calls at lb with concurrent clients, and
+// reports their latency percentiles and statuses, with the transactions
+// canceled by conflicts and the calls throttled by DynamoDB. AWS
+// configuration comes from the environment, like for the rest of lb, and
+// -endpoint points it at another DynamoDB, e.g. DynamoDB Local. The queries
+// of the hottest index partition are reported too, to compare -load-index
+// streams with sharded.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	lb "loadbalancer/go"
+	"loadbalancer/go/bench"
+	"loadbalancer/go/tables"
+	"loadbalancer/go/test_setup"
+)
+
+func main() {
+	clients := flag.Int("clients", bench.DEFAULT_CLIENTS, "concurrent clients")
+	rate := flag.Float64("rate", 0, "calls per second over all clients, as fast as they go when 0")
+	duration := flag.Duration("duration", bench.DEFAULT_DURATION, "how long to run")
+	operations := flag.Int64("operations", 0, "stop after this many calls, when not 0")
+	register := flag.Int("register", 1, "weight of Register calls")
+	unregister := flag.Int("unregister", 1, "weight of Unregister calls")
+	shops := flag.Int("shops", 1000, "shops the streams are spread over")
+	ports := flag.Int("ports", 1000, "ports the streams are spread over")
+	firstPort := flag.Uint("first-port", 20000, "first of the ports")
+	prefix := flag.String("prefix", "bench", "prefix of the shop and stream names")
+	seed := flag.Int64("seed", 1, "seed of the clients' choices")
+	keep := flag.Bool("keep", false, "leave the streams registered at the end")
+	endpoint := flag.String("endpoint", "", "DynamoDB endpoint, e.g. http://localhost:22000 for DynamoDB Local")
+	tablePrefix := flag.String("table-prefix", "", "prefix of the table names, for tables of the benchmark's own")
+	setup := flag.Int("setup", 0, "create the tables with this many instances first, under -table-prefix")
+	loadIndex := flag.String("load-index", string(tables.LoadIndexStreams), "index instances with room are found through: streams or sharded")
+	asJson := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	index := tables.LoadIndex(*loadIndex)
+	if index != tables.LoadIndexStreams && index != tables.LoadIndexSharded {
+		log.Fatalf("Unknown -load-index %v", *loadIndex)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var options []func(*config.LoadOptions) error
+	if *endpoint != "" {
+		resolver := aws.EndpointResolverWithOptionsFunc(func(service string, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint { URL: *endpoint }, nil
+		})
+		options = append(options, config.WithEndpointResolverWithOptions(resolver))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		log.Fatalf("Unable to load the AWS configuration --> %v", err)
+	}
+
+	var ddb tables.DynamoDBAPI = dynamodb.NewFromConfig(cfg)
+	if *tablePrefix != "" {
+		ddb = tables.Namespace(ddb, *tablePrefix)
+	}
+
+	if *setup > 0 {
+		test_setup.CreateTables(ctx, ddb)
+		test_setup.AddInstances(ctx, ddb, test_setup.Fleet(*setup))
+		log.Printf("INFO: Created the tables with %d instances", *setup)
+	}
+
+	counter := bench.Count(ddb)
+	allocator := lb.NewAllocator(counter)
+	allocator.SetLoadIndex(index)
+	report := bench.Run(ctx, bench.Config {
+		Clients: *clients,
+		Rate: *rate,
+		Duration: *duration,
+		Operations: *operations,
+		Mix: bench.Mix { Register: *register, Unregister: *unregister },
+		Shops: *shops,
+		Ports: *ports,
+		FirstPort: uint16(*firstPort),
+		Prefix: *prefix,
+		Seed: *seed,
+		Keep: *keep,
+	}, bench.LbTarget { Allocator: allocator }, counter)
+
+	if *asJson {
+		err = json.NewEncoder(os.Stdout).Encode(report)
+		if err != nil {
+			log.Fatalf("Unable to print the report --> %v", err)
+		}
+
+		return
+	}
+
+	report.Print(os.Stdout)
+}
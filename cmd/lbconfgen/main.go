@@ -0,0 +1,96 @@
+// Renders the allocations into HAProxy, nginx or Envoy configuration, once
+// to stdout or a file, or with -watch whenever they change. AWS
+// configuration comes from the environment, like for the rest of lb.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"loadbalancer/go/changefeed"
+	"loadbalancer/go/confgen"
+	"loadbalancer/go/tables"
+)
+
+func main() {
+	format := flag.String("format", string(confgen.FormatHAProxy), "haproxy, nginx or envoy")
+	templatePath := flag.String("template", "", "template to use instead of the one shipped for -format")
+	out := flag.String("out", "", "file to write, stdout when empty")
+	watch := flag.Bool("watch", false, "keep -out current, following the change feed")
+	interval := flag.Duration("interval", confgen.DEFAULT_WATCH_INTERVAL, "interval between full renders with -watch")
+	reload := flag.String("reload", "", "command run after -out changes, e.g. \"systemctl reload haproxy\"")
+	flag.Parse()
+
+	tmpl, err := loadTemplate(*format, *templatePath)
+	if err != nil {
+		log.Fatalf("Unable to load the template --> %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if !*watch {
+		allocations, err := confgen.LbSource {}.Allocations(ctx)
+		if err != nil {
+			log.Fatalf("Unable to list allocations --> %v", err)
+		}
+
+		w := os.Stdout
+		if *out != "" {
+			w, err = os.Create(*out)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			defer w.Close()
+		}
+
+		err = confgen.Render(w, tmpl, allocations)
+		if err != nil {
+			log.Fatalf("Unable to render --> %v", err)
+		}
+
+		return
+	}
+
+	if *out == "" {
+		log.Fatal("-watch needs -out")
+	}
+
+	watcher := confgen.NewWatcher(confgen.LbSource {}, tmpl, *out)
+	watcher.Interval = *interval
+	if command := strings.Fields(*reload); len(command) > 0 {
+		watcher.Reload = confgen.CommandReload(command[0], command[1:]...)
+	}
+
+	tablesContext, err := tables.Context()
+	if err != nil {
+		log.Fatalf("Unable to load configuration --> %v", err)
+	}
+
+	feed := changefeed.New(tablesContext, changefeed.NewMemoryCheckpointer())
+	feed.StartAtLatest = true
+	feed.Subscribe(watcher.Handler(ctx))
+	go feed.RunRestarting(ctx, time.Second)
+
+	watcher.Run(ctx)
+}
+
+func loadTemplate(format string, path string) (*template.Template, error) {
+	if path == "" {
+		return confgen.DefaultTemplate(confgen.Format(format))
+	}
+
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return confgen.ParseTemplate(path, string(text))
+}
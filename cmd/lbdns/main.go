@@ -0,0 +1,37 @@
+// Answers DNS queries for the streams in a zone. AWS configuration comes
+// from the environment, like for the rest of lb.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"loadbalancer/go/dns"
+)
+
+func main() {
+	zone := flag.String("zone", "", "zone the streams are named in, e.g. streams.example.com")
+	listen := flag.String("listen", ":53", "address to serve UDP and TCP on")
+	ttl := flag.Duration("ttl", dns.DEFAULT_TTL, "how long answers are cached, here and by resolvers")
+	flag.Parse()
+	if *zone == "" {
+		log.Fatal("-zone is required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server, err := dns.New(*zone, *ttl, dns.LbLookup {})
+	if err != nil {
+		log.Fatalf("Invalid zone %v --> %v", *zone, err)
+	}
+
+	err = server.ListenAndServe(ctx, *listen)
+	if err != nil {
+		log.Fatalf("DNS server stopped --> %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+// Checks the health of every instance and records it on the instance
+// records, so that Register skips unhealthy instances, optionally moving
+// their streams away after a grace period. AWS configuration comes from the
+// environment, like for the rest of lb.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"loadbalancer/go/health"
+)
+
+func main() {
+	check := flag.String("check", "tcp", "tcp, http or heartbeat")
+	port := flag.Uint("port", 0, "port to check with tcp and http")
+	path := flag.String("path", "/healthz", "path to get with http")
+	timeout := flag.Duration("timeout", health.DEFAULT_CHECK_TIMEOUT, "timeout of a tcp or http check")
+	maxHeartbeatAge := flag.Duration("max-heartbeat-age", time.Minute, "age past which a heartbeat is missing")
+	interval := flag.Duration("interval", health.DEFAULT_CHECK_INTERVAL, "interval between checks")
+	failures := flag.Int("failures", health.DEFAULT_FAILURE_THRESHOLD, "failed checks in a row before an instance is unhealthy")
+	recoveries := flag.Int("recoveries", health.DEFAULT_RECOVERY_THRESHOLD, "passed checks in a row before an instance is healthy again")
+	evacuate := flag.Bool("evacuate", false, "move the streams off instances unhealthy for the grace period")
+	grace := flag.Duration("grace", health.DEFAULT_GRACE_PERIOD, "how long an instance is unhealthy before it is evacuated")
+	flag.Parse()
+
+	var checker health.Checker
+	switch *check {
+	case "tcp":
+		checker = health.TCPChecker { Port: uint16(*port), Timeout: *timeout }
+	case "http":
+		checker = health.HTTPChecker { Port: uint16(*port), Path: *path, Timeout: *timeout }
+	case "heartbeat":
+		checker = health.NewHeartbeatChecker(*maxHeartbeatAge)
+	default:
+		log.Fatalf("Unknown check %v", *check)
+	}
+
+	if *check != "heartbeat" && (*port == 0 || *port > 65535) {
+		log.Fatalf("-port is required for %v checks", *check)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	monitor := health.New(health.LbBackend {}, checker)
+	monitor.Interval = *interval
+	monitor.FailureThreshold = *failures
+	monitor.RecoveryThreshold = *recoveries
+	monitor.Evacuate = *evacuate
+	monitor.GracePeriod = *grace
+	monitor.Run(ctx)
+}
@@ -0,0 +1,82 @@
+// Migrates the instances table of lb to the sharded load index. Run with
+// -backfill once every lb process writes the Load attribute, then with -add
+// to create InstancesGsiLoad, and -wait until it is built, after which the
+// processes can be switched over with lb.SetLoadIndex(tables.LoadIndexSharded).
+// AWS configuration comes from the environment, like for the rest of lb.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"loadbalancer/go/tables"
+)
+
+func main() {
+	backfill := flag.Bool("backfill", false, "set the Load of instances written before it")
+	add := flag.Bool("add", false, "create the load index")
+	wait := flag.Bool("wait", false, "wait for the load index to be built")
+	interval := flag.Duration("interval", 10 * time.Second, "interval between checks with -wait")
+	tablePrefix := flag.String("table-prefix", "", "prefix of the table names")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tablesContext, err := tables.Context()
+	if err != nil {
+		log.Fatalf("Unable to load the AWS configuration --> %v", err)
+	}
+
+	var ddb tables.DynamoDBAPI = dynamodb.NewFromConfig(*tablesContext.Cfg())
+	if *tablePrefix != "" {
+		ddb = tables.Namespace(ddb, *tablePrefix)
+	}
+
+	if *backfill {
+		n, err := tables.BackfillLoad(ctx, ddb)
+		if err != nil {
+			log.Fatalf("Unable to backfill after %d instances --> %v", n, err)
+		}
+
+		log.Printf("INFO: Set the Load of %d instances", n)
+	}
+
+	if *add {
+		err = tables.AddLoadIndex(ctx, ddb)
+		if err != nil {
+			log.Fatalf("Unable to add the load index --> %v", err)
+		}
+
+		log.Printf("INFO: Adding %v", tables.InstancesGsiLoad)
+	}
+
+	for {
+		ready, err := tables.LoadIndexReady(ctx, ddb)
+		if err != nil {
+			log.Fatalf("Unable to check the load index --> %v", err)
+		}
+
+		if ready {
+			log.Printf("INFO: %v is ready", tables.InstancesGsiLoad)
+			return
+		}
+
+		log.Printf("INFO: %v is not ready", tables.InstancesGsiLoad)
+		if !*wait {
+			os.Exit(1)
+		}
+
+		select {
+		case <-ctx.Done():
+			os.Exit(1)
+		case <-time.After(*interval):
+		}
+	}
+}
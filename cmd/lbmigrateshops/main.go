@@ -0,0 +1,84 @@
+// Rebuilds a shops table created before shops were keyed on ShopId and
+// Stream, which DynamoDB cannot change in place. With every lb process that
+// writes stopped:
+//  1. lbmigrateshops -out -backup shops_v1 copies the shops into a new table
+//  2. aws dynamodb delete-table --table-name shops, and wait for it to go
+//  3. lbmigrateshops -in -backup shops_v1 creates shops with the new key and
+//     indexes and copies the shops back
+//
+// after which the backup table can be deleted. AWS configuration comes from
+// the environment, like for the rest of lb.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"loadbalancer/go/tables"
+)
+
+func main() {
+	out := flag.Bool("out", false, "copy the shops table into -backup")
+	in := flag.Bool("in", false, "recreate the shops table and copy -backup into it")
+	backup := flag.String("backup", "", "table the shops are kept in while shops is rebuilt")
+	interval := flag.Duration("interval", 5 * time.Second, "interval between checks for a created table")
+	tablePrefix := flag.String("table-prefix", "", "prefix of the table names")
+	flag.Parse()
+	if *out == *in || *backup == "" {
+		log.Fatal("One of -out or -in, and -backup, are required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tablesContext, err := tables.Context()
+	if err != nil {
+		log.Fatalf("Unable to load the AWS configuration --> %v", err)
+	}
+
+	var ddb tables.DynamoDBAPI = dynamodb.NewFromConfig(*tablesContext.Cfg())
+	if *tablePrefix != "" {
+		ddb = tables.Namespace(ddb, *tablePrefix)
+	}
+
+	from, to := tables.Shops.TableName, backup
+	if *in {
+		from, to = backup, tables.Shops.TableName
+	}
+
+	_, err = ddb.CreateTable(ctx, tables.ShopsTableInput(to))
+	if err != nil {
+		log.Fatalf("Unable to create %v --> %v", *to, err)
+	}
+
+	for {
+		active, err := tables.TableActive(ctx, ddb, to)
+		if err != nil {
+			log.Fatalf("Unable to check %v --> %v", *to, err)
+		}
+
+		if active {
+			break
+		}
+
+		log.Printf("INFO: Waiting for %v to be created", *to)
+		select {
+		case <-ctx.Done():
+			os.Exit(1)
+		case <-time.After(*interval):
+		}
+	}
+
+	n, err := tables.CopyItems(ctx, ddb, from, to)
+	if err != nil {
+		log.Fatalf("Unable to copy %v to %v after %d shops --> %v", *from, *to, n, err)
+	}
+
+	log.Printf("INFO: Copied %d shops from %v to %v", n, *from, *to)
+}
@@ -0,0 +1,50 @@
+// Runs the proxy on this host, listening on every allocated port and
+// following registrations through the change feed. AWS configuration comes
+// from the environment, like for the rest of lb.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"loadbalancer/go/changefeed"
+	"loadbalancer/go/proxy"
+	"loadbalancer/go/tables"
+)
+
+func main() {
+	listenHost := flag.String("listen", "", "address to listen on, all interfaces when empty")
+	reloadInterval := flag.Duration("reload", proxy.DEFAULT_RELOAD_INTERVAL, "interval between full route reloads")
+	noFeed := flag.Bool("no-feed", false, "only reload periodically, without following the change feed")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	p := proxy.New(proxy.LbSource {})
+	p.ListenHost = *listenHost
+	p.ReloadInterval = *reloadInterval
+	if !*noFeed {
+		tablesContext, err := tables.Context()
+		if err != nil {
+			log.Fatalf("Unable to load configuration --> %v", err)
+		}
+
+		// A restarted proxy reloads everything, so it only needs what
+		// changes from now on.
+		feed := changefeed.New(tablesContext, changefeed.NewMemoryCheckpointer())
+		feed.StartAtLatest = true
+		feed.Subscribe(p.Handler(ctx))
+		go feed.RunRestarting(ctx, time.Second)
+	}
+
+	err := p.Run(ctx)
+	if err != nil {
+		log.Fatalf("Proxy stopped --> %v", err)
+	}
+}
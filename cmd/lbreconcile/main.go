@@ -0,0 +1,66 @@
+// Compares the allocations with what the instances' agents report serving,
+// printing a JSON report of the drift per pass, and correcting it with
+// -fix-counts and -lost. AWS configuration comes from the environment, like
+// for the rest of lb.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"loadbalancer/go/reconcile"
+)
+
+func main() {
+	fixCounts := flag.Bool("fix-counts", false, "repair instance stream counts that drifted from their ports")
+	lost := flag.String("lost", string(reconcile.LostReport), "what to do with lost streams: report, move or unregister")
+	confirmations := flag.Int("confirmations", 0, "passes in a row a drift has to be seen in before it is corrected, 1 without -watch")
+	maxReportAge := flag.Duration("max-report-age", reconcile.DEFAULT_MAX_REPORT_AGE, "age past which an agent report is ignored")
+	watch := flag.Bool("watch", false, "keep reconciling")
+	interval := flag.Duration("interval", reconcile.DEFAULT_RECONCILE_INTERVAL, "interval between passes with -watch")
+	flag.Parse()
+
+	policy := reconcile.LostPolicy(*lost)
+	if policy != reconcile.LostReport && policy != reconcile.LostMove && policy != reconcile.LostUnregister {
+		log.Fatalf("Unknown -lost %v", *lost)
+	}
+
+	r := reconcile.New(reconcile.LbBackend {})
+	r.FixCounts = *fixCounts
+	r.Lost = policy
+	r.MaxReportAge = *maxReportAge
+	r.Interval = *interval
+	r.Confirmations = *confirmations
+	if r.Confirmations == 0 && *watch {
+		r.Confirmations = reconcile.DEFAULT_CONFIRMATIONS
+	} else if r.Confirmations == 0 {
+		r.Confirmations = 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	print := func(report *reconcile.Report) {
+		err := encoder.Encode(report)
+		if err != nil {
+			log.Printf("INFO: Unable to print the report --> %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *watch {
+		r.Run(ctx, print)
+		return
+	}
+
+	report, err := r.Reconcile(ctx)
+	if err != nil {
+		log.Fatalf("Unable to reconcile --> %v", err)
+	}
+
+	print(report)
+}
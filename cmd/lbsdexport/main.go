@@ -0,0 +1,67 @@
+// Writes the allocations as Prometheus file_sd target groups or a Consul
+// style catalog, once or with -watch whenever they change. AWS
+// configuration comes from the environment, like for the rest of lb.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"loadbalancer/go/changefeed"
+	"loadbalancer/go/confgen"
+	"loadbalancer/go/sdexport"
+	"loadbalancer/go/tables"
+)
+
+func main() {
+	format := flag.String("format", "file_sd", "file_sd or consul")
+	out := flag.String("out", "", "file to write")
+	public := flag.Bool("public", false, "target the public rather than the private addresses")
+	serviceName := flag.String("service", sdexport.DEFAULT_SERVICE_NAME, "service name in the consul catalog")
+	watch := flag.Bool("watch", false, "keep -out current, following the change feed")
+	interval := flag.Duration("interval", confgen.DEFAULT_WATCH_INTERVAL, "interval between full exports with -watch")
+	flag.Parse()
+	if *out == "" {
+		log.Fatal("-out is required")
+	}
+
+	options := sdexport.Options { Public: *public, ServiceName: *serviceName }
+	var render confgen.Renderer
+	switch *format {
+	case "file_sd":
+		render = sdexport.FileSDRenderer(options)
+	case "consul":
+		render = sdexport.ConsulCatalogRenderer(options)
+	default:
+		log.Fatalf("Unknown format %v", *format)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	watcher := confgen.NewRenderWatcher(confgen.LbSource {}, render, *out)
+	watcher.Interval = *interval
+	if !*watch {
+		_, err := watcher.Sync(ctx)
+		if err != nil {
+			log.Fatalf("Unable to export --> %v", err)
+		}
+
+		return
+	}
+
+	tablesContext, err := tables.Context()
+	if err != nil {
+		log.Fatalf("Unable to load configuration --> %v", err)
+	}
+
+	feed := changefeed.New(tablesContext, changefeed.NewMemoryCheckpointer())
+	feed.StartAtLatest = true
+	feed.Subscribe(watcher.Handler(ctx))
+	go feed.RunRestarting(ctx, time.Second)
+	watcher.Run(ctx)
+}
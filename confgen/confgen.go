@@ -0,0 +1,180 @@
+// Package confgen renders the allocations into configuration for proxies
+// run in front of the instances, like HAProxy, nginx and Envoy, and keeps
+// the configuration current with Watcher.
+package confgen
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/template"
+
+	lb "loadbalancer/go"
+)
+
+type Format string
+
+const (
+	FormatHAProxy Format = "haproxy"
+	FormatNginx Format = "nginx"
+	FormatEnvoy Format = "envoy"
+)
+
+//go:embed templates
+var templates embed.FS
+
+var templateFiles = map[Format]string {
+	FormatHAProxy: "templates/haproxy.cfg.tmpl",
+	FormatNginx: "templates/nginx.conf.tmpl",
+	FormatEnvoy: "templates/envoy.yaml.tmpl",
+}
+
+// What templates are executed with. Allocations are ordered by stream, and
+// Ports by port, each with the allocations on it.
+type Data struct {
+	Allocations []lb.Shop
+	Ports []Port
+}
+
+type Port struct {
+	Port uint16
+	Allocations []lb.Shop
+}
+
+// Allocations without a private IP cannot be proxied to, and are left out
+func NewData(allocations []lb.Shop) Data {
+	data := Data { Allocations: []lb.Shop {}, Ports: []Port {} }
+	ports := map[uint16]*Port {}
+	for _, allocation := range allocations {
+		if allocation.PrivateIp == "" {
+			continue
+		}
+
+		data.Allocations = append(data.Allocations, allocation)
+		if _, present := ports[allocation.Port]; !present {
+			ports[allocation.Port] = &Port { Port: allocation.Port }
+		}
+
+		ports[allocation.Port].Allocations = append(ports[allocation.Port].Allocations, allocation)
+	}
+
+	sort.Slice(data.Allocations, func(i, j int) bool { return data.Allocations[i].Stream < data.Allocations[j].Stream })
+	for _, port := range ports {
+		sort.Slice(port.Allocations, func(i, j int) bool { return port.Allocations[i].Stream < port.Allocations[j].Stream })
+		data.Ports = append(data.Ports, *port)
+	}
+
+	sort.Slice(data.Ports, func(i, j int) bool { return data.Ports[i].Port < data.Ports[j].Port })
+	return data
+}
+
+// Functions available to templates, besides the text/template builtins
+//
+//	target   "<private ip>:<port>" of an allocation, bracketed for IPv6
+//	ident    a name made safe for use as an identifier, e.g. of a backend
+//	quote    a double quoted string
+var Funcs = template.FuncMap {
+	"target": func(shop lb.Shop) string {
+		return net.JoinHostPort(shop.PrivateIp, strconv.Itoa(int(shop.Port)))
+	},
+	"ident": ident,
+	"quote": strconv.Quote,
+}
+
+var unsafeIdent = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// Names that had to be changed get a hash of the original, so that two of
+// them cannot end up the same.
+func ident(name string) string {
+	safe := unsafeIdent.ReplaceAllString(name, "_")
+	if safe == name {
+		return name
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return fmt.Sprintf("%v_%08x", safe, hash.Sum32())
+}
+
+// The template shipped for format
+func DefaultTemplate(format Format) (*template.Template, error) {
+	file, present := templateFiles[format]
+	if !present {
+		return nil, fmt.Errorf("Unknown format %v", format)
+	}
+
+	text, err := templates.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseTemplate(string(format), string(text))
+}
+
+// A template of one's own, with Funcs available
+func ParseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(Funcs).Option("missingkey=error").Parse(text)
+}
+
+// Renders nothing if any allocation fails Validate
+func Render(w io.Writer, tmpl *template.Template, allocations []lb.Shop) error {
+	data := NewData(allocations)
+	for _, allocation := range data.Allocations {
+		err := Validate(allocation)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tmpl.Execute(w, data)
+}
+
+// Labels of letters, digits, hyphens and underscores, which SNI server names
+// are made of
+var serverName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,63}(\.[A-Za-z0-9_-]{1,63})*$`)
+
+// Stream names go into the configuration as they are, as the server names
+// connections are routed by, so anything else in them, e.g. quotes, spaces,
+// braces or semicolons, could change the configuration around them.
+// Private IPs go in as they are too.
+func Validate(allocation lb.Shop) error {
+	if len(allocation.Stream) > 253 || !serverName.MatchString(allocation.Stream) {
+		return fmt.Errorf("Stream %q is not a valid TLS server name", allocation.Stream)
+	}
+
+	if net.ParseIP(allocation.PrivateIp) == nil {
+		return fmt.Errorf("Private IP %q of stream %v is not an IP address", allocation.PrivateIp, allocation.Stream)
+	}
+
+	return nil
+}
+
+func renderBytes(tmpl *template.Template, allocations []lb.Shop) ([]byte, error) {
+	var buf bytes.Buffer
+	err := Render(&buf, tmpl, allocations)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Where allocations come from
+type Source interface {
+	Allocations(ctx context.Context) ([]lb.Shop, error)
+}
+
+// lb.ListAllocations
+type LbSource struct {}
+
+func (LbSource) Allocations(ctx context.Context) ([]lb.Shop, error) {
+	allocations, _, err := lb.ListAllocations()
+	return allocations, err
+}
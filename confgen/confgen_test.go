@@ -0,0 +1,184 @@
+package confgen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"gopkg.in/yaml.v3"
+
+	lb "loadbalancer/go"
+)
+
+var testAllocations = []lb.Shop {
+	lb.Shop { ShopId: "shop1", Stream: "stream-b", Port: 11000, Instance: "i-2", PrivateIp: "10.0.0.2" },
+	lb.Shop { ShopId: "shop0", Stream: "stream_a", Port: 11000, Instance: "i-1", PrivateIp: "10.0.0.1" },
+	lb.Shop { ShopId: "shop2", Stream: "stream_c", Port: 11001, Instance: "i-3", PrivateIp: "fd00::3" },
+	lb.Shop { ShopId: "shop3", Stream: "stream_d", Port: 11002, Instance: "i-4" },
+}
+
+func render(t *testing.T, format Format, allocations []lb.Shop) string {
+	tmpl, err := DefaultTemplate(format)
+	if err != nil {
+		t.Fatalf("The %v template should have parsed ---> %v", format, err)
+	}
+
+	var buf bytes.Buffer
+	err = Render(&buf, tmpl, allocations)
+	if err != nil {
+		t.Fatalf("The %v template should have rendered ---> %v", format, err)
+	}
+
+	return buf.String()
+}
+
+func TestNewData(t *testing.T) {
+	data := NewData(testAllocations)
+	if len(data.Allocations) != 3 || data.Allocations[0].Stream != "stream-b" {
+		t.Fatalf("Allocations should be the 3 with a private ip, by stream: %v", data.Allocations)
+	}
+
+	if len(data.Ports) != 2 || data.Ports[0].Port != 11000 || len(data.Ports[0].Allocations) != 2 {
+		t.Fatalf("Ports should be 11000 with 2 allocations and 11001: %v", data.Ports)
+	}
+
+	fmt.Println("SUCCESS: TestNewData")
+}
+
+func TestDefaultTemplates(t *testing.T) {
+	haproxy := render(t, FormatHAProxy, testAllocations)
+	for _, line := range []string { "bind :11000", "use_backend stream_b_", "server i_1_", "10.0.0.1:11000", "[fd00::3]:11001" } {
+		if !strings.Contains(haproxy, line) {
+			t.Fatalf("The haproxy config should contain %q:\n%v", line, haproxy)
+		}
+	}
+
+	if strings.Contains(haproxy, "i_4_") {
+		t.Fatalf("The haproxy config should leave out i-4, which has no private ip:\n%v", haproxy)
+	}
+
+	nginx := render(t, FormatNginx, testAllocations)
+	for _, line := range []string { "\"stream_a:11000\" 10.0.0.1:11000;", "listen 11001;" } {
+		if !strings.Contains(nginx, line) {
+			t.Fatalf("The nginx config should contain %q:\n%v", line, nginx)
+		}
+	}
+
+	for _, allocations := range [][]lb.Shop { testAllocations, nil } {
+		envoy := render(t, FormatEnvoy, allocations)
+		var parsed struct {
+			StaticResources struct {
+				Listeners []interface {} `yaml:"listeners"`
+				Clusters []interface {} `yaml:"clusters"`
+			} `yaml:"static_resources"`
+		}
+
+		err := yaml.Unmarshal([]byte(envoy), &parsed)
+		if err != nil {
+			t.Fatalf("The envoy config should be YAML ---> %v\n%v", err, envoy)
+		}
+
+		if len(parsed.StaticResources.Listeners) != len(NewData(allocations).Ports) || len(parsed.StaticResources.Clusters) != len(NewData(allocations).Allocations) {
+			t.Fatalf("The envoy config has the wrong number of listeners or clusters:\n%v", envoy)
+		}
+	}
+
+	fmt.Println("SUCCESS: TestDefaultTemplates")
+}
+
+func TestHostileStreamNames(t *testing.T) {
+	for _, stream := range []string {
+		"x }\nbackend evil\n    server evil 203.0.113.66:22",
+		"x\" 203.0.113.66:22;\n    }\n    server { listen 22; proxy_pass 203.0.113.66:22; } #",
+		"x\"]\n    filters: []",
+		"stream a",
+		"",
+	} {
+		allocations := []lb.Shop { lb.Shop { ShopId: "shop0", Stream: stream, Port: 11000, Instance: "i-1", PrivateIp: "10.0.0.1" } }
+		for format := range templateFiles {
+			tmpl, err := DefaultTemplate(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			err = Render(&buf, tmpl, allocations)
+			if err == nil || buf.Len() != 0 {
+				t.Fatalf("The %v template should not have rendered stream %q:\n%v", format, stream, buf.String())
+			}
+		}
+	}
+
+	tmpl, _ := DefaultTemplate(FormatNginx)
+	err := Render(&bytes.Buffer {}, tmpl, []lb.Shop { lb.Shop { Stream: "stream0", Port: 11000, Instance: "i-1", PrivateIp: "10.0.0.1; evil" } })
+	if err == nil {
+		t.Fatal("A private IP that is not an IP should not have rendered")
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestHostileStreamNames Expected error received --> %v", err))
+}
+
+type testSource struct {
+	allocations []lb.Shop
+}
+
+func (s *testSource) Allocations(ctx context.Context) ([]lb.Shop, error) {
+	return s.allocations, nil
+}
+
+func TestWatcherSync(t *testing.T) {
+	tmpl, err := DefaultTemplate(FormatNginx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &testSource { allocations: testAllocations[:2] }
+	path := filepath.Join(t.TempDir(), "lb.conf")
+	watcher := NewWatcher(source, tmpl, path)
+	reloads := 0
+	failReload := false
+	watcher.Reload = func(ctx context.Context) error {
+		reloads++
+		if failReload {
+			return errors.New("reload failed")
+		}
+
+		return nil
+	}
+
+	for i, expected := range []bool { true, false } {
+		changed, err := watcher.Sync(context.TODO())
+		if err != nil || changed != expected {
+			t.Fatalf("Sync %d should have returned changed=%v, not %v ---> %v", i, expected, changed, err)
+		}
+	}
+
+	if reloads != 1 {
+		t.Fatalf("%d reloads for one change", reloads)
+	}
+
+	source.allocations = testAllocations
+	failReload = true
+	_, err = watcher.Sync(context.TODO())
+	if err == nil {
+		t.Fatal("A failed reload should have been reported")
+	}
+
+	// the file is up to date, but the reload still has to happen
+	failReload = false
+	changed, err := watcher.Sync(context.TODO())
+	if err != nil || changed || reloads != 3 {
+		t.Fatalf("The failed reload should have been retried once: changed=%v reloads=%d ---> %v", changed, reloads, err)
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(written), "listen 11001;") {
+		t.Fatalf("The file should have the latest allocations ---> %v\n%s", err, written)
+	}
+
+	fmt.Println("SUCCESS: TestWatcherSync")
+}
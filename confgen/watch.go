@@ -0,0 +1,168 @@
+package confgen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	lb "loadbalancer/go"
+	"loadbalancer/go/changefeed"
+)
+
+const DEFAULT_WATCH_INTERVAL = time.Minute
+
+// Keeps a rendered configuration file current, running Reload after each
+// change. Renders happen every Interval, and as soon as possible after a
+// Trigger, e.g. from the change feed.
+type Watcher struct {
+	Interval time.Duration
+
+	// Run after a changed file has been written. When it fails, it is run
+	// again at the next render even if nothing changed.
+	Reload func(ctx context.Context) error
+
+	source Source
+	render Renderer
+	path string
+	trigger chan struct {}
+	reloadPending bool
+}
+
+// Turns the allocations into the contents of a file
+type Renderer func(allocations []lb.Shop) ([]byte, error)
+
+func NewWatcher(source Source, tmpl *template.Template, path string) *Watcher {
+	return NewRenderWatcher(source, func(allocations []lb.Shop) ([]byte, error) {
+		return renderBytes(tmpl, allocations)
+	}, path)
+}
+
+// A Watcher for files that are not rendered from a template
+func NewRenderWatcher(source Source, render Renderer, path string) *Watcher {
+	return &Watcher {
+		Interval: DEFAULT_WATCH_INTERVAL,
+		source: source,
+		render: render,
+		path: path,
+		trigger: make(chan struct {}, 1),
+	}
+}
+
+// Asks for a render without waiting for it. Triggers that arrive while one
+// is pending are merged into it.
+func (w *Watcher) Trigger() {
+	select {
+	case w.trigger <- struct {} {}:
+	default:
+	}
+}
+
+// For the change feed. Only placement changes trigger a render.
+func (w *Watcher) Handler(ctx context.Context) changefeed.Handler {
+	return func(event changefeed.Event) error {
+		switch event.(type) {
+		case changefeed.StreamRegistered, changefeed.StreamUnregistered, changefeed.StreamMoved:
+			w.Trigger()
+		}
+
+		return nil
+	}
+}
+
+// Renders until ctx is done. Failed renders and reloads are logged and
+// retried at the next interval or trigger.
+func (w *Watcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		_, err := w.Sync(ctx)
+		if err != nil {
+			log.Printf("INFO: Unable to update %v --> %v", w.path, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-w.trigger:
+		}
+	}
+}
+
+// Renders once, writing the file and reloading only if it changed. Not safe
+// to call concurrently with Run.
+func (w *Watcher) Sync(ctx context.Context) (bool, error) {
+	allocations, err := w.source.Allocations(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	rendered, err := w.render(allocations)
+	if err != nil {
+		return false, err
+	}
+
+	current, err := os.ReadFile(w.path)
+	changed := err != nil || !bytes.Equal(current, rendered)
+	if changed {
+		err = writeAtomically(w.path, rendered)
+		if err != nil {
+			return false, err
+		}
+
+		w.reloadPending = true
+	}
+
+	if w.reloadPending && w.Reload != nil {
+		err = w.Reload(ctx)
+		if err != nil {
+			return changed, fmt.Errorf("Reload failed [%v]", err)
+		}
+	}
+
+	w.reloadPending = false
+	return changed, nil
+}
+
+// So the proxy never reads a half written file
+func writeAtomically(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "." + filepath.Base(path) + ".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// A Reload that runs a command, e.g. "systemctl reload haproxy"
+func CommandReload(name string, args ...string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %v %s", name, err, bytes.TrimSpace(output))
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	lb "loadbalancer/go"
+	"loadbalancer/go/address"
+)
+
+// Where a stream is served from
+type Answer struct {
+	Port uint16
+	Addresses address.Addresses
+}
+
+type Lookup interface {
+	// nil, with no error, for a stream that is not registered
+	Lookup(ctx context.Context, stream string) (*Answer, error)
+}
+
+// Reads the shops table, and the instance addresses through the lb address
+// resolver, which is the instanceIp table unless it has been changed.
+type LbLookup struct {}
+
+func (LbLookup) Lookup(ctx context.Context, stream string) (*Answer, error) {
+	shop, status, err := lb.GetShopByStream(stream)
+	if status == 400 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &Answer { Port: shop.Port, Addresses: shop.Addresses }, nil
+}
+
+// How many streams a CachingLookup keeps answers for
+const DEFAULT_CACHE_SIZE = 10000
+
+// Keeps what another lookup returns for ttl, including that a stream is not
+// registered. Errors are not kept. Since anyone can ask about any name, at
+// most MaxEntries streams are kept, the least recently asked about going
+// first, and expired entries are swept once per ttl.
+type CachingLookup struct {
+	MaxEntries int
+
+	lookup Lookup
+	ttl time.Duration
+	now func() time.Time
+	mutex sync.Mutex
+	entries map[string]*list.Element
+	// of cachedAnswers, most recently asked about first
+	recent *list.List
+	lastSweep time.Time
+}
+
+type cachedAnswer struct {
+	stream string
+	answer *Answer
+	expires time.Time
+}
+
+func NewCachingLookup(lookup Lookup, ttl time.Duration) *CachingLookup {
+	return &CachingLookup {
+		MaxEntries: DEFAULT_CACHE_SIZE,
+		lookup: lookup,
+		ttl: ttl,
+		now: time.Now,
+		entries: map[string]*list.Element {},
+		recent: list.New(),
+		lastSweep: time.Now(),
+	}
+}
+
+func (c *CachingLookup) Lookup(ctx context.Context, stream string) (*Answer, error) {
+	c.mutex.Lock()
+	element, present := c.entries[stream]
+	if present {
+		entry := element.Value.(*cachedAnswer)
+		if c.now().Before(entry.expires) {
+			c.recent.MoveToFront(element)
+			c.mutex.Unlock()
+			return entry.answer, nil
+		}
+	}
+
+	c.mutex.Unlock()
+	answer, err := c.lookup.Lookup(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.store(stream, answer)
+	return answer, nil
+}
+
+// Needs the mutex
+func (c *CachingLookup) store(stream string, answer *Answer) {
+	now := c.now()
+	if now.Sub(c.lastSweep) >= c.ttl {
+		c.sweep(now)
+	}
+
+	entry := &cachedAnswer { stream: stream, answer: answer, expires: now.Add(c.ttl) }
+	if element, present := c.entries[stream]; present {
+		element.Value = entry
+		c.recent.MoveToFront(element)
+		return
+	}
+
+	c.entries[stream] = c.recent.PushFront(entry)
+	for c.recent.Len() > c.MaxEntries {
+		c.remove(c.recent.Back())
+	}
+}
+
+// Needs the mutex
+func (c *CachingLookup) sweep(now time.Time) {
+	c.lastSweep = now
+	for element := c.recent.Front(); element != nil; {
+		next := element.Next()
+		if !now.Before(element.Value.(*cachedAnswer).expires) {
+			c.remove(element)
+		}
+
+		element = next
+	}
+}
+
+// Needs the mutex
+func (c *CachingLookup) remove(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*cachedAnswer).stream)
+}
+
+// The number of streams kept
+func (c *CachingLookup) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.recent.Len()
+}
@@ -0,0 +1,368 @@
+// Package dns is an authoritative DNS server for the streams in a zone.
+// "<stream>.<zone>" has A and AAAA records for the public addresses of the
+// instance serving the stream, and an SRV record with the stream's port.
+// Service and protocol labels, as in "_game._tcp.<stream>.<zone>", are
+// accepted for SRV and ignored. Names are case insensitive, and resolvers may
+// change their case, so only streams with lower case names, and no dots, can
+// be resolved.
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const DEFAULT_TTL = 30 * time.Second
+
+// Big enough for any query, and for answers without EDNS
+const MAX_UDP_MESSAGE = 512
+const TCP_IDLE_TIMEOUT = 10 * time.Second
+
+// UDP queries answered at once. Past that, queries wait in the socket buffer
+// and are dropped by the kernel when it fills, and resolvers retry.
+const DEFAULT_UDP_WORKERS = 256
+
+type Server struct {
+	UdpWorkers int
+
+	zone dnsmessage.Name
+	zoneSuffix string
+	ttl time.Duration
+	lookup Lookup
+	serial uint32
+}
+
+// zone is e.g. "streams.example.com". Answers from lookup are cached for
+// ttl, which is also the TTL of the records.
+func New(zone string, ttl time.Duration, lookup Lookup) (*Server, error) {
+	zone = strings.ToLower(strings.TrimSuffix(zone, ".")) + "."
+	name, err := dnsmessage.NewName(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server {
+		UdpWorkers: DEFAULT_UDP_WORKERS,
+		zone: name,
+		zoneSuffix: "." + zone,
+		ttl: ttl,
+		lookup: NewCachingLookup(lookup, ttl),
+		serial: uint32(time.Now().Unix()),
+	}, nil
+}
+
+// Answers UDP queries on conn until ctx is done
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	workers := make(chan struct{}, s.UdpWorkers)
+	buf := make([]byte, MAX_UDP_MESSAGE)
+	for {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		query := append([]byte {}, buf[:n]...)
+		go func() {
+			defer func() { <-workers }()
+			response, err := s.answer(ctx, query, MAX_UDP_MESSAGE)
+			if err != nil {
+				log.Printf("INFO: Unable to answer DNS query from %v --> %v", addr, err)
+				return
+			}
+
+			conn.WriteTo(response, addr)
+		}()
+	}
+}
+
+// Answers TCP queries, which clients fall back to for truncated answers,
+// until ctx is done
+func (s *Server) ServeTCP(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// Messages on a TCP connection are each preceded by their length
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(TCP_IDLE_TIMEOUT))
+		var length [2]byte
+		_, err := io.ReadFull(conn, length[:])
+		if err != nil {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err = io.ReadFull(conn, query)
+		if err != nil {
+			return
+		}
+
+		response, err := s.answer(ctx, query, math.MaxUint16)
+		if err != nil {
+			log.Printf("INFO: Unable to answer DNS query from %v --> %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		binary.BigEndian.PutUint16(length[:], uint16(len(response)))
+		_, err = conn.Write(append(length[:], response...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Serves both UDP and TCP on addr until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.ServeTCP(ctx, listener) }()
+	err = s.Serve(ctx, conn)
+	listener.Close()
+	tcpErr := <-errs
+	if err == nil {
+		err = tcpErr
+	}
+
+	return err
+}
+
+// The response to a query message, as it would be sent over UDP. Only the
+// first question is answered.
+func (s *Server) Answer(ctx context.Context, query []byte) ([]byte, error) {
+	return s.answer(ctx, query, MAX_UDP_MESSAGE)
+}
+
+// Answers bigger than limit are truncated
+func (s *Server) answer(ctx context.Context, query []byte, limit int) ([]byte, error) {
+	b := builder { limit: limit }
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+
+	responseHeader := dnsmessage.Header {
+		ID: header.ID,
+		Response: true,
+		OpCode: header.OpCode,
+		Authoritative: true,
+		RecursionDesired: header.RecursionDesired,
+	}
+
+	question, err := parser.Question()
+	if err != nil {
+		responseHeader.RCode = dnsmessage.RCodeFormatError
+		return b.build(responseHeader, nil, nil, nil, nil)
+	}
+
+	if header.OpCode != 0 {
+		responseHeader.RCode = dnsmessage.RCodeNotImplemented
+		return b.build(responseHeader, &question, nil, nil, nil)
+	}
+
+	stream, inZone := s.streamOf(question.Name)
+	if !inZone {
+		responseHeader.Authoritative = false
+		responseHeader.RCode = dnsmessage.RCodeRefused
+		return b.build(responseHeader, &question, nil, nil, nil)
+	}
+
+	if stream == "" {
+		// the zone apex only has its SOA
+		if question.Type == dnsmessage.TypeSOA {
+			return b.build(responseHeader, &question, []dnsmessage.Resource { s.soa() }, nil, nil)
+		}
+
+		return b.build(responseHeader, &question, nil, []dnsmessage.Resource { s.soa() }, nil)
+	}
+
+	answer, err := s.lookup.Lookup(ctx, stream)
+	if err != nil {
+		log.Printf("INFO: DNS lookup of stream %v failed --> %v", stream, err)
+		responseHeader.RCode = dnsmessage.RCodeServerFailure
+		return b.build(responseHeader, &question, nil, nil, nil)
+	}
+
+	if answer == nil {
+		responseHeader.RCode = dnsmessage.RCodeNameError
+		return b.build(responseHeader, &question, nil, []dnsmessage.Resource { s.soa() }, nil)
+	}
+
+	addressName := question.Name
+	if strings.HasPrefix(question.Name.String(), "_") {
+		addressName, _ = dnsmessage.NewName(stream + s.zoneSuffix)
+	}
+
+	var answers, additionals []dnsmessage.Resource
+	switch question.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		answers = s.addresses(question.Name, answer, question.Type)
+	case dnsmessage.TypeSRV:
+		answers = []dnsmessage.Resource { s.srv(question.Name, addressName, answer.Port) }
+		additionals = append(s.addresses(addressName, answer, dnsmessage.TypeA), s.addresses(addressName, answer, dnsmessage.TypeAAAA)...)
+	case dnsmessage.TypeALL:
+		answers = append(s.addresses(question.Name, answer, dnsmessage.TypeA), s.addresses(question.Name, answer, dnsmessage.TypeAAAA)...)
+		answers = append(answers, s.srv(question.Name, addressName, answer.Port))
+	}
+
+	// no data of the type asked for
+	if len(answers) == 0 {
+		return b.build(responseHeader, &question, nil, []dnsmessage.Resource { s.soa() }, nil)
+	}
+
+	return b.build(responseHeader, &question, answers, nil, additionals)
+}
+
+// The stream a name in the zone is for, with service and protocol labels
+// dropped. Empty for the zone itself.
+func (s *Server) streamOf(name dnsmessage.Name) (string, bool) {
+	lower := strings.ToLower(name.String())
+	if lower == s.zone.String() {
+		return "", true
+	}
+
+	if !strings.HasSuffix(lower, s.zoneSuffix) {
+		return "", false
+	}
+
+	labels := strings.Split(strings.TrimSuffix(lower[:len(lower) - len(s.zoneSuffix)], "."), ".")
+	for len(labels) > 1 && strings.HasPrefix(labels[0], "_") {
+		labels = labels[1:]
+	}
+
+	// streams with dots in their name cannot be told from subdomains
+	if len(labels) != 1 || labels[0] == "" {
+		return "", false
+	}
+
+	return labels[0], true
+}
+
+func (s *Server) recordTtl() uint32 {
+	return uint32(s.ttl / time.Second)
+}
+
+func (s *Server) addresses(name dnsmessage.Name, answer *Answer, recordType dnsmessage.Type) []dnsmessage.Resource {
+	resources := []dnsmessage.Resource {}
+	for _, ip := range answer.Addresses.Public {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			continue
+		}
+
+		header := dnsmessage.ResourceHeader { Name: name, Type: recordType, Class: dnsmessage.ClassINET, TTL: s.recordTtl() }
+		if ipv4 := parsed.To4(); ipv4 != nil && recordType == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], ipv4)
+			resources = append(resources, dnsmessage.Resource { Header: header, Body: &a })
+		} else if ipv4 == nil && recordType == dnsmessage.TypeAAAA {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], parsed.To16())
+			resources = append(resources, dnsmessage.Resource { Header: header, Body: &aaaa })
+		}
+	}
+
+	return resources
+}
+
+func (s *Server) srv(name dnsmessage.Name, target dnsmessage.Name, port uint16) dnsmessage.Resource {
+	return dnsmessage.Resource {
+		Header: dnsmessage.ResourceHeader { Name: name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: s.recordTtl() },
+		Body: &dnsmessage.SRVResource { Priority: 0, Weight: 0, Port: port, Target: target },
+	}
+}
+
+// Negative answers are cached for the TTL too
+func (s *Server) soa() dnsmessage.Resource {
+	ns, _ := dnsmessage.NewName("ns" + s.zoneSuffix)
+	mbox, _ := dnsmessage.NewName("hostmaster" + s.zoneSuffix)
+	return dnsmessage.Resource {
+		Header: dnsmessage.ResourceHeader { Name: s.zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: s.recordTtl() },
+		Body: &dnsmessage.SOAResource {
+			NS: ns,
+			MBox: mbox,
+			Serial: s.serial,
+			Refresh: 3600,
+			Retry: 600,
+			Expire: 86400,
+			MinTTL: s.recordTtl(),
+		},
+	}
+}
+
+type builder struct {
+	limit int
+}
+
+func (b builder) build(header dnsmessage.Header, question *dnsmessage.Question, answers []dnsmessage.Resource, authorities []dnsmessage.Resource, additionals []dnsmessage.Resource) ([]byte, error) {
+	message := dnsmessage.Message {
+		Header: header,
+		Answers: answers,
+		Authorities: authorities,
+		Additionals: additionals,
+	}
+
+	if question != nil {
+		message.Questions = []dnsmessage.Question { *question }
+	}
+
+	response, err := message.Pack()
+	if err != nil || len(response) <= b.limit {
+		return response, err
+	}
+
+	// too big for UDP without EDNS, so the client should retry over TCP
+	message.Header.Truncated = true
+	message.Answers, message.Authorities, message.Additionals = nil, nil, nil
+	return message.Pack()
+}
@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"loadbalancer/go/address"
+)
+
+// A local stand-in for the shops and instanceIp tables
+type testLookup struct {
+	mutex sync.Mutex
+	calls int
+	answers map[string]*Answer
+}
+
+func (l *testLookup) Lookup(ctx context.Context, stream string) (*Answer, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.calls++
+	return l.answers[stream], nil
+}
+
+func testServer(t *testing.T) (*Server, *testLookup) {
+	lookup := &testLookup {
+		answers: map[string]*Answer {
+			"stream0": &Answer {
+				Port: 11000,
+				Addresses: address.Addresses {
+					Public: []string { "203.0.113.1", "2001:db8::1" },
+					Private: []string { "10.0.0.1" },
+				},
+			},
+		},
+	}
+
+	server, err := New("streams.example.com", time.Minute, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, lookup
+}
+
+func query(t *testing.T, name string, recordType dnsmessage.Type) []byte {
+	message := dnsmessage.Message {
+		Header: dnsmessage.Header { ID: 7, RecursionDesired: true },
+		Questions: []dnsmessage.Question {
+			dnsmessage.Question { Name: dnsmessage.MustNewName(name), Type: recordType, Class: dnsmessage.ClassINET },
+		},
+	}
+
+	packed, err := message.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return packed
+}
+
+func ask(t *testing.T, server *Server, name string, recordType dnsmessage.Type) dnsmessage.Message {
+	response, err := server.Answer(context.TODO(), query(t, name, recordType))
+	if err != nil {
+		t.Fatalf("Query for %v should have been answered ---> %v", name, err)
+	}
+
+	var message dnsmessage.Message
+	err = message.Unpack(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return message
+}
+
+func TestAnswers(t *testing.T) {
+	server, lookup := testServer(t)
+	message := ask(t, server, "stream0.streams.example.com.", dnsmessage.TypeA)
+	if message.RCode != dnsmessage.RCodeSuccess || !message.Authoritative || len(message.Answers) != 1 {
+		t.Fatalf("Unexpected A response %v", message)
+	}
+
+	a := message.Answers[0].Body.(*dnsmessage.AResource)
+	if net.IP(a.A[:]).String() != "203.0.113.1" || message.Answers[0].Header.TTL != 60 {
+		t.Fatalf("Unexpected A record %v", message.Answers[0])
+	}
+
+	message = ask(t, server, "STREAM0.Streams.Example.Com.", dnsmessage.TypeAAAA)
+	if len(message.Answers) != 1 {
+		t.Fatalf("Unexpected AAAA response %v", message)
+	}
+
+	aaaa := message.Answers[0].Body.(*dnsmessage.AAAAResource)
+	if net.IP(aaaa.AAAA[:]).String() != "2001:db8::1" {
+		t.Fatalf("Unexpected AAAA record %v", message.Answers[0])
+	}
+
+	message = ask(t, server, "_game._tcp.stream0.streams.example.com.", dnsmessage.TypeSRV)
+	if len(message.Answers) != 1 || len(message.Additionals) != 2 {
+		t.Fatalf("Unexpected SRV response %v", message)
+	}
+
+	srv := message.Answers[0].Body.(*dnsmessage.SRVResource)
+	if srv.Port != 11000 || srv.Target.String() != "stream0.streams.example.com." {
+		t.Fatalf("Unexpected SRV record %v", srv)
+	}
+
+	message = ask(t, server, "stream9.streams.example.com.", dnsmessage.TypeA)
+	if message.RCode != dnsmessage.RCodeNameError || len(message.Authorities) != 1 {
+		t.Fatalf("An unknown stream should be NXDOMAIN with an SOA, not %v", message)
+	}
+
+	message = ask(t, server, "stream0.example.org.", dnsmessage.TypeA)
+	if message.RCode != dnsmessage.RCodeRefused {
+		t.Fatalf("A name outside the zone should be refused, not %v", message)
+	}
+
+	// stream0 has been looked up once for three queries, and stream9 once
+	if lookup.calls != 2 {
+		t.Fatalf("%d lookups were made rather than 2", lookup.calls)
+	}
+
+	fmt.Println("SUCCESS: TestAnswers")
+}
+
+func TestServeUdpAndTcp(t *testing.T) {
+	server, _ := testServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(ctx, conn)
+	go server.ServeTCP(ctx, listener)
+
+	// Go's own resolver, pointed at the server, over UDP and then TCP
+	for _, network := range []string { "udp", "tcp" } {
+		addr := conn.LocalAddr().String()
+		if network == "tcp" {
+			addr = listener.Addr().String()
+		}
+
+		resolver := net.Resolver {
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}
+
+		_, srvs, err := resolver.LookupSRV(ctx, "game", "tcp", "stream0.streams.example.com")
+		if err != nil || len(srvs) != 1 || srvs[0].Port != 11000 {
+			t.Fatalf("SRV lookup over %v returned %v ---> %v", network, srvs, err)
+		}
+
+		ips, err := resolver.LookupHost(ctx, "stream0.streams.example.com")
+		if err != nil || len(ips) != 2 {
+			t.Fatalf("Host lookup over %v returned %v ---> %v", network, ips, err)
+		}
+	}
+
+	fmt.Println("SUCCESS: TestServeUdpAndTcp")
+}
+
+func TestCachingLookupIsBounded(t *testing.T) {
+	lookup := &testLookup { answers: map[string]*Answer { "stream0": &Answer { Port: 11000 } } }
+	now := time.Now()
+	cache := NewCachingLookup(lookup, time.Minute)
+	cache.MaxEntries = 3
+	cache.now = func() time.Time { return now }
+	for _, stream := range []string { "stream0", "unknown1", "stream0", "unknown2", "unknown3" } {
+		_, err := cache.Lookup(context.TODO(), stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// stream0 was asked about more recently than unknown1, which went first
+	if cache.Len() != 3 || lookup.calls != 4 {
+		t.Fatalf("%d streams are kept after %d lookups, rather than 3 after 4", cache.Len(), lookup.calls)
+	}
+
+	cache.Lookup(context.TODO(), "stream0")
+	if lookup.calls != 4 {
+		t.Fatal("stream0 should still have been kept")
+	}
+
+	now = now.Add(2 * time.Minute)
+	cache.Lookup(context.TODO(), "stream0")
+	if cache.Len() != 1 {
+		t.Fatalf("Expired streams should have been swept, %d are kept", cache.Len())
+	}
+
+	fmt.Println("SUCCESS: TestCachingLookupIsBounded")
+}
@@ -0,0 +1,300 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"loadbalancer/go/tables"
+)
+
+type Verdict string
+
+const (
+	VerdictAvailable Verdict = "available"
+	VerdictPortInUse Verdict = "already using port"
+	VerdictAtCapacity Verdict = "at capacity"
+	VerdictVersionChanged Verdict = "version changed"
+	VerdictMissingIp Verdict = "missing addresses"
+	VerdictCordoned Verdict = "cordoned"
+	VerdictUnhealthy Verdict = "unhealthy"
+	VerdictOverQuota Verdict = "over quota"
+)
+
+// Candidate is set for the instances Register would try to place on. That
+// includes VerdictVersionChanged ones, which were found through a stale
+// Streams GSI entry but still have room, and whose transaction is likely to
+// race another registration.
+type InstanceVerdict struct {
+	Instance string
+	Streams uint8
+	Verdict Verdict
+	Candidate bool
+	Detail string
+}
+
+// What Register would do with the same arguments. Status and Reason are
+// what Register would return, and Instance is where it would place the
+// stream, if anywhere.
+type Explanation struct {
+	ShopId string
+	Stream string
+	Port uint16
+	Status int
+	Reason string
+	Instance string
+	Instances []InstanceVerdict
+}
+
+// Runs the Register candidate search without writing anything. Instances
+// the search never reaches, because they are full, are listed too.
+func Explain(shopId string, stream string, port uint16) (*Explanation, int, error) {
+	return Default.Explain(shopId, stream, port)
+}
+
+func (a *Allocator) Explain(shopId string, stream string, port uint16) (*Explanation, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	explanation := Explanation {
+		ShopId: shopId,
+		Stream: stream,
+		Port: port,
+		Instances: []InstanceVerdict {},
+	}
+
+	shop, err := tables.ConsistentGetShop(ctx, ddb, shopId, stream)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	if shop != nil && shop.Port == port {
+		explanation.Status, explanation.Reason, explanation.Instance = 200, "Already registered", shop.Instance
+		return &explanation, 200, nil
+	} else if shop != nil {
+		explanation.Status, explanation.Reason = 400, fmt.Sprintf("Stream %v in use", stream)
+		return &explanation, 200, nil
+	}
+
+	gov, err := loadGovernance(ctx, ddb, shopId)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	if gov == nil {
+		guard, err := loadStreamsGuard(ctx, ddb, shopId)
+		if err != nil {
+			return nil, 500, err
+		}
+
+		err = guard.check(1)
+		if err != nil {
+			explanation.Status, explanation.Reason = 400, err.Error()
+			return &explanation, 200, nil
+		}
+	} else if err = gov.checkStream(port); err != nil {
+		explanation.Status, explanation.Reason = 400, err.Error()
+		return &explanation, 200, nil
+	}
+
+	streamExists, err := tables.TestStreamPresence(ctx, ddb, stream)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	if streamExists {
+		explanation.Status, explanation.Reason = 400, fmt.Sprintf("Stream %v in use", stream)
+		return &explanation, 200, nil
+	}
+
+	instanceNamesUsingPort, err := tables.QueryInstancesUsingPort(ctx, ddb, port)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	instancesSetUsingPort := map[string]interface{} {}
+	for _, i := range *instanceNamesUsingPort {
+		instancesSetUsingPort[i.Instance] = nil
+	}
+
+	if len(*instanceNamesUsingPort) >= int(MAX_INSTANCES) {
+		explanation.Status, explanation.Reason = 400, fmt.Sprintf("Port %d in use", port)
+	}
+
+	var refused error
+	seen := map[string]interface{} {}
+	var streams uint8
+	for streams = 0; streams < MAX_INSTANCES; streams++ {
+		instanceNameRecords, err := tables.QueryInstancesWithStreams(ctx, ddb, a.loadIndex, streams)
+		if err != nil {
+			return nil, 500, err
+		}
+
+		for _, record := range *instanceNameRecords {
+			if _, present := seen[record.Instance]; present {
+				continue
+			}
+
+			seen[record.Instance] = nil
+			verdict, err := a.judgeInstance(ctx, ddb, record.Instance, streams, instancesSetUsingPort)
+			if err != nil {
+				return nil, 500, err
+			}
+
+			if verdict.Candidate {
+				_, err = gov.admit("", port, record.Instance)
+				if isQuotaError(err) {
+					refused = err
+					verdict.Candidate, verdict.Verdict, verdict.Detail = false, VerdictOverQuota, err.Error()
+				} else if err != nil {
+					return nil, 500, err
+				}
+			}
+
+			explanation.Instances = append(explanation.Instances, verdict.InstanceVerdict)
+			if verdict.Candidate && explanation.Status == 0 {
+				explanation.Status, explanation.Reason, explanation.Instance = 200, "Would be placed", record.Instance
+			}
+		}
+	}
+
+	instanceRecords, err := tables.ScanInstances(ctx, ddb)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	for _, record := range *instanceRecords {
+		if _, present := seen[record.Instance]; !present {
+			explanation.Instances = append(explanation.Instances, InstanceVerdict {
+				Instance: record.Instance,
+				Streams: record.Streams,
+				Verdict: VerdictAtCapacity,
+				Detail: "not among the instances with room in the Streams GSI",
+			})
+		}
+	}
+
+	sort.SliceStable(explanation.Instances, func(i, j int) bool {
+		return explanation.Instances[i].Instance < explanation.Instances[j].Instance
+	})
+
+	if explanation.Status == 0 && refused != nil {
+		explanation.Status, explanation.Reason = 400, refused.Error()
+	} else if explanation.Status == 0 {
+		explanation.Status, explanation.Reason = 503, fmt.Sprintf("Unable to allocate for %v, %v and %d", shopId, stream, port)
+	}
+
+	return &explanation, 200, nil
+}
+
+// Takes an instance out of the candidates for new streams, leaving the
+// streams it already has where they are. The status is 400 if the instance
+// does not exist.
+func Cordon(instance string) (int, error) {
+	return Default.Cordon(instance)
+}
+
+func (a *Allocator) Cordon(instance string) (int, error) {
+	return a.setCordoned(instance, true)
+}
+
+func Uncordon(instance string) (int, error) {
+	return Default.Uncordon(instance)
+}
+
+func (a *Allocator) Uncordon(instance string) (int, error) {
+	return a.setCordoned(instance, false)
+}
+
+func (a *Allocator) setCordoned(instance string, cordoned bool) (int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 500, err
+	}
+
+	present, err := tables.SetInstanceCordoned(ctx, ddb, instance, cordoned)
+	if err != nil {
+		return 500, err
+	}
+
+	if !present {
+		return 400, fmt.Errorf("Instance %s does not exist", instance)
+	}
+
+	a.InvalidateInstance(instance)
+	return 200, nil
+}
+
+type judgement struct {
+	InstanceVerdict
+	record *tables.InstanceType
+	publicIp string
+	privateIp string
+}
+
+// The checks Register makes on an instance found in the Streams GSI bucket
+// indexedStreams, before attempting its transaction.
+func (a *Allocator) judgeInstance(ctx context.Context, ddb tables.DynamoDBAPI, instance string, indexedStreams uint8, instancesSetUsingPort map[string]interface{}) (*judgement, error) {
+	j := judgement {
+		InstanceVerdict: InstanceVerdict {
+			Instance: instance,
+			Streams: indexedStreams,
+		},
+	}
+
+	if _, present := instancesSetUsingPort[instance]; present {
+		j.Verdict = VerdictPortInUse
+		return &j, nil
+	}
+
+	instanceRecord, err := tables.ConsistentGetInstance(ctx, ddb, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	j.record = instanceRecord
+	j.Streams = instanceRecord.Streams
+	a.observeInstance(instanceRecord, instanceRecord.Streams)
+	if instanceRecord.Streams != indexedStreams {
+		a.stale.instanceCounts.Add(1)
+	}
+
+	if instanceRecord.Cordoned {
+		j.Verdict = VerdictCordoned
+		return &j, nil
+	}
+
+	if instanceRecord.Unhealthy {
+		j.Verdict = VerdictUnhealthy
+		j.Detail = instanceRecord.HealthDetail
+		return &j, nil
+	}
+
+	if instanceRecord.Streams >= capacityOf(instanceRecord) {
+		j.Verdict = VerdictAtCapacity
+		j.Detail = fmt.Sprintf("%d streams of %d, Streams GSI said %d", instanceRecord.Streams, capacityOf(instanceRecord), indexedStreams)
+		return &j, nil
+	}
+
+	addresses, err := a.resolveAddresses(ctx, ddb, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	if addresses == nil {
+		j.Verdict = VerdictMissingIp
+		return &j, nil
+	}
+
+	j.publicIp, j.privateIp = addresses.PublicIp(), addresses.PrivateIp()
+	j.Candidate = true
+	j.Verdict = VerdictAvailable
+	if instanceRecord.Streams != indexedStreams {
+		j.Verdict = VerdictVersionChanged
+		j.Detail = fmt.Sprintf("%d streams, Streams GSI said %d", instanceRecord.Streams, indexedStreams)
+	}
+
+	return &j, nil
+}
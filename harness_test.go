@@ -0,0 +1,71 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"loadbalancer/go/tables"
+	"loadbalancer/go/test_setup"
+)
+
+// A test's own tables, with an allocator over them. Every test gets one, so
+// they can run in parallel against the same DynamoDB Local. The tables are
+// checked after every transaction that commits on them, by any allocator the
+// test makes over ddb.
+type harness struct {
+	t *testing.T
+	ctx context.Context
+	ddb tables.DynamoDBAPI
+	a *Allocator
+	unchecked tables.DynamoDBAPI
+	// held shared by transactions, and alone by checks, so that the tables
+	// are not read in the middle of a parallel operation's transaction
+	gate sync.RWMutex
+}
+
+func newHarness(t *testing.T, fleet []test_setup.Instance) *harness {
+	t.Parallel()
+	ctx, ddb := test_setup.Namespace(t, fleet)
+	h := &harness { t: t, ctx: ctx, unchecked: ddb }
+	h.ddb = &checkedDDB { DynamoDBAPI: ddb, h: h }
+	h.a = NewAllocator(h.ddb)
+	return h
+}
+
+// Fails the test if the tables have become inconsistent
+func (h *harness) check() {
+	h.t.Helper()
+	h.gate.Lock()
+	defer h.gate.Unlock()
+	test_setup.AssertInvariants(h.t, h.ctx, h.unchecked, test_setup.Limits { MaxInstances: MAX_INSTANCES, MaxShopStreams: MAX_SHOP_STREAMS })
+}
+
+// Every operation that changes more than one record does so in a
+// transaction, so the tables are consistent after each one that commits.
+type checkedDDB struct {
+	tables.DynamoDBAPI
+	h *harness
+}
+
+func (c *checkedDDB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	c.h.gate.RLock()
+	output, err := c.DynamoDBAPI.TransactWriteItems(ctx, params, optFns...)
+	c.h.gate.RUnlock()
+	if err == nil {
+		c.h.check()
+	}
+
+	return output, err
+}
+
+// Registers what a test needs in place before it starts
+func (h *harness) register(shopId string, stream string, port uint16) {
+	h.t.Helper()
+	_, _, status, err := h.a.Register(shopId, stream, port)
+	if err != nil {
+		h.t.Fatalf(fmt.Sprintf("(%d) Register of %v, %v, %d should have succeeded ---> %v", status, shopId, stream, port, err))
+	}
+}
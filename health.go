@@ -0,0 +1,103 @@
+package lb
+
+import (
+	"fmt"
+	"time"
+
+	"loadbalancer/go/tables"
+)
+
+// Records the outcome of a health check of an instance. Unhealthy instances
+// keep their streams, as cordoned ones do, but get no new ones until they
+// are reported healthy again. The status is 400 if the instance does not
+// exist.
+func ReportHealth(instance string, healthy bool, detail string) (int, error) {
+	return Default.ReportHealth(instance, healthy, detail)
+}
+
+func (a *Allocator) ReportHealth(instance string, healthy bool, detail string) (int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 500, err
+	}
+
+	present, err := tables.SetInstanceHealth(ctx, ddb, instance, healthy, detail, time.Now().Unix())
+	if err != nil {
+		return 500, err
+	}
+
+	if !present {
+		return 400, fmt.Errorf("Instance %s does not exist", instance)
+	}
+
+	return 200, nil
+}
+
+// Records that the agent on an instance is alive. Heartbeats only mark the
+// instance unhealthy through a health checker that finds them missing.
+func Heartbeat(instance string) (int, error) {
+	return Default.Heartbeat(instance)
+}
+
+func (a *Allocator) Heartbeat(instance string) (int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 500, err
+	}
+
+	present, err := tables.SetInstanceHeartbeat(ctx, ddb, instance, time.Now().Unix())
+	if err != nil {
+		return 500, err
+	}
+
+	if !present {
+		return 400, fmt.Errorf("Instance %s does not exist", instance)
+	}
+
+	return 200, nil
+}
+
+// Moves a stream to the first other instance Register would pick, keeping
+// its name and port, for instance to evacuate an unhealthy instance. Returns
+// the IPs of the new instance, with the status codes of Update.
+func Move(shopId string, stream string) (string, string, int, error) {
+	return Default.Move(shopId, stream)
+}
+
+func (a *Allocator) Move(shopId string, stream string) (string, string, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	shop, err := tables.ConsistentGetShop(ctx, ddb, shopId, stream)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	if shop == nil {
+		return "", "", 400, fmt.Errorf("Stream %s of shop %s does not exist", stream, shopId)
+	}
+
+	fromRecord, err := tables.ConsistentGetInstance(ctx, ddb, shop.Instance)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	instanceNamesUsingPort, err := tables.QueryInstancesUsingPort(ctx, ddb, shop.Port)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	instancesSetUsingPort := map[string]interface{} {}
+	for _, i := range *instanceNamesUsingPort {
+		instancesSetUsingPort[i.Instance] = nil
+	}
+
+	gov, err := loadGovernance(ctx, ddb, shopId)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	return a.relocate(ctx, ddb, gov, shop, shop.Stream, shop.Port, fromRecord, instancesSetUsingPort)
+}
@@ -0,0 +1,42 @@
+package health
+
+import (
+	"context"
+
+	lb "loadbalancer/go"
+)
+
+// What the monitor reads and writes instances through
+type Backend interface {
+	Instances(ctx context.Context) ([]lb.Instance, error)
+	ReportHealth(ctx context.Context, instance string, healthy bool, detail string) error
+
+	// The streams placed on instance
+	Streams(ctx context.Context, instance string) ([]lb.Shop, error)
+
+	// Moves a stream to another instance, keeping its name and port
+	Move(ctx context.Context, shopId string, stream string) error
+}
+
+// Goes through the lb APIs
+type LbBackend struct {}
+
+func (LbBackend) Instances(ctx context.Context) ([]lb.Instance, error) {
+	instances, _, err := lb.ListInstances()
+	return instances, err
+}
+
+func (LbBackend) ReportHealth(ctx context.Context, instance string, healthy bool, detail string) error {
+	_, err := lb.ReportHealth(instance, healthy, detail)
+	return err
+}
+
+func (LbBackend) Streams(ctx context.Context, instance string) ([]lb.Shop, error) {
+	shops, _, err := lb.ListShopsOnInstance(instance)
+	return shops, err
+}
+
+func (LbBackend) Move(ctx context.Context, shopId string, stream string) error {
+	_, _, _, err := lb.Move(shopId, stream)
+	return err
+}
@@ -0,0 +1,127 @@
+// Package health probes instances and records the outcome on the instance
+// records, so that Register stops placing streams on instances that are
+// down, and optionally moves their streams away once they have been down
+// for a grace period.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	lb "loadbalancer/go"
+)
+
+const DEFAULT_CHECK_TIMEOUT = 5 * time.Second
+
+// Returns nil when the instance is healthy, and why it is not otherwise
+type Checker interface {
+	Check(ctx context.Context, instance lb.Instance) error
+}
+
+// Healthy when a TCP connection to Port on the instance's private address
+// can be opened
+type TCPChecker struct {
+	Port uint16
+	Timeout time.Duration
+}
+
+func (c TCPChecker) Check(ctx context.Context, instance lb.Instance) error {
+	target, err := privateTarget(instance, c.Port)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer { Timeout: timeoutOrDefault(c.Timeout) }
+	connection, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+
+	return connection.Close()
+}
+
+// Healthy when a GET of Path on Port of the instance's private address
+// returns a 2xx status
+type HTTPChecker struct {
+	Port uint16
+	Path string
+	Timeout time.Duration
+
+	// http.DefaultClient when nil
+	Client *http.Client
+}
+
+func (c HTTPChecker) Check(ctx context.Context, instance lb.Instance) error {
+	target, err := privateTarget(instance, c.Port)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeoutOrDefault(c.Timeout))
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://" + target + c.Path, nil)
+	if err != nil {
+		return err
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%v returned %d", request.URL, response.StatusCode)
+	}
+
+	return nil
+}
+
+// Healthy when the instance's agent has sent a heartbeat, see lb.Heartbeat,
+// within MaxAge
+type HeartbeatChecker struct {
+	MaxAge time.Duration
+	now func() time.Time
+}
+
+func NewHeartbeatChecker(maxAge time.Duration) *HeartbeatChecker {
+	return &HeartbeatChecker { MaxAge: maxAge, now: time.Now }
+}
+
+func (c *HeartbeatChecker) Check(ctx context.Context, instance lb.Instance) error {
+	if instance.Heartbeat.IsZero() {
+		return fmt.Errorf("No heartbeat")
+	}
+
+	age := c.now().Sub(instance.Heartbeat)
+	if age > c.MaxAge {
+		return fmt.Errorf("Last heartbeat %v ago", age.Round(time.Second))
+	}
+
+	return nil
+}
+
+func privateTarget(instance lb.Instance, port uint16) (string, error) {
+	if instance.PrivateIp == "" {
+		return "", fmt.Errorf("No private address")
+	}
+
+	return net.JoinHostPort(instance.PrivateIp, strconv.Itoa(int(port))), nil
+}
+
+func timeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DEFAULT_CHECK_TIMEOUT
+	}
+
+	return timeout
+}
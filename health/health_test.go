@@ -0,0 +1,212 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	lb "loadbalancer/go"
+)
+
+type fakeBackend struct {
+	mutex sync.Mutex
+	instances map[string]*lb.Instance
+	streams map[string][]lb.Shop
+	moved []string
+}
+
+func (b *fakeBackend) Instances(ctx context.Context) ([]lb.Instance, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	instances := []lb.Instance {}
+	for _, instance := range b.instances {
+		instances = append(instances, *instance)
+	}
+
+	return instances, nil
+}
+
+func (b *fakeBackend) ReportHealth(ctx context.Context, instance string, healthy bool, detail string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	record := b.instances[instance]
+	if !healthy && record.Healthy {
+		record.UnhealthySince = time.Unix(1000, 0)
+	} else if healthy {
+		record.UnhealthySince = time.Time {}
+	}
+
+	record.Healthy, record.HealthDetail = healthy, detail
+	return nil
+}
+
+func (b *fakeBackend) Streams(ctx context.Context, instance string) ([]lb.Shop, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.streams[instance], nil
+}
+
+func (b *fakeBackend) Move(ctx context.Context, shopId string, stream string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.moved = append(b.moved, stream)
+	return nil
+}
+
+// Fails for the instances in down
+type fakeChecker struct {
+	mutex sync.Mutex
+	down map[string]bool
+}
+
+func (c *fakeChecker) Check(ctx context.Context, instance lb.Instance) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.down[instance.Instance] {
+		return fmt.Errorf("down")
+	}
+
+	return nil
+}
+
+func (c *fakeChecker) set(instance string, down bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.down[instance] = down
+}
+
+func TestMonitorThresholds(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeBackend {
+		instances: map[string]*lb.Instance {
+			"i-1": &lb.Instance { Instance: "i-1", Healthy: true },
+			"i-2": &lb.Instance { Instance: "i-2", Healthy: true },
+		},
+	}
+
+	checker := &fakeChecker { down: map[string]bool { "i-1": true } }
+	monitor := New(backend, checker)
+	monitor.FailureThreshold, monitor.RecoveryThreshold = 2, 2
+	for i := 0; i < 2; i++ {
+		if !backend.instances["i-1"].Healthy {
+			t.Fatalf("i-1 should stay healthy before %d failed checks", monitor.FailureThreshold)
+		}
+
+		err := monitor.Probe(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if backend.instances["i-1"].Healthy || backend.instances["i-1"].HealthDetail != "down" || !backend.instances["i-2"].Healthy {
+		t.Fatalf("Only i-1 should be unhealthy: %v %v", *backend.instances["i-1"], *backend.instances["i-2"])
+	}
+
+	// a success in between starts the count again
+	checker.set("i-1", false)
+	monitor.Probe(ctx)
+	checker.set("i-1", true)
+	monitor.Probe(ctx)
+	checker.set("i-1", false)
+	monitor.Probe(ctx)
+	if backend.instances["i-1"].Healthy {
+		t.Fatal("i-1 should not recover without successes in a row")
+	}
+
+	monitor.Probe(ctx)
+	if !backend.instances["i-1"].Healthy || backend.instances["i-1"].HealthDetail != "" {
+		t.Fatalf("i-1 should have recovered: %v", *backend.instances["i-1"])
+	}
+
+	fmt.Println("SUCCESS: TestMonitorThresholds")
+}
+
+func TestMonitorEvacuation(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeBackend {
+		instances: map[string]*lb.Instance {
+			"i-1": &lb.Instance { Instance: "i-1", Healthy: true },
+		},
+		streams: map[string][]lb.Shop {
+			"i-1": []lb.Shop { lb.Shop { ShopId: "shop0", Stream: "stream0", Instance: "i-1" } },
+		},
+	}
+
+	monitor := New(backend, &fakeChecker { down: map[string]bool { "i-1": true } })
+	monitor.FailureThreshold = 1
+	monitor.Evacuate = true
+	monitor.GracePeriod = time.Minute
+	monitor.now = func() time.Time { return time.Unix(1000, 0).Add(30 * time.Second) }
+	monitor.Probe(ctx)
+	monitor.Probe(ctx)
+	if len(backend.moved) != 0 {
+		t.Fatalf("Nothing should move within the grace period: %v", backend.moved)
+	}
+
+	monitor.now = func() time.Time { return time.Unix(1000, 0).Add(time.Minute) }
+	monitor.Probe(ctx)
+	if len(backend.moved) != 1 || backend.moved[0] != "stream0" {
+		t.Fatalf("stream0 should have been moved: %v", backend.moved)
+	}
+
+	fmt.Println("SUCCESS: TestMonitorEvacuation")
+}
+
+func TestCheckers(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcpPort := uint16(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	_, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	httpPort, _ := strconv.Atoi(portStr)
+	instance := lb.Instance { Instance: "i-1", PrivateIp: "127.0.0.1" }
+	if (TCPChecker { Port: uint16(httpPort) }).Check(ctx, instance) != nil {
+		t.Fatal("The TCP check of a listening port should pass")
+	}
+
+	if (TCPChecker { Port: tcpPort, Timeout: time.Second }).Check(ctx, instance) == nil {
+		t.Fatal("The TCP check of a closed port should fail")
+	}
+
+	if (HTTPChecker { Port: uint16(httpPort), Path: "/healthz" }).Check(ctx, instance) != nil {
+		t.Fatal("The HTTP check of /healthz should pass")
+	}
+
+	if (HTTPChecker { Port: uint16(httpPort), Path: "/other" }).Check(ctx, instance) == nil {
+		t.Fatal("The HTTP check should fail on a 503")
+	}
+
+	if (TCPChecker { Port: tcpPort }).Check(ctx, lb.Instance { Instance: "i-2" }) == nil {
+		t.Fatal("An instance without addresses cannot be healthy")
+	}
+
+	heartbeat := NewHeartbeatChecker(time.Minute)
+	heartbeat.now = func() time.Time { return time.Unix(1000, 0) }
+	if heartbeat.Check(ctx, lb.Instance { Heartbeat: time.Unix(950, 0) }) != nil {
+		t.Fatal("A recent heartbeat should pass")
+	}
+
+	if heartbeat.Check(ctx, lb.Instance { Heartbeat: time.Unix(900, 0) }) == nil || heartbeat.Check(ctx, lb.Instance {}) == nil {
+		t.Fatal("Old and missing heartbeats should fail")
+	}
+
+	fmt.Println("SUCCESS: TestCheckers")
+}
@@ -0,0 +1,174 @@
+package health
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const DEFAULT_CHECK_INTERVAL = 10 * time.Second
+const DEFAULT_FAILURE_THRESHOLD = 3
+const DEFAULT_RECOVERY_THRESHOLD = 2
+const DEFAULT_GRACE_PERIOD = 5 * time.Minute
+
+// Checks every instance each Interval. An instance is reported unhealthy
+// after FailureThreshold checks in a row fail, and healthy again after
+// RecoveryThreshold in a row succeed, so a single lost probe does not take
+// it out of placement. The health last recorded is read back from the
+// instances, so a restarted monitor carries on where it was.
+type Monitor struct {
+	Interval time.Duration
+	FailureThreshold int
+	RecoveryThreshold int
+
+	// With Evacuate, the streams of an instance that has been unhealthy for
+	// GracePeriod are moved to other instances, one by one. Streams that
+	// cannot be moved, e.g. for lack of room, are tried again at the next
+	// interval.
+	Evacuate bool
+	GracePeriod time.Duration
+
+	backend Backend
+	checker Checker
+	now func() time.Time
+	mutex sync.Mutex
+	failures map[string]int
+	successes map[string]int
+}
+
+func New(backend Backend, checker Checker) *Monitor {
+	return &Monitor {
+		Interval: DEFAULT_CHECK_INTERVAL,
+		FailureThreshold: DEFAULT_FAILURE_THRESHOLD,
+		RecoveryThreshold: DEFAULT_RECOVERY_THRESHOLD,
+		GracePeriod: DEFAULT_GRACE_PERIOD,
+		backend: backend,
+		checker: checker,
+		now: time.Now,
+		failures: map[string]int {},
+		successes: map[string]int {},
+	}
+}
+
+// Checks until ctx is done. Failed rounds are logged and the next one goes
+// ahead as usual.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for {
+		err := m.Probe(ctx)
+		if err != nil {
+			log.Printf("INFO: Health check round failed --> %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checks every instance once, in parallel, then evacuates if enabled.
+// Errors recording health or moving streams are logged rather than
+// returned, so one instance cannot hold up the others.
+func (m *Monitor) Probe(ctx context.Context) error {
+	instances, err := m.backend.Instances(ctx)
+	if err != nil {
+		return err
+	}
+
+	present := map[string]bool {}
+	var wg sync.WaitGroup
+	for i := range instances {
+		instance := instances[i]
+		present[instance.Instance] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkErr := m.checker.Check(ctx, instance)
+			healthy, changed := m.record(instance.Instance, instance.Healthy, checkErr)
+			if !changed {
+				return
+			}
+
+			detail := ""
+			if checkErr != nil {
+				detail = checkErr.Error()
+			}
+
+			log.Printf("INFO: Instance %v is now healthy=%v %v", instance.Instance, healthy, detail)
+			err := m.backend.ReportHealth(ctx, instance.Instance, healthy, detail)
+			if err != nil {
+				log.Printf("INFO: Unable to record health of %v --> %v", instance.Instance, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	m.forget(present)
+	if !m.Evacuate {
+		return nil
+	}
+
+	for _, instance := range instances {
+		if instance.Healthy || instance.UnhealthySince.IsZero() || m.now().Sub(instance.UnhealthySince) < m.GracePeriod {
+			continue
+		}
+
+		m.evacuate(ctx, instance.Instance)
+	}
+
+	return nil
+}
+
+// Counts the outcome of a check and returns the health to record, if it
+// differs from what is recorded.
+func (m *Monitor) record(instance string, recorded bool, checkErr error) (bool, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if checkErr == nil {
+		m.failures[instance] = 0
+		m.successes[instance]++
+		return true, !recorded && m.successes[instance] >= m.RecoveryThreshold
+	}
+
+	m.successes[instance] = 0
+	m.failures[instance]++
+	return false, recorded && m.failures[instance] >= m.FailureThreshold
+}
+
+// Drops the counts of instances that are gone
+func (m *Monitor) forget(present map[string]bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for instance := range m.failures {
+		if !present[instance] {
+			delete(m.failures, instance)
+		}
+	}
+
+	for instance := range m.successes {
+		if !present[instance] {
+			delete(m.successes, instance)
+		}
+	}
+}
+
+func (m *Monitor) evacuate(ctx context.Context, instance string) {
+	shops, err := m.backend.Streams(ctx, instance)
+	if err != nil {
+		log.Printf("INFO: Unable to list the streams of %v --> %v", instance, err)
+		return
+	}
+
+	for _, shop := range shops {
+		err = m.backend.Move(ctx, shop.ShopId, shop.Stream)
+		if err != nil {
+			log.Printf("INFO: Unable to move %v of %v off %v --> %v", shop.Stream, shop.ShopId, instance, err)
+		} else {
+			log.Printf("INFO: Moved %v of %v off unhealthy %v", shop.Stream, shop.ShopId, instance)
+		}
+	}
+}
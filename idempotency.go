@@ -0,0 +1,203 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+
+	"loadbalancer/go/tables"
+)
+
+// How long the outcome of a request made with an idempotency key is kept,
+// and returned to retries of it
+const IDEMPOTENCY_WINDOW = 24 * time.Hour
+
+// Outcomes expire at the end of IDEMPOTENCY_WINDOW after the bucket of this
+// width their request started in, so that attempts started in the same bucket
+// write the same items and can share a transaction token. It is as long as
+// DynamoDB remembers a token for.
+const IDEMPOTENCY_BUCKET = 10 * time.Minute
+
+const (
+	operationRegister = "register"
+	operationUnregister = "unregister"
+)
+
+// Register, for a caller that may retry it. The outcome of the first request
+// that places the stream is written under key in the same transaction, and
+// every retry with the same key within IDEMPOTENCY_WINDOW returns it, rather
+// than e.g. a 400 for a stream its own earlier attempt took. Reusing a key
+// for a different request is a 400.
+func RegisterWithKey(key string, shopId string, stream string, port uint16) (string, string, int, error) {
+	return Default.RegisterWithKey(key, shopId, stream, port)
+}
+
+func (a *Allocator) RegisterWithKey(key string, shopId string, stream string, port uint16) (string, string, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	idem := newIdempotency(tables.IdempotencyKeyType {
+		Key: key,
+		Operation: operationRegister,
+		ShopId: shopId,
+		Stream: stream,
+		Port: port,
+	})
+
+	record, err := idem.recorded(ctx, ddb)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	if record != nil {
+		return a.replayRegister(ctx, ddb, idem, record)
+	}
+
+	publicIp, privateIp, status, err := a.register(ctx, ddb, shopId, stream, port, idem)
+	if status != 200 {
+		// an earlier attempt with the key may have won a race with this one,
+		// or gone through without its caller hearing about it
+		record, er := idem.recorded(ctx, ddb)
+		if er == nil && record != nil {
+			return a.replayRegister(ctx, ddb, idem, record)
+		}
+	}
+
+	return publicIp, privateIp, status, err
+}
+
+// Unregister, for a caller that may retry it, with the same guarantees as
+// RegisterWithKey.
+func UnregisterWithKey(key string, stream string) (int, error) {
+	return Default.UnregisterWithKey(key, stream)
+}
+
+func (a *Allocator) UnregisterWithKey(key string, stream string) (int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 500, err
+	}
+
+	idem := newIdempotency(tables.IdempotencyKeyType {
+		Key: key,
+		Operation: operationUnregister,
+		Stream: stream,
+	})
+
+	record, err := idem.recorded(ctx, ddb)
+	if err != nil {
+		return 500, err
+	}
+
+	if record != nil {
+		return idem.replayUnregister(record)
+	}
+
+	status, err := a.unregisterStream(ctx, ddb, stream, idem)
+	if status != 200 {
+		record, er := idem.recorded(ctx, ddb)
+		if er == nil && record != nil {
+			return idem.replayUnregister(record)
+		}
+	}
+
+	return status, err
+}
+
+// The request made with an idempotency key. A nil idempotency, for a request
+// without one, writes nothing and uses random transaction tokens.
+type idempotency struct {
+	request tables.IdempotencyKeyType
+	now int64
+}
+
+func newIdempotency(request tables.IdempotencyKeyType) *idempotency {
+	return &idempotency { request: request, now: time.Now().Unix() }
+}
+
+func (i *idempotency) recorded(ctx context.Context, ddb tables.DynamoDBAPI) (*tables.IdempotencyKeyType, error) {
+	return tables.ConsistentGetIdempotencyKey(ctx, ddb, i.request.Key, i.now)
+}
+
+// Start of the bucket the request started in, in seconds
+func (i *idempotency) bucket() int64 {
+	width := int64(IDEMPOTENCY_BUCKET / time.Second)
+	return i.now - i.now % width
+}
+
+// The transaction token for an attempt conditioned on instanceRecord and on
+// the other versions, which is also the new version of what it writes. A
+// retry racing the first attempt, conditioned on the same versions, resends
+// the same items with the same token, so only one of them goes through and
+// the other finds its outcome. DynamoDB refuses a token reused with other
+// items, so the bucket, which the outcome's expiry is derived from, is part
+// of it too. A retry in a later bucket gets a token of its own, fails its
+// conditions if the first attempt went through, and finds the outcome then.
+func (i *idempotency) token(instanceRecord *tables.InstanceType, versions ...string) string {
+	if i == nil {
+		return uuid.New().String()
+	}
+
+	parts := []string { instanceRecord.Instance, instanceRecord.Version, strconv.FormatInt(i.bucket(), 10) }
+	return tables.IdempotencyToken(i.request.Key, append(parts, versions...)...)
+}
+
+// Adds the put of the outcome of the request, were it to succeed on
+// instance, to transactItems.
+func (i *idempotency) withOutcome(transactItems []types.TransactWriteItem, instance string) ([]types.TransactWriteItem, error) {
+	if i == nil {
+		return transactItems, nil
+	}
+
+	outcome := i.request
+	outcome.Instance = instance
+	outcome.Status = 200
+	// Expires lies on a bucket boundary, so an outcome that has expired by now
+	// has also expired by the start of the bucket
+	outcome.Expires = i.bucket() + int64((IDEMPOTENCY_BUCKET + IDEMPOTENCY_WINDOW) / time.Second)
+	put, err := tables.PutIdempotencyKey(&outcome, i.bucket())
+	if err != nil {
+		return nil, err
+	}
+
+	return append(transactItems, put), nil
+}
+
+func (i *idempotency) matches(record *tables.IdempotencyKeyType) error {
+	r := i.request
+	if record.Operation != r.Operation || record.Stream != r.Stream ||
+			(r.Operation == operationRegister && (record.ShopId != r.ShopId || record.Port != r.Port)) {
+		return fmt.Errorf("Idempotency key %v was used for a different request", r.Key)
+	}
+
+	return nil
+}
+
+// The IPs are looked up again, in case they have changed since
+func (a *Allocator) replayRegister(ctx context.Context, ddb tables.DynamoDBAPI, idem *idempotency, record *tables.IdempotencyKeyType) (string, string, int, error) {
+	err := idem.matches(record)
+	if err != nil {
+		return "", "", 400, err
+	}
+
+	publicIp, privateIp, err := a.resolveIps(ctx, ddb, record.Instance)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	return publicIp, privateIp, record.Status, nil
+}
+
+func (i *idempotency) replayUnregister(record *tables.IdempotencyKeyType) (int, error) {
+	err := i.matches(record)
+	if err != nil {
+		return 400, err
+	}
+
+	return record.Status, nil
+}
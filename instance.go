@@ -0,0 +1,222 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"loadbalancer/go/address"
+	"loadbalancer/go/tables"
+)
+
+// How many times an instance write is tried when it keeps racing
+// registrations changing the instance's Version
+const INSTANCE_WRITE_ATTEMPTS = 5
+
+// What an instance registers about itself. A zero Capacity is
+// MAX_INSTANCES, and Addresses have their primary ones first.
+type InstanceSpec struct {
+	Instance string
+	Addresses address.Addresses
+	Capacity uint8
+	Labels map[string]string
+}
+
+// Adds the instance with no streams, or updates its capacity, labels and
+// addresses if it is already there, keeping its streams. The status is 400
+// for an invalid spec, and 503 if the instance kept changing under the
+// write.
+func RegisterInstance(spec InstanceSpec) (int, error) {
+	return Default.RegisterInstance(spec)
+}
+
+func (a *Allocator) RegisterInstance(spec InstanceSpec) (int, error) {
+	if spec.Instance == "" {
+		return 400, fmt.Errorf("An instance needs a name")
+	}
+
+	if spec.Capacity > MAX_INSTANCES {
+		return 400, fmt.Errorf(fmt.Sprintf("Capacity %d of %v is over the limit of %d", spec.Capacity, spec.Instance, MAX_INSTANCES))
+	}
+
+	err := spec.Addresses.Validate()
+	if err != nil {
+		return 400, err
+	}
+
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 500, err
+	}
+
+	instanceIp := tables.InstanceIpType {
+		PublicIp: spec.Addresses.PublicIp(),
+		PrivateIp: spec.Addresses.PrivateIp(),
+		PublicIps: spec.Addresses.Public,
+		PrivateIps: spec.Addresses.Private,
+	}
+
+	instanceRecord := tables.InstanceType { Instance: spec.Instance, Capacity: spec.Capacity, Labels: spec.Labels }
+	for attempt := 0; attempt < INSTANCE_WRITE_ATTEMPTS; attempt++ {
+		current, err := tables.ConsistentFindInstance(ctx, ddb, spec.Instance)
+		if err != nil {
+			return 500, err
+		}
+
+		oldVersion := ""
+		if current != nil {
+			oldVersion = current.Version
+		}
+
+		_, err = tables.TransactPutInstance(ctx, ddb, &instanceRecord, &instanceIp, oldVersion)
+		if err == nil {
+			a.InvalidateInstance(spec.Instance)
+			return 200, nil
+		} else if !isTransactionCanceled(err) {
+			return 500, err
+		}
+	}
+
+	return 503, fmt.Errorf(fmt.Sprintf("Instance %v kept changing over %d attempts", spec.Instance, INSTANCE_WRITE_ATTEMPTS))
+}
+
+// Removes an instance and its addresses. The status is 400 while the
+// instance still has streams, which have to be moved or unregistered first,
+// and 200 if it does not exist.
+func DeregisterInstance(instance string) (int, error) {
+	return Default.DeregisterInstance(instance)
+}
+
+func (a *Allocator) DeregisterInstance(instance string) (int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 500, err
+	}
+
+	for attempt := 0; attempt < INSTANCE_WRITE_ATTEMPTS; attempt++ {
+		current, err := tables.ConsistentFindInstance(ctx, ddb, instance)
+		if err != nil {
+			return 500, err
+		}
+
+		if current == nil {
+			return 200, nil
+		}
+
+		if current.Streams > 0 {
+			return 400, fmt.Errorf(fmt.Sprintf("Instance %v still has %d streams", instance, current.Streams))
+		}
+
+		err = tables.TransactDeleteInstance(ctx, ddb, instance, current.Version)
+		if err == nil {
+			a.InvalidateInstance(instance)
+			return 200, nil
+		} else if !isTransactionCanceled(err) {
+			return 500, err
+		}
+	}
+
+	return 503, fmt.Errorf(fmt.Sprintf("Instance %v kept changing over %d attempts", instance, INSTANCE_WRITE_ATTEMPTS))
+}
+
+// What an instance's agent reports serving. Ports, when not nil, are the
+// ports of the streams served, and then ActiveStreams is their number.
+type Load struct {
+	ActiveStreams uint8
+	Ports []uint16
+}
+
+// Records the streams an instance is actually serving, as a heartbeat. The
+// allocated Streams are left alone. The status is 400 if the instance does
+// not exist.
+func ReportLoad(instance string, load Load) (int, error) {
+	return Default.ReportLoad(instance, load)
+}
+
+func (a *Allocator) ReportLoad(instance string, load Load) (int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 500, err
+	}
+
+	if load.Ports != nil {
+		load.ActiveStreams = uint8(len(load.Ports))
+	}
+
+	present, err := tables.SetInstanceLoad(ctx, ddb, instance, load.ActiveStreams, load.Ports, time.Now().Unix())
+	if err != nil {
+		return 500, err
+	}
+
+	if !present {
+		return 400, fmt.Errorf("Instance %s does not exist", instance)
+	}
+
+	return 200, nil
+}
+
+// Sets the Streams of an instance to the number of ports it has in
+// instancePorts, read consistently, should they have drifted apart. Returns
+// the count before and after. The status is 400 if the instance does not
+// exist, and 503 if it kept changing under the repair.
+func RepairStreamCount(instance string) (uint8, uint8, int, error) {
+	return Default.RepairStreamCount(instance)
+}
+
+func (a *Allocator) RepairStreamCount(instance string) (uint8, uint8, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 0, 0, 500, err
+	}
+
+	for attempt := 0; attempt < INSTANCE_WRITE_ATTEMPTS; attempt++ {
+		// read before the ports, so that a stream added in between changes
+		// the Version the repair is conditioned on
+		current, err := tables.ConsistentFindInstance(ctx, ddb, instance)
+		if err != nil {
+			return 0, 0, 500, err
+		}
+
+		if current == nil {
+			return 0, 0, 400, fmt.Errorf("Instance %s does not exist", instance)
+		}
+
+		instancePorts, err := tables.ConsistentScanInstancePorts(ctx, ddb, instance)
+		if err != nil {
+			return 0, 0, 500, err
+		}
+
+		counted := uint8(len(*instancePorts))
+		if counted == current.Streams {
+			return current.Streams, counted, 200, nil
+		}
+
+		_, err = tables.SetInstanceStreams(ctx, ddb, instance, counted, current.Version)
+		if err == nil {
+			log.Printf("INFO: Repaired the stream count of %v from %d to %d", instance, current.Streams, counted)
+			return current.Streams, counted, 200, nil
+		} else if !isTransactionCanceled(err) {
+			return 0, 0, 500, err
+		}
+	}
+
+	return 0, 0, 503, fmt.Errorf(fmt.Sprintf("Instance %v kept changing over %d attempts", instance, INSTANCE_WRITE_ATTEMPTS))
+}
+
+// How many streams can be placed on an instance
+func capacityOf(instanceRecord *tables.InstanceType) uint8 {
+	if instanceRecord.Capacity == 0 || instanceRecord.Capacity > MAX_INSTANCES {
+		return MAX_INSTANCES
+	}
+
+	return instanceRecord.Capacity
+}
+
+// A transaction failing on a condition, or on another transaction, both of
+// which a fresh read may get past
+func isTransactionCanceled(err error) bool {
+	var canceled *types.TransactionCanceledException
+	return errors.As(err, &canceled)
+}
@@ -1,32 +1,41 @@
 package lb
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 
 	"loadbalancer/go/tables"
 )
 
 const MAX_INSTANCES uint8 = 3
 
+// How many streams a shop can have at once
+const MAX_SHOP_STREAMS uint8 = 3
+
 func Register(shopId string, stream string, port uint16) (string, string, int, error) {
-	context, err := tables.Context()
+	return Default.Register(shopId, stream, port)
+}
+
+func (a *Allocator) Register(shopId string, stream string, port uint16) (string, string, int, error) {
+	ctx, ddb, err := a.client()
 	if err != nil {
 		return "", "", 500, err
 	}
 
-	ctx := context.Ctx()
-	cfg := context.Cfg()
-	ddb := dynamodb.NewFromConfig(*cfg)
+	return a.register(ctx, ddb, shopId, stream, port, nil)
+}
 
-	shop, err := tables.ConsistentGetShop(ctx, ddb, shopId)
+// idem is nil unless the request came with an idempotency key
+func (a *Allocator) register(ctx context.Context, ddb tables.DynamoDBAPI, shopId string, stream string, port uint16, idem *idempotency) (string, string, int, error) {
+	shop, err := tables.ConsistentGetShop(ctx, ddb, shopId, stream)
 	if err != nil {
 		return "", "", 500, err
 	}
 
-	if shop != nil && shop.Stream == stream && shop.Port == port {
-		pubIp, privIp, err := tables.GetIps(ctx, ddb, shop.Instance)
+	if shop != nil && shop.Port == port {
+		pubIp, privIp, err := a.resolveIps(ctx, ddb, shop.Instance)
 		if err != nil {
 			return "", "", 500, err
 		}
@@ -34,7 +43,28 @@ func Register(shopId string, stream string, port uint16) (string, string, int, e
 		return pubIp, privIp, 200, nil
 
 	} else if shop != nil {
-		return "", "",  400, fmt.Errorf(fmt.Sprintf("Shop %v in use", shopId))
+		return "", "",  400, fmt.Errorf(fmt.Sprintf("Stream %v in use", stream))
+	}
+
+	gov, err := loadGovernance(ctx, ddb, shopId)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	// A shop with a quota has its streams counted and limited there
+	var guard *streamsGuard
+	if gov == nil {
+		guard, err = loadStreamsGuard(ctx, ddb, shopId)
+		if err != nil {
+			return "", "", 500, err
+		}
+
+		err = guard.check(1)
+		if err != nil {
+			return "", "", 400, err
+		}
+	} else if err = gov.checkStream(port); err != nil {
+		return "", "", 400, err
 	}
 
 	streamExists, err := tables.TestStreamPresence(ctx, ddb, stream)
@@ -67,90 +97,160 @@ func Register(shopId string, stream string, port uint16) (string, string, int, e
 		instancesSetUsingPort[i.Instance] = nil
 	}
 
-	var streams uint8 = 0
-	for streams = 0; streams < MAX_INSTANCES; streams++ {
-		instanceNameRecords, er := tables.QueryAllInstancesWithNumStreams(ctx, ddb, streams)
+	// set when an instance was skipped only for going over a quota
+	var refused error
+	var placed *judgement
+	var fatal error
+	_, er := a.eachCandidate(ctx, ddb, func(instance string, streams uint8) bool {
+		judgement, er := a.judgeInstance(ctx, ddb, instance, streams, instancesSetUsingPort)
 		err = er
-		if err == nil && instanceNameRecords != nil {
-			for _, record := range *instanceNameRecords {
-				if _, present := instancesSetUsingPort[record.Instance]; !present {
-					instanceRecord, er := tables.ConsistentGetInstance(ctx, ddb, record.Instance)
-					err = er
-					if err == nil && instanceRecord != nil && instanceRecord.Streams < MAX_INSTANCES {
-						publicIp, privateIp, er := tables.GetIps(ctx, ddb, record.Instance)
-						err = er
-						if err == nil {
-							er = tables.TransactAddStream(ctx, ddb, shopId, stream, port, instanceRecord)
-							err = er
-							if err == nil {
-								return publicIp, privateIp, 200, nil
-							}
-						}
-					}
+		if err == nil && judgement.Candidate {
+			token := idem.token(judgement.record, append(gov.versions(), guard.versions()...)...)
+			usagePuts, er := gov.admit(token, port, instance)
+			if isQuotaError(er) {
+				refused = er
+				return false
+			}
+
+			err = er
+			var extra []types.TransactWriteItem
+			if err == nil {
+				extra, err = idem.withOutcome(usagePuts, instance)
+			}
+
+			if err == nil {
+				extra, err = guard.put(extra, token)
+			}
+
+			if err == nil {
+				err = tables.TransactAddStreamWithToken(ctx, ddb, token, shopId, stream, port, judgement.record, extra...)
+				if err == nil {
+					a.observeInstance(judgement.record, judgement.record.Streams + 1)
+					placed = judgement
+					return true
+				}
+
+				// the usage, or the shop's streams, may be what changed
+				// under the transaction
+				er = gov.refresh(ctx, ddb)
+				if er == nil {
+					er = guard.refresh(ctx, ddb)
+				}
+
+				if er != nil {
+					fatal = er
+					return true
+				}
+
+				er = guard.check(1)
+				if er != nil {
+					refused, err = er, nil
+					return true
 				}
 			}
-	    }
+		}
 
 		// Preferred less code nesting over meticulous error logging. The code can be changed to get more
 		// precise error logging, if this code ever encounters issues needing deeper troubleshooting.
 		if err != nil {
-			log.Printf("INFO: Error encountered streams=%d shopId=%v stream=%v port=%d \n instance name records: %v \n instancesSetUsingPort %v --> %v", streams, shopId, stream, port, *instanceNameRecords, instancesSetUsingPort, err)
+			log.Printf("INFO: Error encountered streams=%d shopId=%v stream=%v port=%d instance=%v \n instancesSetUsingPort %v --> %v", streams, shopId, stream, port, instance, instancesSetUsingPort, err)
 		}
+
+		return false
+	})
+
+	if fatal != nil {
+		return "", "", 500, fatal
+	}
+
+	// the search also stops when the shop turns out to be at its limit
+	if placed != nil {
+		return placed.publicIp, placed.privateIp, 200, nil
+	}
+
+	if er != nil {
+		return "", "", 500, er
 	}
 
 	if err != nil {
 		return "", "", 500, err
 	}
 
+	if refused != nil {
+		return "", "", 400, refused
+	}
+
 	return "", "", 503, fmt.Errorf(fmt.Sprintf("Unable to allocate for %v, %v and %d", shopId, stream, port))
 }
 
 func Unregister(stream string) (int, error) {
-	context, err := tables.Context()
+	return Default.Unregister(stream)
+}
+
+func (a *Allocator) Unregister(stream string) (int, error) {
+	ctx, ddb, err := a.client()
 	if err != nil {
 		return 500, err
 	}
 
-	ctx := context.Ctx()
-	cfg := context.Cfg()
-	ddb := dynamodb.NewFromConfig(*cfg)
-	shopId, err := tables.QueryShopIdByStream(ctx, ddb, stream)
-	if err != nil {
-		return 500, err
+	return a.unregisterStream(ctx, ddb, stream, nil)
+}
+
+func (a *Allocator) unregisterStream(ctx context.Context, ddb tables.DynamoDBAPI, stream string, idem *idempotency) (int, error) {
+	shop, status, err := a.findStreamShop(ctx, ddb, stream)
+	if status != 200 {
+		return status, err
 	}
 
-	if shopId == "" {
-		return 400, fmt.Errorf("Stream %s does not exist", stream)
+	return unregister(ctx, ddb, shop, idem)
+}
+
+// Like Unregister, but without having to find the shop of the stream first.
+func UnregisterShopStream(shopId string, stream string) (int, error) {
+	return Default.UnregisterShopStream(shopId, stream)
+}
+
+func (a *Allocator) UnregisterShopStream(shopId string, stream string) (int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 500, err
 	}
 
-	shop, err := tables.ConsistentGetShop(ctx, ddb, shopId)
+	shop, err := tables.ConsistentGetShop(ctx, ddb, shopId, stream)
 	if err != nil {
 		return 500, err
 	}
 
 	if shop == nil {
-		streamExists, err := tables.TestStreamPresence(ctx, ddb, stream)
-		if err != nil {
-			return 500, err
-		}
+		return 400, fmt.Errorf("Stream %s of shop %s does not exist", stream, shopId)
+	}
 
-		if streamExists {
-			return 500, fmt.Errorf(fmt.Sprintf("Another stream %v may have been allocated. If this is untrue, please issue the request again.", stream))
-		} else {
-			return 200, nil
-		}
+	return unregister(ctx, ddb, shop, nil)
+}
+
+func unregister(ctx context.Context, ddb tables.DynamoDBAPI, shop *tables.ShopType, idem *idempotency) (int, error) {
+	instanceRecord, err := tables.ConsistentGetInstance(ctx, ddb, shop.Instance)
+	if err != nil {
+		return 500, err
 	}
 
-	if shop.Stream != stream {
-		return 500, fmt.Errorf("That stream may not have been consistently written yet")
+	gov, err := loadGovernance(ctx, ddb, shop.ShopId)
+	if err != nil {
+		return 500, err
 	}
 
-	instanceRecord, err := tables.ConsistentGetInstance(ctx, ddb, shop.Instance)
+	token := idem.token(instanceRecord, gov.versions()...)
+	usagePuts, err := gov.release(token, shop.Port, shop.Instance)
+	if err != nil {
+		return 500, err
+	}
+
+	extra, err := idem.withOutcome(usagePuts, shop.Instance)
 	if err != nil {
 		return 500, err
 	}
 
-	err = tables.TransactDelete(ctx, ddb, shop, instanceRecord)
+	err = tables.TransactDeleteWithToken(ctx, ddb, token, shop, instanceRecord, extra...)
 	if err != nil {
 		return 500, err
 	}
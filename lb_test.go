@@ -1,88 +1,192 @@
 package lb
 
 import (
-	"context"
  	"fmt"
 	"strings"
  	"testing"
- 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"time"
 
+    "loadbalancer/go/address"
+    "loadbalancer/go/tables"
     "loadbalancer/go/test_setup"
 )
 
-var testCtx context.Context
-var testClient *dynamodb.Client
-
 func TestRegister(t *testing.T) {
-	publicIp, privateIp, status, err := Register("shop0", "stream0", 11000)
+	h := newHarness(t, test_setup.Fleet(3))
+	publicIp, privateIp, status, err := h.a.Register("shop0", "stream0", 11000)
 	if err != nil {
 		t.Fatalf(fmt.Sprintf("Register Error: [%v]", err))
 	}
 
+	h.check()
 	fmt.Println(fmt.Sprintf("SUCCESS: TestRegister IP addresses (%d) --> %v %v", status, publicIp, privateIp))
 }
 
 func TestUnregister(t *testing.T) {
-	_, _, status, err := Register("shopU", "streamU", 7000)
+	h := newHarness(t, test_setup.Fleet(3))
+	_, _, status, err := h.a.Register("shopU", "streamU", 7000)
 	if err != nil {
 		t.Fatalf(fmt.Sprintf("Register of shopU, streamU, 7000 should have succeeded: [%v]", err))
 	}
 
-	status, err = Unregister("streamU")
+	status, err = h.a.Unregister("streamU")
 	if err != nil {
 		t.Fatalf(fmt.Sprintf("Unregister Error: %d [%v]", status, err))
 	}
 
+	h.check()
 	fmt.Println(fmt.Sprintf("SUCCESS: TestUnregister (%d)", status))
 }
 
 func TestRegisterWithExactSameData(t *testing.T) {
-	publicIp, privateIp, status, err := Register("shop0", "stream0", 11000)
+	h := newHarness(t, test_setup.Fleet(3))
+	h.register("shop0", "stream0", 11000)
+	publicIp, privateIp, status, err := h.a.Register("shop0", "stream0", 11000)
 	if err != nil {
 		t.Fatalf(fmt.Sprintf("Register Error: [%v]", err))
 	}
 
+	h.check()
 	fmt.Println(fmt.Sprintf("SUCCESS: TestRegister IP addresses (%d) --> %v %v", status, publicIp, privateIp))
 }
 
-func TestRegisterRepeatingShopWithDifferentData(t* testing.T) {
-	_, _, status, err := Register("shop0", "stream1", 11001)
+func TestRegisterRepeatingStreamWithDifferentPort(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	h.register("shop0", "stream0", 11000)
+	_, _, status, err := h.a.Register("shop0", "stream0", 11001)
 	if err == nil {
 		t.Fatalf("No error was received")
 	}
 
-	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterRepeatingShopWithDifferentData Expected error received (%d) --> %v", status, err))
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterRepeatingStreamWithDifferentPort Expected error received (%d) --> %v", status, err))
+}
+
+func TestRegisterSecondStreamForShop(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	h.register("shop0", "stream0", 11000)
+	_, _, status, err := h.a.Register("shop0", "streamS", 11001)
+	if err != nil {
+		t.Fatalf("(%d) Register of a second stream streamS for shop0 should have succeeded ---> %v", status, err)
+	}
+
+	shops, status, err := h.a.GetShop("shop0")
+	if err != nil || len(shops) != 2 {
+		t.Fatalf("(%d) shop0 should have 2 streams: %v ---> %v", status, shops, err)
+	}
+
+	status, err = h.a.UnregisterShopStream("shop0", "streamS")
+	if err != nil {
+		t.Fatalf("(%d) UnregisterShopStream of shop0 and streamS should have succeeded ---> %v", status, err)
+	}
+
+	status, err = h.a.UnregisterShopStream("shop0", "streamS")
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) A second UnregisterShopStream of shop0 and streamS should have failed", status)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterSecondStreamForShop Expected error received (%d) --> %v", status, err))
+}
+
+func TestRegisterBeyondShopStreamLimit(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	var i uint8
+	for i = 0; i < MAX_SHOP_STREAMS; i++ {
+		stream := fmt.Sprintf("streamL%d", i)
+		_, _, status, err := h.a.Register("shopL", stream, 17000 + uint16(i))
+		if err != nil {
+			t.Fatalf("(%d) Register of %v for shopL should have succeeded ---> %v", status, stream, err)
+		}
+	}
+
+	_, _, status, err := h.a.Register("shopL", "streamLX", 17100)
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) Register of one stream too many for shopL should have failed", status)
+	}
+
+	for i = 0; i < MAX_SHOP_STREAMS; i++ {
+		stream := fmt.Sprintf("streamL%d", i)
+		_, err := h.a.UnregisterShopStream("shopL", stream)
+		if err != nil {
+			t.Fatalf("UnregisterShopStream of %v for shopL should have succeeded ---> %v", stream, err)
+		}
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterBeyondShopStreamLimit Expected error received (%d) --> %v", status, err))
+}
+
+// The streams of a shop without a quota are counted outside the
+// transaction, so concurrent Registers could each count the same streams
+// without its guard.
+func TestParallelRegisterShopStreamLimit(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(6))
+	attempts := 2 * int(MAX_SHOP_STREAMS)
+	statuses := make(chan int, attempts)
+	for i := 0; i < attempts; i++ {
+		go func(i int) {
+			_, _, status, _ := h.a.Register("shopP", fmt.Sprintf("streamP%d", i), 17200 + uint16(i))
+			statuses <- status
+		}(i)
+	}
+
+	registered := 0
+	for i := 0; i < attempts; i++ {
+		if <-statuses == 200 {
+			registered++
+		}
+	}
+
+	shops, _, err := h.a.GetShop("shopP")
+	if err != nil || len(shops) != registered || registered > int(MAX_SHOP_STREAMS) {
+		t.Fatalf("shopP has %d streams after %d successful Registers, over the limit of %d ---> %v", len(shops), registered, MAX_SHOP_STREAMS, err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestParallelRegisterShopStreamLimit %d of %d registered", registered, attempts))
 }
 
 func TestRegisterRepeatingStream(t* testing.T) {
-	_, _, status, err := Register("shop1", "stream0", 11002)
+	h := newHarness(t, test_setup.Fleet(3))
+	h.register("shop0", "stream0", 11000)
+	_, _, status, err := h.a.Register("shop1", "stream0", 11002)
 	if err == nil {
 		t.Fatalf("No error was received")
 	}
 
+	h.check()
 	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterRepeatingStream Expected error received (%d) --> %v", status, err))
 }
 
 func TestRegisterRepeatingPortAfterPortExhaustion(t* testing.T) {
-	_, _, status, err := Register("shop1", "stream1", 11000)
+	h := newHarness(t, test_setup.Fleet(3))
+	h.register("shop0", "stream0", 11000)
+	_, _, status, err := h.a.Register("shop1", "stream1", 11000)
 	if err != nil {
 		t.Fatalf("(%d) Port 11000 should have successfully been allocated to shop1 and stream1 ---> %v", status, err)
 	}
 
-	_, _, status, err = Register("shop2", "stream2", 11000)
+	_, _, status, err = h.a.Register("shop2", "stream2", 11000)
 	if err != nil {
 		t.Fatalf("(%d) Port 11000 should have successfully been allocated to shop2 and stream2 ---> %v", status, err)
 	}
 
-	_, _, status, err = Register("shop3", "stream3", 11000)
+	_, _, status, err = h.a.Register("shop3", "stream3", 11000)
 	if err == nil {
 		t.Fatalf("Port 11000 should have NOT been allocated to shop3 and stream3 because port 11000 has already been allocated to the 3 different instances.")
 	}
 
+	h.check()
 	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterRepeatingPortAfterPortExhaustion Expected error received (%d) --> %v", status, err))
 }
 
 func TestRegisterInstanceExhaustion(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	for i := 0; i < 3; i++ {
+		h.register(fmt.Sprintf("shop%d", i), fmt.Sprintf("stream%d", i), 11000)
+	}
+
 	var shopSeed uint16 = 10
 	var streamSeed uint16 = 10
 	var portSeed uint16 = 12000
@@ -94,7 +198,7 @@ func TestRegisterInstanceExhaustion(t* testing.T) {
 		shopId := fmt.Sprintf("shop%d", shopSeed + i)
 		stream := fmt.Sprintf("stream%d", streamSeed + i)
 		port := portSeed + i
-		_, _, status, err := Register(shopId, stream, port)
+		_, _, status, err := h.a.Register(shopId, stream, port)
 		if err != nil {
 			t.Fatalf("(%d) Port %d should have successfully been allocated to %s and %s ---> %v", status, port, shopId, stream, err)
 		}
@@ -102,15 +206,22 @@ func TestRegisterInstanceExhaustion(t* testing.T) {
 
 	// Now attempt to register with a completely different shopId, stream and port
 	// than anything that was previously registered
-	_, _, status, err := Register("MYSHOP", "MYSTREAM", 14000)
+	_, _, status, err := h.a.Register("MYSHOP", "MYSTREAM", 14000)
 	if err == nil {
 		t.Fatalf("(%d) An error should have been received when registering MYSHOP, MYSTREAM, 14000", status)
 	}
 
+	h.check()
 	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterInstanceExhaustion Expected error received (%d) --> %v", status, err))
 }
 
 func TestParallelUnregister(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	var j uint16
+	for j = 10; j < 16; j++ {
+		h.register(fmt.Sprintf("shop%d", j), fmt.Sprintf("stream%d", j), 12000 + j)
+	}
+
 	var streamSeed uint16 = 10
 	channel := make(chan string, 3)
 	var i uint16
@@ -120,7 +231,7 @@ func TestParallelUnregister(t* testing.T) {
 		for i = st; i < fin; i++ {
 			s := fmt.Sprintf("stream%d", streamSeed + i)
 			go func(stream string) {
-				status, err := Unregister(stream)
+				status, err := h.a.Unregister(stream)
 				if err != nil {
 					ch <- fmt.Sprintf("Should have been able to unregister %s: [%d] [%v]", stream, status, err)
 				} else {
@@ -150,10 +261,420 @@ func TestParallelUnregister(t* testing.T) {
 		t.Fatalf(strings.Join(errors, "\n"))
 	}
 
+	h.check()
 	fmt.Println("SUCCESS: TestParallelUnregister")
 }
 
-func TestMain(m *testing.M) {
-	test_setup.Setup()
-	m.Run()
-}
\ No newline at end of file
+func TestReads(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	for i := 0; i < 3; i++ {
+		h.register(fmt.Sprintf("shop%d", i), fmt.Sprintf("stream%d", i), 11000)
+	}
+
+	shop, status, err := h.a.GetShopStream("shop0", "stream0")
+	if err != nil || shop.Stream != "stream0" || shop.Port != 11000 || shop.PublicIp == "" {
+		t.Fatalf("(%d) GetShopStream of shop0 returned %v ---> %v", status, shop, err)
+	}
+
+	byStream, status, err := h.a.GetShopByStream("stream0")
+	if err != nil || byStream.ShopId != "shop0" {
+		t.Fatalf("(%d) GetShopByStream of stream0 returned %v ---> %v", status, byStream, err)
+	}
+
+	_, status, err = h.a.GetShop("MYSHOP")
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) GetShop of an unknown shop should have failed", status)
+	}
+
+	onInstance, status, err := h.a.ListShopsOnInstance(shop.Instance)
+	if err != nil || len(onInstance) == 0 {
+		t.Fatalf("(%d) ListShopsOnInstance of %v returned %v ---> %v", status, shop.Instance, onInstance, err)
+	}
+
+	instances, status, err := h.a.ListInstances()
+	if err != nil || len(instances) != 3 {
+		t.Fatalf("(%d) ListInstances returned %v ---> %v", status, instances, err)
+	}
+
+	usage, status, err := h.a.GetPortUsage(11000)
+	if err != nil || len(usage.Shops) != 3 || usage.Available != 0 {
+		t.Fatalf("(%d) GetPortUsage of 11000 returned %v ---> %v", status, usage, err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestReads %v %v", shop, instances))
+}
+
+func TestExplain(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	for i := 0; i < 3; i++ {
+		h.register(fmt.Sprintf("shop%d", i), fmt.Sprintf("stream%d", i), 11000)
+	}
+
+	explanation, status, err := h.a.Explain("shopE", "streamE", 11000)
+	if err != nil || explanation.Status != 400 {
+		t.Fatalf("(%d) Explain should have found port 11000 in use: %v ---> %v", status, explanation, err)
+	}
+
+	for _, instance := range []string { "instance0", "instance1", "instance2" } {
+		status, err = h.a.Cordon(instance)
+		if err != nil {
+			t.Fatalf("(%d) Cordon of %v failed ---> %v", status, instance, err)
+		}
+	}
+
+	explanation, status, err = h.a.Explain("shopE", "streamE", 16000)
+	if err != nil || explanation.Status != 503 || len(explanation.Instances) != 3 {
+		t.Fatalf("(%d) Explain should not have found a candidate: %v ---> %v", status, explanation, err)
+	}
+
+	for _, verdict := range explanation.Instances {
+		if verdict.Verdict != VerdictCordoned {
+			t.Fatalf("Expected %v to be cordoned: %v", verdict.Instance, verdict)
+		}
+	}
+
+	for _, instance := range []string { "instance0", "instance1", "instance2" } {
+		status, err = h.a.Uncordon(instance)
+		if err != nil {
+			t.Fatalf("(%d) Uncordon of %v failed ---> %v", status, instance, err)
+		}
+	}
+
+	explanation, status, err = h.a.Explain("shopE", "streamE", 16000)
+	if err != nil || explanation.Status != 200 || explanation.Instance == "" {
+		t.Fatalf("(%d) Explain should have found a candidate: %v ---> %v", status, explanation, err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestExplain %v", explanation))
+}
+
+func TestUpdate(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	h.register("shop0", "stream0", 11000)
+	h.register("shop1", "stream1", 11000)
+	before, _, err := h.a.GetShopStream("shop0", "stream0")
+	if err != nil {
+		t.Fatalf("GetShopStream of shop0 failed ---> %v", err)
+	}
+
+	_, _, status, err := h.a.Update("shop0", "stream0", "stream0u", 16001)
+	if err != nil {
+		t.Fatalf("(%d) Update of shop0 to stream0u and 16001 should have succeeded ---> %v", status, err)
+	}
+
+	after, _, err := h.a.GetShopStream("shop0", "stream0u")
+	if err != nil || after.Stream != "stream0u" || after.Port != 16001 || after.Instance != before.Instance {
+		t.Fatalf("shop0 should have stayed on %v with stream0u and 16001: %v ---> %v", before.Instance, after, err)
+	}
+
+	_, _, status, err = h.a.Update("shop0", "stream0u", "stream1", 16001)
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) Update of shop0 to stream1 should have failed", status)
+	}
+
+	_, _, status, err = h.a.Update("shop0", "stream0u", "stream0", 11000)
+	if err != nil {
+		t.Fatalf("(%d) Update of shop0 back to stream0 and 11000 should have succeeded ---> %v", status, err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestUpdate (%d)", status))
+}
+
+func TestRegisterBatch(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	h.register("shop0", "stream0", 11000)
+	requests := []RegisterRequest {
+		RegisterRequest { ShopId: "shopB0", Stream: "streamB0", Port: 15000 },
+		RegisterRequest { ShopId: "shopB1", Stream: "streamB1", Port: 15001 },
+		RegisterRequest { ShopId: "shopB2", Stream: "streamB2", Port: 15002 },
+		RegisterRequest { ShopId: "shopB3", Stream: "streamB3", Port: 15003 },
+		RegisterRequest { ShopId: "shopB4", Stream: "stream0", Port: 15004 },
+		RegisterRequest { ShopId: "shopB0", Stream: "streamB5", Port: 15005 },
+	}
+
+	results := h.a.RegisterBatch(requests)
+	for _, i := range []int { 0, 1, 2, 3, 5 } {
+		result := results[i]
+		if result.Err != nil || result.Status != 200 || result.PublicIp == "" {
+			t.Fatalf("(%d) Batch registration %d should have succeeded ---> %v", result.Status, i, result.Err)
+		}
+	}
+
+	if results[4].Status != 400 {
+		t.Fatalf("Stream in use should have been rejected: (%d) %v", results[4].Status, results[4].Err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterBatch Expected error received (%d) --> %v", results[4].Status, results[4].Err))
+}
+
+func TestUnregisterBatch(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	for _, i := range []int { 0, 1, 2, 3, 5 } {
+		h.register(fmt.Sprintf("shopB%d", i), fmt.Sprintf("streamB%d", i), 15000 + uint16(i))
+	}
+
+	results := h.a.UnregisterBatch([]string { "streamB0", "streamB1", "streamB2", "streamB3", "streamB9", "streamB5" })
+	for _, i := range []int { 0, 1, 2, 3, 5 } {
+		result := results[i]
+		if result.Err != nil || result.Status != 200 {
+			t.Fatalf("(%d) Batch unregistration %d should have succeeded ---> %v", result.Status, i, result.Err)
+		}
+	}
+
+	if results[4].Status != 400 {
+		t.Fatalf("(%d) Unregistering an unknown stream should have failed ---> %v", results[4].Status, results[4].Err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestUnregisterBatch Expected error received (%d) --> %v", results[4].Status, results[4].Err))
+}
+
+func TestQuota(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	status, err := h.a.SetShopQuota("shopQ", Quota { MaxPorts: 1 }, "tenantQ")
+	if err != nil {
+		t.Fatalf("(%d) SetShopQuota of shopQ should have succeeded ---> %v", status, err)
+	}
+
+	_, _, status, err = h.a.Register("shopQ", "streamQ0", 18000)
+	if err != nil {
+		t.Fatalf("(%d) Register of streamQ0 should have succeeded ---> %v", status, err)
+	}
+
+	_, _, status, err = h.a.Register("shopQ", "streamQ1", 18001)
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) Register of a second port for shopQ should have failed", status)
+	}
+
+	status, err = h.a.SetTenantQuota("tenantQ", Quota { MaxStreams: 1 })
+	if err != nil {
+		t.Fatalf("(%d) SetTenantQuota of tenantQ should have succeeded ---> %v", status, err)
+	}
+
+	_, _, status, err = h.a.Register("shopQ", "streamQ1", 18000)
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) Register of a second stream for tenantQ should have failed", status)
+	}
+
+	usage, status, err := h.a.GetTenantUsage("tenantQ")
+	if err != nil || usage.Streams != 1 || usage.Ports != 1 || usage.Instances != 1 {
+		t.Fatalf("(%d) tenantQ should be using one stream, port and instance: %v ---> %v", status, usage, err)
+	}
+
+	status, err = h.a.UnregisterShopStream("shopQ", "streamQ0")
+	if err != nil {
+		t.Fatalf("(%d) UnregisterShopStream of streamQ0 should have succeeded ---> %v", status, err)
+	}
+
+	usage, status, err = h.a.GetShopUsage("shopQ")
+	if err != nil || usage.Streams != 0 || usage.Ports != 0 || usage.Instances != 0 {
+		t.Fatalf("(%d) shopQ should be using nothing: %v ---> %v", status, usage, err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestQuota (%d)", status))
+}
+
+func TestIdempotencyKeys(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	publicIp, privateIp, status, err := h.a.RegisterWithKey("keyI0", "shopI", "streamI", 19000)
+	if err != nil {
+		t.Fatalf("(%d) RegisterWithKey of streamI should have succeeded ---> %v", status, err)
+	}
+
+	retryPublicIp, retryPrivateIp, status, err := h.a.RegisterWithKey("keyI0", "shopI", "streamI", 19000)
+	if err != nil || retryPublicIp != publicIp || retryPrivateIp != privateIp {
+		t.Fatalf("(%d) A retry of RegisterWithKey should have returned %v and %v, not %v and %v ---> %v", status, publicIp, privateIp, retryPublicIp, retryPrivateIp, err)
+	}
+
+	_, _, status, err = h.a.RegisterWithKey("keyI0", "shopI", "streamI", 19001)
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) RegisterWithKey reusing a key for another port should have failed", status)
+	}
+
+	for i := 0; i < 2; i++ {
+		status, err = h.a.UnregisterWithKey("keyI1", "streamI")
+		if err != nil {
+			t.Fatalf("(%d) UnregisterWithKey attempt %d of streamI should have succeeded ---> %v", status, i, err)
+		}
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestIdempotencyKeys Expected error received (%d) --> %v", status, err))
+}
+
+// Retries of a request with a key, racing each other, all get the outcome of
+// the one that went through
+func TestIdempotencyRace(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	type result struct {
+		publicIp string
+		status int
+		err error
+	}
+
+	results := make(chan result, 4)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			publicIp, _, status, err := h.a.RegisterWithKey("keyR", "shopR", "streamR", 19500)
+			results <- result { publicIp, status, err }
+		}()
+	}
+
+	first := <-results
+	for i := 1; i < cap(results); i++ {
+		r := <-results
+		if first.err != nil || r.err != nil || r.publicIp != first.publicIp {
+			t.Fatalf("Racing retries should all have returned the same outcome: %v and %v", first, r)
+		}
+	}
+
+	streams, _, err := h.a.GetShop("shopR")
+	if err != nil || len(streams) != 1 {
+		t.Fatalf("Expected a single stream of shopR, found %v ---> %v", streams, err)
+	}
+
+	h.check()
+	fmt.Println("SUCCESS: TestIdempotencyRace")
+}
+
+// A resent transaction may reuse its token only if it sends the same items
+func TestIdempotencyToken(t* testing.T) {
+	record := &tables.InstanceType { Instance: "i-1", Version: "v1" }
+	request := tables.IdempotencyKeyType { Key: "keyT", Operation: operationRegister, ShopId: "shopT", Stream: "streamT", Port: 19000 }
+	first := &idempotency { request: request, now: 1000 }
+	if first.token(record, "u1") != (&idempotency { request: request, now: 1000 }).token(record, "u1") {
+		t.Fatal("The same attempt should have had the same token")
+	}
+
+	if first.token(record, "u1") != (&idempotency { request: request, now: 1001 }).token(record, "u1") {
+		t.Fatal("A retry a second later writes the same items, and should have had the same token")
+	}
+
+	later := &idempotency { request: request, now: 1000 + int64(IDEMPOTENCY_BUCKET / time.Second) }
+	if first.token(record, "u1") == later.token(record, "u1") {
+		t.Fatal("An attempt in the next bucket writes another expiry, and should have had another token")
+	}
+
+	if first.token(record, "u1") == first.token(record, "u2") {
+		t.Fatal("An attempt conditioned on another usage version should have had another token")
+	}
+
+	fmt.Println("SUCCESS: TestIdempotencyToken")
+}
+
+func TestHealth(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	_, _, status, err := h.a.Register("shopH", "streamH", 20000)
+	if err != nil {
+		t.Fatalf("(%d) Register of streamH should have succeeded ---> %v", status, err)
+	}
+
+	before, _, err := h.a.GetShopStream("shopH", "streamH")
+	if err != nil {
+		t.Fatalf("GetShopStream of shopH failed ---> %v", err)
+	}
+
+	status, err = h.a.ReportHealth(before.Instance, false, "unreachable")
+	if err != nil {
+		t.Fatalf("(%d) ReportHealth of %v failed ---> %v", status, before.Instance, err)
+	}
+
+	explanation, _, err := h.a.Explain("shopH", "streamH1", 20001)
+	if err != nil {
+		t.Fatalf("Explain of streamH1 failed ---> %v", err)
+	}
+
+	for _, verdict := range explanation.Instances {
+		if verdict.Instance == before.Instance && verdict.Verdict != VerdictUnhealthy {
+			t.Fatalf("Expected %v to be unhealthy: %v", verdict.Instance, verdict)
+		}
+	}
+
+	_, _, status, err = h.a.Move("shopH", "streamH")
+	if err != nil {
+		t.Fatalf("(%d) Move of streamH should have succeeded ---> %v", status, err)
+	}
+
+	after, _, err := h.a.GetShopStream("shopH", "streamH")
+	if err != nil || after.Instance == before.Instance || after.Port != 20000 {
+		t.Fatalf("streamH should have moved off %v on port 20000: %v ---> %v", before.Instance, after, err)
+	}
+
+	status, err = h.a.ReportHealth(before.Instance, true, "")
+	if err != nil {
+		t.Fatalf("(%d) ReportHealth of %v failed ---> %v", status, before.Instance, err)
+	}
+
+	status, err = h.a.ReportHealth("instanceMissing", true, "")
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) ReportHealth of a missing instance should have failed", status)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestHealth streamH moved from %v to %v", before.Instance, after.Instance))
+}
+
+func TestRegisterInstance(t* testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	spec := InstanceSpec {
+		Instance: "instanceA",
+		Addresses: address.Addresses { Public: []string { "203.0.113.10" }, Private: []string { "10.1.1.10", "fd00::10" } },
+		Capacity: 1,
+		Labels: map[string]string { "zone": "a" },
+	}
+
+	status, err := h.a.RegisterInstance(spec)
+	if err != nil {
+		t.Fatalf("(%d) RegisterInstance of instanceA should have succeeded ---> %v", status, err)
+	}
+
+	status, err = h.a.ReportLoad("instanceA", Load { Ports: []uint16 {} })
+	if err != nil {
+		t.Fatalf("(%d) ReportLoad of instanceA should have succeeded ---> %v", status, err)
+	}
+
+	spec.Capacity = 2
+	status, err = h.a.RegisterInstance(spec)
+	if err != nil {
+		t.Fatalf("(%d) Registering instanceA again should have updated it ---> %v", status, err)
+	}
+
+	instances, _, err := h.a.ListInstances()
+	found := false
+	for _, instance := range instances {
+		if instance.Instance == "instanceA" {
+			found = true
+			if instance.Capacity != 2 || instance.Labels["zone"] != "a" || len(instance.Addresses.Private) != 2 || instance.Heartbeat.IsZero() {
+				t.Fatalf("Unexpected instanceA %v", instance)
+			}
+		}
+	}
+
+	if err != nil || !found {
+		t.Fatalf("instanceA should have been listed ---> %v", err)
+	}
+
+	spec.Addresses.Public = []string { "not an ip" }
+	status, err = h.a.RegisterInstance(spec)
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) RegisterInstance with an invalid address should have failed", status)
+	}
+
+	before, after, status, err := h.a.RepairStreamCount("instanceA")
+	if err != nil || before != 0 || after != 0 {
+		t.Fatalf("(%d) RepairStreamCount of instanceA should have found nothing to repair: %d -> %d ---> %v", status, before, after, err)
+	}
+
+	status, err = h.a.DeregisterInstance("instanceA")
+	if err != nil {
+		t.Fatalf("(%d) DeregisterInstance of instanceA should have succeeded ---> %v", status, err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterInstance (%d)", status))
+}
@@ -0,0 +1,108 @@
+package lb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"loadbalancer/go/chaos"
+	"loadbalancer/go/tables"
+	"loadbalancer/go/test_setup"
+)
+
+func TestShardedLoadIndex(t *testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	h.a.SetLoadIndex(tables.LoadIndexSharded)
+
+	var i uint16
+	for i = 0; i < 3 * uint16(MAX_INSTANCES); i++ {
+		h.register(fmt.Sprintf("shop%d", i), fmt.Sprintf("stream%d", i), 16000 + i)
+	}
+
+	_, _, status, err := h.a.Register("shopX", "streamX", 16100)
+	if err == nil || status != 503 {
+		t.Fatalf("(%d) Register on a full fleet should have failed", status)
+	}
+
+	status, err = h.a.Unregister("stream0")
+	if err != nil {
+		t.Fatalf("(%d) Unregister should have succeeded ---> %v", status, err)
+	}
+
+	instances, err := tables.QueryInstancesWithLoad(h.ctx, h.ddb, MAX_INSTANCES - 1)
+	if err != nil || len(*instances) != 1 {
+		t.Fatalf("One instance should have had room left, not %v ---> %v", instances, err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestShardedLoadIndex (%d) --> %v", status, (*instances)[0].Instance))
+}
+
+// Instances from before the load index are found by the consistent scan
+// until they are backfilled.
+func TestLoadIndexMigration(t *testing.T) {
+	fleet := test_setup.Fleet(3)
+	h := newHarness(t, fleet)
+	for _, instance := range fleet {
+		key, _ := attributevalue.MarshalMap(tables.InstanceNameType { Instance: instance.Instance })
+		remove := "REMOVE #load"
+		_, err := h.ddb.UpdateItem(h.ctx, &dynamodb.UpdateItemInput {
+			TableName: tables.Instances.TableName,
+			Key: key,
+			UpdateExpression: &remove,
+			ExpressionAttributeNames: map[string]string { "#load": "Load" },
+		})
+		if err != nil {
+			t.Fatalf("Unable to remove the Load of %v ---> %v", instance.Instance, err)
+		}
+	}
+
+	_, err := h.ddb.UpdateTable(h.ctx, &dynamodb.UpdateTableInput {
+		TableName: tables.Instances.TableName,
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate {
+			types.GlobalSecondaryIndexUpdate { Delete: &types.DeleteGlobalSecondaryIndexAction { IndexName: &tables.InstancesGsiLoad } },
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to delete the load index ---> %v", err)
+	}
+
+	err = tables.AddLoadIndex(h.ctx, h.ddb)
+	if err != nil {
+		t.Fatalf("Unable to add the load index ---> %v", err)
+	}
+
+	for ready := false; !ready; {
+		ready, err = tables.LoadIndexReady(h.ctx, h.ddb)
+		if err != nil {
+			t.Fatalf("Unable to check the load index ---> %v", err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	h.a.SetLoadIndex(tables.LoadIndexSharded)
+	h.register("shopM", "streamM", 17000)
+	if h.a.GetStaleReads().InstancesMissed == 0 {
+		t.Fatal("The instances without a Load should have been found by the scan")
+	}
+
+	// as if an instance were registered again between the scan and its update
+	_, c := h.chaos()
+	c.Inject(chaos.Fault { Operation: chaos.OpUpdateItem, Times: 1, Err: &types.ConditionalCheckFailedException {} })
+	n, err := tables.BackfillLoad(h.ctx, c)
+	if err != nil || n != len(fleet) - 1 {
+		t.Fatalf("The %d instances the registration left without a Load should have been backfilled, not %d ---> %v", len(fleet) - 1, n, err)
+	}
+
+	instances, err := tables.QueryInstancesWithLoad(h.ctx, h.ddb, 0)
+	if err != nil || len(*instances) != len(fleet) - 1 {
+		t.Fatalf("The backfilled instances should have been in the load index, not %v ---> %v", instances, err)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestLoadIndexMigration %d backfilled", n))
+}
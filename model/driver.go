@@ -0,0 +1,363 @@
+package model
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// The system under test, e.g. an lb.Allocator over its own tables. Calls
+// are made concurrently.
+type System interface {
+	Register(shopId string, stream string, port uint16) Result
+	Unregister(stream string) Result
+	Move(shopId string, stream string) Result
+	// Read between calls, never during them
+	State() (State, error)
+}
+
+// Makes a system with no streams, for every run of a history
+type Factory func() (System, error)
+
+// Calls made together. A history runs its batches one after the other, and
+// the calls of each batch concurrently.
+type History [][]Op
+
+func (h History) String() string {
+	batches := make([]string, len(h))
+	for i, batch := range h {
+		calls := make([]string, len(batch))
+		for j, op := range batch {
+			calls[j] = op.String()
+		}
+
+		batches[i] = fmt.Sprintf("%d: %v", i, strings.Join(calls, " | "))
+	}
+
+	return strings.Join(batches, "\n")
+}
+
+func (h History) len() int {
+	n := 0
+	for _, batch := range h {
+		n += len(batch)
+	}
+
+	return n
+}
+
+const DEFAULT_BATCHES = 20
+const DEFAULT_CONCURRENCY = 3
+const DEFAULT_RERUNS = 3
+const DEFAULT_MAX_SHRINKS = 200
+
+// Zero values are the defaults. Small Shops, Streams and Ports make the
+// calls collide more often.
+type Config struct {
+	Seed int64
+	Batches int
+	Concurrency int
+	Shops int
+	Streams int
+	Ports int
+	FirstPort uint16
+
+	Limits Limits
+
+	// Failures allowed without the model explaining them, which have to
+	// leave the state as it was. By default 500 and 503, which calls racing
+	// each other may return.
+	Spurious func(status int) bool
+
+	// A shrunk history has to fail in one of Reruns runs to be kept, as
+	// concurrent failures do not always come back. At most MaxShrinks
+	// histories are tried.
+	Reruns int
+	MaxShrinks int
+}
+
+func (c *Config) defaults() {
+	if c.Batches == 0 {
+		c.Batches = DEFAULT_BATCHES
+	}
+
+	if c.Concurrency == 0 {
+		c.Concurrency = DEFAULT_CONCURRENCY
+	}
+
+	if c.Shops == 0 {
+		c.Shops = 4
+	}
+
+	if c.Streams == 0 {
+		c.Streams = 8
+	}
+
+	if c.Ports == 0 {
+		c.Ports = 3
+	}
+
+	if c.FirstPort == 0 {
+		c.FirstPort = 11000
+	}
+
+	if c.Spurious == nil {
+		c.Spurious = func(status int) bool { return status == 500 || status == 503 }
+	}
+
+	if c.Reruns == 0 {
+		c.Reruns = DEFAULT_RERUNS
+	}
+
+	if c.MaxShrinks == 0 {
+		c.MaxShrinks = DEFAULT_MAX_SHRINKS
+	}
+}
+
+// A history the system failed on, as generated and as shrunk
+type Failure struct {
+	Seed int64
+	History History
+	Shrunk History
+	Reason string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("Seed %d failed with %d calls, shrunk to %d: %v\n%v", f.Seed, f.History.len(), f.Shrunk.len(), f.Reason, f.Shrunk)
+}
+
+// Generates a random history from cfg.Seed and runs it, then shrinks it if it
+// fails. The error is a *Failure, or the error of making or reading a system.
+func Run(cfg Config, factory Factory) error {
+	cfg.defaults()
+	history := Generate(cfg)
+	reason, err := Check(cfg, factory, history)
+	if err != nil || reason == "" {
+		return err
+	}
+
+	shrunk, shrunkReason, err := Shrink(cfg, factory, history, reason)
+	if err != nil {
+		return err
+	}
+
+	return &Failure { Seed: cfg.Seed, History: history, Shrunk: shrunk, Reason: shrunkReason }
+}
+
+func Generate(cfg Config) History {
+	cfg.defaults()
+	random := rand.New(rand.NewSource(cfg.Seed))
+	history := make(History, cfg.Batches)
+	for i := range history {
+		history[i] = make([]Op, cfg.Concurrency)
+		for j := range history[i] {
+			op := Op {
+				ShopId: fmt.Sprintf("shop%d", random.Intn(cfg.Shops)),
+				Stream: fmt.Sprintf("stream%d", random.Intn(cfg.Streams)),
+				Port: cfg.FirstPort + uint16(random.Intn(cfg.Ports)),
+			}
+
+			switch n := random.Intn(10); {
+			case n < 5:
+				op.Kind = KindRegister
+			case n < 8:
+				op.Kind = KindUnregister
+			default:
+				op.Kind = KindMove
+			}
+
+			history[i][j] = op
+		}
+	}
+
+	return history
+}
+
+// Runs history on a new system. After every batch the state is read and
+// has to keep the invariants, and there has to be an order of the batch's
+// calls in which the model allows every result and ends in that state. The
+// reason is empty when it does.
+func Check(cfg Config, factory Factory, history History) (string, error) {
+	cfg.defaults()
+	system, err := factory()
+	if err != nil {
+		return "", err
+	}
+
+	model := NewModel(cfg.Limits)
+	for i, batch := range history {
+		results := runBatch(system, batch)
+		state, err := system.State()
+		if err != nil {
+			return "", err
+		}
+
+		err = CheckInvariants(state, cfg.Limits)
+		if err != nil {
+			return fmt.Sprintf("after batch %d: %v", i, err), nil
+		}
+
+		next, reason := linearize(model, batch, results, state, cfg.Spurious)
+		if next == nil {
+			return fmt.Sprintf("batch %d: %v", i, reason), nil
+		}
+
+		model = next
+	}
+
+	return "", nil
+}
+
+func runBatch(system System, batch []Op) []Result {
+	results := make([]Result, len(batch))
+	var wg sync.WaitGroup
+	for i, op := range batch {
+		wg.Add(1)
+		go func(i int, op Op) {
+			defer wg.Done()
+			switch op.Kind {
+			case KindRegister:
+				results[i] = system.Register(op.ShopId, op.Stream, op.Port)
+			case KindUnregister:
+				results[i] = system.Unregister(op.Stream)
+			case KindMove:
+				results[i] = system.Move(op.ShopId, op.Stream)
+			}
+		}(i, op)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// The model after the batch, in the first order of its calls that explains
+// the results and the state, or nil and why none does
+func linearize(model *Model, batch []Op, results []Result, state State, spurious func(int) bool) (*Model, string) {
+	reason := ""
+	var found *Model
+	permute(len(batch), func(order []int) bool {
+		m := model.clone()
+		for _, i := range order {
+			err := m.Apply(batch[i], results[i], spurious)
+			if err != nil {
+				if reason == "" {
+					reason = err.Error()
+				}
+
+				return true
+			}
+		}
+
+		if !m.matches(state) {
+			if reason == "" {
+				reason = fmt.Sprintf("no order of the calls ends with the placements %v", state.Placements)
+			}
+
+			return true
+		}
+
+		found = m
+		return false
+	})
+
+	if found == nil {
+		calls := make([]string, len(batch))
+		for i := range batch {
+			calls[i] = fmt.Sprintf("%v -> %v", batch[i], results[i])
+		}
+
+		return nil, fmt.Sprintf("%v [%v]", reason, strings.Join(calls, ", "))
+	}
+
+	return found, ""
+}
+
+// Calls visit with every order of n items until it returns false
+func permute(n int, visit func([]int) bool) {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+
+	var generate func(k int) bool
+	generate = func(k int) bool {
+		if k == n {
+			return visit(order)
+		}
+
+		for i := k; i < n; i++ {
+			order[k], order[i] = order[i], order[k]
+			if !generate(k + 1) {
+				return false
+			}
+			order[k], order[i] = order[i], order[k]
+		}
+
+		return true
+	}
+
+	generate(0)
+}
+
+// Removes batches, then single calls, for as long as the history still
+// fails, and returns the smallest one found with its reason
+func Shrink(cfg Config, factory Factory, history History, reason string) (History, string, error) {
+	cfg.defaults()
+	tries := 0
+	fails := func(candidate History) (string, error) {
+		for run := 0; run < cfg.Reruns; run++ {
+			tries++
+			r, err := Check(cfg, factory, candidate)
+			if err != nil || r != "" {
+				return r, err
+			}
+		}
+
+		return "", nil
+	}
+
+	for progress := true; progress && tries < cfg.MaxShrinks; {
+		progress = false
+		for _, candidate := range smaller(history) {
+			if tries >= cfg.MaxShrinks {
+				break
+			}
+
+			r, err := fails(candidate)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if r != "" {
+				history, reason, progress = candidate, r, true
+				break
+			}
+		}
+	}
+
+	return history, reason, nil
+}
+
+// The histories with one batch or one call fewer
+func smaller(history History) []History {
+	candidates := []History {}
+	for i := range history {
+		candidate := append(append(History {}, history[:i]...), history[i + 1:]...)
+		candidates = append(candidates, candidate)
+	}
+
+	for i, batch := range history {
+		if len(batch) < 2 {
+			continue
+		}
+
+		for j := range batch {
+			candidate := append(History {}, history...)
+			candidate[i] = append(append([]Op {}, batch[:j]...), batch[j + 1:]...)
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	return candidates
+}
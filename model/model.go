@@ -0,0 +1,294 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+)
+
+type Kind string
+
+const (
+	KindRegister Kind = "register"
+	KindUnregister Kind = "unregister"
+	KindMove Kind = "move"
+)
+
+// A call made on the system. Port is only used by register, and ShopId not by
+// unregister.
+type Op struct {
+	Kind Kind
+	ShopId string
+	Stream string
+	Port uint16
+}
+
+func (o Op) String() string {
+	switch o.Kind {
+	case KindRegister:
+		return fmt.Sprintf("Register(%v, %v, %d)", o.ShopId, o.Stream, o.Port)
+	case KindUnregister:
+		return fmt.Sprintf("Unregister(%v)", o.Stream)
+	default:
+		return fmt.Sprintf("Move(%v, %v)", o.ShopId, o.Stream)
+	}
+}
+
+// What a call returned. Instance is where register or move placed the
+// stream, for a 200.
+type Result struct {
+	Status int
+	Instance string
+	Err error
+}
+
+func (r Result) String() string {
+	if r.Status == 200 {
+		return fmt.Sprintf("200 on %v", r.Instance)
+	}
+
+	return fmt.Sprintf("%d %v", r.Status, r.Err)
+}
+
+type Placement struct {
+	ShopId string
+	Stream string
+	Port uint16
+	Instance string
+}
+
+// What the system holds between calls. Streams is the count each instance
+// keeps of the streams on it, which has to agree with the placements.
+type State struct {
+	Placements []Placement
+	Streams map[string]uint8
+}
+
+// The limits of the system, and its instances with their capacity
+type Limits struct {
+	Instances map[string]uint8
+	MaxInstances uint8
+	MaxShopStreams uint8
+}
+
+// Checks the invariants of an allocation that hold whatever the calls were:
+// one shop per stream, at most one stream per port per instance, at most
+// MaxInstances instances per port and MaxShopStreams streams per shop, the
+// Streams of every instance the streams placed on it, and no instance over
+// its capacity.
+func CheckInvariants(state State, limits Limits) error {
+	streams := map[string]bool {}
+	ports := map[Placement]bool {}
+	instancesOnPort := map[uint16]int {}
+	shopStreams := map[string]int {}
+	placed := map[string]uint8 {}
+	for _, p := range state.Placements {
+		if streams[p.Stream] {
+			return fmt.Errorf("Stream %v is placed twice", p.Stream)
+		}
+
+		streams[p.Stream] = true
+		key := Placement { Port: p.Port, Instance: p.Instance }
+		if ports[key] {
+			return fmt.Errorf("Port %d is used twice on %v", p.Port, p.Instance)
+		}
+
+		ports[key] = true
+		instancesOnPort[p.Port]++
+		shopStreams[p.ShopId]++
+		placed[p.Instance]++
+	}
+
+	for port, n := range instancesOnPort {
+		if n > int(limits.MaxInstances) {
+			return fmt.Errorf("Port %d is on %d instances, over the limit of %d", port, n, limits.MaxInstances)
+		}
+	}
+
+	for shopId, n := range shopStreams {
+		if n > int(limits.MaxShopStreams) {
+			return fmt.Errorf("Shop %v has %d streams, over the limit of %d", shopId, n, limits.MaxShopStreams)
+		}
+	}
+
+	for instance, capacity := range limits.Instances {
+		if state.Streams[instance] != placed[instance] {
+			return fmt.Errorf("%v counts %d streams but has %d", instance, state.Streams[instance], placed[instance])
+		}
+
+		if placed[instance] > capacity {
+			return fmt.Errorf("%v has %d streams, over its capacity of %d", instance, placed[instance], capacity)
+		}
+	}
+
+	for instance := range placed {
+		if _, known := limits.Instances[instance]; !known {
+			return fmt.Errorf("Streams are placed on unknown instance %v", instance)
+		}
+	}
+
+	return nil
+}
+
+// The sequential reference: what each call is allowed to return given the
+// calls before it. Which instance a stream goes to is up to the system, so
+// the model takes it from the result, after checking it was a legal choice.
+type Model struct {
+	limits Limits
+	placements map[string]Placement
+}
+
+func NewModel(limits Limits) *Model {
+	return &Model { limits: limits, placements: map[string]Placement {} }
+}
+
+func (m *Model) clone() *Model {
+	c := NewModel(m.limits)
+	for k, v := range m.placements {
+		c.placements[k] = v
+	}
+
+	return c
+}
+
+// Checks that result is a legal outcome of op, and applies it. A failure that
+// is not explained by the model is only allowed when spurious, e.g. a 503
+// from contention, and then must have changed nothing.
+func (m *Model) Apply(op Op, result Result, spurious func(int) bool) error {
+	expected, targets := m.expect(op)
+	if result.Status != 200 && spurious(result.Status) {
+		return nil
+	}
+
+	if result.Status != expected {
+		return fmt.Errorf("%v returned %v where the model expected %d", op, result, expected)
+	}
+
+	if expected != 200 {
+		return nil
+	}
+
+	if targets != nil && !targets[result.Instance] {
+		return fmt.Errorf("%v placed the stream on %v, which was not a legal choice of %v", op, result.Instance, sortedKeys(targets))
+	}
+
+	switch op.Kind {
+	case KindRegister:
+		if existing, placed := m.placements[op.Stream]; placed && result.Instance != existing.Instance {
+			return fmt.Errorf("%v of an existing stream returned %v instead of %v", op, result.Instance, existing.Instance)
+		}
+
+		m.placements[op.Stream] = Placement { ShopId: op.ShopId, Stream: op.Stream, Port: op.Port, Instance: result.Instance }
+	case KindUnregister:
+		delete(m.placements, op.Stream)
+	case KindMove:
+		p := m.placements[op.Stream]
+		p.Instance = result.Instance
+		m.placements[op.Stream] = p
+	}
+
+	return nil
+}
+
+// The status op has to return, and for a 200 that places a stream the
+// instances it may go to
+func (m *Model) expect(op Op) (int, map[string]bool) {
+	existing, placed := m.placements[op.Stream]
+	switch op.Kind {
+	case KindUnregister:
+		if !placed {
+			return 400, nil
+		}
+
+		return 200, nil
+
+	case KindMove:
+		if !placed || existing.ShopId != op.ShopId {
+			return 400, nil
+		}
+
+		targets := m.targets(existing.Port, existing.Instance)
+		if len(targets) == 0 {
+			return 503, nil
+		}
+
+		return 200, targets
+
+	default:
+		if placed {
+			if existing.ShopId == op.ShopId && existing.Port == op.Port {
+				return 200, nil
+			}
+
+			return 400, nil
+		}
+
+		shopStreams := 0
+		instancesOnPort := 0
+		for _, p := range m.placements {
+			if p.ShopId == op.ShopId {
+				shopStreams++
+			}
+
+			if p.Port == op.Port {
+				instancesOnPort++
+			}
+		}
+
+		if shopStreams >= int(m.limits.MaxShopStreams) || instancesOnPort >= int(m.limits.MaxInstances) {
+			return 400, nil
+		}
+
+		targets := m.targets(op.Port, "")
+		if len(targets) == 0 {
+			return 503, nil
+		}
+
+		return 200, targets
+	}
+}
+
+// The instances a stream on port can be placed on, other than except
+func (m *Model) targets(port uint16, except string) map[string]bool {
+	streams := map[string]uint8 {}
+	usingPort := map[string]bool {}
+	for _, p := range m.placements {
+		streams[p.Instance]++
+		if p.Port == port {
+			usingPort[p.Instance] = true
+		}
+	}
+
+	targets := map[string]bool {}
+	for instance, capacity := range m.limits.Instances {
+		if instance != except && !usingPort[instance] && streams[instance] < capacity {
+			targets[instance] = true
+		}
+	}
+
+	return targets
+}
+
+// Whether the placements of the model are those of state
+func (m *Model) matches(state State) bool {
+	if len(state.Placements) != len(m.placements) {
+		return false
+	}
+
+	for _, p := range state.Placements {
+		if m.placements[p.Stream] != p {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,197 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// Allocates in memory, under a lock. With overfill it ignores the capacity
+// of instances.
+type memSystem struct {
+	limits Limits
+	overfill bool
+	mutex sync.Mutex
+	placements map[string]Placement
+}
+
+func (s *memSystem) instances() []string {
+	instances := []string {}
+	for instance := range s.limits.Instances {
+		instances = append(instances, instance)
+	}
+
+	sort.Strings(instances)
+	return instances
+}
+
+func (s *memSystem) place(port uint16, except string) string {
+	streams := map[string]uint8 {}
+	usingPort := map[string]bool {}
+	for _, p := range s.placements {
+		streams[p.Instance]++
+		usingPort[p.Instance] = usingPort[p.Instance] || p.Port == port
+	}
+
+	for _, instance := range s.instances() {
+		if instance != except && !usingPort[instance] && (s.overfill || streams[instance] < s.limits.Instances[instance]) {
+			return instance
+		}
+	}
+
+	return ""
+}
+
+func (s *memSystem) Register(shopId string, stream string, port uint16) Result {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if p, placed := s.placements[stream]; placed {
+		if p.ShopId == shopId && p.Port == port {
+			return Result { Status: 200, Instance: p.Instance }
+		}
+
+		return Result { Status: 400, Err: errors.New("Stream in use") }
+	}
+
+	shopStreams, onPort := 0, 0
+	for _, p := range s.placements {
+		if p.ShopId == shopId {
+			shopStreams++
+		}
+
+		if p.Port == port {
+			onPort++
+		}
+	}
+
+	if shopStreams >= int(s.limits.MaxShopStreams) || onPort >= int(s.limits.MaxInstances) {
+		return Result { Status: 400, Err: errors.New("Limit reached") }
+	}
+
+	instance := s.place(port, "")
+	if instance == "" {
+		return Result { Status: 503, Err: errors.New("No room") }
+	}
+
+	s.placements[stream] = Placement { ShopId: shopId, Stream: stream, Port: port, Instance: instance }
+	return Result { Status: 200, Instance: instance }
+}
+
+func (s *memSystem) Unregister(stream string) Result {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, placed := s.placements[stream]; !placed {
+		return Result { Status: 400, Err: errors.New("Unknown stream") }
+	}
+
+	delete(s.placements, stream)
+	return Result { Status: 200 }
+}
+
+func (s *memSystem) Move(shopId string, stream string) Result {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p, placed := s.placements[stream]
+	if !placed || p.ShopId != shopId {
+		return Result { Status: 400, Err: errors.New("Unknown stream") }
+	}
+
+	instance := s.place(p.Port, p.Instance)
+	if instance == "" {
+		return Result { Status: 503, Err: errors.New("No room") }
+	}
+
+	p.Instance = instance
+	s.placements[stream] = p
+	return Result { Status: 200, Instance: instance }
+}
+
+func (s *memSystem) State() (State, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := State { Streams: map[string]uint8 {} }
+	for _, p := range s.placements {
+		state.Placements = append(state.Placements, p)
+		state.Streams[p.Instance]++
+	}
+
+	return state, nil
+}
+
+var testLimits = Limits {
+	Instances: map[string]uint8 { "instance0": 1, "instance1": 2, "instance2": 2 },
+	MaxInstances: 2,
+	MaxShopStreams: 3,
+}
+
+func TestCorrectSystem(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		err := Run(Config { Seed: seed, Limits: testLimits }, func() (System, error) {
+			return &memSystem { limits: testLimits, placements: map[string]Placement {} }, nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fmt.Println("SUCCESS: TestCorrectSystem")
+}
+
+func TestShrink(t *testing.T) {
+	var failure *Failure
+	for seed := int64(0); seed < 20 && failure == nil; seed++ {
+		err := Run(Config { Seed: seed, Limits: testLimits }, func() (System, error) {
+			return &memSystem { limits: testLimits, overfill: true, placements: map[string]Placement {} }, nil
+		})
+
+		if err != nil && !errors.As(err, &failure) {
+			t.Fatal(err)
+		}
+	}
+
+	if failure == nil {
+		t.Fatal("Overfilling instance0 should have been found")
+	}
+
+	// instance0 takes one stream, so two registrations show it
+	if failure.Shrunk.len() != 2 || failure.History.len() <= 2 {
+		t.Fatalf("Expected a history of 2 calls: %v", failure)
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestShrink %v", failure))
+}
+
+func TestModel(t *testing.T) {
+	m := NewModel(testLimits)
+	never := func(int) bool { return false }
+	steps := []struct {
+		op Op
+		result Result
+		legal bool
+	} {
+		{ Op { Kind: KindRegister, ShopId: "shop0", Stream: "stream0", Port: 11000 }, Result { Status: 200, Instance: "instance0" }, true },
+		{ Op { Kind: KindRegister, ShopId: "shop0", Stream: "stream0", Port: 11000 }, Result { Status: 200, Instance: "instance0" }, true },
+		{ Op { Kind: KindRegister, ShopId: "shop1", Stream: "stream0", Port: 11000 }, Result { Status: 400 }, true },
+		// instance0 is full
+		{ Op { Kind: KindRegister, ShopId: "shop1", Stream: "stream1", Port: 11001 }, Result { Status: 200, Instance: "instance0" }, false },
+		{ Op { Kind: KindRegister, ShopId: "shop1", Stream: "stream1", Port: 11000 }, Result { Status: 200, Instance: "instance1" }, true },
+		// 11000 is on its limit of 2 instances
+		{ Op { Kind: KindRegister, ShopId: "shop2", Stream: "stream2", Port: 11000 }, Result { Status: 400 }, true },
+		{ Op { Kind: KindMove, ShopId: "shop1", Stream: "stream1" }, Result { Status: 200, Instance: "instance2" }, true },
+		{ Op { Kind: KindMove, ShopId: "shop0", Stream: "stream1" }, Result { Status: 400 }, true },
+		{ Op { Kind: KindUnregister, Stream: "stream1" }, Result { Status: 200 }, true },
+		{ Op { Kind: KindUnregister, Stream: "stream1" }, Result { Status: 503 }, false },
+	}
+
+	for i, step := range steps {
+		err := m.Apply(step.op, step.result, never)
+		if (err == nil) != step.legal {
+			t.Fatalf("Step %d %v -> %v: expected legal=%v ---> %v", i, step.op, step.result, step.legal, err)
+		}
+	}
+
+	fmt.Println("SUCCESS: TestModel")
+}
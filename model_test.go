@@ -0,0 +1,99 @@
+package lb
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"testing"
+
+	"loadbalancer/go/model"
+	"loadbalancer/go/tables"
+	"loadbalancer/go/test_setup"
+)
+
+var modelSeed = flag.Int64("model.seed", 1, "seed of the first history TestModel runs")
+var modelRuns = flag.Int("model.runs", 3, "histories TestModel runs")
+
+// An allocator over tables of its own, for the model
+type allocatorSystem struct {
+	a *Allocator
+	ctx context.Context
+	ddb tables.DynamoDBAPI
+	byIp map[string]string
+}
+
+func newAllocatorSystem(t *testing.T, fleet []test_setup.Instance) *allocatorSystem {
+	ctx, ddb := test_setup.Namespace(t, fleet)
+	byIp := map[string]string {}
+	for _, instance := range fleet {
+		byIp[instance.PublicIp] = instance.Instance
+	}
+
+	return &allocatorSystem { a: NewAllocator(ddb), ctx: ctx, ddb: ddb, byIp: byIp }
+}
+
+func (s *allocatorSystem) Register(shopId string, stream string, port uint16) model.Result {
+	publicIp, _, status, err := s.a.Register(shopId, stream, port)
+	return model.Result { Status: status, Instance: s.byIp[publicIp], Err: err }
+}
+
+func (s *allocatorSystem) Unregister(stream string) model.Result {
+	status, err := s.a.Unregister(stream)
+	return model.Result { Status: status, Err: err }
+}
+
+func (s *allocatorSystem) Move(shopId string, stream string) model.Result {
+	publicIp, _, status, err := s.a.Move(shopId, stream)
+	return model.Result { Status: status, Instance: s.byIp[publicIp], Err: err }
+}
+
+func (s *allocatorSystem) State() (model.State, error) {
+	shops, err := tables.ConsistentScanTable[tables.ShopType](s.ctx, s.ddb, tables.Shops.TableName)
+	if err != nil {
+		return model.State {}, err
+	}
+
+	instances, err := tables.ConsistentScanTable[tables.InstanceType](s.ctx, s.ddb, tables.Instances.TableName)
+	if err != nil {
+		return model.State {}, err
+	}
+
+	state := model.State { Streams: map[string]uint8 {} }
+	for _, shop := range *shops {
+		state.Placements = append(state.Placements, model.Placement { ShopId: shop.ShopId, Stream: shop.Stream, Port: shop.Port, Instance: shop.Instance })
+	}
+
+	for _, instance := range *instances {
+		state.Streams[instance.Instance] = instance.Streams
+	}
+
+	return state, nil
+}
+
+// Random concurrent Register, Unregister and Move calls, checked against the
+// model after every batch. A failure prints the seed and the shrunk history,
+// to be run again with -model.seed.
+func TestModel(t *testing.T) {
+	t.Parallel()
+	fleet := test_setup.Fleet(3)
+	fleet[0].Capacity = 1
+	limits := model.Limits {
+		Instances: map[string]uint8 { "instance0": 1, "instance1": MAX_INSTANCES, "instance2": MAX_INSTANCES },
+		MaxInstances: MAX_INSTANCES,
+		MaxShopStreams: MAX_SHOP_STREAMS,
+	}
+
+	factory := func() (model.System, error) {
+		return newAllocatorSystem(t, fleet), nil
+	}
+
+	for run := 0; run < *modelRuns; run++ {
+		seed := *modelSeed + int64(run)
+		err := model.Run(model.Config { Seed: seed, Batches: 10, Limits: limits, MaxShrinks: 30 }, factory)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fmt.Println(fmt.Sprintf("SUCCESS: TestModel seeds %d to %d", *modelSeed, *modelSeed + int64(*modelRuns) - 1))
+}
@@ -0,0 +1,429 @@
+// Package proxy forwards TLS connections to the instance serving a stream.
+// It listens on every port that has a placement, and since up to
+// MAX_INSTANCES instances share a port, it routes by the server name (SNI)
+// of the ClientHello, which has to be the stream name, like the confgen
+// templates do. The TLS session is not terminated: the ClientHello and the
+// rest of the connection are passed through untouched.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"loadbalancer/go/changefeed"
+)
+
+// ClientHellos are a few hundred bytes, or a few KiB with post-quantum key
+// shares
+const MAX_CLIENT_HELLO_LENGTH = 64 * 1024
+const DEFAULT_HELLO_TIMEOUT = 10 * time.Second
+const DEFAULT_DIAL_TIMEOUT = 5 * time.Second
+const DEFAULT_RELOAD_INTERVAL = time.Minute
+
+// How long a stream the source did not know is refused without asking it
+// again, and how many such streams are remembered
+const DEFAULT_UNKNOWN_TTL = 10 * time.Second
+const DEFAULT_MAX_UNKNOWN = 10000
+
+// Lookups of streams missing from the routes that may be in flight at once.
+// Connections past that are refused rather than queued.
+const DEFAULT_MAX_LOOKUPS = 16
+
+type Proxy struct {
+	// Address to listen on, all interfaces when empty
+	ListenHost string
+	HelloTimeout time.Duration
+	DialTimeout time.Duration
+
+	// Full reloads, as a safety net for missed change feed events
+	ReloadInterval time.Duration
+
+	UnknownTTL time.Duration
+	MaxUnknown int
+
+	source Source
+	mutex sync.Mutex
+	routes map[uint16]map[string]Route
+	// when lookups of streams, by port, stop being refused
+	unknown map[uint16]map[string]time.Time
+	unknownCount int
+	lookups chan struct{}
+	listeners map[uint16]net.Listener
+	connections sync.WaitGroup
+}
+
+func New(source Source) *Proxy {
+	return &Proxy {
+		HelloTimeout: DEFAULT_HELLO_TIMEOUT,
+		DialTimeout: DEFAULT_DIAL_TIMEOUT,
+		ReloadInterval: DEFAULT_RELOAD_INTERVAL,
+		UnknownTTL: DEFAULT_UNKNOWN_TTL,
+		MaxUnknown: DEFAULT_MAX_UNKNOWN,
+		source: source,
+		routes: map[uint16]map[string]Route {},
+		unknown: map[uint16]map[string]time.Time {},
+		lookups: make(chan struct{}, DEFAULT_MAX_LOOKUPS),
+		listeners: map[uint16]net.Listener {},
+	}
+}
+
+// Loads the routes and serves until ctx is done, then stops listening and
+// waits for open connections to finish. Failed reloads are logged and
+// retried at the next interval.
+func (p *Proxy) Run(ctx context.Context) error {
+	err := p.Reload(ctx)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(p.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.mutex.Lock()
+			for port, listener := range p.listeners {
+				listener.Close()
+				delete(p.listeners, port)
+			}
+
+			p.mutex.Unlock()
+			p.connections.Wait()
+			return nil
+		case <-ticker.C:
+			err = p.Reload(ctx)
+			if err != nil {
+				log.Printf("INFO: Proxy reload failed --> %v", err)
+			}
+		}
+	}
+}
+
+// Replaces every route with what the source has now
+func (p *Proxy) Reload(ctx context.Context) error {
+	routes, err := p.source.Routes(ctx)
+	if err != nil {
+		return err
+	}
+
+	table := map[uint16]map[string]Route {}
+	for _, route := range routes {
+		if _, present := table[route.Port]; !present {
+			table[route.Port] = map[string]Route {}
+		}
+
+		table[route.Port][route.Stream] = route
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.routes = table
+	p.syncListeners(ctx)
+	return nil
+}
+
+// For the change feed. Registrations and moves are looked up again through
+// the source, which knows the instance addresses. Lookup failures drop the
+// route rather than stop the feed, and connections for it then go to the
+// source themselves.
+func (p *Proxy) Handler(ctx context.Context) changefeed.Handler {
+	return func(event changefeed.Event) error {
+		switch e := event.(type) {
+		case changefeed.StreamRegistered:
+			p.refreshRoute(ctx, e.Stream, e.Port)
+		case changefeed.StreamMoved:
+			p.refreshRoute(ctx, e.Stream, e.Port)
+		case changefeed.StreamUnregistered:
+			p.mutex.Lock()
+			p.removeRoute(e.Stream, e.Port)
+			p.syncListeners(ctx)
+			p.mutex.Unlock()
+		}
+
+		return nil
+	}
+}
+
+func (p *Proxy) refreshRoute(ctx context.Context, stream string, port uint16) {
+	route, err := p.source.Route(ctx, stream)
+	if err != nil {
+		log.Printf("INFO: Proxy lookup of stream %v failed --> %v", stream, err)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.removeRoute(stream, port)
+	if route != nil {
+		p.addRoute(*route)
+	}
+
+	p.syncListeners(ctx)
+}
+
+// The routes, for inspection
+func (p *Proxy) Routes() []Route {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	routes := []Route {}
+	for _, streams := range p.routes {
+		for _, route := range streams {
+			routes = append(routes, route)
+		}
+	}
+
+	return routes
+}
+
+// Needs the mutex
+func (p *Proxy) addRoute(route Route) {
+	if _, present := p.routes[route.Port]; !present {
+		p.routes[route.Port] = map[string]Route {}
+	}
+
+	p.routes[route.Port][route.Stream] = route
+	p.forgetUnknown(route.Stream, route.Port)
+}
+
+// Needs the mutex
+func (p *Proxy) removeRoute(stream string, port uint16) {
+	delete(p.routes[port], stream)
+	if len(p.routes[port]) == 0 {
+		delete(p.routes, port)
+	}
+}
+
+// Listens on ports that gained routes and stops listening on ports that lost
+// all of theirs. Connections already open on those are left alone. Needs the
+// mutex.
+func (p *Proxy) syncListeners(ctx context.Context) {
+	for port := range p.routes {
+		if _, present := p.listeners[port]; present {
+			continue
+		}
+
+		listener, err := net.Listen("tcp", net.JoinHostPort(p.ListenHost, strconv.Itoa(int(port))))
+		if err != nil {
+			log.Printf("INFO: Proxy unable to listen on port %d --> %v", port, err)
+			continue
+		}
+
+		p.listeners[port] = listener
+		go p.accept(ctx, port, listener)
+	}
+
+	for port, listener := range p.listeners {
+		if _, present := p.routes[port]; !present {
+			listener.Close()
+			delete(p.listeners, port)
+		}
+	}
+}
+
+func (p *Proxy) accept(ctx context.Context, port uint16, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.connections.Add(1)
+		go func() {
+			defer p.connections.Done()
+			err := p.serve(ctx, port, conn)
+			if err != nil {
+				log.Printf("INFO: Proxy connection from %v on port %d --> %v", conn.RemoteAddr(), port, err)
+			}
+		}()
+	}
+}
+
+// Connections that cannot be routed are closed without a word, since the
+// client expects a TLS server
+func (p *Proxy) serve(ctx context.Context, port uint16, conn net.Conn) error {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(p.HelloTimeout))
+	stream, hello, err := peekServerName(conn)
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Time {})
+	route, err := p.lookup(ctx, port, stream)
+	if err != nil {
+		return err
+	}
+
+	if route == nil {
+		return fmt.Errorf("Stream %v is not registered on port %d", stream, port)
+	}
+
+	dialer := net.Dialer { Timeout: p.DialTimeout }
+	target, err := dialer.DialContext(ctx, "tcp", route.Target)
+	if err != nil {
+		return err
+	}
+
+	defer target.Close()
+	done := make(chan error, 1)
+	go func() {
+		// the ClientHello was read to route the connection, and goes first
+		_, err := io.Copy(target, io.MultiReader(bytes.NewReader(hello), conn))
+		closeWrite(target)
+		done <- err
+	}()
+
+	_, err = io.Copy(conn, target)
+	closeWrite(conn)
+	copyErr := <-done
+	if err == nil {
+		err = copyErr
+	}
+
+	return err
+}
+
+// The route table first, then the source, for streams registered since the
+// last reload or event. Anyone can name any stream, so streams the source
+// did not know are not asked about again for UnknownTTL, and only so many
+// lookups go to the source at once.
+func (p *Proxy) lookup(ctx context.Context, port uint16, stream string) (*Route, error) {
+	now := time.Now()
+	p.mutex.Lock()
+	route, present := p.routes[port][stream]
+	refusedUntil, unknown := p.unknown[port][stream]
+	p.mutex.Unlock()
+	if present {
+		return &route, nil
+	}
+
+	if unknown && now.Before(refusedUntil) {
+		return nil, nil
+	}
+
+	select {
+	case p.lookups <- struct{}{}:
+		defer func() { <-p.lookups }()
+	default:
+		return nil, fmt.Errorf("Too many lookups in flight for stream %v", stream)
+	}
+
+	found, err := p.source.Route(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if found == nil || found.Port != port {
+		p.rememberUnknown(stream, port, now.Add(p.UnknownTTL))
+		return nil, nil
+	}
+
+	p.addRoute(*found)
+	return found, nil
+}
+
+// Expired entries are swept when the limit is reached, and if that frees
+// nothing the stream is not remembered. Needs the mutex.
+func (p *Proxy) rememberUnknown(stream string, port uint16, until time.Time) {
+	if p.unknownCount >= p.MaxUnknown {
+		now := time.Now()
+		for port, streams := range p.unknown {
+			for stream, refusedUntil := range streams {
+				if !now.Before(refusedUntil) {
+					p.forgetUnknown(stream, port)
+				}
+			}
+		}
+
+		if p.unknownCount >= p.MaxUnknown {
+			return
+		}
+	}
+
+	if _, present := p.unknown[port]; !present {
+		p.unknown[port] = map[string]time.Time {}
+	}
+
+	if _, present := p.unknown[port][stream]; !present {
+		p.unknownCount++
+	}
+
+	p.unknown[port][stream] = until
+}
+
+// Needs the mutex
+func (p *Proxy) forgetUnknown(stream string, port uint16) {
+	if _, present := p.unknown[port][stream]; !present {
+		return
+	}
+
+	delete(p.unknown[port], stream)
+	p.unknownCount--
+	if len(p.unknown[port]) == 0 {
+		delete(p.unknown, port)
+	}
+}
+
+var errPeeked = errors.New("peeked")
+
+// The server name of the ClientHello conn starts with, and the bytes read to
+// find it. crypto/tls parses the ClientHello, over a conn that cannot write
+// so no alert reaches the client, and the handshake is stopped once it has.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	peeked := &bytes.Buffer {}
+	reader := io.TeeReader(io.LimitReader(conn, MAX_CLIENT_HELLO_LENGTH), peeked)
+	var serverName *string
+	config := &tls.Config {
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = &hello.ServerName
+			return nil, errPeeked
+		},
+	}
+
+	err := tls.Server(readOnlyConn { Conn: conn, reader: reader }, config).Handshake()
+	if serverName == nil {
+		return "", nil, fmt.Errorf("No TLS ClientHello --> %v", err)
+	}
+
+	if *serverName == "" {
+		return "", nil, fmt.Errorf("The ClientHello names no server")
+	}
+
+	return *serverName, peeked.Bytes(), nil
+}
+
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// serve closes the connection
+func (c readOnlyConn) Close() error {
+	return nil
+}
+
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"loadbalancer/go/changefeed"
+)
+
+// A local stand-in for the lb read APIs
+type testSource struct {
+	mutex sync.Mutex
+	routes map[string]Route
+	lookups int
+}
+
+func (s *testSource) Routes(ctx context.Context) ([]Route, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	routes := []Route {}
+	for _, route := range s.routes {
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+func (s *testSource) Route(ctx context.Context, stream string) (*Route, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lookups++
+	route, present := s.routes[stream]
+	if !present {
+		return nil, nil
+	}
+
+	return &route, nil
+}
+
+func (s *testSource) set(route Route) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.routes[route.Stream] = route
+}
+
+// A free port, found by listening on it for a moment
+func freePort(t *testing.T) uint16 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// A self-signed certificate for the backends, which the clients do not verify
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate {
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name { CommonName: "backend" },
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate { Certificate: [][]byte { der }, PrivateKey: key }
+}
+
+// Answers each line with the name of the backend and the line, over TLS. The
+// backends listen on other loopback addresses than the proxy, on the same
+// port.
+func backend(t *testing.T, ip string, port uint16, name string) net.Listener {
+	config := &tls.Config { Certificates: []tls.Certificate { testCertificate(t) } }
+	listener, err := tls.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(int(port))), config)
+	if err != nil {
+		t.Skipf("Unable to listen on %v, needs the whole loopback range ---> %v", ip, err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fmt.Fprintf(conn, "%v %v\n", name, scanner.Text())
+				}
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// Sends line over TLS with stream as the server name, and returns the reply,
+// or the error of a connection the proxy closed
+func send(t *testing.T, port uint16, stream string, line string) (string, error) {
+	raw, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := tls.Client(raw, &tls.Config { ServerName: stream, InsecureSkipVerify: true })
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, line + "\n")
+	if err != nil {
+		return "", err
+	}
+
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func expectReply(t *testing.T, port uint16, stream string, expected string) {
+	reply, err := send(t, port, stream, "hello")
+	if err != nil || reply != expected {
+		t.Fatalf("%v should have been answered with %q, got %q ---> %v", stream, expected, reply, err)
+	}
+}
+
+func TestProxyRoutesByStream(t *testing.T) {
+	port := freePort(t)
+	a := backend(t, "127.0.0.2", port, "a")
+	defer a.Close()
+	b := backend(t, "127.0.0.3", port, "b")
+	defer b.Close()
+
+	source := &testSource { routes: map[string]Route {} }
+	source.set(Route { Stream: "streamA", Port: port, Instance: "a", Target: a.Addr().String() })
+	p := New(source)
+	p.ListenHost = "127.0.0.1"
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitForRoutes(t, p, 1)
+	expectReply(t, port, "streamA", "a hello\n")
+
+	// registered after the load, and found through the source
+	source.set(Route { Stream: "streamB", Port: port, Instance: "b", Target: b.Addr().String() })
+	expectReply(t, port, "streamB", "b hello\n")
+
+	for i := 0; i < 3; i++ {
+		reply, err := send(t, port, "streamC", "hello")
+		if err == nil {
+			t.Fatalf("streamC should have been refused, got %q", reply)
+		}
+	}
+
+	source.mutex.Lock()
+	lookups := source.lookups
+	source.mutex.Unlock()
+	if lookups != 2 {
+		t.Fatalf("The source should have been asked about streamB and streamC once each, not %d times", lookups)
+	}
+
+	// without TLS there is no server name to route by
+	raw, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(raw, "STREAM streamA\nhello\n")
+	reply, err := bufio.NewReader(raw).ReadString('\n')
+	if err == nil {
+		t.Fatalf("A connection without a ClientHello should have been closed, got %q", reply)
+	}
+
+	fmt.Println("SUCCESS: TestProxyRoutesByStream")
+}
+
+func TestProxyFollowsChangeFeed(t *testing.T) {
+	port := freePort(t)
+	a := backend(t, "127.0.0.2", port, "a")
+	defer a.Close()
+	b := backend(t, "127.0.0.3", port, "b")
+	defer b.Close()
+
+	source := &testSource { routes: map[string]Route {} }
+	p := New(source)
+	p.ListenHost = "127.0.0.1"
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	handler := p.Handler(ctx)
+	source.set(Route { Stream: "streamA", Port: port, Instance: "a", Target: a.Addr().String() })
+	handler(changefeed.StreamRegistered { Stream: "streamA", Port: port, Instance: "a" })
+	expectReply(t, port, "streamA", "a hello\n")
+
+	source.set(Route { Stream: "streamA", Port: port, Instance: "b", Target: b.Addr().String() })
+	handler(changefeed.StreamMoved { Stream: "streamA", Port: port, Instance: "b", PreviousInstance: "a" })
+	expectReply(t, port, "streamA", "b hello\n")
+
+	handler(changefeed.StreamUnregistered { Stream: "streamA", Port: port, Instance: "b" })
+	if len(p.Routes()) != 0 {
+		t.Fatalf("Unregistering streamA should have left no routes, not %v", p.Routes())
+	}
+
+	_, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), time.Second)
+	if err == nil {
+		t.Fatal("The proxy should have stopped listening on a port without routes")
+	}
+
+	fmt.Println("SUCCESS: TestProxyFollowsChangeFeed")
+}
+
+func TestUnknownStreamsAreBounded(t *testing.T) {
+	source := &testSource { routes: map[string]Route {} }
+	p := New(source)
+	p.MaxUnknown = 2
+	for _, stream := range []string { "streamA", "streamB", "streamC" } {
+		route, err := p.lookup(context.TODO(), 1000, stream)
+		if route != nil || err != nil {
+			t.Fatalf("%v should have been unknown, not %v ---> %v", stream, route, err)
+		}
+	}
+
+	if p.unknownCount != 2 {
+		t.Fatalf("%d unknown streams are remembered rather than 2", p.unknownCount)
+	}
+
+	// expired, so swept to make room
+	p.unknown[1000]["streamA"] = time.Now().Add(-time.Second)
+	p.lookup(context.TODO(), 1000, "streamC")
+	_, present := p.unknown[1000]["streamC"]
+	if !present || p.unknownCount != 2 {
+		t.Fatalf("streamC should have replaced the expired streamA, not %v", p.unknown)
+	}
+
+	fmt.Println("SUCCESS: TestUnknownStreamsAreBounded")
+}
+
+func waitForRoutes(t *testing.T, p *Proxy, n int) {
+	for i := 0; i < 100; i++ {
+		if len(p.Routes()) == n {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("The proxy has %d routes rather than %d", len(p.Routes()), n)
+}
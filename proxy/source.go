@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	lb "loadbalancer/go"
+)
+
+// Where connections for a stream go. Target is the instance's private IP and
+// the stream's port.
+type Route struct {
+	ShopId string
+	Stream string
+	Port uint16
+	Instance string
+	Target string
+}
+
+// Where the proxy learns placements from
+type Source interface {
+	// Every placement
+	Routes(ctx context.Context) ([]Route, error)
+
+	// nil, with no error, for a stream that is not registered
+	Route(ctx context.Context, stream string) (*Route, error)
+}
+
+// Reads placements through the lb read APIs. The full listing goes through
+// GSIs, so it can miss placements made moments ago, which Route, reading
+// consistently, finds.
+type LbSource struct {}
+
+func (LbSource) Routes(ctx context.Context) ([]Route, error) {
+	instances, _, err := lb.ListInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []Route {}
+	for _, instance := range instances {
+		shops, _, err := lb.ListShopsOnInstance(instance.Instance)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range shops {
+			route, ok := toRoute(&shops[i])
+			if ok {
+				routes = append(routes, route)
+			}
+		}
+	}
+
+	return routes, nil
+}
+
+func (LbSource) Route(ctx context.Context, stream string) (*Route, error) {
+	shop, status, err := lb.GetShopByStream(stream)
+	if status == 400 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	route, ok := toRoute(shop)
+	if !ok {
+		return nil, nil
+	}
+
+	return &route, nil
+}
+
+// A shop whose instance has no private address cannot be routed to
+func toRoute(shop *lb.Shop) (Route, bool) {
+	if shop.PrivateIp == "" {
+		return Route {}, false
+	}
+
+	return Route {
+		ShopId: shop.ShopId,
+		Stream: shop.Stream,
+		Port: shop.Port,
+		Instance: shop.Instance,
+		Target: net.JoinHostPort(shop.PrivateIp, strconv.Itoa(int(shop.Port))),
+	}, true
+}
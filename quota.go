@@ -0,0 +1,490 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+
+	"loadbalancer/go/tables"
+)
+
+// Limits for a shop or a tenant group. Zero is no limit, except for the
+// MaxStreams of a shop, where it is MAX_SHOP_STREAMS.
+type Quota struct {
+	MaxStreams uint16
+	MaxPorts uint16
+	MaxInstances uint16
+}
+
+// Streams, distinct ports and distinct instances in use
+type Usage struct {
+	Streams uint16
+	Ports uint16
+	Instances uint16
+}
+
+// Sets the quota of a shop and the tenant group it belongs to, if any. The
+// shop's usage is recounted from its streams, and moved from the tenant it
+// was in before. From then on every Register, Unregister and Update for the
+// shop checks and updates the usage in the same transaction as the shop, so
+// concurrent requests cannot take it over its quotas. Shops without a quota
+// are only held to MAX_SHOP_STREAMS.
+func SetShopQuota(shopId string, quota Quota, tenant string) (int, error) {
+	return Default.SetShopQuota(shopId, quota, tenant)
+}
+
+func (a *Allocator) SetShopQuota(shopId string, quota Quota, tenant string) (int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 500, err
+	}
+
+	shopScope := tables.ShopScope(shopId)
+	oldQuota, err := tables.ConsistentGetQuota(ctx, ddb, shopScope)
+	if err != nil {
+		return 500, err
+	}
+
+	shopStreams, err := tables.ConsistentQueryShop(ctx, ddb, shopId)
+	if err != nil {
+		return 500, err
+	}
+
+	counted := tables.QuotaUsageType { Scope: shopScope, Ports: map[string]uint16 {}, Instances: map[string]uint16 {} }
+	for _, shop := range *shopStreams {
+		addUsage(&counted, shop.Port, shop.Instance)
+	}
+
+	newVersion := uuid.New().String()
+	shopUsage, err := tables.ConsistentGetQuotaUsage(ctx, ddb, shopScope)
+	if err != nil {
+		return 500, err
+	}
+
+	usagePut, err := tables.PutQuotaUsage(&counted, newVersion, shopUsage.Version)
+	if err != nil {
+		return 500, err
+	}
+
+	newQuota := tables.QuotaType {
+		Scope: shopScope,
+		MaxStreams: quota.MaxStreams,
+		MaxPorts: quota.MaxPorts,
+		MaxInstances: quota.MaxInstances,
+		Tenant: tenant,
+	}
+
+	quotaPut, err := tables.PutQuota(&newQuota)
+	if err != nil {
+		return 500, err
+	}
+
+	transactItems := []types.TransactWriteItem { quotaPut, usagePut }
+	oldTenant := ""
+	if oldQuota != nil {
+		oldTenant = oldQuota.Tenant
+	}
+
+	// A shop that was already in the tenant had its usage counted there as
+	// it changed. Otherwise it moves, as counted now.
+	if oldTenant != tenant {
+		for _, t := range []string { oldTenant, tenant } {
+			if t == "" {
+				continue
+			}
+
+			tenantUsage, err := tables.ConsistentGetQuotaUsage(ctx, ddb, tables.TenantScope(t))
+			if err != nil {
+				return 500, err
+			}
+
+			oldVersion := tenantUsage.Version
+			for _, shop := range *shopStreams {
+				if t == oldTenant {
+					removeUsage(tenantUsage, shop.Port, shop.Instance)
+				} else {
+					addUsage(tenantUsage, shop.Port, shop.Instance)
+				}
+			}
+
+			tenantPut, err := tables.PutQuotaUsage(tenantUsage, newVersion, oldVersion)
+			if err != nil {
+				return 500, err
+			}
+
+			transactItems = append(transactItems, tenantPut)
+		}
+	}
+
+	err = tables.TransactWrite(ctx, ddb, transactItems, newVersion)
+	if err != nil {
+		return 500, err
+	}
+
+	return 200, nil
+}
+
+func SetTenantQuota(tenant string, quota Quota) (int, error) {
+	return Default.SetTenantQuota(tenant, quota)
+}
+
+func (a *Allocator) SetTenantQuota(tenant string, quota Quota) (int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return 500, err
+	}
+
+	newQuota := tables.QuotaType {
+		Scope: tables.TenantScope(tenant),
+		MaxStreams: quota.MaxStreams,
+		MaxPorts: quota.MaxPorts,
+		MaxInstances: quota.MaxInstances,
+	}
+
+	quotaPut, err := tables.PutQuota(&newQuota)
+	if err != nil {
+		return 500, err
+	}
+
+	err = tables.TransactWrite(ctx, ddb, []types.TransactWriteItem { quotaPut }, uuid.New().String())
+	if err != nil {
+		return 500, err
+	}
+
+	return 200, nil
+}
+
+// Only shops with a quota have their usage tracked
+func GetShopUsage(shopId string) (*Usage, int, error) {
+	return Default.GetShopUsage(shopId)
+}
+
+func (a *Allocator) GetShopUsage(shopId string) (*Usage, int, error) {
+	return a.getUsage(tables.ShopScope(shopId))
+}
+
+func GetTenantUsage(tenant string) (*Usage, int, error) {
+	return Default.GetTenantUsage(tenant)
+}
+
+func (a *Allocator) GetTenantUsage(tenant string) (*Usage, int, error) {
+	return a.getUsage(tables.TenantScope(tenant))
+}
+
+func (a *Allocator) getUsage(scope string) (*Usage, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	usage, err := tables.ConsistentGetQuotaUsage(ctx, ddb, scope)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	return &Usage {
+		Streams: usage.Streams,
+		Ports: uint16(len(usage.Ports)),
+		Instances: uint16(len(usage.Instances)),
+	}, 200, nil
+}
+
+// A placement refused for going over a quota, rather than failing
+type quotaError struct {
+	reason string
+}
+
+func (e *quotaError) Error() string {
+	return e.reason
+}
+
+func isQuotaError(err error) bool {
+	var qe *quotaError
+	return errors.As(err, &qe)
+}
+
+type scopedUsage struct {
+	name string
+	quota tables.QuotaType
+	usage *tables.QuotaUsageType
+}
+
+// The quota scopes a shop is governed by, with their usage as read. A nil
+// governance, for a shop without a quota, allows everything and writes
+// nothing.
+type governance struct {
+	scopes []*scopedUsage
+}
+
+// nil for shops without a quota
+func loadGovernance(ctx context.Context, ddb tables.DynamoDBAPI, shopId string) (*governance, error) {
+	shopQuota, err := tables.ConsistentGetQuota(ctx, ddb, tables.ShopScope(shopId))
+	if err != nil || shopQuota == nil {
+		return nil, err
+	}
+
+	if shopQuota.MaxStreams == 0 {
+		shopQuota.MaxStreams = uint16(MAX_SHOP_STREAMS)
+	}
+
+	g := governance {
+		scopes: []*scopedUsage {
+			&scopedUsage { name: fmt.Sprintf("Shop %v", shopId), quota: *shopQuota },
+		},
+	}
+
+	if shopQuota.Tenant != "" {
+		tenantQuota, err := tables.ConsistentGetQuota(ctx, ddb, tables.TenantScope(shopQuota.Tenant))
+		if err != nil {
+			return nil, err
+		}
+
+		// usage is tracked for the tenant even before it gets a quota
+		if tenantQuota == nil {
+			tenantQuota = &tables.QuotaType { Scope: tables.TenantScope(shopQuota.Tenant) }
+		}
+
+		g.scopes = append(g.scopes, &scopedUsage { name: fmt.Sprintf("Tenant %v", shopQuota.Tenant), quota: *tenantQuota })
+	}
+
+	err = g.refresh(ctx, ddb)
+	if err != nil {
+		return nil, err
+	}
+
+	return &g, nil
+}
+
+// Rereads the usage, after a transaction may have failed on its version
+func (g *governance) refresh(ctx context.Context, ddb tables.DynamoDBAPI) error {
+	if g == nil {
+		return nil
+	}
+
+	for _, scope := range g.scopes {
+		usage, err := tables.ConsistentGetQuotaUsage(ctx, ddb, scope.quota.Scope)
+		if err != nil {
+			return err
+		}
+
+		scope.usage = usage
+	}
+
+	return nil
+}
+
+// Checks the limits that do not depend on the instance chosen, so Register
+// can fail early.
+func (g *governance) checkStream(port uint16) error {
+	if g == nil {
+		return nil
+	}
+
+	for _, scope := range g.scopes {
+		next := copyUsage(scope.usage)
+		addUsage(next, port, "")
+		delete(next.Instances, "")
+		err := scope.exceeds(next)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The versions of the usage as read, which the usage puts are conditioned on
+func (g *governance) versions() []string {
+	if g == nil {
+		return nil
+	}
+
+	versions := []string {}
+	for _, scope := range g.scopes {
+		versions = append(versions, scope.usage.Version)
+	}
+
+	return versions
+}
+
+// The usage puts for placing a stream on port and instance, writing the usage
+// as newVersion. Errors if any scope would go over its quota.
+func (g *governance) admit(newVersion string, port uint16, instance string) ([]types.TransactWriteItem, error) {
+	return g.change(newVersion, nil, &tables.PlacementType { Port: port, Instance: instance })
+}
+
+func (g *governance) release(newVersion string, port uint16, instance string) ([]types.TransactWriteItem, error) {
+	return g.change(newVersion, &tables.PlacementType { Port: port, Instance: instance }, nil)
+}
+
+// Moving a stream only counts against a quota for what it adds
+func (g *governance) swap(newVersion string, oldPort uint16, oldInstance string, newPort uint16, newInstance string) ([]types.TransactWriteItem, error) {
+	return g.change(newVersion, &tables.PlacementType { Port: oldPort, Instance: oldInstance }, &tables.PlacementType { Port: newPort, Instance: newInstance })
+}
+
+func (g *governance) change(newVersion string, removed *tables.PlacementType, added *tables.PlacementType) ([]types.TransactWriteItem, error) {
+	if g == nil {
+		return nil, nil
+	}
+
+	transactItems := []types.TransactWriteItem {}
+	for _, scope := range g.scopes {
+		next := copyUsage(scope.usage)
+		if removed != nil {
+			removeUsage(next, removed.Port, removed.Instance)
+		}
+
+		if added != nil {
+			addUsage(next, added.Port, added.Instance)
+			err := scope.exceeds(next)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		put, err := tables.PutQuotaUsage(next, newVersion, scope.usage.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		transactItems = append(transactItems, put)
+	}
+
+	return transactItems, nil
+}
+
+// Only growth past a limit is refused, so that lowering a quota below the
+// current usage does not stop streams from being moved or removed.
+func (s *scopedUsage) exceeds(next *tables.QuotaUsageType) error {
+	current := s.usage
+	if s.quota.MaxStreams > 0 && next.Streams > s.quota.MaxStreams && next.Streams > current.Streams {
+		return &quotaError { fmt.Sprintf("%v has reached its limit of %d streams", s.name, s.quota.MaxStreams) }
+	}
+
+	if s.quota.MaxPorts > 0 && len(next.Ports) > int(s.quota.MaxPorts) && len(next.Ports) > len(current.Ports) {
+		return &quotaError { fmt.Sprintf("%v has reached its limit of %d ports", s.name, s.quota.MaxPorts) }
+	}
+
+	if s.quota.MaxInstances > 0 && len(next.Instances) > int(s.quota.MaxInstances) && len(next.Instances) > len(current.Instances) {
+		return &quotaError { fmt.Sprintf("%v has reached its limit of %d instances", s.name, s.quota.MaxInstances) }
+	}
+
+	return nil
+}
+
+func copyUsage(usage *tables.QuotaUsageType) *tables.QuotaUsageType {
+	next := *usage
+	next.Ports = make(map[string]uint16, len(usage.Ports))
+	for k, v := range usage.Ports {
+		next.Ports[k] = v
+	}
+
+	next.Instances = make(map[string]uint16, len(usage.Instances))
+	for k, v := range usage.Instances {
+		next.Instances[k] = v
+	}
+
+	return &next
+}
+
+func addUsage(usage *tables.QuotaUsageType, port uint16, instance string) {
+	usage.Streams++
+	usage.Ports[strconv.Itoa(int(port))]++
+	usage.Instances[instance]++
+}
+
+// Counts never go below zero, for streams placed before the shop had a quota
+func removeUsage(usage *tables.QuotaUsageType, port uint16, instance string) {
+	if usage.Streams > 0 {
+		usage.Streams--
+	}
+
+	decrement(usage.Ports, strconv.Itoa(int(port)))
+	decrement(usage.Instances, instance)
+}
+
+func decrement(counts map[string]uint16, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+	} else {
+		counts[key]--
+	}
+}
+
+// What holds a shop without a quota to MAX_SHOP_STREAMS, see
+// tables.PutStreamsGuard. A nil guard, for a shop with a quota, allows
+// everything and writes nothing.
+type streamsGuard struct {
+	shopId string
+	streams int
+	version string
+}
+
+func loadStreamsGuard(ctx context.Context, ddb tables.DynamoDBAPI, shopId string) (*streamsGuard, error) {
+	guard := &streamsGuard { shopId: shopId }
+	return guard, guard.refresh(ctx, ddb)
+}
+
+// The version is read before the streams are counted, so that a registration
+// committed in between fails the condition instead of going uncounted.
+func (g *streamsGuard) refresh(ctx context.Context, ddb tables.DynamoDBAPI) error {
+	if g == nil {
+		return nil
+	}
+
+	guard, err := tables.ConsistentGetQuotaUsage(ctx, ddb, tables.StreamsScope(g.shopId))
+	if err != nil {
+		return err
+	}
+
+	shopStreams, err := tables.ConsistentQueryShop(ctx, ddb, g.shopId)
+	if err != nil {
+		return err
+	}
+
+	g.version, g.streams = guard.Version, len(*shopStreams)
+	return nil
+}
+
+// Errors if the shop cannot have added more streams
+func (g *streamsGuard) check(added int) error {
+	if g == nil || g.streams + added <= int(MAX_SHOP_STREAMS) {
+		return nil
+	}
+
+	return &quotaError { fmt.Sprintf("Shop %v has reached its limit of %d streams", g.shopId, MAX_SHOP_STREAMS) }
+}
+
+// The version the guard put is conditioned on
+func (g *streamsGuard) versions() []string {
+	if g == nil {
+		return nil
+	}
+
+	return []string { g.version }
+}
+
+// Adds the guard put to transactItems, for a transaction adding streams
+func (g *streamsGuard) put(transactItems []types.TransactWriteItem, newVersion string) ([]types.TransactWriteItem, error) {
+	if g == nil {
+		return transactItems, nil
+	}
+
+	put, err := tables.PutStreamsGuard(g.shopId, newVersion, g.version)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(transactItems, put), nil
+}
+
+// Once the transaction written with put has committed
+func (g *streamsGuard) committed(added int, newVersion string) {
+	if g != nil {
+		g.streams += added
+		g.version = newVersion
+	}
+}
@@ -0,0 +1,337 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"loadbalancer/go/address"
+	"loadbalancer/go/tables"
+)
+
+// A registered stream and where it is served from. PublicIp and PrivateIp
+// are the primary ones of Addresses.
+type Shop struct {
+	ShopId string
+	Stream string
+	Port uint16
+	Instance string
+	PublicIp string
+	PrivateIp string
+	Addresses address.Addresses
+}
+
+// UnhealthySince and Heartbeat are zero when the instance is healthy and
+// when it has no agent reporting, respectively. ActiveStreams is what the
+// agent reported serving at Heartbeat, and ActivePorts their ports, if it
+// reports them.
+type Instance struct {
+	Instance string
+	Streams uint8
+	Capacity uint8
+	PublicIp string
+	PrivateIp string
+	Addresses address.Addresses
+	Labels map[string]string
+	ActiveStreams uint8
+	ActivePorts []uint16
+	Cordoned bool
+	Healthy bool
+	HealthDetail string
+	UnhealthySince time.Time
+	Heartbeat time.Time
+}
+
+// Instances using a port, and how many more can use it
+type PortUsage struct {
+	Port uint16
+	Shops []Shop
+	Available uint8
+}
+
+// Every stream of a shop, in stream order. The status is 400 when the shop
+// has none, like Unregister does for streams.
+func GetShop(shopId string) ([]Shop, int, error) {
+	return Default.GetShop(shopId)
+}
+
+func (a *Allocator) GetShop(shopId string) ([]Shop, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	records, err := tables.ConsistentQueryShop(ctx, ddb, shopId)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	if len(*records) == 0 {
+		return nil, 400, fmt.Errorf("Shop %s does not exist", shopId)
+	}
+
+	shops := make([]Shop, len(*records))
+	for i := range *records {
+		result, err := a.withIps(ctx, ddb, &(*records)[i])
+		if err != nil {
+			return nil, 500, err
+		}
+
+		shops[i] = *result
+	}
+
+	return shops, 200, nil
+}
+
+func GetShopStream(shopId string, stream string) (*Shop, int, error) {
+	return Default.GetShopStream(shopId, stream)
+}
+
+func (a *Allocator) GetShopStream(shopId string, stream string) (*Shop, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	shop, err := tables.ConsistentGetShop(ctx, ddb, shopId, stream)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	if shop == nil {
+		return nil, 400, fmt.Errorf("Stream %s of shop %s does not exist", stream, shopId)
+	}
+
+	result, err := a.withIps(ctx, ddb, shop)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	return result, 200, nil
+}
+
+func GetShopByStream(stream string) (*Shop, int, error) {
+	return Default.GetShopByStream(stream)
+}
+
+func (a *Allocator) GetShopByStream(stream string) (*Shop, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	shop, status, err := a.findStreamShop(ctx, ddb, stream)
+	if status != 200 {
+		return nil, status, err
+	}
+
+	result, err := a.withIps(ctx, ddb, shop)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	return result, 200, nil
+}
+
+// Read from a GSI, so a shop placed or removed moments ago may not show up
+// yet. Shops are in port order.
+func ListShopsOnInstance(instance string) ([]Shop, int, error) {
+	return Default.ListShopsOnInstance(instance)
+}
+
+func (a *Allocator) ListShopsOnInstance(instance string) ([]Shop, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	addresses, err := a.resolveAddresses(ctx, ddb, instance)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	records, err := tables.QueryShopsByInstance(ctx, ddb, instance)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	shops := make([]Shop, len(*records))
+	for i := range *records {
+		shops[i] = toShop(&(*records)[i], addresses)
+	}
+
+	return shops, 200, nil
+}
+
+// Every instance with its load, ordered by name. The loads come from a scan
+// and are only as fresh as an eventually consistent read.
+func ListInstances() ([]Instance, int, error) {
+	return Default.ListInstances()
+}
+
+func (a *Allocator) ListInstances() ([]Instance, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	records, err := tables.ScanInstances(ctx, ddb)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	instances := make([]Instance, len(*records))
+	for i, record := range *records {
+		addresses, err := a.resolveAddresses(ctx, ddb, record.Instance)
+		if err != nil {
+			return nil, 500, err
+		}
+
+		instances[i] = toInstance(&record)
+
+		if addresses != nil {
+			instances[i].PublicIp, instances[i].PrivateIp = addresses.PublicIp(), addresses.PrivateIp()
+			instances[i].Addresses = *addresses
+		}
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Instance < instances[j].Instance })
+	return instances, 200, nil
+}
+
+// Every registered stream, ordered by stream. Read with a scan, so as fresh
+// as an eventually consistent read.
+func ListAllocations() ([]Shop, int, error) {
+	return Default.ListAllocations()
+}
+
+func (a *Allocator) ListAllocations() ([]Shop, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	records, err := tables.ScanShops(ctx, ddb)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	instanceAddresses := map[string]*address.Addresses {}
+	shops := make([]Shop, len(*records))
+	for i := range *records {
+		record := &(*records)[i]
+		addresses, present := instanceAddresses[record.Instance]
+		if !present {
+			addresses, err = a.resolveAddresses(ctx, ddb, record.Instance)
+			if err != nil {
+				return nil, 500, err
+			}
+
+			instanceAddresses[record.Instance] = addresses
+		}
+
+		shops[i] = toShop(record, addresses)
+	}
+
+	sort.Slice(shops, func(i, j int) bool { return shops[i].Stream < shops[j].Stream })
+	return shops, 200, nil
+}
+
+func GetPortUsage(port uint16) (*PortUsage, int, error) {
+	return Default.GetPortUsage(port)
+}
+
+func (a *Allocator) GetPortUsage(port uint16) (*PortUsage, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	instanceNamesUsingPort, err := tables.QueryInstancesUsingPort(ctx, ddb, port)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	usage := PortUsage {
+		Port: port,
+		Shops: []Shop {},
+	}
+
+	for _, record := range *instanceNamesUsingPort {
+		shop, err := tables.QueryShopByInstancePort(ctx, ddb, record.Instance, port)
+		if err != nil {
+			return nil, 500, err
+		}
+
+		// The instancePorts row is written in the same transaction as the
+		// shop, so only the GSI can be missing it.
+		if shop == nil {
+			shop = &tables.ShopType { Port: port, Instance: record.Instance }
+		}
+
+		result, err := a.withIps(ctx, ddb, shop)
+		if err != nil {
+			return nil, 500, err
+		}
+
+		usage.Shops = append(usage.Shops, *result)
+	}
+
+	if len(usage.Shops) < int(MAX_INSTANCES) {
+		usage.Available = MAX_INSTANCES - uint8(len(usage.Shops))
+	}
+
+	return &usage, 200, nil
+}
+
+func (a *Allocator) withIps(ctx context.Context, ddb tables.DynamoDBAPI, shop *tables.ShopType) (*Shop, error) {
+	addresses, err := a.resolveAddresses(ctx, ddb, shop.Instance)
+	if err != nil {
+		return nil, err
+	}
+
+	result := toShop(shop, addresses)
+	return &result, nil
+}
+
+// Missing addresses leave the IPs empty rather than failing a read
+func toShop(shop *tables.ShopType, addresses *address.Addresses) Shop {
+	result := Shop {
+		ShopId: shop.ShopId,
+		Stream: shop.Stream,
+		Port: shop.Port,
+		Instance: shop.Instance,
+	}
+
+	if addresses != nil {
+		result.PublicIp, result.PrivateIp = addresses.PublicIp(), addresses.PrivateIp()
+		result.Addresses = *addresses
+	}
+
+	return result
+}
+
+func toInstance(record *tables.InstanceType) Instance {
+	instance := Instance {
+		Instance: record.Instance,
+		Streams: record.Streams,
+		Capacity: capacityOf(record),
+		Labels: record.Labels,
+		ActiveStreams: record.ActiveStreams,
+		ActivePorts: record.ActivePorts,
+		Cordoned: record.Cordoned,
+		Healthy: !record.Unhealthy,
+		HealthDetail: record.HealthDetail,
+	}
+
+	if record.UnhealthySince != 0 {
+		instance.UnhealthySince = time.Unix(record.UnhealthySince, 0)
+	}
+
+	if record.Heartbeat != 0 {
+		instance.Heartbeat = time.Unix(record.Heartbeat, 0)
+	}
+
+	return instance
+}
@@ -0,0 +1,48 @@
+package reconcile
+
+import (
+	"context"
+
+	lb "loadbalancer/go"
+)
+
+// What the reconciler reads the allocations through, and corrects them with
+type Backend interface {
+	Instances(ctx context.Context) ([]lb.Instance, error)
+
+	// The streams placed on instance
+	Streams(ctx context.Context, instance string) ([]lb.Shop, error)
+
+	// Returns the Streams of instance before and after the repair
+	RepairStreamCount(ctx context.Context, instance string) (uint8, uint8, error)
+	Move(ctx context.Context, shopId string, stream string) error
+	Unregister(ctx context.Context, shopId string, stream string) error
+}
+
+// Goes through the lb APIs
+type LbBackend struct {}
+
+func (LbBackend) Instances(ctx context.Context) ([]lb.Instance, error) {
+	instances, _, err := lb.ListInstances()
+	return instances, err
+}
+
+func (LbBackend) Streams(ctx context.Context, instance string) ([]lb.Shop, error) {
+	shops, _, err := lb.ListShopsOnInstance(instance)
+	return shops, err
+}
+
+func (LbBackend) RepairStreamCount(ctx context.Context, instance string) (uint8, uint8, error) {
+	before, after, _, err := lb.RepairStreamCount(instance)
+	return before, after, err
+}
+
+func (LbBackend) Move(ctx context.Context, shopId string, stream string) error {
+	_, _, _, err := lb.Move(shopId, stream)
+	return err
+}
+
+func (LbBackend) Unregister(ctx context.Context, shopId string, stream string) error {
+	_, err := lb.UnregisterShopStream(shopId, stream)
+	return err
+}
@@ -0,0 +1,240 @@
+// Package reconcile compares the allocations in the tables with what the
+// instances' agents report actually serving, reports where they drift
+// apart, and corrects the drift according to a policy.
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	lb "loadbalancer/go"
+)
+
+const DEFAULT_CONFIRMATIONS = 2
+const DEFAULT_MAX_REPORT_AGE = 2 * time.Minute
+const DEFAULT_RECONCILE_INTERVAL = time.Minute
+
+type Kind string
+
+const (
+	// Streams of an instance differs from the streams placed on it
+	DriftStreamCount Kind = "stream count"
+
+	// A stream placed on an instance whose agent does not report its port
+	DriftLostStream Kind = "lost stream"
+
+	// A port an agent reports active with no stream placed on it
+	DriftUnknownPort Kind = "unknown port"
+
+	// An agent that only counts its streams counts other than Streams
+	DriftActiveCount Kind = "active count"
+)
+
+// What is done with lost streams
+type LostPolicy string
+
+const (
+	LostReport LostPolicy = "report"
+
+	// Moved to another instance, keeping their name and port
+	LostMove LostPolicy = "move"
+	LostUnregister LostPolicy = "unregister"
+)
+
+// Expected is what the tables say and Actual what was found. Seen is the
+// number of passes in a row the drift has been found in, and Action what
+// was done about it, if anything.
+type Drift struct {
+	Kind Kind
+	Instance string
+	ShopId string `json:",omitempty"`
+	Stream string `json:",omitempty"`
+	Port uint16 `json:",omitempty"`
+	Expected int
+	Actual int
+	Seen int
+	Action string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// Unreported are the instances whose agents have not reported within
+// MaxReportAge, which are only checked for DriftStreamCount.
+type Report struct {
+	Time time.Time
+	Instances int
+	Unreported []string
+	Drifts []Drift
+}
+
+// Only acts on a drift once it has been seen in Confirmations passes in a
+// row, since the tables and the agents' reports are not read at the same
+// moment, and a stream registered moments ago is not served yet.
+// DriftUnknownPort and DriftActiveCount are only ever reported.
+type Reconciler struct {
+	// Corrects DriftStreamCount, see lb.RepairStreamCount
+	FixCounts bool
+	Lost LostPolicy
+	Confirmations int
+	MaxReportAge time.Duration
+
+	// Between passes of Run
+	Interval time.Duration
+
+	backend Backend
+	now func() time.Time
+	seen map[string]int
+}
+
+func New(backend Backend) *Reconciler {
+	return &Reconciler {
+		Lost: LostReport,
+		Confirmations: DEFAULT_CONFIRMATIONS,
+		MaxReportAge: DEFAULT_MAX_REPORT_AGE,
+		Interval: DEFAULT_RECONCILE_INTERVAL,
+		backend: backend,
+		now: time.Now,
+		seen: map[string]int {},
+	}
+}
+
+// Reconciles every Interval until ctx is done, handing each report to
+// handle. Failed passes are logged.
+func (r *Reconciler) Run(ctx context.Context, handle func(*Report)) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		report, err := r.Reconcile(ctx)
+		if err != nil {
+			log.Printf("INFO: Reconciliation failed --> %v", err)
+		} else {
+			handle(report)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// One pass over every instance
+func (r *Reconciler) Reconcile(ctx context.Context) (*Report, error) {
+	instances, err := r.backend.Instances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := Report {
+		Time: r.now(),
+		Instances: len(instances),
+		Unreported: []string {},
+		Drifts: []Drift {},
+	}
+
+	seen := map[string]int {}
+	for _, instance := range instances {
+		shops, err := r.backend.Streams(ctx, instance.Instance)
+		if err != nil {
+			return nil, err
+		}
+
+		drifts := []Drift {}
+		if int(instance.Streams) != len(shops) {
+			drifts = append(drifts, Drift { Kind: DriftStreamCount, Instance: instance.Instance, Expected: int(instance.Streams), Actual: len(shops) })
+		}
+
+		if instance.Heartbeat.IsZero() || r.now().Sub(instance.Heartbeat) > r.MaxReportAge {
+			report.Unreported = append(report.Unreported, instance.Instance)
+		} else {
+			drifts = append(drifts, agentDrifts(&instance, shops)...)
+		}
+
+		for i := range drifts {
+			drift := &drifts[i]
+			key := driftKey(drift)
+			seen[key] = r.seen[key] + 1
+			drift.Seen = seen[key]
+			if drift.Seen >= r.Confirmations {
+				r.correct(ctx, drift)
+			}
+		}
+
+		report.Drifts = append(report.Drifts, drifts...)
+	}
+
+	// drifts not found in this pass start over
+	r.seen = seen
+	return &report, nil
+}
+
+// Compares the streams placed on an instance with what its agent reports
+func agentDrifts(instance *lb.Instance, shops []lb.Shop) []Drift {
+	drifts := []Drift {}
+	if instance.ActivePorts == nil {
+		if int(instance.ActiveStreams) != len(shops) {
+			drifts = append(drifts, Drift { Kind: DriftActiveCount, Instance: instance.Instance, Expected: len(shops), Actual: int(instance.ActiveStreams) })
+		}
+
+		return drifts
+	}
+
+	active := map[uint16]bool {}
+	for _, port := range instance.ActivePorts {
+		active[port] = true
+	}
+
+	placed := map[uint16]bool {}
+	for _, shop := range shops {
+		placed[shop.Port] = true
+		if !active[shop.Port] {
+			drifts = append(drifts, Drift { Kind: DriftLostStream, Instance: instance.Instance, ShopId: shop.ShopId, Stream: shop.Stream, Port: shop.Port, Expected: 1, Actual: 0 })
+		}
+	}
+
+	unknown := []uint16 {}
+	for port := range active {
+		if !placed[port] {
+			unknown = append(unknown, port)
+		}
+	}
+
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i] < unknown[j] })
+	for _, port := range unknown {
+		drifts = append(drifts, Drift { Kind: DriftUnknownPort, Instance: instance.Instance, Port: port, Expected: 0, Actual: 1 })
+	}
+
+	return drifts
+}
+
+func (r *Reconciler) correct(ctx context.Context, drift *Drift) {
+	var err error
+	switch {
+	case drift.Kind == DriftStreamCount && r.FixCounts:
+		var before, after uint8
+		before, after, err = r.backend.RepairStreamCount(ctx, drift.Instance)
+		drift.Action = fmt.Sprintf("stream count %d -> %d", before, after)
+	case drift.Kind == DriftLostStream && r.Lost == LostMove:
+		err = r.backend.Move(ctx, drift.ShopId, drift.Stream)
+		drift.Action = "moved"
+	case drift.Kind == DriftLostStream && r.Lost == LostUnregister:
+		err = r.backend.Unregister(ctx, drift.ShopId, drift.Stream)
+		drift.Action = "unregistered"
+	default:
+		return
+	}
+
+	if err != nil {
+		drift.Action, drift.Error = "", err.Error()
+		log.Printf("INFO: Unable to correct %v drift on %v %v --> %v", drift.Kind, drift.Instance, drift.Stream, err)
+	} else {
+		log.Printf("INFO: Corrected %v drift on %v %v: %v", drift.Kind, drift.Instance, drift.Stream, drift.Action)
+	}
+}
+
+func driftKey(drift *Drift) string {
+	return fmt.Sprintf("%v|%v|%v|%d", drift.Kind, drift.Instance, drift.Stream, drift.Port)
+}
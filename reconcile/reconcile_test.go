@@ -0,0 +1,124 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	lb "loadbalancer/go"
+)
+
+type fakeBackend struct {
+	instances []lb.Instance
+	streams map[string][]lb.Shop
+	repaired []string
+	moved []string
+	unregistered []string
+}
+
+func (b *fakeBackend) Instances(ctx context.Context) ([]lb.Instance, error) {
+	return b.instances, nil
+}
+
+func (b *fakeBackend) Streams(ctx context.Context, instance string) ([]lb.Shop, error) {
+	return b.streams[instance], nil
+}
+
+func (b *fakeBackend) RepairStreamCount(ctx context.Context, instance string) (uint8, uint8, error) {
+	b.repaired = append(b.repaired, instance)
+	return 2, 1, nil
+}
+
+func (b *fakeBackend) Move(ctx context.Context, shopId string, stream string) error {
+	b.moved = append(b.moved, stream)
+	return nil
+}
+
+func (b *fakeBackend) Unregister(ctx context.Context, shopId string, stream string) error {
+	b.unregistered = append(b.unregistered, stream)
+	return nil
+}
+
+var testNow = time.Unix(10000, 0)
+
+func newTestBackend() *fakeBackend {
+	return &fakeBackend {
+		instances: []lb.Instance {
+			// Streams says 2 where 1 is placed, and 11001 is served
+			// instead of 11000
+			lb.Instance { Instance: "i-1", Streams: 2, Heartbeat: testNow, ActivePorts: []uint16 { 11001 } },
+			// counts only, and one short
+			lb.Instance { Instance: "i-2", Streams: 2, Heartbeat: testNow, ActiveStreams: 1 },
+			// no recent report
+			lb.Instance { Instance: "i-3", Streams: 1, Heartbeat: testNow.Add(-time.Hour) },
+		},
+		streams: map[string][]lb.Shop {
+			"i-1": []lb.Shop { lb.Shop { ShopId: "shop0", Stream: "stream0", Port: 11000, Instance: "i-1" } },
+			"i-2": []lb.Shop {
+				lb.Shop { ShopId: "shop1", Stream: "stream1", Port: 11000, Instance: "i-2" },
+				lb.Shop { ShopId: "shop2", Stream: "stream2", Port: 11002, Instance: "i-2" },
+			},
+			"i-3": []lb.Shop { lb.Shop { ShopId: "shop3", Stream: "stream3", Port: 11003, Instance: "i-3" } },
+		},
+	}
+}
+
+func TestReport(t *testing.T) {
+	r := New(newTestBackend())
+	r.now = func() time.Time { return testNow }
+	report, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := []Kind {}
+	for _, drift := range report.Drifts {
+		kinds = append(kinds, drift.Kind)
+		if drift.Action != "" {
+			t.Fatalf("Nothing should be corrected by default: %v", drift)
+		}
+	}
+
+	expected := fmt.Sprint([]Kind { DriftStreamCount, DriftLostStream, DriftUnknownPort, DriftActiveCount })
+	if fmt.Sprint(kinds) != expected || len(report.Unreported) != 1 || report.Unreported[0] != "i-3" {
+		t.Fatalf("Expected %v drifts and i-3 unreported: %+v", expected, report)
+	}
+
+	fmt.Println("SUCCESS: TestReport")
+}
+
+func TestCorrections(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend()
+	r := New(backend)
+	r.now = func() time.Time { return testNow }
+	r.FixCounts = true
+	r.Lost = LostMove
+	r.Reconcile(ctx)
+	if len(backend.repaired) != 0 || len(backend.moved) != 0 {
+		t.Fatal("Nothing should be corrected before the drifts are confirmed")
+	}
+
+	report, _ := r.Reconcile(ctx)
+	if fmt.Sprint(backend.repaired) != "[i-1]" || fmt.Sprint(backend.moved) != "[stream0]" || report.Drifts[1].Action != "moved" || report.Drifts[1].Seen != 2 {
+		t.Fatalf("i-1 should have been repaired and stream0 moved: %v %v %+v", backend.repaired, backend.moved, report.Drifts)
+	}
+
+	// a drift missing from one pass has to be confirmed again
+	backend.instances[0].ActivePorts = []uint16 { 11000 }
+	r.Reconcile(ctx)
+	backend.instances[0].ActivePorts = []uint16 {}
+	r.Lost = LostUnregister
+	r.Reconcile(ctx)
+	if len(backend.unregistered) != 0 {
+		t.Fatalf("stream0 should not have been unregistered on its first sighting: %v", backend.unregistered)
+	}
+
+	r.Reconcile(ctx)
+	if fmt.Sprint(backend.unregistered) != "[stream0]" {
+		t.Fatalf("stream0 should have been unregistered: %v", backend.unregistered)
+	}
+
+	fmt.Println("SUCCESS: TestCorrections")
+}
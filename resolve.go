@@ -0,0 +1,49 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+
+	"loadbalancer/go/address"
+	"loadbalancer/go/tables"
+)
+
+// Changes where the addresses of Default come from, e.g. to a cached EC2 or
+// file resolver. Meant to be called once, before anything else in the
+// package.
+func SetAddressResolver(resolver address.AddressResolver) {
+	Default.SetAddressResolver(resolver)
+}
+
+// nil is the instanceIp table
+func (a *Allocator) SetAddressResolver(resolver address.AddressResolver) {
+	a.resolver = resolver
+}
+
+// nil when the instance has no addresses
+func (a *Allocator) resolveAddresses(ctx context.Context, ddb tables.DynamoDBAPI, instance string) (*address.Addresses, error) {
+	if a.addresses != nil {
+		return a.addresses.Resolve(ctx, instance)
+	}
+
+	resolver := a.resolver
+	if resolver == nil {
+		resolver = address.NewTableResolver(ddb)
+	}
+
+	return resolver.Resolve(ctx, instance)
+}
+
+// The primary public and private addresses, which have to be there
+func (a *Allocator) resolveIps(ctx context.Context, ddb tables.DynamoDBAPI, instance string) (string, string, error) {
+	addresses, err := a.resolveAddresses(ctx, ddb, instance)
+	if err != nil {
+		return "", "", err
+	}
+
+	if addresses == nil {
+		return "", "", fmt.Errorf("Instance ip information for %v is absent", instance)
+	}
+
+	return addresses.PublicIp(), addresses.PrivateIp(), nil
+}
@@ -0,0 +1,143 @@
+// Package sdexport writes the allocations out for service discovery, as
+// Prometheus file_sd target groups or a Consul style catalog, one target per
+// stream, at the instance address and the stream's port.
+package sdexport
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+
+	lb "loadbalancer/go"
+	"loadbalancer/go/confgen"
+)
+
+const DEFAULT_SERVICE_NAME = "lb-stream"
+
+// Labels set on every file_sd target. "instance" is left to Prometheus,
+// which sets it to the target address.
+const (
+	LABEL_SHOP_ID = "lb_shop_id"
+	LABEL_STREAM = "lb_stream"
+	LABEL_INSTANCE = "lb_instance"
+	LABEL_PORT = "lb_port"
+)
+
+type Options struct {
+	// Targets use the public address of the instance rather than its private
+	// one. Allocations without the address are left out.
+	Public bool
+
+	// The service every allocation is registered as in the catalog
+	ServiceName string
+}
+
+// One element of a file_sd file
+type TargetGroup struct {
+	Targets []string `json:"targets"`
+	Labels map[string]string `json:"labels"`
+}
+
+// One element of a catalog, as Consul returns them for /v1/catalog/service
+type CatalogService struct {
+	Node string
+	Address string
+	ServiceID string
+	ServiceName string
+	ServiceAddress string
+	ServicePort uint16
+	ServiceTags []string
+	ServiceMeta map[string]string
+}
+
+func (o Options) address(shop *lb.Shop) string {
+	if o.Public {
+		return shop.PublicIp
+	}
+
+	return shop.PrivateIp
+}
+
+func (o Options) serviceName() string {
+	if o.ServiceName == "" {
+		return DEFAULT_SERVICE_NAME
+	}
+
+	return o.ServiceName
+}
+
+// In the order of the allocations
+func FileSD(allocations []lb.Shop, options Options) []TargetGroup {
+	groups := []TargetGroup {}
+	for i := range allocations {
+		shop := &allocations[i]
+		ip := options.address(shop)
+		if ip == "" {
+			continue
+		}
+
+		groups = append(groups, TargetGroup {
+			Targets: []string { net.JoinHostPort(ip, strconv.Itoa(int(shop.Port))) },
+			Labels: map[string]string {
+				LABEL_SHOP_ID: shop.ShopId,
+				LABEL_STREAM: shop.Stream,
+				LABEL_INSTANCE: shop.Instance,
+				LABEL_PORT: strconv.Itoa(int(shop.Port)),
+			},
+		})
+	}
+
+	return groups
+}
+
+// Nodes are the instances, and each stream is a service instance with its
+// stream name as ServiceID, tagged with its shop.
+func ConsulCatalog(allocations []lb.Shop, options Options) []CatalogService {
+	services := []CatalogService {}
+	for i := range allocations {
+		shop := &allocations[i]
+		ip := options.address(shop)
+		if ip == "" {
+			continue
+		}
+
+		services = append(services, CatalogService {
+			Node: shop.Instance,
+			Address: ip,
+			ServiceID: shop.Stream,
+			ServiceName: options.serviceName(),
+			ServiceAddress: ip,
+			ServicePort: shop.Port,
+			ServiceTags: []string { "shop:" + shop.ShopId },
+			ServiceMeta: map[string]string {
+				"shopId": shop.ShopId,
+				"stream": shop.Stream,
+				"instance": shop.Instance,
+			},
+		})
+	}
+
+	return services
+}
+
+// For confgen.NewRenderWatcher
+func FileSDRenderer(options Options) confgen.Renderer {
+	return func(allocations []lb.Shop) ([]byte, error) {
+		return marshal(FileSD(allocations, options))
+	}
+}
+
+func ConsulCatalogRenderer(options Options) confgen.Renderer {
+	return func(allocations []lb.Shop) ([]byte, error) {
+		return marshal(ConsulCatalog(allocations, options))
+	}
+}
+
+func marshal(v interface {}) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
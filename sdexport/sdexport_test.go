@@ -0,0 +1,57 @@
+package sdexport
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	lb "loadbalancer/go"
+)
+
+var testAllocations = []lb.Shop {
+	lb.Shop { ShopId: "shop0", Stream: "stream0", Port: 11000, Instance: "i-1", PublicIp: "203.0.113.1", PrivateIp: "10.0.0.1" },
+	lb.Shop { ShopId: "shop1", Stream: "stream1", Port: 11001, Instance: "i-2", PrivateIp: "fd00::2" },
+}
+
+func TestFileSD(t *testing.T) {
+	data, err := FileSDRenderer(Options {})(testAllocations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var groups []TargetGroup
+	err = json.Unmarshal(data, &groups)
+	if err != nil {
+		t.Fatalf("file_sd output should be JSON ---> %v\n%s", err, data)
+	}
+
+	if len(groups) != 2 || groups[1].Targets[0] != "[fd00::2]:11001" || groups[0].Labels[LABEL_SHOP_ID] != "shop0" || groups[0].Labels[LABEL_INSTANCE] != "i-1" {
+		t.Fatalf("Unexpected target groups %v", groups)
+	}
+
+	public := FileSD(testAllocations, Options { Public: true })
+	if len(public) != 1 || public[0].Targets[0] != "203.0.113.1:11000" {
+		t.Fatalf("Only stream0 has a public address: %v", public)
+	}
+
+	fmt.Println("SUCCESS: TestFileSD")
+}
+
+func TestConsulCatalog(t *testing.T) {
+	data, err := ConsulCatalogRenderer(Options { ServiceName: "game" })(testAllocations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var services []CatalogService
+	err = json.Unmarshal(data, &services)
+	if err != nil {
+		t.Fatalf("Catalog output should be JSON ---> %v\n%s", err, data)
+	}
+
+	if len(services) != 2 || services[0].ServiceName != "game" || services[0].ServiceID != "stream0" || services[0].ServicePort != 11000 || services[1].Node != "i-2" {
+		t.Fatalf("Unexpected catalog %v", services)
+	}
+
+	fmt.Println("SUCCESS: TestConsulCatalog")
+}
@@ -0,0 +1,211 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/go/tables"
+)
+
+// How many times the Stream GSI is read for a stream it is behind on, and
+// how long to wait before each read after the first, times the attempt
+const STALE_READ_ATTEMPTS = 4
+const STALE_READ_BACKOFF = 50 * time.Millisecond
+
+// How often the instances are scanned for ones the Streams GSI missed when
+// nothing showed it to be behind
+const MISSED_INSTANCE_SCAN_INTERVAL = 10 * time.Second
+
+// The global secondary indexes are eventually consistent. Their results are
+// checked against consistent reads of the tables behind them, and these are
+// the results found stale since the allocator was made.
+type StaleReads struct {
+	// Instances whose Streams the Streams GSI had wrong
+	InstanceCounts uint64
+	// Instances with room the Streams GSI did not have, found by the
+	// consistent scan made when none of those it had could take a stream
+	InstancesMissed uint64
+	// Consistent scans made for those
+	Scans uint64
+	// Streams the Stream GSI had no shop, or another shop, for
+	StreamOwners uint64
+	// Reads of the Stream GSI repeated because of those
+	Retries uint64
+}
+
+type staleCounters struct {
+	instanceCounts atomic.Uint64
+	instancesMissed atomic.Uint64
+	streamOwners atomic.Uint64
+	retries atomic.Uint64
+	scans atomic.Uint64
+	// UnixNano of the last scan for missed instances
+	lastScan atomic.Int64
+}
+
+func GetStaleReads() StaleReads {
+	return Default.GetStaleReads()
+}
+
+func (a *Allocator) GetStaleReads() StaleReads {
+	return StaleReads {
+		InstanceCounts: a.stale.instanceCounts.Load(),
+		InstancesMissed: a.stale.instancesMissed.Load(),
+		StreamOwners: a.stale.streamOwners.Load(),
+		Retries: a.stale.retries.Load(),
+		Scans: a.stale.scans.Load(),
+	}
+}
+
+// The shop record of a stream. streamNames has the shop of streams
+// registered since it was recorded there, so it is read consistently. For
+// older streams the Stream GSI is queried, and its answer checked against the
+// shop record, until the two agree. The status is 400 if the stream does not
+// exist, and 503 if the GSI did not catch up within STALE_READ_ATTEMPTS.
+func (a *Allocator) findStreamShop(ctx context.Context, ddb tables.DynamoDBAPI, stream string) (*tables.ShopType, int, error) {
+	for attempt := 1; ; attempt++ {
+		streamRecord, err := tables.ConsistentGetStream(ctx, ddb, stream)
+		if err != nil {
+			return nil, 500, err
+		}
+
+		if streamRecord == nil {
+			return nil, 400, fmt.Errorf("Stream %s does not exist", stream)
+		}
+
+		shopId := streamRecord.ShopId
+		if shopId == "" {
+			shopId, err = tables.QueryShopIdByStream(ctx, ddb, stream)
+			if err != nil {
+				return nil, 500, err
+			}
+		}
+
+		if shopId != "" {
+			shop, err := tables.ConsistentGetShop(ctx, ddb, shopId, stream)
+			if err != nil {
+				return nil, 500, err
+			}
+
+			if shop != nil {
+				return shop, 200, nil
+			}
+		}
+
+		// otherwise the stream changed hands between the reads, or the GSI
+		// is behind
+		if streamRecord.ShopId == "" {
+			a.stale.streamOwners.Add(1)
+		}
+
+		if attempt == STALE_READ_ATTEMPTS {
+			return nil, 503, fmt.Errorf(fmt.Sprintf("The shop of stream %v could not be read consistently after %d attempts, please try again", stream, attempt))
+		}
+
+		a.stale.retries.Add(1)
+		err = sleep(ctx, time.Duration(attempt) * STALE_READ_BACKOFF)
+		if err != nil {
+			return nil, 500, err
+		}
+	}
+}
+
+// Calls try with the instances a new stream could go on, least loaded first
+// as the candidate cache, then the Streams GSI, or the load index, has
+// them, until it returns true. An instance whose count changed lately can
+// be missing from the GSI, so when none of those it has takes the stream,
+// the instances are scanned consistently and those it missed tried too, as
+// are those of a query that failed. The scan reads every instance, so it
+// is only made when a query failed or try found an instance the GSI had a
+// wrong count for, and otherwise at most once per
+// MISSED_INSTANCE_SCAN_INTERVAL. Returns whether try took one, with the
+// error of the scan.
+func (a *Allocator) eachCandidate(ctx context.Context, ddb tables.DynamoDBAPI, try func(instance string, indexedStreams uint8) bool) (bool, error) {
+	// bumped by try, here or in a parallel call, which only scans sooner
+	staleCounts := a.stale.instanceCounts.Load()
+	listed := map[string]bool {}
+	cached, err := a.cachedCandidates(ctx, ddb)
+	if err != nil {
+		log.Printf("INFO: Could not read the instances with room for the cache, the index will be queried --> %v", err)
+	}
+
+	for _, c := range cached {
+		listed[c.instance] = true
+		if try(c.instance, c.streams) {
+			return true, nil
+		}
+	}
+
+	queried := true
+	var streams uint8
+	for streams = 0; streams < MAX_INSTANCES; streams++ {
+		instanceNameRecords, err := tables.QueryInstancesWithStreams(ctx, ddb, a.loadIndex, streams)
+		if err != nil {
+			log.Printf("INFO: Could not query instances with %d streams, they will be scanned for --> %v", streams, err)
+			queried = false
+			continue
+		}
+
+		for _, record := range *instanceNameRecords {
+			if listed[record.Instance] {
+				continue
+			}
+
+			listed[record.Instance] = true
+			if try(record.Instance, streams) {
+				return true, nil
+			}
+		}
+	}
+
+	if queried && a.stale.instanceCounts.Load() == staleCounts && !a.scanDue() {
+		return false, nil
+	}
+
+	a.stale.scans.Add(1)
+	instanceRecords, err := tables.ConsistentScanTable[tables.InstanceType](ctx, ddb, tables.Instances.TableName)
+	if err != nil {
+		return false, err
+	}
+
+	for _, record := range *instanceRecords {
+		if listed[record.Instance] || record.Streams >= MAX_INSTANCES {
+			continue
+		}
+
+		if queried {
+			a.stale.instancesMissed.Add(1)
+		}
+
+		if try(record.Instance, record.Streams) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Claims the periodic scan, if it is due
+func (a *Allocator) scanDue() bool {
+	now := time.Now().UnixNano()
+	last := a.stale.lastScan.Load()
+	if now - last < int64(MISSED_INSTANCE_SCAN_INTERVAL) {
+		return false
+	}
+
+	return a.stale.lastScan.CompareAndSwap(last, now)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
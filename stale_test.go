@@ -0,0 +1,96 @@
+package lb
+
+import (
+	"fmt"
+	"testing"
+
+	"loadbalancer/go/tables"
+	"loadbalancer/go/test_setup"
+)
+
+// The Stream GSI still has no shop for the stream, but streamNames has it.
+func TestUnregisterStaleStreamIndex(t *testing.T) {
+	h := newHarness(t, test_setup.Fleet(3))
+	a, c := h.chaos()
+	c.Lag(*tables.Shops.TableName, tables.ShopsGsiStream)
+
+	_, status, err := a.GetShopByStream("streamS")
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) GetShopByStream of a stream not registered yet should have failed", status)
+	}
+
+	_, _, status, err = a.Register("shopS", "streamS", 14000)
+	if err != nil {
+		t.Fatalf("(%d) Register should have succeeded ---> %v", status, err)
+	}
+
+	shop, status, err := a.GetShopByStream("streamS")
+	if err != nil || shop.ShopId != "shopS" {
+		t.Fatalf("(%d) GetShopByStream should have found the shop behind the lagging index ---> %v", status, err)
+	}
+
+	status, err = a.Unregister("streamS")
+	if err != nil || status != 200 {
+		t.Fatalf("(%d) Unregister should have found the shop behind the lagging index ---> %v", status, err)
+	}
+
+	status, err = a.Unregister("streamS")
+	if err == nil || status != 400 {
+		t.Fatalf("(%d) Unregister of an unregistered stream should have failed", status)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestUnregisterStaleStreamIndex (%d) --> %v", status, err))
+}
+
+// An instance added while the Streams GSI lags is found by the consistent scan.
+func TestRegisterMissedInstance(t *testing.T) {
+	fleet := test_setup.Fleet(2)
+	h := newHarness(t, fleet[:1])
+	a, c := h.chaos()
+	c.Lag(*tables.Instances.TableName, tables.InstancesGsiStreamsInstance)
+
+	var i uint16
+	for i = 0; i < uint16(MAX_INSTANCES); i++ {
+		h.register(fmt.Sprintf("shop%d", i), fmt.Sprintf("stream%d", i), 15000 + i)
+	}
+
+	_, _, status, err := a.Register("shopM", "streamM", 15100)
+	if err == nil || status != 503 {
+		t.Fatalf("(%d) Register on a full fleet should have failed", status)
+	}
+
+	test_setup.AddInstances(h.ctx, h.ddb, fleet[1:])
+	publicIp, _, status, err := a.Register("shopM", "streamM", 15100)
+	if err != nil || publicIp != fleet[1].PublicIp {
+		t.Fatalf("(%d) Register should have placed the stream on %v, not %v ---> %v", status, fleet[1].Instance, publicIp, err)
+	}
+
+	stale := a.GetStaleReads()
+	if stale.InstancesMissed == 0 {
+		t.Fatalf("The instance missed should have been counted: %v", stale)
+	}
+
+	h.check()
+	fmt.Println(fmt.Sprintf("SUCCESS: TestRegisterMissedInstance %v", stale))
+}
+
+// Without a failed query or a wrong count, the scan for missed instances is
+// made once per interval
+func TestScanDue(t *testing.T) {
+	a := NewAllocator(nil)
+	if !a.scanDue() {
+		t.Fatal("The first scan should have been due")
+	}
+
+	if a.scanDue() {
+		t.Fatal("A second scan within the interval should not have been due")
+	}
+
+	a.stale.lastScan.Add(-int64(MISSED_INSTANCE_SCAN_INTERVAL))
+	if !a.scanDue() {
+		t.Fatal("A scan after the interval should have been due")
+	}
+
+	fmt.Println("SUCCESS: TestScanDue")
+}
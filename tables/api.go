@@ -0,0 +1,133 @@
+package tables
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The DynamoDB operations lb uses, so that the client can be wrapped, e.g.
+// by Namespace. *dynamodb.Client implements it.
+type DynamoDBAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+	CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	UpdateTable(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error)
+}
+
+// Prefixes the name of every table ddb is asked about, so that several sets
+// of lb tables, e.g. one per test, can live side by side. Index names are
+// per table, so they are left alone.
+func Namespace(ddb DynamoDBAPI, prefix string) DynamoDBAPI {
+	return namespace { ddb: ddb, prefix: prefix }
+}
+
+// Inputs are copied before their table names are changed, since callers,
+// like the paginators, reuse them.
+type namespace struct {
+	ddb DynamoDBAPI
+	prefix string
+}
+
+func (n namespace) name(table *string) *string {
+	if table == nil {
+		return nil
+	}
+
+	prefixed := n.prefix + *table
+	return &prefixed
+}
+
+func (n namespace) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	input := *params
+	input.TableName = n.name(params.TableName)
+	return n.ddb.GetItem(ctx, &input, optFns...)
+}
+
+func (n namespace) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	input := *params
+	input.TableName = n.name(params.TableName)
+	return n.ddb.PutItem(ctx, &input, optFns...)
+}
+
+func (n namespace) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	input := *params
+	input.TableName = n.name(params.TableName)
+	return n.ddb.UpdateItem(ctx, &input, optFns...)
+}
+
+func (n namespace) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	input := *params
+	input.TableName = n.name(params.TableName)
+	return n.ddb.DeleteItem(ctx, &input, optFns...)
+}
+
+func (n namespace) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	input := *params
+	input.TableName = n.name(params.TableName)
+	return n.ddb.Query(ctx, &input, optFns...)
+}
+
+func (n namespace) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	input := *params
+	input.TableName = n.name(params.TableName)
+	return n.ddb.Scan(ctx, &input, optFns...)
+}
+
+func (n namespace) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	input := *params
+	input.TransactItems = make([]types.TransactWriteItem, len(params.TransactItems))
+	for i, item := range params.TransactItems {
+		if item.Put != nil {
+			put := *item.Put
+			put.TableName = n.name(put.TableName)
+			item.Put = &put
+		}
+
+		if item.Update != nil {
+			update := *item.Update
+			update.TableName = n.name(update.TableName)
+			item.Update = &update
+		}
+
+		if item.Delete != nil {
+			delete := *item.Delete
+			delete.TableName = n.name(delete.TableName)
+			item.Delete = &delete
+		}
+
+		if item.ConditionCheck != nil {
+			check := *item.ConditionCheck
+			check.TableName = n.name(check.TableName)
+			item.ConditionCheck = &check
+		}
+
+		input.TransactItems[i] = item
+	}
+
+	return n.ddb.TransactWriteItems(ctx, &input, optFns...)
+}
+
+func (n namespace) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	input := *params
+	input.TableName = n.name(params.TableName)
+	return n.ddb.CreateTable(ctx, &input, optFns...)
+}
+
+func (n namespace) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	input := *params
+	input.TableName = n.name(params.TableName)
+	return n.ddb.DescribeTable(ctx, &input, optFns...)
+}
+
+func (n namespace) UpdateTable(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+	input := *params
+	input.TableName = n.name(params.TableName)
+	return n.ddb.UpdateTable(ctx, &input, optFns...)
+}
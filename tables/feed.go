@@ -0,0 +1,94 @@
+package tables
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+func LatestStreamArn(ctx context.Context, ddb DynamoDBAPI, table *string) (string, error) {
+	input := dynamodb.DescribeTableInput {
+		TableName: table,
+	}
+
+	output, err := ddb.DescribeTable(ctx, &input)
+	if err != nil {
+		return "", fmt.Errorf("Could not describe table %v [%v]", *table, err)
+	}
+
+	if output.Table == nil || output.Table.LatestStreamArn == nil {
+		return "", fmt.Errorf("Table %v does not have a stream enabled", *table)
+	}
+
+	return *output.Table.LatestStreamArn, nil
+}
+
+// The shard id is only unique within a stream, so the checkpoints are keyed
+// on both.
+func feedCheckpointKey(streamArn string, shardId string) string {
+	return fmt.Sprintf("%v/%v", streamArn, shardId)
+}
+
+func GetFeedCheckpoint(ctx context.Context, ddb DynamoDBAPI, streamArn string, shardId string) (string, error) {
+	shardKeyMatch := struct {
+		Shard string
+	}{
+		Shard: feedCheckpointKey(streamArn, shardId),
+	}
+
+	shardKeyMatchMap, err := attributevalue.MarshalMap(shardKeyMatch)
+	if err != nil {
+		return "", err
+	}
+
+	consistentRead := true
+	input := dynamodb.GetItemInput {
+		TableName: FeedCheckpoints.TableName,
+		Key: shardKeyMatchMap,
+		ConsistentRead: &consistentRead,
+	}
+
+	output, err := ddb.GetItem(ctx, &input)
+	if err != nil {
+		log.Println(fmt.Sprintf("INFO: Error getting checkpoint for shard %v: [%v]", shardKeyMatch.Shard, err))
+		return "", err
+	}
+
+	if len(output.Item) == 0 {
+		return "", nil
+	}
+
+	var checkpoint FeedCheckpointType
+	err = attributevalue.UnmarshalMap(output.Item, &checkpoint)
+	if err != nil {
+		return "", err
+	}
+
+	return checkpoint.SequenceNumber, nil
+}
+
+func PutFeedCheckpoint(ctx context.Context, ddb DynamoDBAPI, streamArn string, shardId string, sequenceNumber string) error {
+	checkpoint := FeedCheckpointType {
+		Shard: feedCheckpointKey(streamArn, shardId),
+		SequenceNumber: sequenceNumber,
+	}
+
+	put, err := putItem(checkpoint, FeedCheckpoints.TableName)
+	if err != nil {
+		return err
+	}
+
+	input := dynamodb.PutItemInput {
+		TableName: put.TableName,
+		Item: put.Item,
+	}
+
+	_, err = ddb.PutItem(ctx, &input)
+	if err != nil {
+		return fmt.Errorf("Could not save checkpoint for shard %v [%v]", checkpoint.Shard, err)
+	}
+
+	return nil
+}
@@ -6,41 +6,41 @@ import (
 	"log"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 )
 
-func TestShopIdPresence(ctx context.Context, ddb *dynamodb.Client, shopId string) (bool, error) {
-	shopIdKeyMatch := struct {
-		ShopId string
-	} {
-		ShopId: shopId,
-	}
-	shopIdKeyMatchMap, err := attributevalue.MarshalMap(shopIdKeyMatch)
+func TestShopIdPresence(ctx context.Context, ddb DynamoDBAPI, shopId string) (bool, error) {
+	kexpr := expression.Key(*Shops.ShopId.AttributeName).Equal(expression.Value(shopId))
+	expr, err := expression.NewBuilder().WithKeyCondition(kexpr).Build()
 	if err != nil {
 		// true so that we error out even if the err is not considered
-		return true, err
+		return true, fmt.Errorf("Unable to create expression for query [%v]", err)
 	}
 
-	projectionExpression := *Shops.ShopId.AttributeName
-	input := dynamodb.GetItemInput {
+	var limit int32 = 1
+	input := dynamodb.QueryInput {
 		TableName: Shops.TableName,
-		Key: shopIdKeyMatchMap,
-		ProjectionExpression: &projectionExpression,
+		ProjectionExpression: Shops.ShopId.AttributeName,
+		ExpressionAttributeValues: expr.Values(),
+		ExpressionAttributeNames: expr.Names(),
+		KeyConditionExpression: expr.KeyCondition(),
+		Limit: &limit,
 	}
 
-	output, err := ddb.GetItem(ctx, &input)
+	output, err := ddb.Query(ctx, &input)
 	if err != nil {
 		log.Println(fmt.Sprintf("INFO: Error getting shop for shop id %v: [%v]", shopId, err))
 		return true, err
 	}
 
-	if len(output.Item) == 0 {
+	if len(output.Items) == 0 {
 		return false, nil
 	}
 
 	return true, nil
 }
 
-func TestStreamPresence(ctx context.Context, ddb *dynamodb.Client, stream string) (bool, error) {
+func TestStreamPresence(ctx context.Context, ddb DynamoDBAPI, stream string) (bool, error) {
 	streamKeyMatch := StreamType {
 		Stream: stream,
 	}
@@ -72,7 +72,17 @@ func TestStreamPresence(ctx context.Context, ddb *dynamodb.Client, stream string
 	return true, nil
 }
 
-func ConsistentGetInstance(ctx context.Context, ddb *dynamodb.Client, instance string) (*InstanceType, error) {
+func ConsistentGetInstance(ctx context.Context, ddb DynamoDBAPI, instance string) (*InstanceType, error) {
+	instanceRecord, err := ConsistentFindInstance(ctx, ddb, instance)
+	if err == nil && instanceRecord == nil {
+		return nil, fmt.Errorf("Instance %v is absent", instance)
+	}
+
+	return instanceRecord, err
+}
+
+// Same as ConsistentGetInstance, but a missing record is not an error
+func ConsistentFindInstance(ctx context.Context, ddb DynamoDBAPI, instance string) (*InstanceType, error) {
 	instanceKeyMatch := InstanceNameType {
 		Instance: instance,
 	}
@@ -83,11 +93,9 @@ func ConsistentGetInstance(ctx context.Context, ddb *dynamodb.Client, instance s
 	}
 
 	consistentRead := true
-	projectionExpression := fmt.Sprintf("%v, %v, %v", *Instances.Instance.AttributeName, *Instances.Streams.AttributeName, *Instances.Version.AttributeName)
 	input := dynamodb.GetItemInput {
 		TableName: Instances.TableName,
 		Key: instanceKeyMatchMap,
-		ProjectionExpression: &projectionExpression,
 		ConsistentRead: &consistentRead,
 	}
 
@@ -98,7 +106,7 @@ func ConsistentGetInstance(ctx context.Context, ddb *dynamodb.Client, instance s
 	}
 
 	if len(output.Item) == 0 {
-		return nil, fmt.Errorf("Instance %v is absent", instance)
+		return nil, nil
 	}
 
 	var instanceRecord InstanceType
@@ -112,14 +120,13 @@ func ConsistentGetInstance(ctx context.Context, ddb *dynamodb.Client, instance s
 
 
 
-func ConsistentGetShop(ctx context.Context, ddb *dynamodb.Client, shopId string) (*ShopType, error) {
-	shopIdKeyMatch := struct {
-		ShopId string
-	}{
+func ConsistentGetShop(ctx context.Context, ddb DynamoDBAPI, shopId string, stream string) (*ShopType, error) {
+	shopKeyMatch := ShopKeyType {
 		ShopId: shopId,
+		Stream: stream,
 	}
 
-	shopIdKeyMatchMap, err := attributevalue.MarshalMap(shopIdKeyMatch)
+	shopKeyMatchMap, err := attributevalue.MarshalMap(shopKeyMatch)
 	if err != nil {
 		return nil, err
 	}
@@ -127,13 +134,13 @@ func ConsistentGetShop(ctx context.Context, ddb *dynamodb.Client, shopId string)
 	consistentRead := true
 	input := dynamodb.GetItemInput {
 		TableName: Shops.TableName,
-		Key: shopIdKeyMatchMap,
+		Key: shopKeyMatchMap,
 		ConsistentRead: &consistentRead,
 	}
 
 	output, err := ddb.GetItem(ctx, &input)
 	if err != nil {
-		log.Println(fmt.Sprintf("INFO: Error getting shop %v: [%v]", shopId, err))
+		log.Println(fmt.Sprintf("INFO: Error getting shop %v stream %v: [%v]", shopId, stream, err))
 		return nil, err
 	}
 
@@ -150,18 +157,103 @@ func ConsistentGetShop(ctx context.Context, ddb *dynamodb.Client, shopId string)
 	return &shop, nil
 }
 
-func GetIps(ctx context.Context, ddb *dynamodb.Client, instance string) (string, string, error) {
+// nil when the stream is not in use
+func ConsistentGetStream(ctx context.Context, ddb DynamoDBAPI, stream string) (*StreamType, error) {
+	streamKeyMatchMap, err := attributevalue.MarshalMap(StreamType { Stream: stream })
+	if err != nil {
+		return nil, err
+	}
+
+	consistentRead := true
+	input := dynamodb.GetItemInput {
+		TableName: StreamNames.TableName,
+		Key: streamKeyMatchMap,
+		ConsistentRead: &consistentRead,
+	}
+
+	output, err := ddb.GetItem(ctx, &input)
+	if err != nil {
+		log.Println(fmt.Sprintf("INFO: Error getting stream %v: [%v]", stream, err))
+		return nil, err
+	}
+
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+
+	var streamRecord StreamType
+	err = attributevalue.UnmarshalMap(output.Item, &streamRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamRecord, nil
+}
+
+// Every stream of a shop, read from the base table so that it can be
+// consistent, in stream order.
+func ConsistentQueryShop(ctx context.Context, ddb DynamoDBAPI, shopId string) (*[]ShopType, error) {
+	kexpr := expression.Key(*Shops.ShopId.AttributeName).Equal(expression.Value(shopId))
+	expr, err := expression.NewBuilder().WithKeyCondition(kexpr).Build()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create expression for query [%v]", err)
+	}
+
+	consistentRead := true
+	input := dynamodb.QueryInput {
+		TableName: Shops.TableName,
+		ExpressionAttributeNames: expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression: expr.KeyCondition(),
+		ConsistentRead: &consistentRead,
+	}
+
+	records := []ShopType {}
+	paginator := dynamodb.NewQueryPaginator(ddb, &input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Println(fmt.Sprintf("INFO: Error getting shop %v: [%v]", shopId, err))
+			return nil, err
+		}
+
+		var page []ShopType
+		err = attributevalue.UnmarshalListOfMaps(output.Items, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, page...)
+	}
+
+	return &records, nil
+}
+
+func GetIps(ctx context.Context, ddb DynamoDBAPI, instance string) (string, string, error) {
+	instanceIpRecord, err := GetInstanceIp(ctx, ddb, instance)
+	if err != nil {
+		return "", "", err
+	}
+
+	if instanceIpRecord == nil {
+		return "", "", fmt.Errorf("Instance ip information for %v is absent", instance)
+	}
+
+	return instanceIpRecord.PublicIp, instanceIpRecord.PrivateIp, nil
+}
+
+// Same as GetIps, but a missing record is not an error
+func GetInstanceIp(ctx context.Context, ddb DynamoDBAPI, instance string) (*InstanceIpType, error) {
 	instanceKeyMatch := InstanceNameType {
 		Instance: instance,
 	}
 	instanceKeyMatchMap, err := attributevalue.MarshalMap(instanceKeyMatch)
 	if err != nil {
-		// true so that we error out even if the err is not considered
-		return "", "", err
+		return nil, err
 	}
 
 	consistentRead := true
-	projectionExpression := fmt.Sprintf("%v, %v", *InstanceIp.PublicIp.AttributeName, *InstanceIp.PrivateIp.AttributeName)
+	projectionExpression := fmt.Sprintf("%v, %v, %v, %v", *InstanceIp.PublicIp.AttributeName, *InstanceIp.PrivateIp.AttributeName, publicIps, privateIps)
 	input := dynamodb.GetItemInput {
 		TableName: InstanceIp.TableName,
 		Key: instanceKeyMatchMap,
@@ -172,18 +264,18 @@ func GetIps(ctx context.Context, ddb *dynamodb.Client, instance string) (string,
 	output, err := ddb.GetItem(ctx, &input)
 	if err != nil {
 		log.Println(fmt.Sprintf("INFO: Error getting instance ip info for %v: [%v]", instance, err))
-		return "", "", err
+		return nil, err
 	}
 
 	if len(output.Item) == 0 {
-		return "", "", fmt.Errorf("Instance ip information for %v is absent", instance)
+		return nil, nil
 	}
 
 	var instanceIpRecord InstanceIpType
 	err = attributevalue.UnmarshalMap(output.Item, &instanceIpRecord)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	return instanceIpRecord.PublicIp, instanceIpRecord.PrivateIp, nil
+	return &instanceIpRecord, nil
 }
@@ -0,0 +1,94 @@
+package tables
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// Namespace of the transaction tokens derived from idempotency keys
+var idempotencyNamespace = uuid.MustParse("5b8f3d4e-2a61-4c07-9e1d-7f0a6c2b9d35")
+
+// nil when the key has not been used, or its record has expired by now
+func ConsistentGetIdempotencyKey(ctx context.Context, ddb DynamoDBAPI, key string, now int64) (*IdempotencyKeyType, error) {
+	keyMatch := struct {
+		Key string
+	}{
+		Key: key,
+	}
+
+	keyMatchMap, err := attributevalue.MarshalMap(keyMatch)
+	if err != nil {
+		return nil, err
+	}
+
+	consistentRead := true
+	input := dynamodb.GetItemInput {
+		TableName: IdempotencyKeys.TableName,
+		Key: keyMatchMap,
+		ConsistentRead: &consistentRead,
+	}
+
+	output, err := ddb.GetItem(ctx, &input)
+	if err != nil {
+		log.Println(fmt.Sprintf("INFO: Error getting idempotency key %v: [%v]", key, err))
+		return nil, err
+	}
+
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+
+	var record IdempotencyKeyType
+	err = attributevalue.UnmarshalMap(output.Item, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.Expires <= now {
+		return nil, nil
+	}
+
+	return &record, nil
+}
+
+// Puts the record on the condition that the key is unused, or its previous
+// record has expired by now. The same now must be passed to every attempt
+// sharing a transaction token.
+func PutIdempotencyKey(record *IdempotencyKeyType, now int64) (types.TransactWriteItem, error) {
+	cexpr := expression.Or(
+		expression.AttributeNotExists(expression.Name(*IdempotencyKeys.Key.AttributeName)),
+		expression.LessThanEqual(expression.Name(*IdempotencyKeys.Expires.AttributeName), expression.Value(now)))
+	expr, err := expression.NewBuilder().WithCondition(cexpr).Build()
+	if err != nil {
+		return types.TransactWriteItem {}, fmt.Errorf("Unable to create expression for idempotency key [%v]", err)
+	}
+
+	put, err := putItem(record, IdempotencyKeys.TableName)
+	if err != nil {
+		return types.TransactWriteItem {}, err
+	}
+
+	put.ConditionExpression = expr.Condition()
+	put.ExpressionAttributeNames = expr.Names()
+	put.ExpressionAttributeValues = expr.Values()
+	return types.TransactWriteItem { Put: put }, nil
+}
+
+// A ClientRequestToken for one attempt at the request made with key. The
+// same key and parts always give the same token, so a resent attempt is
+// recognised by DynamoDB, while another attempt, e.g. on another instance,
+// gets a token of its own.
+func IdempotencyToken(key string, parts ...string) string {
+	name := key
+	for _, part := range parts {
+		name += "/" + part
+	}
+
+	return uuid.NewSHA1(idempotencyNamespace, []byte(name)).String()
+}
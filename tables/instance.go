@@ -0,0 +1,173 @@
+package tables
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// Adds an instance with no streams when oldVersion is empty, on the
+// condition that it does not exist yet. Otherwise updates the Capacity and
+// Labels of the instance, on the condition that its Version is still
+// oldVersion, leaving its streams as they are. The instanceIp record is
+// replaced in the same transaction. Returns the new Version.
+func TransactPutInstance(ctx context.Context, ddb DynamoDBAPI, instanceRecord *InstanceType, instanceIp *InstanceIpType, oldVersion string) (string, error) {
+	newVersion := uuid.New().String()
+	instanceItem := types.TransactWriteItem {}
+	if oldVersion == "" {
+		newRecord := InstanceType {
+			Instance: instanceRecord.Instance,
+			Version: newVersion,
+			Load: LoadKey(instanceRecord.Instance, 0),
+			Capacity: instanceRecord.Capacity,
+			Labels: instanceRecord.Labels,
+		}
+
+		put, err := putItem(newRecord, Instances.TableName)
+		if err != nil {
+			return "", err
+		}
+
+		put, err = ifAbsent(put, Instances.Instance.AttributeName)
+		if err != nil {
+			return "", err
+		}
+
+		instanceItem.Put = put
+	} else {
+		update, err := updateInstanceSpec(instanceRecord, newVersion, oldVersion)
+		if err != nil {
+			return "", err
+		}
+
+		instanceItem.Update = update
+	}
+
+	ipRecord := struct {
+		Instance string
+		InstanceIpType
+	}{
+		Instance: instanceRecord.Instance,
+		InstanceIpType: *instanceIp,
+	}
+
+	ipPut, err := putItem(ipRecord, InstanceIp.TableName)
+	if err != nil {
+		return "", err
+	}
+
+	err = TransactWrite(ctx, ddb, []types.TransactWriteItem { instanceItem, types.TransactWriteItem { Put: ipPut } }, newVersion)
+	if err != nil {
+		return "", err
+	}
+
+	return newVersion, nil
+}
+
+// Deletes an instance and its instanceIp record, on the condition that its
+// Version is still version and it has no streams.
+func TransactDeleteInstance(ctx context.Context, ddb DynamoDBAPI, instance string, version string) error {
+	cexpr := expression.Equal(
+		expression.Name(*Instances.Version.AttributeName),
+		expression.Value(version)).
+		And(expression.Equal(expression.Name(*Instances.Streams.AttributeName), expression.Value(0)))
+	expr, err := expression.NewBuilder().WithCondition(cexpr).Build()
+	if err != nil {
+		return fmt.Errorf("Unable to create expression for instance key [%v]", err)
+	}
+
+	instanceDelete, err := deleteItem(InstanceNameType { Instance: instance }, Instances.TableName)
+	if err != nil {
+		return err
+	}
+
+	instanceDelete.ConditionExpression = expr.Condition()
+	instanceDelete.ExpressionAttributeNames = expr.Names()
+	instanceDelete.ExpressionAttributeValues = expr.Values()
+	ipDelete, err := deleteItem(InstanceNameType { Instance: instance }, InstanceIp.TableName)
+	if err != nil {
+		return err
+	}
+
+	transactItems := []types.TransactWriteItem {
+		types.TransactWriteItem { Delete: instanceDelete },
+		types.TransactWriteItem { Delete: ipDelete },
+	}
+
+	return TransactWrite(ctx, ddb, transactItems, uuid.New().String())
+}
+
+func updateInstanceSpec(instanceRecord *InstanceType, newVersion string, oldVersion string) (*types.Update, error) {
+	vexpr := expression.Equal(
+		expression.Name(*Instances.Version.AttributeName),
+		expression.Value(oldVersion))
+	uexpr := expression.Set(expression.Name(*Instances.Version.AttributeName), expression.Value(newVersion))
+	if instanceRecord.Capacity == 0 {
+		uexpr = uexpr.Remove(expression.Name(capacityStr))
+	} else {
+		uexpr = uexpr.Set(expression.Name(capacityStr), expression.Value(instanceRecord.Capacity))
+	}
+
+	if len(instanceRecord.Labels) == 0 {
+		uexpr = uexpr.Remove(expression.Name(labelsStr))
+	} else {
+		uexpr = uexpr.Set(expression.Name(labelsStr), expression.Value(instanceRecord.Labels))
+	}
+
+	expr, err := expression.NewBuilder().WithCondition(vexpr).WithUpdate(uexpr).Build()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create expression for instance key [%v]", err)
+	}
+
+	key, err := attributevalue.MarshalMap(InstanceNameType { Instance: instanceRecord.Instance })
+	if err != nil {
+		return nil, err
+	}
+
+	update := types.Update {
+		TableName: Instances.TableName,
+		Key: key,
+		ConditionExpression: expr.Condition(),
+		UpdateExpression: expr.Update(),
+		ExpressionAttributeNames: expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+
+	return &update, nil
+}
+
+// Sets what the instance's agent reports, along with its Heartbeat. A nil
+// activePorts removes the ports reported before. Returns false if the
+// instance is absent.
+func SetInstanceLoad(ctx context.Context, ddb DynamoDBAPI, instance string, activeStreams uint8, activePorts []uint16, now int64) (bool, error) {
+	uexpr := expression.
+		Set(expression.Name(heartbeatStr), expression.Value(now)).
+		Set(expression.Name(activeStreamsStr), expression.Value(activeStreams))
+	if activePorts == nil {
+		uexpr = uexpr.Remove(expression.Name(activePortsStr))
+	} else {
+		uexpr = uexpr.Set(expression.Name(activePortsStr), expression.Value(activePorts))
+	}
+
+	return updateInstanceAttributes(ctx, ddb, instance, uexpr)
+}
+
+// Overwrites the stream count of an instance, on the condition that its
+// Version is still oldVersion. Returns the new Version.
+func SetInstanceStreams(ctx context.Context, ddb DynamoDBAPI, instance string, streams uint8, oldVersion string) (string, error) {
+	newVersion := uuid.New().String()
+	update, err := updateInstanceStreams(instance, streams, newVersion, oldVersion)
+	if err != nil {
+		return "", err
+	}
+
+	err = TransactWrite(ctx, ddb, []types.TransactWriteItem { types.TransactWriteItem { Update: update } }, newVersion)
+	if err != nil {
+		return "", err
+	}
+
+	return newVersion, nil
+}
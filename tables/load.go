@@ -0,0 +1,254 @@
+package tables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+// How many keys of the load index each stream count is spread over. Changing
+// it moves every instance to another key, so it takes a BackfillLoad.
+const LOAD_SHARDS = 8
+
+// Which GSI the instances with a given number of streams are found through
+type LoadIndex string
+
+const (
+	// InstancesGsiStreamsInstance, the only one on tables made before
+	// InstancesGsiLoad
+	LoadIndexStreams LoadIndex = "streams"
+	// InstancesGsiLoad, queried on all LOAD_SHARDS keys of a count at once
+	LoadIndexSharded LoadIndex = "sharded"
+)
+
+// The load index key of an instance with streams streams. The shard comes
+// from the instance name, so an instance only ever moves between the keys of
+// its own shard.
+func LoadKey(instance string, streams uint8) string {
+	return fmt.Sprintf("%d#%d", streams, loadShard(instance))
+}
+
+func loadShard(instance string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(instance))
+	return h.Sum32() % LOAD_SHARDS
+}
+
+// The instances with num streams, as index has them, ordered by name
+func QueryInstancesWithStreams(ctx context.Context, ddb DynamoDBAPI, index LoadIndex, num uint8) (*[]InstanceNameType, error) {
+	if index == LoadIndexSharded {
+		return QueryInstancesWithLoad(ctx, ddb, num)
+	}
+
+	return QueryAllInstancesWithNumStreams(ctx, ddb, num)
+}
+
+// Queries the LOAD_SHARDS keys of num in parallel, and merges what they have
+func QueryInstancesWithLoad(ctx context.Context, ddb DynamoDBAPI, num uint8) (*[]InstanceNameType, error) {
+	shards := make([][]InstanceNameType, LOAD_SHARDS)
+	errs := make([]error, LOAD_SHARDS)
+	var wg sync.WaitGroup
+	for shard := 0; shard < LOAD_SHARDS; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			shards[shard], errs[shard] = queryLoadKey(ctx, ddb, fmt.Sprintf("%d#%d", num, shard))
+		}(shard)
+	}
+
+	wg.Wait()
+	records := []InstanceNameType {}
+	for shard := range shards {
+		if errs[shard] != nil {
+			return nil, errs[shard]
+		}
+
+		records = append(records, shards[shard]...)
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Instance < records[j].Instance })
+	return &records, nil
+}
+
+func queryLoadKey(ctx context.Context, ddb DynamoDBAPI, load string) ([]InstanceNameType, error) {
+	kexpr := expression.Key(*Instances.Load.AttributeName).Equal(expression.Value(load))
+	expr, err := expression.NewBuilder().WithKeyCondition(kexpr).Build()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create expression for query [%v]", err)
+	}
+
+	input := dynamodb.QueryInput {
+		TableName: Instances.TableName,
+		IndexName: &InstancesGsiLoad,
+		ExpressionAttributeNames: expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression: expr.KeyCondition(),
+		ProjectionExpression: Instances.Instance.AttributeName,
+	}
+
+	records := []InstanceNameType {}
+	paginator := dynamodb.NewQueryPaginator(ddb, &input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Could not query Instances table by load %v [%v]", load, err)
+		}
+
+		var page []InstanceNameType
+		err = attributevalue.UnmarshalListOfMaps(output.Items, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, page...)
+	}
+
+	return records, nil
+}
+
+// How many times BackfillLoad reads and updates an instance that keeps
+// changing under it
+const BACKFILL_ATTEMPTS = 5
+
+// Sets the Load of every instance whose Load is not LoadKey of its Streams,
+// on the condition that its Version has not changed. Writes that change
+// Streams set Load too, but others, e.g. a re-registration, change Version
+// without it, so an instance whose condition fails is read again and
+// retried. Returns how many were set. Safe to run while streams are being
+// registered, and again.
+func BackfillLoad(ctx context.Context, ddb DynamoDBAPI) (int, error) {
+	instanceRecords, err := ConsistentScanTable[InstanceType](ctx, ddb, Instances.TableName)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := range *instanceRecords {
+		set, err := backfillInstance(ctx, ddb, &(*instanceRecords)[i])
+		if err != nil {
+			return n, err
+		}
+
+		if set {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Returns false if the instance already had its Load, or is gone
+func backfillInstance(ctx context.Context, ddb DynamoDBAPI, record *InstanceType) (bool, error) {
+	for attempt := 0; attempt < BACKFILL_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			var err error
+			record, err = ConsistentFindInstance(ctx, ddb, record.Instance)
+			if err != nil {
+				return false, err
+			}
+
+			if record == nil {
+				return false, nil
+			}
+		}
+
+		load := LoadKey(record.Instance, record.Streams)
+		if record.Load == load {
+			return false, nil
+		}
+
+		cexpr := expression.Equal(expression.Name(*Instances.Version.AttributeName), expression.Value(record.Version))
+		uexpr := expression.Set(expression.Name(*Instances.Load.AttributeName), expression.Value(load))
+		expr, err := expression.NewBuilder().WithCondition(cexpr).WithUpdate(uexpr).Build()
+		if err != nil {
+			return false, fmt.Errorf("Unable to create expression for instance key [%v]", err)
+		}
+
+		key, err := attributevalue.MarshalMap(InstanceNameType { Instance: record.Instance })
+		if err != nil {
+			return false, err
+		}
+
+		input := dynamodb.UpdateItemInput {
+			TableName: Instances.TableName,
+			Key: key,
+			ConditionExpression: expr.Condition(),
+			UpdateExpression: expr.Update(),
+			ExpressionAttributeNames: expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		}
+
+		_, err = ddb.UpdateItem(ctx, &input)
+		if err == nil {
+			return true, nil
+		}
+
+		var conditionFailed *types.ConditionalCheckFailedException
+		if !errors.As(err, &conditionFailed) {
+			return false, err
+		}
+	}
+
+	return false, fmt.Errorf("Instance %v kept changing over %d attempts", record.Instance, BACKFILL_ATTEMPTS)
+}
+
+// Creates InstancesGsiLoad on an instances table made before it. DynamoDB
+// builds it in the background, see LoadIndexReady.
+func AddLoadIndex(ctx context.Context, ddb DynamoDBAPI) error {
+	output, err := ddb.DescribeTable(ctx, &dynamodb.DescribeTableInput { TableName: Instances.TableName })
+	if err != nil {
+		return fmt.Errorf("Could not describe table %v [%v]", *Instances.TableName, err)
+	}
+
+	create := types.CreateGlobalSecondaryIndexAction {
+		IndexName: loadGsi.IndexName,
+		KeySchema: loadGsi.KeySchema,
+		Projection: loadGsi.Projection,
+	}
+
+	// on demand tables take no throughput for their indexes
+	billing := output.Table.BillingModeSummary
+	if billing == nil || billing.BillingMode != types.BillingModePayPerRequest {
+		create.ProvisionedThroughput = loadGsi.ProvisionedThroughput
+	}
+
+	input := dynamodb.UpdateTableInput {
+		TableName: Instances.TableName,
+		AttributeDefinitions: []types.AttributeDefinition { Instances.Load, Instances.Instance },
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate {
+			types.GlobalSecondaryIndexUpdate { Create: &create },
+		},
+	}
+
+	_, err = ddb.UpdateTable(ctx, &input)
+	if err != nil {
+		return fmt.Errorf("Could not add %v to table %v [%v]", InstancesGsiLoad, *Instances.TableName, err)
+	}
+
+	return nil
+}
+
+// Whether InstancesGsiLoad exists and is done being built, so that it has
+// every instance with a Load
+func LoadIndexReady(ctx context.Context, ddb DynamoDBAPI) (bool, error) {
+	output, err := ddb.DescribeTable(ctx, &dynamodb.DescribeTableInput { TableName: Instances.TableName })
+	if err != nil {
+		return false, fmt.Errorf("Could not describe table %v [%v]", *Instances.TableName, err)
+	}
+
+	for _, gsi := range output.Table.GlobalSecondaryIndexes {
+		if gsi.IndexName != nil && *gsi.IndexName == InstancesGsiLoad {
+			backfilling := gsi.Backfilling != nil && *gsi.Backfilling
+			return gsi.IndexStatus == types.IndexStatusActive && !backfilling, nil
+		}
+	}
+
+	return false, nil
+}
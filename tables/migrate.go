@@ -0,0 +1,73 @@
+package tables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The shops table as lb expects it, under tableName. Tables created before
+// streams were keyed on ShopId and Stream have to be rebuilt with it, since
+// DynamoDB cannot change a key schema, see cmd/lbmigrateshops.
+func ShopsTableInput(tableName *string) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput {
+		TableName: tableName,
+		AttributeDefinitions: []types.AttributeDefinition {
+			Shops.ShopId,
+			Shops.Stream,
+			Shops.Instance,
+			Shops.Port,
+		},
+		KeySchema: Shops.KeySchema,
+		GlobalSecondaryIndexes: Shops.Gsi,
+		ProvisionedThroughput: Shops.ProvisionedThroughput,
+		StreamSpecification: Shops.StreamSpecification,
+	}
+}
+
+// Whether the table exists and can be written to
+func TableActive(ctx context.Context, ddb DynamoDBAPI, tableName *string) (bool, error) {
+	output, err := ddb.DescribeTable(ctx, &dynamodb.DescribeTableInput { TableName: tableName })
+	if err != nil {
+		var notFound *types.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Could not describe table %v [%v]", *tableName, err)
+	}
+
+	return output.Table.TableStatus == types.TableStatusActive, nil
+}
+
+// Puts every item of one table into another as it is, returning how many
+// were copied. Meant for offline migrations, with nothing writing to either.
+func CopyItems(ctx context.Context, ddb DynamoDBAPI, from *string, to *string) (int, error) {
+	consistentRead := true
+	input := dynamodb.ScanInput {
+		TableName: from,
+		ConsistentRead: &consistentRead,
+	}
+
+	copied := 0
+	paginator := dynamodb.NewScanPaginator(ddb, &input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return copied, fmt.Errorf("Could not scan %v table [%v]", *from, err)
+		}
+
+		for _, item := range output.Items {
+			_, err = ddb.PutItem(ctx, &dynamodb.PutItemInput { TableName: to, Item: item })
+			if err != nil {
+				return copied, fmt.Errorf("Could not put into %v table [%v]", *to, err)
+			}
+
+			copied++
+		}
+	}
+
+	return copied, nil
+}
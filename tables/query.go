@@ -9,7 +9,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 )
 
-func QueryAllInstancesWithNumStreams(ctx context.Context, ddb *dynamodb.Client, num uint8) (*[]InstanceNameType, error) {
+func QueryAllInstancesWithNumStreams(ctx context.Context, ddb DynamoDBAPI, num uint8) (*[]InstanceNameType, error) {
 	kexpr := expression.Key(*Instances.Streams.AttributeName).Equal(expression.Value(num))
 	expr, err := expression.NewBuilder().WithKeyCondition(kexpr).Build()
 	if err != nil {
@@ -36,7 +36,7 @@ func QueryAllInstancesWithNumStreams(ctx context.Context, ddb *dynamodb.Client,
 	return &records, err
 }
 
-func QueryInstancesUsingPort(ctx context.Context, ddb *dynamodb.Client, port uint16) (*[]InstanceNameType, error) {
+func QueryInstancesUsingPort(ctx context.Context, ddb DynamoDBAPI, port uint16) (*[]InstanceNameType, error) {
 	kexpr := expression.Key(*InstancePorts.Port.AttributeName).Equal(expression.Value(port))
 	expr, err := expression.NewBuilder().WithKeyCondition(kexpr).Build()
 	if err != nil {
@@ -66,7 +66,7 @@ func QueryInstancesUsingPort(ctx context.Context, ddb *dynamodb.Client, port uin
 	return &records, nil
 }
 
-func QueryShopIdByStream(ctx context.Context, ddb *dynamodb.Client, stream string) (string, error) {
+func QueryShopIdByStream(ctx context.Context, ddb DynamoDBAPI, stream string) (string, error) {
 	kexpr := expression.Key(*Shops.Stream.AttributeName).Equal(expression.Value(stream))
 	expr, err := expression.NewBuilder().WithKeyCondition(kexpr).Build()
 	if err != nil {
@@ -92,7 +92,7 @@ func QueryShopIdByStream(ctx context.Context, ddb *dynamodb.Client, stream strin
 	} else if len(output.Items) > 1 {
 		// don't panic, since we aren't adding to our data corruption problem here
 		// since we are on the deletion path
-		log.Println(fmt.Sprintf("ERROR: More than one shop for stream %s was detected"))
+		log.Println(fmt.Sprintf("ERROR: More than one shop for stream %s was detected", stream))
 	}
 
 	var records []struct {
@@ -105,3 +105,61 @@ func QueryShopIdByStream(ctx context.Context, ddb *dynamodb.Client, stream strin
 
 	return records[0].ShopId, nil
 }
+
+func QueryShopsByInstance(ctx context.Context, ddb DynamoDBAPI, instance string) (*[]ShopType, error) {
+	kexpr := expression.Key(*Shops.Instance.AttributeName).Equal(expression.Value(instance))
+	return queryShopsGsiInstancePort(ctx, ddb, kexpr)
+}
+
+// GSIs are not unique, but a port is only ever used by one shop on an
+// instance.
+func QueryShopByInstancePort(ctx context.Context, ddb DynamoDBAPI, instance string, port uint16) (*ShopType, error) {
+	kexpr := expression.Key(*Shops.Instance.AttributeName).Equal(expression.Value(instance)).
+		And(expression.Key(*Shops.Port.AttributeName).Equal(expression.Value(port)))
+	records, err := queryShopsGsiInstancePort(ctx, ddb, kexpr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*records) == 0 {
+		return nil, nil
+	} else if len(*records) > 1 {
+		log.Println(fmt.Sprintf("ERROR: More than one shop for port %d on instance %v was detected", port, instance))
+	}
+
+	return &(*records)[0], nil
+}
+
+func queryShopsGsiInstancePort(ctx context.Context, ddb DynamoDBAPI, kexpr expression.KeyConditionBuilder) (*[]ShopType, error) {
+	expr, err := expression.NewBuilder().WithKeyCondition(kexpr).Build()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create expression for query [%v]", err)
+	}
+
+	input := dynamodb.QueryInput {
+		TableName: Shops.TableName,
+		IndexName: &ShopsGsiInstancePort,
+		ExpressionAttributeNames: expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression: expr.KeyCondition(),
+	}
+
+	records := []ShopType {}
+	paginator := dynamodb.NewQueryPaginator(ddb, &input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Could not query Shops table by instance [%v]", err)
+		}
+
+		var page []ShopType
+		err = attributevalue.UnmarshalListOfMaps(output.Items, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, page...)
+	}
+
+	return &records, nil
+}
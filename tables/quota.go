@@ -0,0 +1,151 @@
+package tables
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func ShopScope(shopId string) string {
+	return "shop#" + shopId
+}
+
+func TenantScope(tenant string) string {
+	return "tenant#" + tenant
+}
+
+// nil when the scope has no quota
+func ConsistentGetQuota(ctx context.Context, ddb DynamoDBAPI, scope string) (*QuotaType, error) {
+	var quota QuotaType
+	found, err := consistentGetScope(ctx, ddb, Quotas.TableName, scope, &quota)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &quota, nil
+}
+
+// An empty usage with no Version when the scope has not been used yet
+func ConsistentGetQuotaUsage(ctx context.Context, ddb DynamoDBAPI, scope string) (*QuotaUsageType, error) {
+	usage := QuotaUsageType { Scope: scope }
+	_, err := consistentGetScope(ctx, ddb, QuotaUsage.TableName, scope, &usage)
+	if err != nil {
+		return nil, err
+	}
+
+	if usage.Ports == nil {
+		usage.Ports = map[string]uint16 {}
+	}
+
+	if usage.Instances == nil {
+		usage.Instances = map[string]uint16 {}
+	}
+
+	return &usage, nil
+}
+
+func consistentGetScope(ctx context.Context, ddb DynamoDBAPI, table *string, scope string, out interface{}) (bool, error) {
+	scopeKeyMatch := struct {
+		Scope string
+	}{
+		Scope: scope,
+	}
+
+	scopeKeyMatchMap, err := attributevalue.MarshalMap(scopeKeyMatch)
+	if err != nil {
+		return false, err
+	}
+
+	consistentRead := true
+	input := dynamodb.GetItemInput {
+		TableName: table,
+		Key: scopeKeyMatchMap,
+		ConsistentRead: &consistentRead,
+	}
+
+	output, err := ddb.GetItem(ctx, &input)
+	if err != nil {
+		log.Println(fmt.Sprintf("INFO: Error getting %v for %v: [%v]", *table, scope, err))
+		return false, err
+	}
+
+	if len(output.Item) == 0 {
+		return false, nil
+	}
+
+	err = attributevalue.UnmarshalMap(output.Item, out)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Puts the usage with a new version, on the condition that nobody has
+// changed it since it was read with oldVersion. An empty oldVersion means it
+// was read as absent.
+func PutQuotaUsage(usage *QuotaUsageType, newVersion string, oldVersion string) (types.TransactWriteItem, error) {
+	cexpr := expression.AttributeNotExists(expression.Name(*QuotaUsage.Scope.AttributeName))
+	if oldVersion != "" {
+		cexpr = expression.Equal(
+			expression.Name(*QuotaUsage.Version.AttributeName),
+			expression.Value(oldVersion))
+	}
+
+	expr, err := expression.NewBuilder().WithCondition(cexpr).Build()
+	if err != nil {
+		return types.TransactWriteItem {}, fmt.Errorf("Unable to create expression for usage key [%v]", err)
+	}
+
+	newUsage := *usage
+	newUsage.Version = newVersion
+	put, err := putItem(newUsage, QuotaUsage.TableName)
+	if err != nil {
+		return types.TransactWriteItem {}, err
+	}
+
+	put.ConditionExpression = expr.Condition()
+	put.ExpressionAttributeNames = expr.Names()
+	put.ExpressionAttributeValues = expr.Values()
+	return types.TransactWriteItem { Put: put }, nil
+}
+
+func PutQuota(quota *QuotaType) (types.TransactWriteItem, error) {
+	put, err := putItem(quota, Quotas.TableName)
+	if err != nil {
+		return types.TransactWriteItem {}, err
+	}
+
+	return types.TransactWriteItem { Put: put }, nil
+}
+
+func TransactWrite(ctx context.Context, ddb DynamoDBAPI, transactItems []types.TransactWriteItem, clientRequestToken string) error {
+	input := dynamodb.TransactWriteItemsInput {
+		TransactItems: transactItems,
+		ClientRequestToken: &clientRequestToken,
+	}
+
+	_, err := ddb.TransactWriteItems(ctx, &input)
+	return err
+}
+
+// The guard of a shop without a quota, see PutStreamsGuard. It is kept in the
+// quotaUsage table with only a Version, apart from the shop's own usage.
+func StreamsScope(shopId string) string {
+	return "streams#" + shopId
+}
+
+// A shop without a quota is held to its limit of streams by counting them,
+// which is not part of the transaction that adds one. That transaction also
+// rewrites the shop's guard on the condition that it still has the version
+// read before counting, so of the registrations that counted the same
+// streams only one can commit. An empty oldVersion means it was read as
+// absent.
+func PutStreamsGuard(shopId string, newVersion string, oldVersion string) (types.TransactWriteItem, error) {
+	guard := QuotaUsageType { Scope: StreamsScope(shopId), Ports: map[string]uint16 {}, Instances: map[string]uint16 {} }
+	return PutQuotaUsage(&guard, newVersion, oldVersion)
+}
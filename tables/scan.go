@@ -0,0 +1,104 @@
+package tables
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+)
+
+// Scans are eventually consistent and read the whole table, so they are only
+// meant for listings, not for any decision made while allocating.
+func ScanInstances(ctx context.Context, ddb DynamoDBAPI) (*[]InstanceType, error) {
+	var records []InstanceType
+	err := scanTable(ctx, ddb, Instances.TableName, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	return &records, nil
+}
+
+func ScanShops(ctx context.Context, ddb DynamoDBAPI) (*[]ShopType, error) {
+	var records []ShopType
+	err := scanTable(ctx, ddb, Shops.TableName, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	return &records, nil
+}
+
+// The ports an instance uses, read consistently. instancePorts is keyed by
+// port, so this is a scan of the whole table, only meant for repairs.
+func ConsistentScanInstancePorts(ctx context.Context, ddb DynamoDBAPI, instance string) (*[]InstancePortType, error) {
+	fexpr := expression.Name(*InstancePorts.Instance.AttributeName).Equal(expression.Value(instance))
+	expr, err := expression.NewBuilder().WithFilter(fexpr).Build()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create expression for scan [%v]", err)
+	}
+
+	consistentRead := true
+	input := dynamodb.ScanInput {
+		TableName: InstancePorts.TableName,
+		FilterExpression: expr.Filter(),
+		ExpressionAttributeNames: expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead: &consistentRead,
+	}
+
+	var records []InstancePortType
+	err = scan(ctx, ddb, &input, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	return &records, nil
+}
+
+func scanTable[T any](ctx context.Context, ddb DynamoDBAPI, table *string, records *[]T) error {
+	input := dynamodb.ScanInput {
+		TableName: table,
+	}
+
+	return scan(ctx, ddb, &input, records)
+}
+
+func scan[T any](ctx context.Context, ddb DynamoDBAPI, input *dynamodb.ScanInput, records *[]T) error {
+	*records = []T {}
+	paginator := dynamodb.NewScanPaginator(ddb, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("Could not scan %v table [%v]", *input.TableName, err)
+		}
+
+		var page []T
+		err = attributevalue.UnmarshalListOfMaps(output.Items, &page)
+		if err != nil {
+			return err
+		}
+
+		*records = append(*records, page...)
+	}
+
+	return nil
+}
+
+// Every record of a table, read consistently, only meant for checks
+func ConsistentScanTable[T any](ctx context.Context, ddb DynamoDBAPI, table *string) (*[]T, error) {
+	consistentRead := true
+	input := dynamodb.ScanInput {
+		TableName: table,
+		ConsistentRead: &consistentRead,
+	}
+
+	var records []T
+	err := scan(ctx, ddb, &input, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	return &records, nil
+}
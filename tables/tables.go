@@ -12,16 +12,48 @@ var streamStr = "Stream"
 var instanceStr = "Instance"
 var portStr = "Port"
 var streamsStr = "Streams"
+var loadStr = "Load"
 var publicIp = "PublicIp"
 var privateIp = "PrivateIp"
 var versionStr = "Version"
+var cordonedStr = "Cordoned"
+var unhealthyStr = "Unhealthy"
+var unhealthySinceStr = "UnhealthySince"
+var healthDetailStr = "HealthDetail"
+var heartbeatStr = "Heartbeat"
+var capacityStr = "Capacity"
+var labelsStr = "Labels"
+var activeStreamsStr = "ActiveStreams"
+var activePortsStr = "ActivePorts"
+var publicIps = "PublicIps"
+var privateIps = "PrivateIps"
+var feedCheckpoints = "feedCheckpoints"
+var quotas = "quotas"
+var quotaUsage = "quotaUsage"
+var scopeStr = "Scope"
+var idempotencyKeys = "idempotencyKeys"
+var keyStr = "Key"
+var expiresStr = "Expires"
+var shardStr = "Shard"
+var sequenceNumberStr = "SequenceNumber"
 var ShopsGsiStream = "ShopsGsiStream"
+var ShopsGsiInstancePort = "ShopsGsiInstancePort"
 var InstancesGsiStreamsInstance = "InstancesGsiStreamsInstance"
+var InstancesGsiLoad = "InstancesGsiLoad"
 var projectionAll = types.Projection { ProjectionType: types.ProjectionTypeAll }
 var readCapacity int64 = 5
 var writeCapacity int64 = 5
 var provisionedThroughput = types.ProvisionedThroughput { ReadCapacityUnits: &readCapacity, WriteCapacityUnits: &writeCapacity }
 
+// The lowest limit on the number of items in a TransactWriteItems call across
+// DynamoDB and DynamoDB local versions
+const MAX_TRANSACT_ITEMS = 25
+var streamEnabled = true
+
+// Both old and new images are needed by the change feed to tell what changed
+// on a MODIFY, e.g. the previous Streams count of an instance.
+var streamSpecification = types.StreamSpecification { StreamEnabled: &streamEnabled, StreamViewType: types.StreamViewTypeNewAndOldImages }
+
 type shopsTableType struct {
 	TableName *string
 	ProvisionedThroughput *types.ProvisionedThroughput
@@ -32,18 +64,22 @@ type shopsTableType struct {
 	Version types.AttributeDefinition
 	KeySchema []types.KeySchemaElement
 	Gsi []types.GlobalSecondaryIndex
+	StreamSpecification *types.StreamSpecification
 }
 
 var Shops = shopsTableType {
 	TableName: &shopsStr,
 	ProvisionedThroughput: &provisionedThroughput,
+	StreamSpecification: &streamSpecification,
 	ShopId: types.AttributeDefinition { AttributeName: &shopId, AttributeType: types.ScalarAttributeTypeS },
 	Stream: types.AttributeDefinition { AttributeName: &streamStr, AttributeType: types.ScalarAttributeTypeS },
 	Instance: types.AttributeDefinition { AttributeName: &instanceStr, AttributeType: types.ScalarAttributeTypeS },
 	Port: types.AttributeDefinition { AttributeName: &portStr, AttributeType: types.ScalarAttributeTypeN },
 	Version: types.AttributeDefinition { AttributeName: &versionStr, AttributeType: types.ScalarAttributeTypeS },
+	// A shop can have several streams, each of which is unique across shops
 	KeySchema: []types.KeySchemaElement {
 		types.KeySchemaElement { AttributeName: &shopId, KeyType: types.KeyTypeHash },
+		types.KeySchemaElement { AttributeName: &streamStr, KeyType: types.KeyTypeRange },
 	},
 	Gsi: []types.GlobalSecondaryIndex {
 		types.GlobalSecondaryIndex {
@@ -54,6 +90,17 @@ var Shops = shopsTableType {
 			    types.KeySchemaElement { AttributeName: &streamStr, KeyType: types.KeyTypeHash },
 			},
 		},
+		// To list the shops on an instance, and find the shop using a port
+		// on an instance
+		types.GlobalSecondaryIndex {
+		    IndexName: &ShopsGsiInstancePort,
+			Projection: &projectionAll,
+			ProvisionedThroughput: &provisionedThroughput,
+		    KeySchema: []types.KeySchemaElement {
+			    types.KeySchemaElement { AttributeName: &instanceStr, KeyType: types.KeyTypeHash },
+			    types.KeySchemaElement { AttributeName: &portStr, KeyType: types.KeyTypeRange },
+			},
+		},
 	},
 }
 
@@ -62,8 +109,10 @@ type instanceTableType struct {
 	ProvisionedThroughput *types.ProvisionedThroughput
 	Instance types.AttributeDefinition
 	Streams types.AttributeDefinition
+	Load types.AttributeDefinition
 	KeySchema []types.KeySchemaElement
 	Gsi []types.GlobalSecondaryIndex
+	StreamSpecification *types.StreamSpecification
 
 	// Used as for application managed optimistic locking
 	Version types.AttributeDefinition
@@ -72,8 +121,10 @@ type instanceTableType struct {
 var Instances = instanceTableType {
 	TableName: &instancesStr,
 	ProvisionedThroughput: &provisionedThroughput,
+	StreamSpecification: &streamSpecification,
 	Instance: types.AttributeDefinition { AttributeName: &instanceStr, AttributeType: types.ScalarAttributeTypeS },
 	Streams: types.AttributeDefinition { AttributeName: &streamsStr, AttributeType: types.ScalarAttributeTypeN },
+	Load: types.AttributeDefinition { AttributeName: &loadStr, AttributeType: types.ScalarAttributeTypeS },
 	Version: types.AttributeDefinition { AttributeName: &versionStr, AttributeType: types.ScalarAttributeTypeS },
 	KeySchema: []types.KeySchemaElement {
 	    types.KeySchemaElement { AttributeName: &instanceStr, KeyType: types.KeyTypeHash },
@@ -88,6 +139,20 @@ var Instances = instanceTableType {
 				types.KeySchemaElement { AttributeName: &instanceStr, KeyType: types.KeyTypeRange },
 			},
 		},
+		loadGsi,
+	},
+}
+
+// The Streams GSI has only MAX_INSTANCES partition key values, which every
+// Register reads and every stream count change writes. This one spreads each
+// of them over LOAD_SHARDS keys, see LoadKey.
+var loadGsi = types.GlobalSecondaryIndex {
+	IndexName: &InstancesGsiLoad,
+	Projection: &projectionAll,
+	ProvisionedThroughput: &provisionedThroughput,
+	KeySchema: []types.KeySchemaElement {
+		types.KeySchemaElement { AttributeName: &loadStr, KeyType: types.KeyTypeHash },
+		types.KeySchemaElement { AttributeName: &instanceStr, KeyType: types.KeyTypeRange },
 	},
 }
 
@@ -146,6 +211,87 @@ var StreamNames = streamNamesType {
 	},
 }
 
+// Where the change feed has got to in each shard of a table's stream
+type feedCheckpointsType struct {
+	TableName *string
+	ProvisionedThroughput *types.ProvisionedThroughput
+	Shard types.AttributeDefinition
+	SequenceNumber types.AttributeDefinition
+	KeySchema []types.KeySchemaElement
+}
+
+var FeedCheckpoints = feedCheckpointsType {
+	TableName: &feedCheckpoints,
+	ProvisionedThroughput: &provisionedThroughput,
+	Shard: types.AttributeDefinition { AttributeName: &shardStr, AttributeType: types.ScalarAttributeTypeS },
+	SequenceNumber: types.AttributeDefinition { AttributeName: &sequenceNumberStr, AttributeType: types.ScalarAttributeTypeS },
+	KeySchema: []types.KeySchemaElement {
+	    types.KeySchemaElement { AttributeName: &shardStr, KeyType: types.KeyTypeHash },
+	},
+}
+
+// Limits on a shop ("shop#<ShopId>") or a tenant group ("tenant#<Tenant>").
+// A shop record naming a Tenant puts the shop in that group.
+type quotasType struct {
+	TableName *string
+	ProvisionedThroughput *types.ProvisionedThroughput
+	Scope types.AttributeDefinition
+	KeySchema []types.KeySchemaElement
+}
+
+var Quotas = quotasType {
+	TableName: &quotas,
+	ProvisionedThroughput: &provisionedThroughput,
+	Scope: types.AttributeDefinition { AttributeName: &scopeStr, AttributeType: types.ScalarAttributeTypeS },
+	KeySchema: []types.KeySchemaElement {
+	    types.KeySchemaElement { AttributeName: &scopeStr, KeyType: types.KeyTypeHash },
+	},
+}
+
+// What each quota scope is using. Written in the same transactions as the
+// shops, with the Version used for optimistic locking like in instances.
+// Needed even without quotas, since the StreamsScope guard of every shop
+// without one is rewritten by each of its registrations.
+type quotaUsageType struct {
+	TableName *string
+	ProvisionedThroughput *types.ProvisionedThroughput
+	Scope types.AttributeDefinition
+	Version types.AttributeDefinition
+	KeySchema []types.KeySchemaElement
+}
+
+var QuotaUsage = quotaUsageType {
+	TableName: &quotaUsage,
+	ProvisionedThroughput: &provisionedThroughput,
+	Scope: types.AttributeDefinition { AttributeName: &scopeStr, AttributeType: types.ScalarAttributeTypeS },
+	Version: types.AttributeDefinition { AttributeName: &versionStr, AttributeType: types.ScalarAttributeTypeS },
+	KeySchema: []types.KeySchemaElement {
+	    types.KeySchemaElement { AttributeName: &scopeStr, KeyType: types.KeyTypeHash },
+	},
+}
+
+// The outcome of a Register or Unregister made with an idempotency key,
+// written in the same transaction as the change. Expires, in Unix seconds,
+// can be used as the table's TTL attribute. Expired records are ignored
+// whether or not DynamoDB has removed them yet.
+type idempotencyKeysType struct {
+	TableName *string
+	ProvisionedThroughput *types.ProvisionedThroughput
+	Key types.AttributeDefinition
+	Expires types.AttributeDefinition
+	KeySchema []types.KeySchemaElement
+}
+
+var IdempotencyKeys = idempotencyKeysType {
+	TableName: &idempotencyKeys,
+	ProvisionedThroughput: &provisionedThroughput,
+	Key: types.AttributeDefinition { AttributeName: &keyStr, AttributeType: types.ScalarAttributeTypeS },
+	Expires: types.AttributeDefinition { AttributeName: &expiresStr, AttributeType: types.ScalarAttributeTypeN },
+	KeySchema: []types.KeySchemaElement {
+	    types.KeySchemaElement { AttributeName: &keyStr, KeyType: types.KeyTypeHash },
+	},
+}
+
 type ShopType struct {
 	ShopId string
 	Stream string
@@ -154,10 +300,40 @@ type ShopType struct {
 	Version string
 }
 
+type ShopKeyType struct {
+	ShopId string
+	Stream string
+}
+
 type InstanceType struct {
 	Instance string
 	Streams uint8
 	Version string
+
+	// The key of the instance in the load index, LoadKey of its Instance and
+	// Streams. Empty on instances written before the index, until
+	// BackfillLoad.
+	Load string `dynamodbav:",omitempty"`
+
+	// Cordoned instances keep their streams but get no new ones
+	Cordoned bool `dynamodbav:",omitempty"`
+
+	// Unhealthy instances get no new streams either. UnhealthySince is when
+	// the instance was first found unhealthy, and Heartbeat when its agent
+	// last reported, in Unix seconds.
+	Unhealthy bool `dynamodbav:",omitempty"`
+	UnhealthySince int64 `dynamodbav:",omitempty"`
+	HealthDetail string `dynamodbav:",omitempty"`
+	Heartbeat int64 `dynamodbav:",omitempty"`
+
+	// At most Capacity streams are placed on the instance, MAX_INSTANCES
+	// when zero. Labels come from the instance's agent, and so does
+	// ActiveStreams, the streams it was serving at its last Heartbeat, and
+	// ActivePorts, their ports, which are nil when the agent only counts.
+	Capacity uint8 `dynamodbav:",omitempty"`
+	Labels map[string]string `dynamodbav:",omitempty"`
+	ActiveStreams uint8 `dynamodbav:",omitempty"`
+	ActivePorts []uint16 `dynamodbav:",omitempty"`
 }
 
 type InstancePortType struct {
@@ -165,15 +341,68 @@ type InstancePortType struct {
 	Port uint16
 }
 
+// Where a stream is to be placed
+type PlacementType struct {
+	ShopId string
+	Stream string
+	Port uint16
+	Instance string
+}
+
 type InstanceNameType struct {
 	Instance string
 }
 
+// PublicIps and PrivateIps, when present, hold every address of the
+// instance, the primary ones first.
 type InstanceIpType struct {
 	PublicIp string
 	PrivateIp string
+	PublicIps []string `dynamodbav:",omitempty"`
+	PrivateIps []string `dynamodbav:",omitempty"`
 }
 
+// ShopId is absent for streams registered before it was recorded here
 type StreamType struct {
 	Stream string
+	ShopId string `dynamodbav:",omitempty"`
+}
+
+type FeedCheckpointType struct {
+	Shard string
+	SequenceNumber string
+}
+
+// A zero limit is no limit
+type QuotaType struct {
+	Scope string
+	MaxStreams uint16
+	MaxPorts uint16
+	MaxInstances uint16
+	Tenant string `dynamodbav:",omitempty"`
+}
+
+// Ports and Instances count the streams on each port and instance, keyed by
+// the decimal port and the instance name, so that the number of distinct
+// ones is the size of the map.
+type QuotaUsageType struct {
+	Scope string
+	Streams uint16
+	Ports map[string]uint16
+	Instances map[string]uint16
+	Version string
+}
+
+// Operation is "register" or "unregister". ShopId, Stream and Port identify
+// the request, so a key reused for another one can be told apart. Instance
+// is where a registered stream was placed.
+type IdempotencyKeyType struct {
+	Key string
+	Operation string
+	ShopId string
+	Stream string
+	Port uint16
+	Instance string
+	Status int
+	Expires int64
 }
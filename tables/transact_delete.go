@@ -10,34 +10,77 @@ import (
 	"github.com/google/uuid"
 )
 
-func TransactDelete(ctx context.Context, ddb *dynamodb.Client, shop *ShopType, instanceRecord *InstanceType) error {
-	instance := shop.Instance
-	newVersion := uuid.New().String()
-	instancePut, err := putNewInstanceRecord(instance, instanceRecord.Streams - 1, newVersion, instanceRecord.Version)
-	if err != nil {
-		return err
-	}
+// extra items, like quota usage puts, are written in the same transaction
+func TransactDelete(ctx context.Context, ddb DynamoDBAPI, shop *ShopType, instanceRecord *InstanceType, extra ...types.TransactWriteItem) error {
+	return TransactDeleteWithToken(ctx, ddb, uuid.New().String(), shop, instanceRecord, extra...)
+}
 
-	instancePortDelete, err := deleteInstancePort(instance, shop.Port)
-	if err != nil {
-		return err
-	}
+// The counterpart of TransactAddStreamWithToken
+func TransactDeleteWithToken(ctx context.Context, ddb DynamoDBAPI, token string, shop *ShopType, instanceRecord *InstanceType, extra ...types.TransactWriteItem) error {
+	instanceRecords := map[string]*InstanceType { shop.Instance: instanceRecord }
+	_, err := transactDeleteStreams(ctx, ddb, token, []*ShopType { shop }, instanceRecords, extra)
+	return err
+}
 
-	streamNameDelete, err := deleteStreamName(shop.Stream)
-	if err != nil {
-		return err
+// The counterpart of TransactAddStreams, with the same limits on the number
+// of transact items.
+func TransactDeleteStreams(ctx context.Context, ddb DynamoDBAPI, shops []*ShopType, instanceRecords map[string]*InstanceType) (string, error) {
+	return transactDeleteStreams(ctx, ddb, uuid.New().String(), shops, instanceRecords, nil)
+}
+
+func transactDeleteStreams(ctx context.Context, ddb DynamoDBAPI, newVersion string, shops []*ShopType, instanceRecords map[string]*InstanceType, extra []types.TransactWriteItem) (string, error) {
+	removed := map[string]uint8 {}
+	instances := []string {}
+	transactItems := []types.TransactWriteItem {}
+	for _, shop := range shops {
+		instance := shop.Instance
+		if _, present := instanceRecords[instance]; !present {
+			return "", fmt.Errorf("Instance record for %v is missing", instance)
+		}
+
+		if _, present := removed[instance]; !present {
+			instances = append(instances, instance)
+		}
+
+		removed[instance]++
+		instancePortDelete, err := deleteInstancePort(instance, shop.Port)
+		if err != nil {
+			return "", err
+		}
+
+		streamNameDelete, err := deleteStreamName(shop.Stream)
+		if err != nil {
+			return "", err
+		}
+
+		shopDelete, err := deleteShopRecord(shop.ShopId, shop.Stream, shop.Version)
+		if err != nil {
+			return "", err
+		}
+
+		transactItems = append(transactItems,
+			types.TransactWriteItem { Delete: instancePortDelete },
+			types.TransactWriteItem { Delete: streamNameDelete },
+			types.TransactWriteItem { Delete: shopDelete })
 	}
 
-	shopDelete, err := deleteShopRecord(shop.ShopId, shop.Version)
-	if err != nil {
-		return err
+	for _, instance := range instances {
+		instanceRecord := instanceRecords[instance]
+		if instanceRecord.Streams < removed[instance] {
+			return "", fmt.Errorf("Instance %v has %d streams, cannot remove %d", instance, instanceRecord.Streams, removed[instance])
+		}
+
+		instanceUpdate, err := updateInstanceStreams(instance, instanceRecord.Streams - removed[instance], newVersion, instanceRecord.Version)
+		if err != nil {
+			return "", err
+		}
+
+		transactItems = append(transactItems, types.TransactWriteItem { Update: instanceUpdate })
 	}
 
-	transactItems := []types.TransactWriteItem {
-		types.TransactWriteItem { Put: instancePut },
-		types.TransactWriteItem { Delete: instancePortDelete },
-		types.TransactWriteItem { Delete: streamNameDelete },
-		types.TransactWriteItem { Delete: shopDelete },
+	transactItems = append(transactItems, extra...)
+	if len(transactItems) > MAX_TRANSACT_ITEMS {
+		return "", fmt.Errorf("%d transact items exceed the limit of %d", len(transactItems), MAX_TRANSACT_ITEMS)
 	}
 
 	input := dynamodb.TransactWriteItemsInput {
@@ -45,15 +88,15 @@ func TransactDelete(ctx context.Context, ddb *dynamodb.Client, shop *ShopType, i
 		ClientRequestToken: &newVersion,
 	}
 
-	_, err = ddb.TransactWriteItems(ctx, &input)
+	_, err := ddb.TransactWriteItems(ctx, &input)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return newVersion, nil
 }
 
-func deleteShopRecord(shopId string, version string) (*types.Delete, error) {
+func deleteShopRecord(shopId string, stream string, version string) (*types.Delete, error) {
 	vexpr := expression.Equal(
 		expression.Name(*Shops.Version.AttributeName),
 		expression.Value(version))
@@ -62,10 +105,9 @@ func deleteShopRecord(shopId string, version string) (*types.Delete, error) {
 		return nil, fmt.Errorf("Unable to create expression for instance key [%v]", err)
 	}
 
-	object := struct {
-		ShopId string
-	}{
+	object := ShopKeyType {
 		ShopId: shopId,
+		Stream: stream,
 	}
 
 	key, err := attributevalue.MarshalMap(object)
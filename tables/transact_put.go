@@ -10,37 +10,86 @@ import (
 	"github.com/google/uuid"
 )
 
-func TransactAddStream(ctx context.Context, ddb *dynamodb.Client, shopId string, stream string, port uint16, instanceRecord *InstanceType) error {
-	// NOTE: The same version is reused across tables. However, equality cannot
-	// be assumed. Do not rely on equality. Its use for idempotency is also just
-	// a convenience, and has no significance besides being a random string that
-	// can reasonably be assumed to be ungeneratable again for a long time.
-	newVersion := uuid.New().String()
-	instancePut, err := putNewInstanceRecord(instanceRecord.Instance, instanceRecord.Streams + 1, newVersion, instanceRecord.Version)
-	if err != nil {
-		return err
-	}
+// extra items, like quota usage puts, are written in the same transaction
+func TransactAddStream(ctx context.Context, ddb DynamoDBAPI, shopId string, stream string, port uint16, instanceRecord *InstanceType, extra ...types.TransactWriteItem) error {
+	return TransactAddStreamWithToken(ctx, ddb, uuid.New().String(), shopId, stream, port, instanceRecord, extra...)
+}
 
-	instancePortPut, err := putNewInstancePort(instanceRecord.Instance, port)
-	if err != nil {
-		return err
+// Like TransactAddStream, with the given ClientRequestToken, which is also
+// the new version of the records written. A resent transaction with the same
+// token and items is not applied twice.
+func TransactAddStreamWithToken(ctx context.Context, ddb DynamoDBAPI, token string, shopId string, stream string, port uint16, instanceRecord *InstanceType, extra ...types.TransactWriteItem) error {
+	placements := []PlacementType {
+		PlacementType { ShopId: shopId, Stream: stream, Port: port, Instance: instanceRecord.Instance },
 	}
 
-	streamNamePut, err := putNewStreamName(stream)
-	if err != nil {
-		return err
+	instanceRecords := map[string]*InstanceType { instanceRecord.Instance: instanceRecord }
+	_, err := transactAddStreams(ctx, ddb, token, placements, instanceRecords, extra)
+	return err
+}
+
+// Places several streams in one transaction. Every instance in placements
+// needs its record in instanceRecords, and gets a single conditional put for
+// all of the streams placed on it. Returns the version the instances were
+// written with. The caller has to keep the number of transact items, which is
+// 3 per placement and 1 per instance, with the extra items, within
+// MAX_TRANSACT_ITEMS.
+func TransactAddStreams(ctx context.Context, ddb DynamoDBAPI, placements []PlacementType, instanceRecords map[string]*InstanceType, extra ...types.TransactWriteItem) (string, error) {
+	return transactAddStreams(ctx, ddb, uuid.New().String(), placements, instanceRecords, extra)
+}
+
+// NOTE: The same version is reused across tables. However, equality cannot
+// be assumed. Do not rely on equality. Its use for idempotency is also just
+// a convenience, and has no significance besides being a random string that
+// can reasonably be assumed to be ungeneratable again for a long time.
+func transactAddStreams(ctx context.Context, ddb DynamoDBAPI, newVersion string, placements []PlacementType, instanceRecords map[string]*InstanceType, extra []types.TransactWriteItem) (string, error) {
+	added := map[string]uint8 {}
+	instances := []string {}
+	transactItems := []types.TransactWriteItem {}
+	for _, placement := range placements {
+		if _, present := instanceRecords[placement.Instance]; !present {
+			return "", fmt.Errorf("Instance record for %v is missing", placement.Instance)
+		}
+
+		if _, present := added[placement.Instance]; !present {
+			instances = append(instances, placement.Instance)
+		}
+
+		added[placement.Instance]++
+		instancePortPut, err := putNewInstancePort(placement.Instance, placement.Port)
+		if err != nil {
+			return "", err
+		}
+
+		streamNamePut, err := putNewStreamName(placement.Stream, placement.ShopId)
+		if err != nil {
+			return "", err
+		}
+
+		shopPut, err := putShopRecord(placement.ShopId, placement.Stream, placement.Port, placement.Instance, newVersion)
+		if err != nil {
+			return "", err
+		}
+
+		transactItems = append(transactItems,
+			types.TransactWriteItem { Put: instancePortPut },
+			types.TransactWriteItem { Put: streamNamePut },
+			types.TransactWriteItem { Put: shopPut })
 	}
 
-	shopPut, err := putShopRecord(shopId, stream, port, instanceRecord.Instance, newVersion)
-	if err != nil {
-		return err
+	for _, instance := range instances {
+		instanceRecord := instanceRecords[instance]
+		instanceUpdate, err := updateInstanceStreams(instance, instanceRecord.Streams + added[instance], newVersion, instanceRecord.Version)
+		if err != nil {
+			return "", err
+		}
+
+		transactItems = append(transactItems, types.TransactWriteItem { Update: instanceUpdate })
 	}
 
-	transactItems := []types.TransactWriteItem {
-		types.TransactWriteItem { Put: instancePut },
-		types.TransactWriteItem { Put: instancePortPut},
-		types.TransactWriteItem { Put: streamNamePut},
-		types.TransactWriteItem { Put: shopPut },
+	transactItems = append(transactItems, extra...)
+	if len(transactItems) > MAX_TRANSACT_ITEMS {
+		return "", fmt.Errorf("%d transact items exceed the limit of %d", len(transactItems), MAX_TRANSACT_ITEMS)
 	}
 
 	input := dynamodb.TransactWriteItemsInput {
@@ -48,43 +97,45 @@ func TransactAddStream(ctx context.Context, ddb *dynamodb.Client, shopId string,
 		ClientRequestToken: &newVersion,
 	}
 
-	_, err = ddb.TransactWriteItems(ctx, &input)
+	_, err := ddb.TransactWriteItems(ctx, &input)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return newVersion, nil
 }
 
-func putNewInstanceRecord(instance string, streams uint8, newVersion string, oldVersion string) (*types.Put, error) {
+// An update rather than a put, so that attributes that are not about the
+// stream count, like Cordoned, are left as they are. The Load key moves with
+// the count.
+func updateInstanceStreams(instance string, streams uint8, newVersion string, oldVersion string) (*types.Update, error) {
 	vexpr := expression.Equal(
 		expression.Name(*Instances.Version.AttributeName),
 		expression.Value(oldVersion))
-	expr, err := expression.NewBuilder().WithCondition(vexpr).Build()
+	uexpr := expression.
+		Set(expression.Name(*Instances.Streams.AttributeName), expression.Value(streams)).
+		Set(expression.Name(*Instances.Load.AttributeName), expression.Value(LoadKey(instance, streams))).
+		Set(expression.Name(*Instances.Version.AttributeName), expression.Value(newVersion))
+	expr, err := expression.NewBuilder().WithCondition(vexpr).WithUpdate(uexpr).Build()
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create expression for instance key [%v]", err)
 	}
-	
-	instanceObj := InstanceType {
-		Instance: instance,
-		Streams: streams,
-		Version: newVersion,
-	}
 
-	item, err := attributevalue.MarshalMap(&instanceObj)
+	key, err := attributevalue.MarshalMap(InstanceNameType { Instance: instance })
 	if err != nil {
 		return nil, err
 	}
 
-	put := types.Put {
+	update := types.Update {
 		TableName: Instances.TableName,
-		Item: item,
+		Key: key,
 		ConditionExpression: expr.Condition(),
+		UpdateExpression: expr.Update(),
 		ExpressionAttributeNames: expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 	}
 
-	return &put, nil
+	return &update, nil
 }
 
 func putNewInstancePort(instance string, port uint16) (*types.Put, error) {
@@ -96,8 +147,8 @@ func putNewInstancePort(instance string, port uint16) (*types.Put, error) {
 	return putItem(instancePortObj, InstancePorts.TableName)
 }
 
-func putNewStreamName(stream string) (*types.Put, error) {
-	streamObj := StreamType { Stream: stream }
+func putNewStreamName(stream string, shopId string) (*types.Put, error) {
+	streamObj := StreamType { Stream: stream, ShopId: shopId }
 	return putItem(streamObj, StreamNames.TableName)
 }
 
@@ -0,0 +1,151 @@
+package tables
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// Rewrites a shop record with a new stream, port or instance, swapping the
+// streamNames and instancePorts rows to match. A new stream replaces the shop
+// record, since the stream is part of its key. fromRecord is the instance the
+// shop is on now. toRecord is nil when the shop stays on that instance, and
+// otherwise the instance it moves to, in which case the Streams counts of
+// both are changed. The new rows are only written if they are absent, and
+// the shop only if its Version has not changed, so the transaction fails
+// rather than take a stream or port from someone else. extra items are
+// written in the same transaction. Returns the shop as written.
+func TransactRelocateStream(ctx context.Context, ddb DynamoDBAPI, shop *ShopType, newStream string, newPort uint16, fromRecord *InstanceType, toRecord *InstanceType, extra ...types.TransactWriteItem) (*ShopType, error) {
+	newVersion := uuid.New().String()
+	newInstance := shop.Instance
+	if toRecord != nil {
+		newInstance = toRecord.Instance
+	}
+
+	transactItems := []types.TransactWriteItem {}
+	if newStream != shop.Stream {
+		streamNameDelete, err := deleteStreamName(shop.Stream)
+		if err != nil {
+			return nil, err
+		}
+
+		streamNamePut, err := putNewStreamName(newStream, shop.ShopId)
+		if err != nil {
+			return nil, err
+		}
+
+		streamNamePut, err = ifAbsent(streamNamePut, StreamNames.Stream.AttributeName)
+		if err != nil {
+			return nil, err
+		}
+
+		transactItems = append(transactItems,
+			types.TransactWriteItem { Delete: streamNameDelete },
+			types.TransactWriteItem { Put: streamNamePut })
+	}
+
+	if newPort != shop.Port || newInstance != shop.Instance {
+		instancePortDelete, err := deleteInstancePort(shop.Instance, shop.Port)
+		if err != nil {
+			return nil, err
+		}
+
+		instancePortPut, err := putNewInstancePort(newInstance, newPort)
+		if err != nil {
+			return nil, err
+		}
+
+		instancePortPut, err = ifAbsent(instancePortPut, InstancePorts.Port.AttributeName)
+		if err != nil {
+			return nil, err
+		}
+
+		transactItems = append(transactItems,
+			types.TransactWriteItem { Delete: instancePortDelete },
+			types.TransactWriteItem { Put: instancePortPut })
+	}
+
+	if toRecord != nil {
+		fromUpdate, err := updateInstanceStreams(fromRecord.Instance, fromRecord.Streams - 1, newVersion, fromRecord.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		toUpdate, err := updateInstanceStreams(toRecord.Instance, toRecord.Streams + 1, newVersion, toRecord.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		transactItems = append(transactItems,
+			types.TransactWriteItem { Update: fromUpdate },
+			types.TransactWriteItem { Update: toUpdate })
+	}
+
+	newShop := *shop
+	newShop.Stream, newShop.Port, newShop.Instance, newShop.Version = newStream, newPort, newInstance, newVersion
+	shopPut, err := putShopRecord(newShop.ShopId, newShop.Stream, newShop.Port, newShop.Instance, newShop.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	// The stream is part of the shop key, so a new stream is a new item
+	if newStream != shop.Stream {
+		shopDelete, err := deleteShopRecord(shop.ShopId, shop.Stream, shop.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		shopPut, err = ifAbsent(shopPut, Shops.ShopId.AttributeName)
+		if err != nil {
+			return nil, err
+		}
+
+		transactItems = append(transactItems,
+			types.TransactWriteItem { Delete: shopDelete },
+			types.TransactWriteItem { Put: shopPut })
+	} else {
+		vexpr := expression.Equal(
+			expression.Name(*Shops.Version.AttributeName),
+			expression.Value(shop.Version))
+		expr, err := expression.NewBuilder().WithCondition(vexpr).Build()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create expression for shop key [%v]", err)
+		}
+
+		shopPut.ConditionExpression = expr.Condition()
+		shopPut.ExpressionAttributeNames = expr.Names()
+		shopPut.ExpressionAttributeValues = expr.Values()
+		transactItems = append(transactItems, types.TransactWriteItem { Put: shopPut })
+	}
+
+	transactItems = append(transactItems, extra...)
+	input := dynamodb.TransactWriteItemsInput {
+		TransactItems: transactItems,
+		ClientRequestToken: &newVersion,
+	}
+
+	_, err = ddb.TransactWriteItems(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+
+	return &newShop, nil
+}
+
+// Makes a put fail if the item is already there. keyAttribute can be any
+// attribute of the key.
+func ifAbsent(put *types.Put, keyAttribute *string) (*types.Put, error) {
+	cexpr := expression.AttributeNotExists(expression.Name(*keyAttribute))
+	expr, err := expression.NewBuilder().WithCondition(cexpr).Build()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create expression for %v key [%v]", *put.TableName, err)
+	}
+
+	put.ConditionExpression = expr.Condition()
+	put.ExpressionAttributeNames = expr.Names()
+	put.ExpressionAttributeValues = expr.Values()
+	return put, nil
+}
@@ -0,0 +1,82 @@
+package tables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Does not touch the Version, since cordoning does not change anything a
+// registration in flight has checked. Returns false if the instance is absent.
+func SetInstanceCordoned(ctx context.Context, ddb DynamoDBAPI, instance string, cordoned bool) (bool, error) {
+	cordonedName := expression.Name(cordonedStr)
+	uexpr := expression.Set(cordonedName, expression.Value(true))
+	if !cordoned {
+		uexpr = expression.Remove(cordonedName)
+	}
+
+	return updateInstanceAttributes(ctx, ddb, instance, uexpr)
+}
+
+// Like cordoning, leaves the Version alone. UnhealthySince is only set when
+// the instance was healthy, so it keeps the start of an outage however often
+// the outage is reported, and is cleared with the rest when it ends.
+func SetInstanceHealth(ctx context.Context, ddb DynamoDBAPI, instance string, healthy bool, detail string, now int64) (bool, error) {
+	unhealthySinceName := expression.Name(unhealthySinceStr)
+	uexpr := expression.
+		Set(expression.Name(unhealthyStr), expression.Value(true)).
+		Set(unhealthySinceName, expression.IfNotExists(unhealthySinceName, expression.Value(now))).
+		Set(expression.Name(healthDetailStr), expression.Value(detail))
+	if healthy {
+		uexpr = expression.
+			Remove(expression.Name(unhealthyStr)).
+			Remove(unhealthySinceName).
+			Remove(expression.Name(healthDetailStr))
+	}
+
+	return updateInstanceAttributes(ctx, ddb, instance, uexpr)
+}
+
+func SetInstanceHeartbeat(ctx context.Context, ddb DynamoDBAPI, instance string, now int64) (bool, error) {
+	uexpr := expression.Set(expression.Name(heartbeatStr), expression.Value(now))
+	return updateInstanceAttributes(ctx, ddb, instance, uexpr)
+}
+
+// Returns false if the instance is absent
+func updateInstanceAttributes(ctx context.Context, ddb DynamoDBAPI, instance string, uexpr expression.UpdateBuilder) (bool, error) {
+	cexpr := expression.AttributeExists(expression.Name(*Instances.Instance.AttributeName))
+	expr, err := expression.NewBuilder().WithCondition(cexpr).WithUpdate(uexpr).Build()
+	if err != nil {
+		return false, fmt.Errorf("Unable to create expression for instance key [%v]", err)
+	}
+
+	key, err := attributevalue.MarshalMap(InstanceNameType { Instance: instance })
+	if err != nil {
+		return false, err
+	}
+
+	input := dynamodb.UpdateItemInput {
+		TableName: Instances.TableName,
+		Key: key,
+		ConditionExpression: expr.Condition(),
+		UpdateExpression: expr.Update(),
+		ExpressionAttributeNames: expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}
+
+	_, err = ddb.UpdateItem(ctx, &input)
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
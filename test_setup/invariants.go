@@ -0,0 +1,187 @@
+package test_setup
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"loadbalancer/go/tables"
+)
+
+// The limits the allocator was run with
+type Limits struct {
+	MaxInstances uint8
+	MaxShopStreams uint8
+}
+
+// Reads every table consistently and fails the test if the records of the
+// streams placed disagree with each other, or with the limits:
+//   - every shop stream has its streamNames and instancePorts records, on an
+//     instance that exists, and there are no others
+//   - the Streams of every instance are the streams placed on it, within its
+//     capacity, and its Load, when it has one, is the load index key of them
+//   - no port is on more than MaxInstances instances
+//   - shops without a quota have at most MaxShopStreams streams, and the usage
+//     of every shop and tenant with a quota is what is placed
+// It is meant to be called between operations, not during them.
+func AssertInvariants(t testing.TB, ctx context.Context, ddb tables.DynamoDBAPI, limits Limits) {
+	t.Helper()
+	shops := scanAll[tables.ShopType](t, ctx, ddb, tables.Shops.TableName)
+	streamNames := scanAll[tables.StreamType](t, ctx, ddb, tables.StreamNames.TableName)
+	instancePorts := scanAll[tables.InstancePortType](t, ctx, ddb, tables.InstancePorts.TableName)
+	instances := scanAll[tables.InstanceType](t, ctx, ddb, tables.Instances.TableName)
+	quotas := scanAll[tables.QuotaType](t, ctx, ddb, tables.Quotas.TableName)
+	usages := scanAll[tables.QuotaUsageType](t, ctx, ddb, tables.QuotaUsage.TableName)
+
+	streams := map[string]bool {}
+	for _, s := range streamNames {
+		streams[s.Stream] = true
+	}
+
+	ports := map[tables.InstancePortType]bool {}
+	instancesOnPort := map[uint16]int {}
+	for _, p := range instancePorts {
+		ports[p] = true
+		instancesOnPort[p.Port]++
+	}
+
+	byInstance := map[string]*tables.InstanceType {}
+	for i := range instances {
+		byInstance[instances[i].Instance] = &instances[i]
+	}
+
+	placed := map[string]uint8 {}
+	shopStreams := map[string][]tables.ShopType {}
+	for _, shop := range shops {
+		if !streams[shop.Stream] {
+			t.Errorf("INVARIANT: stream %v of shop %v has no streamNames record", shop.Stream, shop.ShopId)
+		}
+
+		if !ports[tables.InstancePortType { Instance: shop.Instance, Port: shop.Port }] {
+			t.Errorf("INVARIANT: port %d of shop %v on %v has no instancePorts record", shop.Port, shop.ShopId, shop.Instance)
+		}
+
+		if byInstance[shop.Instance] == nil {
+			t.Errorf("INVARIANT: stream %v of shop %v is on missing instance %v", shop.Stream, shop.ShopId, shop.Instance)
+		}
+
+		placed[shop.Instance]++
+		shopStreams[shop.ShopId] = append(shopStreams[shop.ShopId], shop)
+	}
+
+	if len(streamNames) != len(shops) {
+		t.Errorf("INVARIANT: %d streamNames records for %d shop streams", len(streamNames), len(shops))
+	}
+
+	if len(instancePorts) != len(shops) {
+		t.Errorf("INVARIANT: %d instancePorts records for %d shop streams", len(instancePorts), len(shops))
+	}
+
+	for _, instance := range instances {
+		if instance.Streams != placed[instance.Instance] {
+			t.Errorf("INVARIANT: %v counts %d streams but has %d", instance.Instance, instance.Streams, placed[instance.Instance])
+		}
+
+		if instance.Load != "" && instance.Load != tables.LoadKey(instance.Instance, instance.Streams) {
+			t.Errorf("INVARIANT: %v has the Load %v with %d streams", instance.Instance, instance.Load, instance.Streams)
+		}
+
+		capacity := instance.Capacity
+		if capacity == 0 || capacity > limits.MaxInstances {
+			capacity = limits.MaxInstances
+		}
+
+		if placed[instance.Instance] > capacity {
+			t.Errorf("INVARIANT: %v has %d streams, over its capacity of %d", instance.Instance, placed[instance.Instance], capacity)
+		}
+	}
+
+	for port, n := range instancesOnPort {
+		if n > int(limits.MaxInstances) {
+			t.Errorf("INVARIANT: port %d is on %d instances, over the limit of %d", port, n, limits.MaxInstances)
+		}
+	}
+
+	byScope := map[string]*tables.QuotaType {}
+	for i := range quotas {
+		byScope[quotas[i].Scope] = &quotas[i]
+	}
+
+	expected := map[string]*tables.QuotaUsageType {}
+	for shopId, streams := range shopStreams {
+		quota := byScope[tables.ShopScope(shopId)]
+		if quota == nil {
+			if len(streams) > int(limits.MaxShopStreams) {
+				t.Errorf("INVARIANT: shop %v has %d streams, over the limit of %d", shopId, len(streams), limits.MaxShopStreams)
+			}
+
+			continue
+		}
+
+		scopes := []string { quota.Scope }
+		if quota.Tenant != "" {
+			scopes = append(scopes, tables.TenantScope(quota.Tenant))
+		}
+
+		for _, scope := range scopes {
+			if expected[scope] == nil {
+				expected[scope] = &tables.QuotaUsageType { Scope: scope, Ports: map[string]uint16 {}, Instances: map[string]uint16 {} }
+			}
+
+			for _, shop := range streams {
+				expected[scope].Streams++
+				expected[scope].Ports[strconv.Itoa(int(shop.Port))]++
+				expected[scope].Instances[shop.Instance]++
+			}
+		}
+	}
+
+	// usage is only tracked from when a shop gets a quota, so scopes without
+	// streams may have no usage record
+	actual := map[string]*tables.QuotaUsageType {}
+	for i := range usages {
+		actual[usages[i].Scope] = &usages[i]
+	}
+
+	for scope, want := range expected {
+		got := actual[scope]
+		if got == nil {
+			t.Errorf("INVARIANT: %v has %d streams but no usage", scope, want.Streams)
+			continue
+		}
+
+		if got.Streams != want.Streams || !sameCounts(got.Ports, want.Ports) || !sameCounts(got.Instances, want.Instances) {
+			t.Errorf("INVARIANT: usage of %v is %v, but %v is placed", scope, *got, *want)
+		}
+	}
+
+	for scope, got := range actual {
+		if expected[scope] == nil && got.Streams != 0 {
+			t.Errorf("INVARIANT: usage of %v is %d streams, but none are placed", scope, got.Streams)
+		}
+	}
+}
+
+func scanAll[T any](t testing.TB, ctx context.Context, ddb tables.DynamoDBAPI, table *string) []T {
+	t.Helper()
+	records, err := tables.ConsistentScanTable[T](ctx, ddb, table)
+	if err != nil {
+		t.Fatalf("Could not scan %v [%v]", *table, err)
+	}
+
+	return *records
+}
+
+func sameCounts(a map[string]uint16, b map[string]uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
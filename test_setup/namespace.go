@@ -0,0 +1,95 @@
+package test_setup
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/google/uuid"
+
+	"loadbalancer/go/tables"
+)
+
+// An instance a test starts with
+type Instance struct {
+	Instance string
+	PublicIp string
+	PrivateIp string
+	Capacity uint8
+	Cordoned bool
+}
+
+// n instances, instance0 to instance<n-1>, with distinct IPs
+func Fleet(n int) []Instance {
+	fleet := make([]Instance, n)
+	for i := range fleet {
+		fleet[i] = Instance {
+			Instance: fmt.Sprintf("instance%d", i),
+			PublicIp: fmt.Sprintf("189.189.189.%d", 189 + i),
+			PrivateIp: fmt.Sprintf("10.1.1.%d", 1 + i),
+		}
+	}
+
+	return fleet
+}
+
+var unsafeTableChars = regexp.MustCompile("[^a-zA-Z0-9_.-]")
+
+// A set of lb tables of its own for the test, in DynamoDB Local, holding
+// fleet. The tables are deleted when the test is done, so tests using
+// different namespaces can run in parallel.
+func Namespace(t testing.TB, fleet []Instance) (context.Context, tables.DynamoDBAPI) {
+	ctx, client := Client()
+	prefix := fmt.Sprintf("%v_%v_", unsafeTableChars.ReplaceAllString(t.Name(), "_"), uuid.New().String()[:8])
+	ddb := tables.Namespace(client, prefix)
+	t.Cleanup(func() {
+		for _, table := range tableNames() {
+			name := prefix + *table
+			_, err := client.DeleteTable(ctx, &dynamodb.DeleteTableInput { TableName: &name })
+			if err != nil {
+				t.Logf("Could not delete table %v [%v]", name, err)
+			}
+		}
+	})
+
+	CreateTables(ctx, ddb)
+	AddInstances(ctx, ddb, fleet)
+	return ctx, ddb
+}
+
+// Puts instances with no streams
+func AddInstances(ctx context.Context, ddb tables.DynamoDBAPI, fleet []Instance) {
+	for _, instance := range fleet {
+		record := tables.InstanceType {
+			Instance: instance.Instance,
+			Streams: 0,
+			Version: uuid.New().String(),
+			Load: tables.LoadKey(instance.Instance, 0),
+			Cordoned: instance.Cordoned,
+			Capacity: instance.Capacity,
+		}
+		putItem(ctx, ddb, tables.Instances.TableName, record)
+
+		ip := InstanceIpCreateType {
+			Instance: instance.Instance,
+			PublicIp: instance.PublicIp,
+			PrivateIp: instance.PrivateIp,
+		}
+		putItem(ctx, ddb, tables.InstanceIp.TableName, ip)
+	}
+}
+
+func tableNames() []*string {
+	return []*string {
+		tables.Shops.TableName,
+		tables.Instances.TableName,
+		tables.InstancePorts.TableName,
+		tables.StreamNames.TableName,
+		tables.InstanceIp.TableName,
+		tables.FeedCheckpoints.TableName,
+		tables.Quotas.TableName,
+		tables.QuotaUsage.TableName,
+		tables.IdempotencyKeys.TableName,
+	}
+}
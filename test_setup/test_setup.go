@@ -7,7 +7,6 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/google/uuid"
 
 	"loadbalancer/go/tables"
 )
@@ -19,12 +18,6 @@ const (
 	awsEndpoint = "http://localhost:22000"
 )
 
-const (
-	instance0 = "instance0"
-	instance1 = "instance1"
-	instance2 = "instance2"
-)
-
 type ddbLocalEndpointResolverWithOptions struct {}
 func (resolver ddbLocalEndpointResolverWithOptions) ResolveEndpoint(service, region string, options ...interface{}) (aws.Endpoint, error) {
 	return aws.Endpoint {
@@ -42,21 +35,23 @@ func (credprovider ddbLocalCredentialProvider) Retrieve(ctx context.Context) (aw
 	return credentials, nil
 }
 
-func Setup() {
+// A client of DynamoDB Local, which has to be running on port 22000
+func Client() (context.Context, *dynamodb.Client) {
 	ctx, cfg := ddbLocalConfig()
-	ddbLocal := dynamodb.NewFromConfig(*cfg)
-	version := uuid.New().String()
-	createShopsTable(ctx, ddbLocal)
-	createInstancesTable(ctx, ddbLocal, version)
-	createInstancePortTable(ctx, ddbLocal)
-	createStreams(ctx, ddbLocal)
-	createInstanceIpTable(ctx, ddbLocal)
-	_, err := ddbLocal.ListTables(ctx, &dynamodb.ListTablesInput{})
-	if err != nil {
-		panic(fmt.Sprintf("Error listing tables %v", err))
-	}
+	return ctx, dynamodb.NewFromConfig(*cfg)
+}
 
-	tables.TestMockAwsCfg = cfg
+// Creates every lb table, empty
+func CreateTables(ctx context.Context, ddb tables.DynamoDBAPI) {
+	createShopsTable(ctx, ddb)
+	createInstancesTable(ctx, ddb)
+	createInstancePortTable(ctx, ddb)
+	createStreams(ctx, ddb)
+	createInstanceIpTable(ctx, ddb)
+	createFeedCheckpointsTable(ctx, ddb)
+	createQuotasTable(ctx, ddb)
+	createQuotaUsageTable(ctx, ddb)
+	createIdempotencyKeysTable(ctx, ddb)
 }
 
 func ddbLocalConfig() (context.Context, *aws.Config) {
@@ -68,21 +63,11 @@ func ddbLocalConfig() (context.Context, *aws.Config) {
 	return ctx, cfg
 }
 
-func createShopsTable(ctx context.Context, ddb *dynamodb.Client) {
-	input := dynamodb.CreateTableInput {
-		TableName: tables.Shops.TableName,
-		AttributeDefinitions: []types.AttributeDefinition {
-			tables.Shops.ShopId,
-			tables.Shops.Stream,
-		},
-		KeySchema: tables.Shops.KeySchema,
-		GlobalSecondaryIndexes: tables.Shops.Gsi,
-		ProvisionedThroughput: tables.Shops.ProvisionedThroughput,
-	}
-	createTable(ctx, ddb, &input)
+func createShopsTable(ctx context.Context, ddb tables.DynamoDBAPI) {
+	createTable(ctx, ddb, tables.ShopsTableInput(tables.Shops.TableName))
 }
 
-func createInstancePortTable(ctx context.Context, ddb *dynamodb.Client) {
+func createInstancePortTable(ctx context.Context, ddb tables.DynamoDBAPI) {
 	input := dynamodb.CreateTableInput {
 		TableName: tables.InstancePorts.TableName,
 		AttributeDefinitions: []types.AttributeDefinition {
@@ -95,7 +80,7 @@ func createInstancePortTable(ctx context.Context, ddb *dynamodb.Client) {
 	createTable(ctx, ddb, &input)
 }
 
-func createStreams(ctx context.Context, ddb *dynamodb.Client) {
+func createStreams(ctx context.Context, ddb tables.DynamoDBAPI) {
 	input := dynamodb.CreateTableInput {
 		TableName: tables.StreamNames.TableName,
 		AttributeDefinitions: []types.AttributeDefinition {
@@ -107,13 +92,62 @@ func createStreams(ctx context.Context, ddb *dynamodb.Client) {
 	createTable(ctx, ddb, &input)
 }
 
+func createFeedCheckpointsTable(ctx context.Context, ddb tables.DynamoDBAPI) {
+	input := dynamodb.CreateTableInput {
+		TableName: tables.FeedCheckpoints.TableName,
+		AttributeDefinitions: []types.AttributeDefinition {
+			tables.FeedCheckpoints.Shard,
+		},
+		KeySchema: tables.FeedCheckpoints.KeySchema,
+		ProvisionedThroughput: tables.FeedCheckpoints.ProvisionedThroughput,
+	}
+	createTable(ctx, ddb, &input)
+}
+
+func createQuotasTable(ctx context.Context, ddb tables.DynamoDBAPI) {
+	input := dynamodb.CreateTableInput {
+		TableName: tables.Quotas.TableName,
+		AttributeDefinitions: []types.AttributeDefinition {
+			tables.Quotas.Scope,
+		},
+		KeySchema: tables.Quotas.KeySchema,
+		ProvisionedThroughput: tables.Quotas.ProvisionedThroughput,
+	}
+	createTable(ctx, ddb, &input)
+}
+
+// Created for every test, like in every deployment, see tables.QuotaUsage
+func createQuotaUsageTable(ctx context.Context, ddb tables.DynamoDBAPI) {
+	input := dynamodb.CreateTableInput {
+		TableName: tables.QuotaUsage.TableName,
+		AttributeDefinitions: []types.AttributeDefinition {
+			tables.QuotaUsage.Scope,
+		},
+		KeySchema: tables.QuotaUsage.KeySchema,
+		ProvisionedThroughput: tables.QuotaUsage.ProvisionedThroughput,
+	}
+	createTable(ctx, ddb, &input)
+}
+
+func createIdempotencyKeysTable(ctx context.Context, ddb tables.DynamoDBAPI) {
+	input := dynamodb.CreateTableInput {
+		TableName: tables.IdempotencyKeys.TableName,
+		AttributeDefinitions: []types.AttributeDefinition {
+			tables.IdempotencyKeys.Key,
+		},
+		KeySchema: tables.IdempotencyKeys.KeySchema,
+		ProvisionedThroughput: tables.IdempotencyKeys.ProvisionedThroughput,
+	}
+	createTable(ctx, ddb, &input)
+}
+
 type InstanceIpCreateType struct {
 	Instance string
 	PublicIp string
 	PrivateIp string
 }
 
-func createInstanceIpTable(ctx context.Context, ddb *dynamodb.Client) {
+func createInstanceIpTable(ctx context.Context, ddb tables.DynamoDBAPI) {
 	createInput := dynamodb.CreateTableInput {
 		TableName: tables.InstanceIp.TableName,
 		AttributeDefinitions: []types.AttributeDefinition {
@@ -123,71 +157,36 @@ func createInstanceIpTable(ctx context.Context, ddb *dynamodb.Client) {
 		ProvisionedThroughput: tables.InstanceIp.ProvisionedThroughput,
 	}
 	createTable(ctx, ddb, &createInput)
-	item0 := InstanceIpCreateType {
-		Instance: instance0,
-		PublicIp: "189.189.189.191",
-		PrivateIp: "10.1.1.1",
-	}
-	putItem(ctx, ddb, tables.InstanceIp.TableName, item0)
-	item1 := InstanceIpCreateType {
-		Instance: instance1,
-		PublicIp: "189.189.189.189",
-		PrivateIp: "10.1.1.3",
-	}
-	putItem(ctx, ddb, tables.InstanceIp.TableName, item1)
-	item2 := InstanceIpCreateType {
-		Instance: instance2,
-		PublicIp: "189.189.189.190",
-		PrivateIp: "10.1.1.2",
-	}
-	putItem(ctx, ddb, tables.InstanceIp.TableName, item2)
 }
 
-func createInstancesTable(ctx context.Context, ddb *dynamodb.Client, version string) {
+func createInstancesTable(ctx context.Context, ddb tables.DynamoDBAPI) {
 	createInput := dynamodb.CreateTableInput {
 		TableName: tables.Instances.TableName,
 		AttributeDefinitions: []types.AttributeDefinition {
 			tables.Instances.Streams,
+			tables.Instances.Load,
 			tables.Instances.Instance,
 			tables.Instances.Version,
 		},
 		KeySchema: tables.Instances.KeySchema,
 		GlobalSecondaryIndexes: tables.Instances.Gsi,
 		ProvisionedThroughput: tables.Instances.ProvisionedThroughput,
+		StreamSpecification: tables.Instances.StreamSpecification,
 	}
 	createTable(ctx, ddb, &createInput)
-	item0 := tables.InstanceType {
-		Instance: instance0,
-		Streams: 0,
-		Version: version,
-	}
-	putItem(ctx, ddb, tables.Instances.TableName, item0)
-	item1 := tables.InstanceType {
-		Instance: instance1,
-		Streams: 0,
-		Version: version,
-	}
-	putItem(ctx, ddb, tables.Instances.TableName, item1)
-	item2 := tables.InstanceType {
-		Instance: instance2,
-		Streams: 0,
-		Version: version,
-	}
-	putItem(ctx, ddb, tables.Instances.TableName, item2)
 }
 
-func createTable(ctx context.Context, ddb *dynamodb.Client, input *dynamodb.CreateTableInput) {
+func createTable(ctx context.Context, ddb tables.DynamoDBAPI, input *dynamodb.CreateTableInput) {
 	_, err := ddb.CreateTable(ctx, input)
 	if err != nil {
 		panic(fmt.Sprintf("Error creating %v Table [%v]", *input.TableName, err))
 	}
 }
 
-func putItem(ctx context.Context, ddb *dynamodb.Client, tableName *string, itemPut interface{}) {
+func putItem(ctx context.Context, ddb tables.DynamoDBAPI, tableName *string, itemPut interface{}) {
 	item, err := attributevalue.MarshalMap(itemPut)
 	if err != nil {
 		panic(fmt.Sprintf("Unable to marshal items to put in %v because of [%v]", *tableName, err))
-		return
 	}
 
 	putItem := dynamodb.PutItemInput {
@@ -0,0 +1,181 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"github.com/google/uuid"
+
+	"loadbalancer/go/tables"
+)
+
+// Changes the name and/or port of one of a shop's streams in one
+// transaction. The shop stays on its instance if the instance is free to use
+// newPort, and is otherwise moved to the first instance Register would pick.
+// Returns the IPs of the instance the stream ends up on, with the same status
+// codes as Register, plus 400 when the shop does not have the stream.
+func Update(shopId string, stream string, newStream string, newPort uint16) (string, string, int, error) {
+	return Default.Update(shopId, stream, newStream, newPort)
+}
+
+func (a *Allocator) Update(shopId string, stream string, newStream string, newPort uint16) (string, string, int, error) {
+	ctx, ddb, err := a.client()
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	shop, err := tables.ConsistentGetShop(ctx, ddb, shopId, stream)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	if shop == nil {
+		return "", "", 400, fmt.Errorf("Stream %s of shop %s does not exist", stream, shopId)
+	}
+
+	if shop.Stream == newStream && shop.Port == newPort {
+		publicIp, privateIp, err := a.resolveIps(ctx, ddb, shop.Instance)
+		if err != nil {
+			return "", "", 500, err
+		}
+
+		return publicIp, privateIp, 200, nil
+	}
+
+	if shop.Stream != newStream {
+		streamExists, err := tables.TestStreamPresence(ctx, ddb, newStream)
+		if err != nil {
+			return "", "", 500, err
+		}
+
+		if streamExists {
+			return "", "", 400, fmt.Errorf(fmt.Sprintf("Stream %v in use", newStream))
+		}
+	}
+
+	fromRecord, err := tables.ConsistentGetInstance(ctx, ddb, shop.Instance)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	instancesSetUsingPort := map[string]interface{} {}
+	if shop.Port != newPort {
+		instanceNamesUsingPort, err := tables.QueryInstancesUsingPort(ctx, ddb, newPort)
+		if err != nil {
+			return "", "", 500, err
+		}
+
+		for _, i := range *instanceNamesUsingPort {
+			instancesSetUsingPort[i.Instance] = nil
+		}
+	}
+
+	gov, err := loadGovernance(ctx, ddb, shopId)
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	if _, present := instancesSetUsingPort[shop.Instance]; !present {
+		usagePuts, err := gov.swap(uuid.New().String(), shop.Port, shop.Instance, newPort, shop.Instance)
+		if isQuotaError(err) {
+			return "", "", 400, err
+		} else if err != nil {
+			return "", "", 500, err
+		}
+
+		_, err = tables.TransactRelocateStream(ctx, ddb, shop, newStream, newPort, fromRecord, nil, usagePuts...)
+		if err != nil {
+			return "", "", 500, err
+		}
+
+		publicIp, privateIp, err := a.resolveIps(ctx, ddb, shop.Instance)
+		if err != nil {
+			return "", "", 500, err
+		}
+
+		return publicIp, privateIp, 200, nil
+	}
+
+	if len(instancesSetUsingPort) >= int(MAX_INSTANCES) {
+		return "", "", 400, fmt.Errorf(fmt.Sprintf("Port %d in use", newPort))
+	}
+
+	return a.relocate(ctx, ddb, gov, shop, newStream, newPort, fromRecord, instancesSetUsingPort)
+}
+
+// Tries the candidates Register would, in the same order, until a
+// transaction moving the shop onto one of them goes through. Instances in
+// exclude are skipped, and the shop's own instance always is, as are those
+// that would take the shop over a quota of gov.
+func (a *Allocator) relocate(ctx context.Context, ddb tables.DynamoDBAPI, gov *governance, shop *tables.ShopType, newStream string, newPort uint16, fromRecord *tables.InstanceType, exclude map[string]interface{}) (string, string, int, error) {
+	var err error
+	var refused error
+	var placed *judgement
+	var fatal error
+	placedOn, er := a.eachCandidate(ctx, ddb, func(instance string, streams uint8) bool {
+		if _, excluded := exclude[instance]; excluded || instance == shop.Instance {
+			return false
+		}
+
+		judgement, er := a.judgeInstance(ctx, ddb, instance, streams, exclude)
+		err = er
+		if err == nil && judgement.Candidate {
+			usagePuts, er := gov.swap(uuid.New().String(), shop.Port, shop.Instance, newPort, instance)
+			if isQuotaError(er) {
+				refused = er
+				return false
+			}
+
+			err = er
+			if err == nil {
+				_, err = tables.TransactRelocateStream(ctx, ddb, shop, newStream, newPort, fromRecord, judgement.record, usagePuts...)
+				if err == nil {
+					a.observeInstance(judgement.record, judgement.record.Streams + 1)
+					a.observeInstance(fromRecord, fromRecord.Streams - 1)
+					placed = judgement
+					return true
+				}
+			}
+		}
+
+		if err != nil {
+			log.Printf("INFO: Error relocating shopId=%v from %v to %v --> %v", shop.ShopId, shop.Instance, instance, err)
+
+			// the failure may have been the version of the instance
+			// being left, which the next attempt would fail on too
+			fromRecord, er = tables.ConsistentGetInstance(ctx, ddb, shop.Instance)
+			if er == nil {
+				er = gov.refresh(ctx, ddb)
+			}
+
+			if er != nil {
+				fatal = er
+				return true
+			}
+		}
+
+		return false
+	})
+
+	if fatal != nil {
+		return "", "", 500, fatal
+	}
+
+	if placedOn {
+		return placed.publicIp, placed.privateIp, 200, nil
+	}
+
+	if er != nil {
+		return "", "", 500, er
+	}
+
+	if err != nil {
+		return "", "", 500, err
+	}
+
+	if refused != nil {
+		return "", "", 400, refused
+	}
+
+	return "", "", 503, fmt.Errorf(fmt.Sprintf("Unable to relocate %v, %v and %d", shop.ShopId, newStream, newPort))
+}
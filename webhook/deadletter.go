@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"sync"
+	"time"
+)
+
+// A delivery that ran out of attempts
+type DeadLetter struct {
+	SubscriptionId string
+	Payload Payload
+	Attempts int
+	LastError string
+	Time time.Time
+}
+
+type DeadLetterStore interface {
+	Put(letter DeadLetter) error
+	List() ([]DeadLetter, error)
+
+	// Removes the letters for a payload id once it has been redelivered
+	Remove(subscriptionId string, payloadId string) error
+}
+
+type MemoryDeadLetterStore struct {
+	mutex sync.Mutex
+	letters []DeadLetter
+}
+
+func NewMemoryDeadLetterStore() *MemoryDeadLetterStore {
+	return &MemoryDeadLetterStore {}
+}
+
+func (s *MemoryDeadLetterStore) Put(letter DeadLetter) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func (s *MemoryDeadLetterStore) List() ([]DeadLetter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	letters := make([]DeadLetter, len(s.letters))
+	copy(letters, s.letters)
+	return letters, nil
+}
+
+func (s *MemoryDeadLetterStore) Remove(subscriptionId string, payloadId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	kept := s.letters[:0]
+	for _, letter := range s.letters {
+		if letter.SubscriptionId != subscriptionId || letter.Payload.Id != payloadId {
+			kept = append(kept, letter)
+		}
+	}
+
+	s.letters = kept
+	return nil
+}
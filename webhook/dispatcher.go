@@ -0,0 +1,306 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"loadbalancer/go/changefeed"
+)
+
+const DEFAULT_MAX_ATTEMPTS = 5
+const DEFAULT_INITIAL_BACKOFF = 500 * time.Millisecond
+const DEFAULT_MAX_BACKOFF = 30 * time.Second
+const DEFAULT_QUEUE_SIZE = 1024
+
+// POSTs payloads to every matching subscription, retrying with exponential
+// backoff and parking the ones that never got through in DeadLetters. Each
+// subscription has a queue of its own, delivered in order by a goroutine of
+// its own, so a slow subscriber only holds up its own payloads. Once its
+// queue holds QueueSize payloads, new ones go straight to DeadLetters.
+type Dispatcher struct {
+	Client *http.Client
+	MaxAttempts int
+	InitialBackoff time.Duration
+	MaxBackoff time.Duration
+	// Of the queues of subscriptions made after it is set
+	QueueSize int
+	DeadLetters DeadLetterStore
+
+	mutex sync.RWMutex
+	subscriptions map[string]Subscription
+	queues map[string]*queue
+	// Counts the payloads queued and not yet delivered or dead-lettered.
+	// Notify may run alongside Wait, which a WaitGroup does not allow.
+	pendingMutex sync.Mutex
+	pending int
+	idle *sync.Cond
+}
+
+type queue struct {
+	payloads chan *Payload
+	cancel context.CancelFunc
+}
+
+func NewDispatcher(deadLetters DeadLetterStore) *Dispatcher {
+	d := &Dispatcher {
+		Client: &http.Client { Timeout: 10 * time.Second },
+		MaxAttempts: DEFAULT_MAX_ATTEMPTS,
+		InitialBackoff: DEFAULT_INITIAL_BACKOFF,
+		MaxBackoff: DEFAULT_MAX_BACKOFF,
+		QueueSize: DEFAULT_QUEUE_SIZE,
+		DeadLetters: deadLetters,
+		subscriptions: map[string]Subscription {},
+		queues: map[string]*queue {},
+	}
+
+	d.idle = sync.NewCond(&d.pendingMutex)
+	return d
+}
+
+// Replaces any subscription with the same id, keeping its queue
+func (d *Dispatcher) Subscribe(subscription Subscription) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.subscriptions[subscription.Id] = subscription
+	if _, present := d.queues[subscription.Id]; present {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &queue { payloads: make(chan *Payload, d.QueueSize), cancel: cancel }
+	d.queues[subscription.Id] = q
+	go d.work(ctx, subscription.Id, q)
+}
+
+// Payloads still queued for the subscription are dropped
+func (d *Dispatcher) Unsubscribe(id string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.subscriptions, id)
+	d.stop(id)
+}
+
+// Stops every delivery. Payloads still queued are dead-lettered.
+func (d *Dispatcher) Close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for id := range d.queues {
+		d.stop(id)
+	}
+}
+
+// Called with the lock held
+func (d *Dispatcher) stop(id string) {
+	q, present := d.queues[id]
+	if !present {
+		return
+	}
+
+	q.cancel()
+	close(q.payloads)
+	delete(d.queues, id)
+}
+
+// Returns once every payload queued so far has been delivered or
+// dead-lettered. Payloads queued while it waits are waited for too.
+func (d *Dispatcher) Wait() {
+	d.pendingMutex.Lock()
+	defer d.pendingMutex.Unlock()
+	for d.pending > 0 {
+		d.idle.Wait()
+	}
+}
+
+func (d *Dispatcher) addPending(delta int) {
+	d.pendingMutex.Lock()
+	defer d.pendingMutex.Unlock()
+	d.pending += delta
+	if d.pending == 0 {
+		d.idle.Broadcast()
+	}
+}
+
+func (d *Dispatcher) work(ctx context.Context, id string, q *queue) {
+	for payload := range q.payloads {
+		d.mutex.RLock()
+		subscription, present := d.subscriptions[id]
+		d.mutex.RUnlock()
+		if present {
+			err := d.deliverOrDeadLetter(ctx, &subscription, payload)
+			if err != nil {
+				log.Println(fmt.Sprintf("WARN: Unable to dead-letter %v for subscription %v: [%v]", payload.Id, id, err))
+			}
+		}
+
+		d.addPending(-1)
+	}
+}
+
+// For the change feed. Only queues the payloads, so the feed never waits on
+// a subscriber, and only errors when a payload can neither be queued nor
+// dead-lettered.
+func (d *Dispatcher) Handler(ctx context.Context) changefeed.Handler {
+	return func(event changefeed.Event) error {
+		payload, ok := FromEvent(event)
+		if !ok {
+			return nil
+		}
+
+		return d.Notify(ctx, payload)
+	}
+}
+
+// Queues the payload for all matching subscriptions, see Wait
+func (d *Dispatcher) Notify(ctx context.Context, payload *Payload) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	for id, subscription := range d.subscriptions {
+		if !subscription.Matches(payload) {
+			continue
+		}
+
+		q, present := d.queues[id]
+		if present {
+			d.addPending(1)
+			select {
+			case q.payloads <- payload:
+				continue
+			default:
+			}
+
+			d.addPending(-1)
+		}
+
+		log.Println(fmt.Sprintf("WARN: Queue of subscription %v is full or closed, dead-lettering %v", id, payload.Id))
+		if d.DeadLetters == nil {
+			continue
+		}
+
+		err := d.DeadLetters.Put(DeadLetter { SubscriptionId: id, Payload: *payload, LastError: "Queue full or closed", Time: time.Now() })
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Tries the dead letters once more, each with the full number of attempts.
+// The ones that get through are removed from the store.
+func (d *Dispatcher) Redeliver(ctx context.Context) error {
+	letters, err := d.DeadLetters.List()
+	if err != nil {
+		return err
+	}
+
+	for _, letter := range letters {
+		d.mutex.RLock()
+		subscription, present := d.subscriptions[letter.SubscriptionId]
+		d.mutex.RUnlock()
+		if !present {
+			continue
+		}
+
+		_, err := d.deliver(ctx, &subscription, &letter.Payload)
+		if err == nil {
+			err = d.DeadLetters.Remove(letter.SubscriptionId, letter.Payload.Id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) deliverOrDeadLetter(ctx context.Context, subscription *Subscription, payload *Payload) error {
+	attempts, err := d.deliver(ctx, subscription, payload)
+	if err == nil {
+		return nil
+	}
+
+	log.Println(fmt.Sprintf("WARN: Giving up on %v for subscription %v after %d attempts: [%v]", payload.Id, subscription.Id, attempts, err))
+	if d.DeadLetters == nil {
+		return nil
+	}
+
+	letter := DeadLetter {
+		SubscriptionId: subscription.Id,
+		Payload: *payload,
+		Attempts: attempts,
+		LastError: err.Error(),
+		Time: time.Now(),
+	}
+
+	return d.DeadLetters.Put(letter)
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, subscription *Subscription, payload *Payload) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	backoff := d.InitialBackoff
+	attempt := 0
+	for {
+		attempt++
+		retry, err := d.post(ctx, subscription, payload, body)
+		if err == nil {
+			return attempt, nil
+		}
+
+		if !retry || attempt >= d.MaxAttempts {
+			return attempt, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > d.MaxBackoff {
+			backoff = d.MaxBackoff
+		}
+	}
+}
+
+// Client errors other than timeouts and throttling will not get better by
+// sending the same request again.
+func (d *Dispatcher) post(ctx context.Context, subscription *Subscription, payload *Payload, body []byte) (bool, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EVENT_HEADER, string(payload.Type))
+	request.Header.Set(TIMESTAMP_HEADER, timestamp)
+	request.Header.Set(SIGNATURE_HEADER, Sign(subscription.Secret, timestamp, body))
+
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return true, err
+	}
+
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("Subscriber responded with %d", response.StatusCode)
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusRequestTimeout || response.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
@@ -0,0 +1,258 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"loadbalancer/go/changefeed"
+)
+
+const testSecret = "hush"
+
+// A local stand-in for a subscriber that fails the first failures requests
+type testSubscriber struct {
+	mutex sync.Mutex
+	failures int
+	received []Payload
+	errors []string
+}
+
+func (s *testSubscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	err := Verify(testSecret, r.Header.Get(TIMESTAMP_HEADER), body, r.Header.Get(SIGNATURE_HEADER), time.Minute)
+	if err != nil {
+		s.errors = append(s.errors, err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var payload Payload
+	json.Unmarshal(body, &payload)
+	s.received = append(s.received, payload)
+}
+
+func testDispatcher() (*Dispatcher, *MemoryDeadLetterStore) {
+	deadLetters := NewMemoryDeadLetterStore()
+	dispatcher := NewDispatcher(deadLetters)
+	dispatcher.MaxAttempts = 3
+	dispatcher.InitialBackoff = time.Millisecond
+	return dispatcher, deadLetters
+}
+
+func TestDeliveryAfterRetries(t *testing.T) {
+	subscriber := &testSubscriber { failures: 2 }
+	server := httptest.NewServer(subscriber)
+	defer server.Close()
+
+	dispatcher, deadLetters := testDispatcher()
+	dispatcher.Subscribe(Subscription { Id: "edge", URL: server.URL, Secret: testSecret })
+	event := changefeed.StreamRegistered { ShopId: "shop0", Stream: "stream0", Port: 11000, Instance: "instance0" }
+	err := dispatcher.Handler(context.TODO())(event)
+	if err != nil {
+		t.Fatalf("Handler Error: [%v]", err)
+	}
+
+	dispatcher.Wait()
+
+	if len(subscriber.errors) > 0 {
+		t.Fatalf("Subscriber could not verify requests %v", subscriber.errors)
+	}
+
+	if len(subscriber.received) != 1 || subscriber.received[0].Type != Register || subscriber.received[0].Stream != "stream0" {
+		t.Fatalf("Unexpected payloads received %v", subscriber.received)
+	}
+
+	letters, _ := deadLetters.List()
+	if len(letters) != 0 {
+		t.Fatalf("Unexpected dead letters %v", letters)
+	}
+}
+
+func TestDeadLetterAndRedeliver(t *testing.T) {
+	subscriber := &testSubscriber { failures: 3 }
+	server := httptest.NewServer(subscriber)
+	defer server.Close()
+
+	dispatcher, deadLetters := testDispatcher()
+	dispatcher.Subscribe(Subscription { Id: "edge", URL: server.URL, Secret: testSecret })
+	payload := Payload { Id: "1-unregister", Type: Unregister, ShopId: "shop0", Stream: "stream0", Instance: "instance0" }
+	err := dispatcher.Notify(context.TODO(), &payload)
+	if err != nil {
+		t.Fatalf("Notify Error: [%v]", err)
+	}
+
+	dispatcher.Wait()
+
+	letters, _ := deadLetters.List()
+	if len(letters) != 1 || letters[0].Attempts != 3 {
+		t.Fatalf("Expected a single dead letter after 3 attempts, found %v", letters)
+	}
+
+	err = dispatcher.Redeliver(context.TODO())
+	if err != nil {
+		t.Fatalf("Redeliver Error: [%v]", err)
+	}
+
+	letters, _ = deadLetters.List()
+	if len(letters) != 0 || len(subscriber.received) != 1 {
+		t.Fatalf("Redelivery did not go through: letters %v received %v", letters, subscriber.received)
+	}
+}
+
+func TestSubscriptionFiltering(t *testing.T) {
+	subscription := Subscription { Events: []EventType { Move }, InstancePrefix: "eu-", ShopPrefix: "acme" }
+	cases := []struct {
+		payload Payload
+		matches bool
+	} {
+		{ Payload { Type: Move, ShopId: "acme1", Instance: "eu-1", PreviousInstance: "us-1" }, true },
+		{ Payload { Type: Move, ShopId: "acme1", Instance: "us-2", PreviousInstance: "eu-1" }, true },
+		{ Payload { Type: Move, ShopId: "other", Instance: "eu-1", PreviousInstance: "eu-2" }, false },
+		{ Payload { Type: Register, ShopId: "acme1", Instance: "eu-1" }, false },
+		{ Payload { Type: Move, ShopId: "acme1", Instance: "us-1", PreviousInstance: "us-2" }, false },
+	}
+
+	for _, c := range cases {
+		if subscription.Matches(&c.payload) != c.matches {
+			t.Fatalf("Expected match %v for %v", c.matches, c.payload)
+		}
+	}
+}
+
+// A subscriber that does not answer until released
+type blockedSubscriber struct {
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func (s *blockedSubscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.arrived <- struct{} {}
+	<-s.release
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	blocked := &blockedSubscriber { arrived: make(chan struct{}, 10), release: make(chan struct{}) }
+	slow := httptest.NewServer(blocked)
+	defer slow.Close()
+	subscriber := &testSubscriber {}
+	fast := httptest.NewServer(subscriber)
+	defer fast.Close()
+
+	dispatcher, deadLetters := testDispatcher()
+	dispatcher.QueueSize = 2
+	dispatcher.Subscribe(Subscription { Id: "slow", URL: slow.URL, Secret: testSecret })
+	dispatcher.Subscribe(Subscription { Id: "fast", URL: fast.URL, Secret: testSecret })
+	handler := dispatcher.Handler(context.TODO())
+	for i := 0; i < 4; i++ {
+		err := handler(changefeed.StreamRegistered { Meta: changefeed.Meta { SequenceNumber: fmt.Sprint(i) }, ShopId: "shop0", Stream: fmt.Sprint("stream", i) })
+		if err != nil {
+			t.Fatalf("Handler Error: [%v]", err)
+		}
+
+		if i == 0 {
+			<-blocked.arrived
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			subscriber.mutex.Lock()
+			received := len(subscriber.received)
+			subscriber.mutex.Unlock()
+			if received == i + 1 {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("The fast subscriber was held up, with %d payloads of %d", received, i + 1)
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The first payload is being delivered to the slow subscriber and the
+	// next two are queued, so the last could only be dead-lettered
+	letters, _ := deadLetters.List()
+	if len(letters) != 1 || letters[0].SubscriptionId != "slow" || letters[0].Payload.Stream != "stream3" {
+		t.Fatalf("Expected a single dead letter of stream3 for slow, found %v", letters)
+	}
+
+	close(blocked.release)
+	dispatcher.Wait()
+}
+
+// Notify keeps queueing while Wait waits, as the change feed does
+func TestNotifyDuringWait(t *testing.T) {
+	subscriber := &testSubscriber {}
+	server := httptest.NewServer(subscriber)
+	defer server.Close()
+
+	dispatcher, _ := testDispatcher()
+	dispatcher.Subscribe(Subscription { Id: "edge", URL: server.URL, Secret: testSecret })
+	var notifiers sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		notifiers.Add(1)
+		go func(n int) {
+			defer notifiers.Done()
+			for i := 0; i < 25; i++ {
+				payload := Payload { Id: fmt.Sprint(n, "-", i), Type: Register, ShopId: "shop0", Stream: "stream0" }
+				err := dispatcher.Notify(context.TODO(), &payload)
+				if err != nil {
+					t.Errorf("Notify Error: [%v]", err)
+				}
+			}
+		}(n)
+	}
+
+	waiters := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			dispatcher.Wait()
+		}
+
+		close(waiters)
+	}()
+
+	notifiers.Wait()
+	<-waiters
+	dispatcher.Wait()
+
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+	if len(subscriber.received) != 100 {
+		t.Fatalf("Expected 100 payloads after Wait, found %d", len(subscriber.received))
+	}
+}
+
+func TestVerifyTolerance(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte("{}")
+	for _, offset := range []time.Duration { -2 * time.Minute, 2 * time.Minute } {
+		timestamp := fmt.Sprint(now.Add(offset).Unix())
+		err := verifyAt(now, testSecret, timestamp, body, Sign(testSecret, timestamp, body), time.Minute)
+		if err == nil {
+			t.Fatalf("A timestamp %v from now should have been refused", offset)
+		}
+	}
+
+	timestamp := fmt.Sprint(now.Add(30 * time.Second).Unix())
+	err := verifyAt(now, testSecret, timestamp, body, Sign(testSecret, timestamp, body), time.Minute)
+	if err != nil {
+		t.Fatalf("A timestamp within the tolerance should have been accepted ---> %v", err)
+	}
+}
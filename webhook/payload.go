@@ -0,0 +1,134 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"loadbalancer/go/changefeed"
+)
+
+type EventType string
+
+const (
+	Register EventType = "register"
+	Unregister EventType = "unregister"
+	Move EventType = "move"
+)
+
+const SIGNATURE_HEADER = "X-Lb-Signature"
+const TIMESTAMP_HEADER = "X-Lb-Timestamp"
+const EVENT_HEADER = "X-Lb-Event"
+
+// The JSON body POSTed to subscribers. PreviousInstance is only set for
+// move events.
+type Payload struct {
+	Id string `json:"id"`
+	Type EventType `json:"type"`
+	ShopId string `json:"shopId"`
+	Stream string `json:"stream"`
+	Port uint16 `json:"port"`
+	Instance string `json:"instance"`
+	PreviousInstance string `json:"previousInstance,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// Change feed events that are not about allocations, like instance load
+// changes, have no payload.
+func FromEvent(event changefeed.Event) (*Payload, bool) {
+	meta := event.EventMeta()
+	payload := Payload {
+		Id: meta.SequenceNumber,
+		Time: meta.Time,
+	}
+
+	switch e := event.(type) {
+	case changefeed.StreamRegistered:
+		payload.Type = Register
+		payload.ShopId, payload.Stream, payload.Port, payload.Instance = e.ShopId, e.Stream, e.Port, e.Instance
+	case changefeed.StreamUnregistered:
+		payload.Type = Unregister
+		payload.ShopId, payload.Stream, payload.Port, payload.Instance = e.ShopId, e.Stream, e.Port, e.Instance
+	case changefeed.StreamMoved:
+		payload.Type = Move
+		payload.ShopId, payload.Stream, payload.Port, payload.Instance = e.ShopId, e.Stream, e.Port, e.Instance
+		payload.PreviousInstance = e.PreviousInstance
+	default:
+		return nil, false
+	}
+
+	// A MODIFY record turns into an unregister and a register with the same
+	// sequence number, and subscribers dedupe on the id.
+	payload.Id = fmt.Sprintf("%v-%v", payload.Id, payload.Type)
+	return &payload, true
+}
+
+// The signature covers the timestamp as well as the body so that a captured
+// request cannot be replayed later with a fresh timestamp.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// For receivers. Rejects signatures made more than tolerance before or after
+// now.
+func Verify(secret string, timestamp string, body []byte, signature string, tolerance time.Duration) error {
+	return verifyAt(time.Now(), secret, timestamp, body, signature, tolerance)
+}
+
+func verifyAt(now time.Time, secret string, timestamp string, body []byte, signature string, tolerance time.Duration) error {
+	expected := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("Signature mismatch")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid timestamp %v", timestamp)
+	}
+
+	signed := time.Unix(seconds, 0)
+	if signed.Before(now.Add(-tolerance)) || signed.After(now.Add(tolerance)) {
+		return fmt.Errorf("Timestamp %v is more than %v from now", timestamp, tolerance)
+	}
+
+	return nil
+}
+
+// Empty filters match everything. Prefixes are plain string prefixes.
+type Subscription struct {
+	Id string
+	URL string
+	Secret string
+	Events []EventType
+	InstancePrefix string
+	ShopPrefix string
+}
+
+func (s *Subscription) Matches(payload *Payload) bool {
+	if len(s.Events) > 0 {
+		found := false
+		for _, t := range s.Events {
+			found = found || t == payload.Type
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if !strings.HasPrefix(payload.ShopId, s.ShopPrefix) {
+		return false
+	}
+
+	// A move is interesting to the subscriber of either instance
+	return strings.HasPrefix(payload.Instance, s.InstancePrefix) ||
+		(payload.PreviousInstance != "" && strings.HasPrefix(payload.PreviousInstance, s.InstancePrefix))
+}